@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-distributed-storage/p2p"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+)
+
+// DefaultAdminSocket is the path of the local admin socket when none is configured.
+const DefaultAdminSocket = "fs.sock"
+
+// NewAdminHandler returns the handler served on the local admin socket. It
+// serves the object routes of the HTTP gateway, which the put, get, rm and ls
+// commands use, GET /peers, which lists the connected peers, and GET /metrics.
+//
+// It also serves the state of the node and the operational actions:
+//
+//	GET    /status            the NodeStatus of the node
+//	DELETE /peers/{address}   disconnect the peer with that remote address
+//	POST   /rebalance         send every stored file to the peers
+//	GET    /bandwidth         the p2p.BandwidthLimits of the node
+//	PUT    /bandwidth         replace the bandwidth limits with those of the body
+//
+// When the server has an AccessControl, the actions that change the node
+// require the bearer token of a principal with PermissionAdmin.
+func NewAdminHandler(server *FileServer) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/objects", NewGateway(server))
+	mux.Handle("/objects/", NewGateway(server))
+	mux.Handle("GET /metrics", server.MetricsHandler())
+	mux.HandleFunc("GET /peers", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, server.logger(), http.StatusOK, map[string]any{
+			"peers":          server.Peers(),
+			"peersAddresses": server.PeersAddresses(),
+		})
+	})
+	mux.HandleFunc("DELETE /peers/{address}", adminOnly(server, func(w http.ResponseWriter, r *http.Request) {
+		if err := server.DisconnectPeer(r.PathValue("address")); err != nil {
+			writeError(w, server.logger(), err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		status, err := server.Status()
+		if err != nil {
+			writeError(w, server.logger(), err)
+			return
+		}
+		writeJSON(w, server.logger(), http.StatusOK, status)
+	})
+	mux.HandleFunc("POST /rebalance", adminOnly(server, func(w http.ResponseWriter, r *http.Request) {
+		report, err := server.Rebalance(r.Context())
+		if err != nil {
+			writeError(w, server.logger(), err)
+			return
+		}
+		writeJSON(w, server.logger(), http.StatusOK, report)
+	}))
+	mux.HandleFunc("GET /bandwidth", func(w http.ResponseWriter, r *http.Request) {
+		limits, err := server.BandwidthLimits()
+		if err != nil {
+			writeError(w, server.logger(), err)
+			return
+		}
+		writeJSON(w, server.logger(), http.StatusOK, limits)
+	})
+	mux.HandleFunc("PUT /bandwidth", adminOnly(server, func(w http.ResponseWriter, r *http.Request) {
+		var limits p2p.BandwidthLimits
+		if err := json.NewDecoder(r.Body).Decode(&limits); err != nil {
+			http.Error(w, "invalid bandwidth limits: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := server.SetBandwidthLimits(limits); err != nil {
+			writeError(w, server.logger(), err)
+			return
+		}
+		writeJSON(w, server.logger(), http.StatusOK, limits)
+	}))
+	return mux
+}
+
+// adminOnly passes to next the requests holding the bearer token of a
+// principal with PermissionAdmin, or every request when the server has no
+// AccessControl.
+func adminOnly(server *FileServer, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ac := server.Config.AccessControl
+		if ac == nil {
+			next(w, r)
+			return
+		}
+
+		principal, err := ac.Authenticate(bearerToken(r.Header.Get("Authorization")))
+		if err == nil && !principal.isAdmin() {
+			err = fmt.Errorf("%s %s: %w: principal %s has no %s grant", r.Method, r.URL.Path, ErrAccessDenied, principal.Name, PermissionAdmin)
+		}
+		if err != nil {
+			server.auditDenied(r.Context(), string(PermissionAdmin), "", r.URL.Path, err)
+			if errors.Is(err, ErrUnauthenticated) {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="fs"`)
+			}
+			writeError(w, server.logger(), err)
+			return
+		}
+		// The actions are made by the node itself, not for the principal.
+		next(w, r)
+	}
+}
+
+// ServeAdminSocket serves the admin handler of the server on a unix socket at
+// path. A stale socket left behind by a previous run is removed first.
+func ServeAdminSocket(server *FileServer, path string) (net.Listener, error) {
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		if err := http.Serve(listener, NewAdminHandler(server)); err != nil && !errors.Is(err, net.ErrClosed) {
+			server.logger().Error("Admin socket stopped serving", "path", path, "error", err)
+		}
+	}()
+
+	server.logger().Info("Admin socket listening", "path", path)
+	return listener, nil
+}
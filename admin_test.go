@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdminSocket(t *testing.T) {
+	server := makeServer("127.0.0.6:4060", true)
+	go func() {
+		if err := server.Start(); err != nil {
+			log.Fatalf("Failed to start server on 127.0.0.6:4060: %v", err)
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	defer server.Storage.Clear()
+
+	socket := filepath.Join(t.TempDir(), "fs.sock")
+	listener, err := ServeAdminSocket(server, socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	client := newAdminClient(socket)
+	content := generateRandomData(1024)
+
+	resp, err := client.do(http.MethodPut, objectPath("docs/report 1.txt"), bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	resp.Body.Close()
+
+	resp, err = client.do(http.MethodGet, objectPath("docs/report 1.txt"), nil)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	got, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !bytes.Equal(got, content) {
+		t.Errorf("get: got %d bytes, want %d", len(got), len(content))
+	}
+
+	resp, err = client.do(http.MethodGet, "/objects?prefix=docs/", nil)
+	if err != nil {
+		t.Fatalf("ls: %v", err)
+	}
+	var list struct {
+		Objects []ObjectInfo `json:"objects"`
+	}
+	json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if len(list.Objects) != 1 || list.Objects[0].Key != "docs/report 1.txt" {
+		t.Errorf("ls: got %+v", list.Objects)
+	}
+
+	resp, err = client.do(http.MethodGet, "/peers", nil)
+	if err != nil {
+		t.Fatalf("peers: %v", err)
+	}
+	resp.Body.Close()
+
+	resp, err = client.do(http.MethodDelete, objectPath("docs/report 1.txt"), nil)
+	if err != nil {
+		t.Fatalf("rm: %v", err)
+	}
+	resp.Body.Close()
+
+	if _, err := client.do(http.MethodGet, objectPath("docs/report 1.txt"), nil); err == nil {
+		t.Error("get after rm: expected an error")
+	}
+}
+
+func TestAdminStatus(t *testing.T) {
+	server1 := makeServer("127.0.0.10:4130", true)
+	go func() {
+		if err := server1.Start(); err != nil {
+			log.Fatalf("Failed to start server on 127.0.0.10:4130: %v", err)
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	defer server1.Storage.Clear()
+
+	server2 := makeServer("127.0.0.10:4131", false, "127.0.0.10:4130")
+	go func() {
+		if err := server2.Start(); err != nil {
+			log.Fatalf("Failed to start server on 127.0.0.10:4131: %v", err)
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+	defer server2.Storage.Clear()
+
+	socket := filepath.Join(t.TempDir(), "fs.sock")
+	listener, err := ServeAdminSocket(server1, socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	client := newAdminClient(socket)
+
+	if err := server1.Store("status/data", bytes.NewReader(generateRandomData(2048))); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	resp, err := client.do(http.MethodGet, "/status", nil)
+	if err != nil {
+		t.Fatalf("status: %v", err)
+	}
+	var status NodeStatus
+	json.NewDecoder(resp.Body).Decode(&status)
+	resp.Body.Close()
+
+	if status.ID != "127.0.0.10:4130" || status.Version == "" || status.Uptime <= 0 {
+		t.Errorf("status: got id %q, version %q and uptime %v", status.ID, status.Version, status.Uptime)
+	}
+	// The replica dialed in from an ephemeral port and introduced its listen address.
+	if len(status.Peers) != 2 || status.Peers[0].Direction != "inbound" || status.Peers[0].State != "connected" ||
+		status.Peers[1].Address != "127.0.0.10:4131" || status.Peers[1].State != "known" {
+		t.Errorf("status: got peers %+v, want an inbound connected peer and its known address", status.Peers)
+	}
+	if len(status.Storage.Keys) != 1 || status.Storage.Keys[0] != "status/data" || status.Storage.Bytes != 2048 || status.Storage.DiskUsage == 0 {
+		t.Errorf("status: got storage %+v", status.Storage)
+	}
+	if peers := server2.Peers(); len(peers) != 1 || peers[0].Direction != "outbound" {
+		t.Errorf("replica peers: got %+v, want one outbound peer", peers)
+	}
+
+	// The replica lost its copy, a rebalance sends it again.
+	server2.Storage.DeleteFile("status/data")
+	resp, err = client.do(http.MethodPost, "/rebalance", nil)
+	if err != nil {
+		t.Fatalf("rebalance: %v", err)
+	}
+	var report RebalanceReport
+	json.NewDecoder(resp.Body).Decode(&report)
+	resp.Body.Close()
+	time.Sleep(50 * time.Millisecond)
+	if report.Files != 1 || report.Peers != 1 || len(report.Errors) != 0 {
+		t.Errorf("rebalance: got %+v", report)
+	}
+	if !server2.Storage.HasKey("status/data") {
+		t.Error("rebalance: the replica was not restored")
+	}
+
+	resp, err = client.do(http.MethodDelete, "/peers/"+url.PathEscape(status.Peers[0].Address), nil)
+	if err != nil {
+		t.Fatalf("disconnect: %v", err)
+	}
+	resp.Body.Close()
+	if peers := server1.Peers(); len(peers) != 0 {
+		t.Errorf("disconnect: still connected to %+v", peers)
+	}
+	if _, err := client.do(http.MethodDelete, "/peers/"+url.PathEscape(status.Peers[0].Address), nil); err == nil {
+		t.Error("disconnect of an unknown peer: expected an error")
+	}
+}
+
+func TestAdminAccessControl(t *testing.T) {
+	adminToken, adminSHA := NewToken()
+	writerToken, writerSHA := NewToken()
+
+	server := makeServer("127.0.0.14:4176", true)
+	server.Config.AccessControl = &AccessControl{
+		PeerSecret: (&BasicCrypto{}).newEncryptionKey(),
+		Principals: []Principal{
+			{Name: "operator", TokenSHA256: adminSHA, Grants: []Grant{
+				{Namespace: AnyNamespace, Permissions: []Permission{PermissionAdmin}},
+			}},
+			{Name: "writer", TokenSHA256: writerSHA, Grants: []Grant{
+				{Namespace: AnyNamespace, Permissions: []Permission{PermissionRead, PermissionWrite, PermissionDelete}},
+			}},
+		},
+	}
+	startServer(t, server)
+	t.Cleanup(func() {
+		server.Stop()
+		server.Storage.Clear()
+	})
+
+	admin := httptest.NewServer(NewAdminHandler(server))
+	defer admin.Close()
+
+	do := func(method, token, path, body string) int {
+		t.Helper()
+		req, err := http.NewRequest(method, admin.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	actions := []struct {
+		method, path, body string
+		status             int
+	}{
+		{http.MethodDelete, "/peers/" + url.PathEscape("127.0.0.1:1"), "", http.StatusNotFound},
+		{http.MethodPost, "/rebalance", "", http.StatusOK},
+		{http.MethodPut, "/bandwidth", `{"total": 1048576}`, http.StatusOK},
+	}
+	for _, action := range actions {
+		if status := do(action.method, "", action.path, action.body); status != http.StatusUnauthorized {
+			t.Errorf("%s %s without a token: got status %d, want 401", action.method, action.path, status)
+		}
+		if status := do(action.method, writerToken, action.path, action.body); status != http.StatusForbidden {
+			t.Errorf("%s %s without the admin permission: got status %d, want 403", action.method, action.path, status)
+		}
+		if status := do(action.method, adminToken, action.path, action.body); status != action.status {
+			t.Errorf("%s %s as an admin: got status %d, want %d", action.method, action.path, status, action.status)
+		}
+	}
+
+	// Reading the state of the node needs no token.
+	for _, path := range []string{"/status", "/peers", "/bandwidth"} {
+		if status := do(http.MethodGet, "", path, ""); status != http.StatusOK {
+			t.Errorf("GET %s without a token: got status %d", path, status)
+		}
+	}
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultAuditMaxSize is the size past which an AuditLog starts a new
+	// file when AuditLogOPT.MaxSize is not set.
+	defaultAuditMaxSize = 100 * 1024 * 1024 // 100 MB
+
+	// auditFileName is the file records are appended to. Once full, it is
+	// renamed after the sequence number of its first record.
+	auditFileName      = "audit.log"
+	auditRotatedPrefix = "audit-"
+)
+
+// Results of an audited operation.
+const (
+	AuditOK     = "ok"
+	AuditDenied = "denied"
+	AuditError  = "error"
+)
+
+// AuditRecord is a line of the audit log.
+type AuditRecord struct {
+	// Seq numbers the records of a node from 1, across rotations.
+	Seq  uint64    `json:"seq"`
+	Time time.Time `json:"time"`
+	// Node is the address of the node that wrote the record.
+	Node string `json:"node,omitempty"`
+	// Actor is the principal the operation was made for, "node" for the
+	// requests of peers made on their own behalf, or "local" for calls
+	// without a principal.
+	Actor string `json:"actor"`
+	// Action is store, get, delete, list, authenticate, peer-join or peer-leave.
+	Action    string `json:"action"`
+	Namespace string `json:"namespace,omitempty"`
+	Key       string `json:"key,omitempty"`
+	// Size is the size of the file stored, read or deleted, or the number
+	// of bytes sent to the peer that read it.
+	Size int64 `json:"size,omitempty"`
+	// Peer is the address of the peer that sent the request, or that
+	// joined or left.
+	Peer   string `json:"peer,omitempty"`
+	Result string `json:"result"`
+	Error  string `json:"error,omitempty"`
+	// PrevHash is the Hash of the record before, empty for the first one.
+	PrevHash string `json:"prev_hash"`
+	// Hash is the hex SHA-256 of the record with an empty Hash, which chains
+	// every record to all the ones before it.
+	Hash string `json:"hash"`
+}
+
+// hash returns the hash of the record, computed over its JSON encoding
+// without Hash.
+func (r AuditRecord) hash() (string, error) {
+	r.Hash = ""
+	b, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+type AuditLogOPT struct {
+	// Dir holds the audit files.
+	Dir string
+	// MaxSize is the size past which a new file is started. A zero value
+	// means defaultAuditMaxSize.
+	MaxSize int64
+}
+
+// AuditLog is an append-only log of the operations of a node. Every record
+// holds the hash of the one before, so that editing, removing or reordering
+// records breaks the chain, which VerifyAuditLog detects. Records are synced
+// to disk as they are written.
+type AuditLog struct {
+	opt AuditLogOPT
+
+	mu       sync.Mutex
+	file     *os.File
+	size     int64
+	firstSeq uint64
+	seq      uint64
+	lastHash string
+}
+
+// NewAuditLog opens the audit log under opt.Dir and continues the chain of
+// the records already there. It fails if the last record is damaged, which
+// must be looked into before more records are appended.
+func NewAuditLog(opt AuditLogOPT) (*AuditLog, error) {
+	if opt.MaxSize == 0 {
+		opt.MaxSize = defaultAuditMaxSize
+	}
+	if err := os.MkdirAll(opt.Dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	a := &AuditLog{opt: opt}
+	files, err := auditFiles(opt.Dir)
+	if err != nil {
+		return nil, err
+	}
+	// The last record is in the active file, or in the last rotated one
+	// when the active file is still empty.
+	for i := len(files) - 1; i >= 0 && a.seq == 0; i-- {
+		last, err := lastAuditRecord(files[i])
+		if err != nil {
+			return nil, err
+		}
+		if last != nil {
+			a.seq, a.lastHash = last.Seq, last.Hash
+		}
+	}
+
+	path := filepath.Join(opt.Dir, auditFileName)
+	a.file, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	info, err := a.file.Stat()
+	if err != nil {
+		a.file.Close()
+		return nil, err
+	}
+	a.size = info.Size()
+	if a.size == 0 {
+		a.firstSeq = a.seq + 1
+	} else if first, err := firstAuditRecord(path); err == nil && first != nil {
+		a.firstSeq = first.Seq
+	}
+	return a, nil
+}
+
+// Append chains the record to the log and writes it. Seq, PrevHash and Hash
+// are set by Append.
+func (a *AuditLog) Append(record AuditRecord) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.file == nil {
+		return os.ErrClosed
+	}
+	if a.size >= a.opt.MaxSize {
+		if err := a.rotate(); err != nil {
+			return err
+		}
+	}
+
+	record.Seq = a.seq + 1
+	record.PrevHash = a.lastHash
+	hash, err := record.hash()
+	if err != nil {
+		return err
+	}
+	record.Hash = hash
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	if _, err := a.file.Write(line); err != nil {
+		return err
+	}
+	if err := a.file.Sync(); err != nil {
+		return err
+	}
+	a.size += int64(len(line))
+	a.seq, a.lastHash = record.Seq, record.Hash
+	return nil
+}
+
+// rotate renames the active file after its first record and starts a new
+// one. The caller must hold mu.
+func (a *AuditLog) rotate() error {
+	if err := a.file.Close(); err != nil {
+		return err
+	}
+	path := filepath.Join(a.opt.Dir, auditFileName)
+	rotated := filepath.Join(a.opt.Dir, fmt.Sprintf("%s%020d.log", auditRotatedPrefix, a.firstSeq))
+	if err := os.Rename(path, rotated); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		a.file = nil
+		return err
+	}
+	a.file, a.size, a.firstSeq = f, 0, a.seq+1
+	return nil
+}
+
+// Close closes the active file. Appending afterwards fails.
+func (a *AuditLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.file == nil {
+		return nil
+	}
+	err := a.file.Close()
+	a.file = nil
+	return err
+}
+
+// auditFiles returns the files of the audit log in dir, oldest first.
+func auditFiles(dir string) ([]string, error) {
+	rotated, err := filepath.Glob(filepath.Join(dir, auditRotatedPrefix+"*.log"))
+	if err != nil {
+		return nil, err
+	}
+	// The sequence numbers are zero padded, so the names sort in order.
+	sort.Strings(rotated)
+
+	active := filepath.Join(dir, auditFileName)
+	if _, err := os.Stat(active); err == nil {
+		rotated = append(rotated, active)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return rotated, nil
+}
+
+// readAuditFile calls fn with every record of the file and its line number.
+func readAuditFile(path string, fn func(line int, record AuditRecord) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var record AuditRecord
+		decoder := json.NewDecoder(bytes.NewReader(scanner.Bytes()))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&record); err != nil {
+			return fmt.Errorf("%s:%d: damaged record: %w", path, line, err)
+		}
+		if err := fn(line, record); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+func firstAuditRecord(path string) (*AuditRecord, error) {
+	var first *AuditRecord
+	errFound := errors.New("found")
+	err := readAuditFile(path, func(_ int, record AuditRecord) error {
+		first = &record
+		return errFound
+	})
+	if err != nil && !errors.Is(err, errFound) {
+		return nil, err
+	}
+	return first, nil
+}
+
+func lastAuditRecord(path string) (*AuditRecord, error) {
+	var last *AuditRecord
+	err := readAuditFile(path, func(_ int, record AuditRecord) error {
+		last = &record
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return last, nil
+}
+
+// AuditReport is the result of VerifyAuditLog.
+type AuditReport struct {
+	Files   int
+	Records int
+	// FirstSeq and LastSeq are the sequence numbers of the first and last
+	// records found. FirstSeq is above 1 when older files were removed.
+	FirstSeq uint64
+	LastSeq  uint64
+}
+
+// VerifyAuditLog reads every file of the audit log in dir and checks that the
+// records are numbered in order, that every record holds the hash of the one
+// before and that every hash matches its record. It returns the first break
+// of the chain, with the file and line where it was found.
+func VerifyAuditLog(dir string) (AuditReport, error) {
+	var report AuditReport
+	files, err := auditFiles(dir)
+	if err != nil {
+		return report, err
+	}
+	if len(files) == 0 {
+		return report, fmt.Errorf("no audit log in %s", dir)
+	}
+
+	var prevHash string
+	for _, path := range files {
+		report.Files++
+		err := readAuditFile(path, func(line int, record AuditRecord) error {
+			at := fmt.Sprintf("%s:%d", path, line)
+			if report.Records == 0 {
+				// The chain is anchored by the first record found, unless
+				// it is the very first record of the node.
+				report.FirstSeq = record.Seq
+				if record.Seq == 1 && record.PrevHash != "" {
+					return fmt.Errorf("%s: first record has a previous hash", at)
+				}
+			} else {
+				if record.Seq != report.LastSeq+1 {
+					return fmt.Errorf("%s: record %d follows record %d", at, record.Seq, report.LastSeq)
+				}
+				if record.PrevHash != prevHash {
+					return fmt.Errorf("%s: record %d does not chain to record %d", at, record.Seq, report.LastSeq)
+				}
+			}
+			hash, err := record.hash()
+			if err != nil {
+				return fmt.Errorf("%s: %w", at, err)
+			}
+			if record.Hash != hash {
+				return fmt.Errorf("%s: record %d was modified: its hash does not match", at, record.Seq)
+			}
+
+			report.Records++
+			report.LastSeq, prevHash = record.Seq, record.Hash
+			return nil
+		})
+		if err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// auditResult returns the result of an operation that returned err.
+func auditResult(err error) string {
+	switch {
+	case err == nil:
+		return AuditOK
+	case isDenied(err):
+		return AuditDenied
+	default:
+		return AuditError
+	}
+}
+
+// isDenied reports whether err refused a request.
+func isDenied(err error) bool {
+	return errors.Is(err, ErrAccessDenied) || errors.Is(err, ErrUnauthenticated)
+}
+
+// audit appends a record of an operation that returned err to the audit log of
+// the node, if it has one. The actor and the peer default to the caller of ctx.
+func (s *FileServer) audit(ctx context.Context, record AuditRecord, err error) {
+	log := s.Config.AuditLog
+	if log == nil {
+		return
+	}
+
+	if record.Actor == "" {
+		c, ok := ctx.Value(callerKey{}).(caller)
+		switch {
+		case ok:
+			record.Actor = c.principal.Name
+			if record.Peer == "" {
+				record.Peer = c.peer
+			}
+		case record.Peer != "":
+			record.Actor = nodePrincipal.Name
+		default:
+			record.Actor = "local"
+		}
+	}
+	record.Time = time.Now().UTC()
+	record.Node = s.Config.Transport.RemoteAddr()
+	record.Result = auditResult(err)
+	if err != nil {
+		record.Error = err.Error()
+	}
+
+	if err := log.Append(record); err != nil && !errors.Is(err, os.ErrClosed) {
+		s.logger().Error("Failed to write audit record", "action", record.Action, "key", record.Key, "error", err)
+	}
+}
+
+// auditOperation records the outcome of a data operation. Denied operations
+// were already recorded by auditDenied.
+func (s *FileServer) auditOperation(ctx context.Context, record AuditRecord, err error) {
+	if !isDenied(err) {
+		s.audit(ctx, record, err)
+	}
+}
+
+// auditPeer records a peer joining or leaving the node.
+func (s *FileServer) auditPeer(address string, joined bool) {
+	action := "peer-leave"
+	if joined {
+		action = "peer-join"
+	}
+	s.audit(context.Background(), AuditRecord{Action: action, Peer: address}, nil)
+}
+
+// auditAction is the action of the audit records of an operation that needs permission.
+func auditAction(permission Permission) string {
+	switch permission {
+	case PermissionRead:
+		return "get"
+	case PermissionWrite:
+		return "store"
+	default:
+		return string(permission)
+	}
+}
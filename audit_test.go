@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditLog(t *testing.T) {
+	dir := t.TempDir()
+	log, err := NewAuditLog(AuditLogOPT{Dir: dir, MaxSize: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 20 {
+		if err := log.Append(AuditRecord{Actor: "ci", Action: "store", Key: fmt.Sprintf("key-%d", i), Result: AuditOK}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	log.Close()
+
+	report, err := VerifyAuditLog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Records != 20 || report.FirstSeq != 1 || report.LastSeq != 20 || report.Files < 2 {
+		t.Errorf("report: got %+v, want 20 records rotated over several files", report)
+	}
+
+	// The chain goes on after reopening the log.
+	log, err = NewAuditLog(AuditLogOPT{Dir: dir, MaxSize: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := log.Append(AuditRecord{Actor: "ci", Action: "get", Key: "key-0", Result: AuditOK}); err != nil {
+		t.Fatal(err)
+	}
+	log.Close()
+	if report, err := VerifyAuditLog(dir); err != nil || report.LastSeq != 21 {
+		t.Fatalf("after reopening: got %+v, %v", report, err)
+	}
+
+	files, _ := auditFiles(dir)
+	tamper := func(edit func(string) string) {
+		t.Helper()
+		original, err := os.ReadFile(files[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { os.WriteFile(files[0], original, 0o600) })
+		os.WriteFile(files[0], []byte(edit(string(original))), 0o600)
+	}
+
+	tamper(func(s string) string { return strings.Replace(s, `"key":"key-1"`, `"key":"key-9"`, 1) })
+	if _, err := VerifyAuditLog(dir); err == nil || !strings.Contains(err.Error(), "record 2 was modified") {
+		t.Errorf("modified record: got %v", err)
+	}
+
+	tamper(func(s string) string {
+		lines := strings.SplitAfter(s, "\n")
+		return strings.Join(append(lines[:1], lines[2:]...), "")
+	})
+	if _, err := VerifyAuditLog(dir); err == nil || !strings.Contains(err.Error(), "record 3 follows record 1") {
+		t.Errorf("removed record: got %v", err)
+	}
+}
+
+func TestServerAudit(t *testing.T) {
+	dir := t.TempDir()
+	log, err := NewAuditLog(AuditLogOPT{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, sha := NewToken()
+	server := makeServer("127.0.0.14:4174", true)
+	server.Config.AuditLog = log
+	server.Config.AccessControl = &AccessControl{
+		PeerSecret: (&BasicCrypto{}).newEncryptionKey(),
+		Principals: []Principal{{Name: "ci", TokenSHA256: sha, Grants: []Grant{
+			{Namespace: DefaultNamespace, Prefix: "builds/", Permissions: []Permission{PermissionRead, PermissionWrite}},
+		}}},
+	}
+	startServer(t, server)
+	defer server.Storage.Clear()
+
+	peer := makeServer("127.0.0.14:4175", false, "127.0.0.14:4174")
+	peer.Config.AccessControl = server.Config.AccessControl
+	startServer(t, peer)
+	defer peer.Storage.Clear()
+	time.Sleep(30 * time.Millisecond)
+
+	ci, _ := server.Config.AccessControl.Principal("ci")
+	ctx := WithPrincipal(context.Background(), ci)
+	if err := server.StoreContext(ctx, "builds/1", bytes.NewReader([]byte("build"))); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	r, err := server.GetContext(ctx, "builds/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	if err := server.DeleteContext(ctx, "builds/1"); err == nil {
+		t.Error("delete without a delete grant succeeded")
+	}
+	if err := server.Delete("builds/1"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	peer.Stop()
+	time.Sleep(50 * time.Millisecond)
+	server.Stop()
+
+	var got []string
+	err = readAuditFile(filepath.Join(dir, auditFileName), func(_ int, record AuditRecord) error {
+		got = append(got, fmt.Sprintf("%s %s %s %d %s", record.Actor, record.Action, record.Key, record.Size, record.Result))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"node peer-join  0 ok",
+		"ci store builds/1 5 ok",
+		"ci get builds/1 5 ok",
+		"ci delete builds/1 0 denied",
+		"local delete builds/1 5 ok",
+		"node peer-leave  0 ok",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("audit records:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if _, err := VerifyAuditLog(dir); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"net"
+	"strings"
+	"time"
+)
+
+// ErrUnauthenticated is returned when a client presents no API token, or one
+// that no principal holds.
+var ErrUnauthenticated = errors.New("unauthenticated")
+
+// Permission is an operation a Grant allows.
+type Permission string
+
+const (
+	// PermissionRead allows Get, GetRange, Stat and List.
+	PermissionRead Permission = "read"
+	// PermissionWrite allows Store.
+	PermissionWrite Permission = "write"
+	// PermissionDelete allows Delete.
+	PermissionDelete Permission = "delete"
+	// PermissionAdmin allows the actions of the admin socket that change the
+	// node: disconnecting a peer, rebalancing and setting the bandwidth
+	// limits. It is only given by a grant of AnyNamespace without a Prefix.
+	PermissionAdmin Permission = "admin"
+)
+
+// permissions are the valid values of Grant.Permissions.
+var permissions = map[Permission]bool{
+	PermissionRead:   true,
+	PermissionWrite:  true,
+	PermissionDelete: true,
+	PermissionAdmin:  true,
+}
+
+// AnyNamespace is the Grant.Namespace that matches every namespace.
+const AnyNamespace = "*"
+
+// Grant allows some operations on the keys of a namespace that start with a prefix.
+type Grant struct {
+	// Namespace is the name of the namespace, DefaultNamespace included, or AnyNamespace.
+	Namespace string
+	// Prefix restricts the grant to the keys starting with it. An empty
+	// Prefix matches every key.
+	Prefix      string
+	Permissions []Permission
+}
+
+// matches reports whether the grant allows permission on the key of the namespace.
+func (g Grant) matches(permission Permission, namespace, key string) bool {
+	if g.Namespace != AnyNamespace && g.Namespace != namespace {
+		return false
+	}
+	if !strings.HasPrefix(key, g.Prefix) {
+		return false
+	}
+	for _, p := range g.Permissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// Principal is a client of the cluster, identified by an API token.
+type Principal struct {
+	// Name identifies the principal in audit records and in the requests
+	// relayed to peers. With the S3 gateway, it is the access key ID.
+	Name string
+	// TokenSHA256 is the hex encoded SHA-256 of the API token of the
+	// principal, so that the configuration does not hold the token itself.
+	TokenSHA256 string
+	Grants      []Grant
+}
+
+// Allows reports whether one of the grants of the principal allows permission
+// on the key of the namespace.
+func (p *Principal) Allows(permission Permission, namespace, key string) bool {
+	for _, g := range p.Grants {
+		if g.matches(permission, namespace, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// isAdmin reports whether the principal has PermissionAdmin.
+func (p *Principal) isAdmin() bool {
+	return p.Allows(PermissionAdmin, AnyNamespace, "")
+}
+
+// allowsAny reports whether the principal may use permission on some of the
+// keys of the namespace.
+func (p *Principal) allowsAny(permission Permission, namespace string) bool {
+	for _, g := range p.Grants {
+		if g.matches(permission, namespace, g.Prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// nodePrincipal makes the requests a node sends on its own behalf, such as
+// fetching a replica to heal a corrupted blob or rebalancing files.
+var nodePrincipal = &Principal{
+	Name: "node",
+	Grants: []Grant{{
+		Namespace:   AnyNamespace,
+		Permissions: []Permission{PermissionRead, PermissionWrite, PermissionDelete},
+	}},
+}
+
+// AccessControl restricts who may use a node. Clients present an API token to
+// the HTTP and gRPC front ends, or sign their S3 requests with an access key
+// named like their principal. The requests the nodes send each other are
+// signed with PeerSecret and name the principal they are made for, which the
+// receiving node checks against its own grants.
+//
+// Every node of a cluster must use the same AccessControl.
+type AccessControl struct {
+	// PeerSecret signs the requests sent to peers.
+	PeerSecret []byte
+	// Principals are the clients allowed to use the node.
+	Principals []Principal
+}
+
+// Authenticate returns the principal holding the API token, or an error
+// wrapping ErrUnauthenticated.
+func (ac *AccessControl) Authenticate(token string) (*Principal, error) {
+	if token == "" {
+		return nil, fmt.Errorf("%w: no API token", ErrUnauthenticated)
+	}
+	sum := sha256.Sum256([]byte(token))
+	hash := hex.EncodeToString(sum[:])
+
+	// Compare with every principal, so that the time taken does not tell
+	// which one came close.
+	var found *Principal
+	for i := range ac.Principals {
+		if subtle.ConstantTimeCompare([]byte(hash), []byte(strings.ToLower(ac.Principals[i].TokenSHA256))) == 1 {
+			found = &ac.Principals[i]
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("%w: invalid API token", ErrUnauthenticated)
+	}
+	return found, nil
+}
+
+// Principal returns the principal called name.
+func (ac *AccessControl) Principal(name string) (*Principal, bool) {
+	for i := range ac.Principals {
+		if ac.Principals[i].Name == name {
+			return &ac.Principals[i], true
+		}
+	}
+	return nil, false
+}
+
+// NewToken returns a random API token and the SHA-256 to configure for it.
+func NewToken() (token, sha string) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	token = hex.EncodeToString(b)
+	sum := sha256.Sum256([]byte(token))
+	return token, hex.EncodeToString(sum[:])
+}
+
+// bearerToken returns the token of an "Authorization: Bearer <token>" header.
+func bearerToken(authorization string) string {
+	scheme, token, ok := strings.Cut(authorization, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// caller is who a request is made for: the principal and, for requests
+// relayed by a peer, its address.
+type caller struct {
+	principal *Principal
+	peer      string
+}
+
+type callerKey struct{}
+
+// WithPrincipal returns a context whose requests are made for the principal
+// and checked against its grants. Requests made with a context without a
+// principal come from the node itself or a trusted caller in the same process,
+// and are always allowed.
+func WithPrincipal(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, callerKey{}, caller{principal: principal})
+}
+
+// PrincipalFromContext returns the principal set by WithPrincipal.
+func PrincipalFromContext(ctx context.Context) (*Principal, bool) {
+	c, ok := ctx.Value(callerKey{}).(caller)
+	return c.principal, ok
+}
+
+// authorize returns an error wrapping ErrAccessDenied, and audits the denial,
+// if the principal of ctx may not use permission on the key of the namespace.
+func (s *FileServer) authorize(ctx context.Context, ns *Namespace, permission Permission, key string) error {
+	c, ok := ctx.Value(callerKey{}).(caller)
+	if !ok || c.principal.Allows(permission, ns.name, key) {
+		return nil
+	}
+	err := fmt.Errorf("%s %s: %w: principal %s has no %s grant", permission, ns.qualify(key), ErrAccessDenied, c.principal.Name, permission)
+	s.auditDenied(ctx, auditAction(permission), ns.name, key, err)
+	return err
+}
+
+// authorizeList returns the filter List applies for the principal of ctx, or
+// an error wrapping ErrAccessDenied if it may not read any key of the namespace.
+func (s *FileServer) authorizeList(ctx context.Context, ns *Namespace, prefix string) (func(key string) bool, error) {
+	c, ok := ctx.Value(callerKey{}).(caller)
+	if !ok {
+		return func(string) bool { return true }, nil
+	}
+	if !c.principal.allowsAny(PermissionRead, ns.name) {
+		err := fmt.Errorf("listing %s: %w: principal %s has no read grant", ns.qualify(prefix), ErrAccessDenied, c.principal.Name)
+		s.auditDenied(ctx, "list", ns.name, prefix, err)
+		return nil, err
+	}
+	return func(key string) bool {
+		return c.principal.Allows(PermissionRead, ns.name, key)
+	}, nil
+}
+
+// auditDenied records a request that was refused. action is the operation,
+// or "authenticate" for a client without a valid token.
+func (s *FileServer) auditDenied(ctx context.Context, action, namespace, key string, err error) {
+	actor, peer := "anonymous", ""
+	if c, ok := ctx.Value(callerKey{}).(caller); ok {
+		actor, peer = c.principal.Name, c.peer
+	}
+	s.metrics.accessDenied.WithLabelValues(action).Inc()
+	s.logger().Warn("Access denied", "actor", actor, "action", action, "namespace", namespace, "key", key, "peer", peer, "error", err)
+	s.audit(ctx, AuditRecord{Actor: actor, Action: action, Namespace: namespace, Key: key, Peer: peer}, err)
+}
+
+// maxMessageAge is how far the time a peer signed a request may be from the
+// local clock. The nonces of the requests are remembered for that long, so a
+// captured request cannot be replayed.
+const maxMessageAge = 5 * time.Minute
+
+// messageNonceSize is the number of random bytes of a MessageAuth nonce.
+const messageNonceSize = 16
+
+// MessageAuth proves that a request was sent by a node holding the peer secret
+// and names the principal it is made for. An empty Principal means the node
+// itself. Nonce is random, so that every request is accepted once.
+type MessageAuth struct {
+	Principal string
+	IssuedAt  time.Time
+	Nonce     []byte
+	Signature []byte
+}
+
+// messageSignature returns the HMAC of a request: the principal it is made for,
+// the permission it needs, when and with which nonce it was signed, and the
+// digest of its whole payload. Each field is prefixed with its length, so that
+// bytes cannot be moved from one field to the next.
+func messageSignature(secret []byte, auth *MessageAuth, permission Permission, payload any) ([]byte, error) {
+	digest, err := payloadDigest(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	for _, field := range [][]byte{
+		[]byte(auth.Principal),
+		[]byte(permission),
+		[]byte(auth.IssuedAt.UTC().Format(time.RFC3339Nano)),
+		auth.Nonce,
+		[]byte(fmt.Sprintf("%T", payload)),
+		digest,
+	} {
+		writeField(mac, field)
+	}
+	return mac.Sum(nil), nil
+}
+
+// payloadDigest returns the SHA-256 of the payload of a message in JSON, once
+// it went through gob like the payload received by a peer, since gob drops
+// empty maps and slices. JSON sorts the keys of the maps, so the sender and the
+// peer compute the same digest.
+func payloadDigest(payload any) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(Message{Payload: payload}); err != nil {
+		return nil, err
+	}
+	var received Message
+	if err := gob.NewDecoder(buf).Decode(&received); err != nil {
+		return nil, err
+	}
+
+	payloadJSON, err := json.Marshal(received.Payload)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(payloadJSON)
+	return digest[:], nil
+}
+
+// writeField writes the field to h after its length.
+func writeField(h hash.Hash, field []byte) {
+	h.Write(binary.BigEndian.AppendUint64(nil, uint64(len(field))))
+	h.Write(field)
+}
+
+// rememberNonce records the nonce of a request accepted from a peer until
+// expires. It returns false if the nonce was already recorded. Expired nonces
+// are forgotten at most once per maxMessageAge.
+func (s *FileServer) rememberNonce(nonce []byte, expires time.Time) bool {
+	s.nonceLock.Lock()
+	defer s.nonceLock.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.noncesPruned) > maxMessageAge {
+		for n, exp := range s.nonces {
+			if now.After(exp) {
+				delete(s.nonces, n)
+			}
+		}
+		s.noncesPruned = now
+	}
+
+	if _, ok := s.nonces[string(nonce)]; ok {
+		return false
+	}
+	s.nonces[string(nonce)] = expires
+	return true
+}
+
+// requestPermission returns what a request sent to peers needs to be allowed.
+func requestPermission(payload any) (permission Permission, namespace, key string, ok bool) {
+	switch m := payload.(type) {
+	case GetFileMessage:
+		return PermissionRead, m.Namespace, m.Key, true
+	case StoreFileMessage:
+		return PermissionWrite, m.Namespace, m.Key, true
+	case DeleteFileMessage:
+		return PermissionDelete, m.Namespace, m.Key, true
+	}
+	return "", "", "", false
+}
+
+// controlMessage reports whether the payload changes what a node knows of the
+// network, which only the nodes holding the peer secret may do. Control
+// messages are signed for the node itself and need no permission.
+func controlMessage(payload any) bool {
+	switch payload.(type) {
+	case PeersInfoMessage, NodeIntroductionMessage, NodeLeavingMessage, CapacityMessage:
+		return true
+	}
+	return false
+}
+
+// signMessage signs a request sent to peers for the principal of ctx, or a
+// control message for the node itself.
+func (s *FileServer) signMessage(ctx context.Context, message *Message) error {
+	ac := s.Config.AccessControl
+	permission, _, _, ok := requestPermission(message.Payload)
+	control := controlMessage(message.Payload)
+	if ac == nil || !ok && !control {
+		return nil
+	}
+
+	auth := &MessageAuth{IssuedAt: time.Now(), Nonce: make([]byte, messageNonceSize)}
+	if _, err := rand.Read(auth.Nonce); err != nil {
+		return err
+	}
+	if principal, ok := PrincipalFromContext(ctx); ok && !control {
+		auth.Principal = principal.Name
+	}
+	signature, err := messageSignature(ac.PeerSecret, auth, permission, message.Payload)
+	if err != nil {
+		return err
+	}
+	auth.Signature = signature
+	message.Auth = auth
+	return nil
+}
+
+// authorizePeer checks the signature of a request sent by a peer, then the
+// grants of the principal it is made for on this node. It returns ctx with the
+// caller of the request.
+func (s *FileServer) authorizePeer(ctx context.Context, from net.Addr, auth *MessageAuth, payload any, permission Permission, ns *Namespace, key string) (context.Context, error) {
+	ac := s.Config.AccessControl
+	if ac == nil {
+		return ctx, nil
+	}
+
+	c, err := s.authenticatePeer(ac, from, auth, payload, permission)
+	if err != nil {
+		ctx = context.WithValue(ctx, callerKey{}, caller{principal: &Principal{Name: "anonymous"}, peer: from.String()})
+		s.auditDenied(ctx, auditAction(permission), ns.name, key, err)
+		return ctx, err
+	}
+
+	ctx = context.WithValue(ctx, callerKey{}, c)
+	return ctx, s.authorize(ctx, ns, permission, key)
+}
+
+// authorizeControl checks the signature of a control message sent by a peer,
+// which must be signed for the node itself.
+func (s *FileServer) authorizeControl(ctx context.Context, from net.Addr, auth *MessageAuth, payload any) error {
+	ac := s.Config.AccessControl
+	if ac == nil {
+		return nil
+	}
+
+	c, err := s.authenticatePeer(ac, from, auth, payload, "")
+	if err == nil && c.principal != nodePrincipal {
+		err = fmt.Errorf("%w: control message from peer %s is signed for principal %s", ErrUnauthenticated, from, c.principal.Name)
+	}
+	if err != nil {
+		ctx = context.WithValue(ctx, callerKey{}, caller{principal: &Principal{Name: "anonymous"}, peer: from.String()})
+		s.auditDenied(ctx, "authenticate", "", "", err)
+	}
+	return err
+}
+
+// authenticatePeer checks the signature of a message sent by a peer over its
+// payload, its age, and that its nonce was not seen before. It returns the
+// caller the message is sent for.
+func (s *FileServer) authenticatePeer(ac *AccessControl, from net.Addr, auth *MessageAuth, payload any, permission Permission) (caller, error) {
+	c := caller{principal: nodePrincipal, peer: from.String()}
+	switch {
+	case auth == nil:
+		return c, fmt.Errorf("%w: request from peer %s is not signed", ErrUnauthenticated, from)
+	case len(auth.Nonce) != messageNonceSize:
+		return c, fmt.Errorf("%w: request from peer %s has no valid nonce", ErrUnauthenticated, from)
+	case !s.validSignature(ac.PeerSecret, auth, permission, payload):
+		return c, fmt.Errorf("%w: request from peer %s has an invalid signature", ErrUnauthenticated, from)
+	case time.Since(auth.IssuedAt).Abs() > maxMessageAge:
+		return c, fmt.Errorf("%w: request from peer %s was signed at %s", ErrUnauthenticated, from, auth.IssuedAt)
+	case !s.rememberNonce(auth.Nonce, auth.IssuedAt.Add(maxMessageAge)):
+		return c, fmt.Errorf("%w: request from peer %s replays a nonce", ErrUnauthenticated, from)
+	case auth.Principal != "":
+		principal, ok := ac.Principal(auth.Principal)
+		if !ok {
+			return c, fmt.Errorf("%w: unknown principal %s in request from peer %s", ErrUnauthenticated, auth.Principal, from)
+		}
+		c.principal = principal
+	}
+	return c, nil
+}
+
+// validSignature reports whether auth carries the signature of the payload.
+func (s *FileServer) validSignature(secret []byte, auth *MessageAuth, permission Permission, payload any) bool {
+	signature, err := messageSignature(secret, auth, permission, payload)
+	if err != nil {
+		s.logger().Warn("Failed to compute the signature of a request", "error", err)
+		return false
+	}
+	return hmac.Equal(auth.Signature, signature)
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestPrincipalAllows(t *testing.T) {
+	principal := &Principal{
+		Name: "ci",
+		Grants: []Grant{
+			{Namespace: "team-a", Prefix: "builds/", Permissions: []Permission{PermissionRead, PermissionWrite}},
+			{Namespace: AnyNamespace, Prefix: "public/", Permissions: []Permission{PermissionRead}},
+		},
+	}
+
+	tests := []struct {
+		permission Permission
+		namespace  string
+		key        string
+		want       bool
+	}{
+		{PermissionWrite, "team-a", "builds/1.tar", true},
+		{PermissionRead, "team-a", "builds/1.tar", true},
+		{PermissionDelete, "team-a", "builds/1.tar", false},
+		{PermissionWrite, "team-a", "secrets/key", false},
+		{PermissionWrite, "team-b", "builds/1.tar", false},
+		{PermissionRead, "team-b", "public/logo.png", true},
+		{PermissionRead, DefaultNamespace, "public/logo.png", true},
+		{PermissionWrite, DefaultNamespace, "public/logo.png", false},
+	}
+	for _, tt := range tests {
+		if got := principal.Allows(tt.permission, tt.namespace, tt.key); got != tt.want {
+			t.Errorf("Allows(%s, %q, %q): got %v, want %v", tt.permission, tt.namespace, tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestAccessControlAuthenticate(t *testing.T) {
+	token, sha := NewToken()
+	ac := &AccessControl{Principals: []Principal{{Name: "other", TokenSHA256: "00"}, {Name: "ci", TokenSHA256: sha}}}
+
+	principal, err := ac.Authenticate(token)
+	if err != nil || principal.Name != "ci" {
+		t.Errorf("valid token: got %+v, %v", principal, err)
+	}
+	for _, token := range []string{"", "wrong", sha} {
+		if _, err := ac.Authenticate(token); !errors.Is(err, ErrUnauthenticated) {
+			t.Errorf("token %q: got %v, want ErrUnauthenticated", token, err)
+		}
+	}
+}
+
+func TestGatewayAccessControl(t *testing.T) {
+	writerToken, writerSHA := NewToken()
+	readerToken, readerSHA := NewToken()
+
+	server := makeServer("127.0.0.14:4170", true)
+	server.Config.AccessControl = &AccessControl{
+		PeerSecret: (&BasicCrypto{}).newEncryptionKey(),
+		Principals: []Principal{
+			{Name: "writer", TokenSHA256: writerSHA, Grants: []Grant{
+				{Namespace: DefaultNamespace, Permissions: []Permission{PermissionRead, PermissionWrite, PermissionDelete}},
+			}},
+			{Name: "reader", TokenSHA256: readerSHA, Grants: []Grant{
+				{Namespace: DefaultNamespace, Prefix: "public/", Permissions: []Permission{PermissionRead}},
+			}},
+		},
+	}
+	startServer(t, server)
+	t.Cleanup(func() {
+		server.Stop()
+		server.Storage.Clear()
+	})
+
+	gateway := httptest.NewServer(NewGateway(server))
+	defer gateway.Close()
+
+	do := func(method, token, path string, body io.Reader) (*http.Response, []byte) {
+		t.Helper()
+		req, err := http.NewRequest(method, gateway.URL+path, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp, b
+	}
+
+	if resp, _ := do(http.MethodPut, "", "/objects/public/a", bytes.NewReader([]byte("a"))); resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("WWW-Authenticate") == "" {
+		t.Errorf("PUT without a token: got %s", resp.Status)
+	}
+	if resp, _ := do(http.MethodGet, "not-a-token", "/objects", nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("GET with an invalid token: got %s", resp.Status)
+	}
+	for _, key := range []string{"public/a", "private/b"} {
+		if resp, _ := do(http.MethodPut, writerToken, "/objects/"+key, bytes.NewReader([]byte(key))); resp.StatusCode != http.StatusCreated {
+			t.Fatalf("PUT %s: got %s", key, resp.Status)
+		}
+	}
+
+	if resp, _ := do(http.MethodPut, readerToken, "/objects/public/c", bytes.NewReader([]byte("c"))); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("PUT without a write grant: got %s, want 403", resp.Status)
+	}
+	if server.Storage.HasKey("public/c") {
+		t.Error("the denied file was stored")
+	}
+	if resp, _ := do(http.MethodGet, readerToken, "/objects/public/a", nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("GET under the granted prefix: got %s", resp.Status)
+	}
+	if resp, _ := do(http.MethodGet, readerToken, "/objects/private/b", nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("GET outside the granted prefix: got %s, want 403", resp.Status)
+	}
+	if resp, _ := do(http.MethodDelete, readerToken, "/objects/public/a", nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("DELETE without a delete grant: got %s, want 403", resp.Status)
+	}
+
+	// Listing only shows what the principal may read.
+	resp, body := do(http.MethodGet, readerToken, "/objects", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /objects: got %s", resp.Status)
+	}
+	var list struct {
+		Objects []ObjectInfo `json:"objects"`
+	}
+	if err := json.Unmarshal(body, &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Objects) != 1 || list.Objects[0].Key != "public/a" {
+		t.Errorf("GET /objects as reader: got %+v", list.Objects)
+	}
+}
+
+func TestPeerAccessControl(t *testing.T) {
+	secret := (&BasicCrypto{}).newEncryptionKey()
+	_, sha := NewToken()
+	principals := []Principal{{Name: "ci", TokenSHA256: sha, Grants: []Grant{
+		{Namespace: DefaultNamespace, Prefix: "builds/", Permissions: []Permission{PermissionRead, PermissionWrite}},
+	}}}
+
+	servers := make([]*FileServer, 3)
+	for i, address := range []string{"127.0.0.14:4171", "127.0.0.14:4172", "127.0.0.14:4173"} {
+		var server *FileServer
+		if i == 0 {
+			server = makeServer(address, true)
+		} else {
+			server = makeServer(address, false, "127.0.0.14:4171")
+		}
+		server.Config.AccessControl = &AccessControl{PeerSecret: secret, Principals: principals}
+		if i == 2 {
+			// The last node does not know the secret of the cluster.
+			server.Config.AccessControl = &AccessControl{PeerSecret: (&BasicCrypto{}).newEncryptionKey(), Principals: principals}
+		}
+		startServer(t, server)
+		t.Cleanup(func() {
+			server.Stop()
+			server.Storage.Clear()
+		})
+		servers[i] = server
+	}
+	time.Sleep(30 * time.Millisecond)
+
+	ci, _ := servers[1].Config.AccessControl.Principal("ci")
+	ctx := WithPrincipal(context.Background(), ci)
+	if err := servers[1].StoreContext(ctx, "builds/1", bytes.NewReader([]byte("build"))); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if !servers[0].Storage.HasKey("builds/1") {
+		t.Error("the replica signed for the principal was refused")
+	}
+
+	if err := servers[1].StoreContext(ctx, "releases/1", bytes.NewReader([]byte("release"))); !errors.Is(err, ErrAccessDenied) {
+		t.Errorf("store outside the grants: got %v, want ErrAccessDenied", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	// Requests signed with another secret are refused.
+	if err := servers[2].Store("builds/2", bytes.NewReader([]byte("build"))); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if servers[0].Storage.HasKey("builds/2") {
+		t.Error("a replica signed with the wrong secret was stored")
+	}
+
+	// So is the introduction of the node that does not know the secret.
+	addresses := servers[0].PeersAddresses()
+	if !slices.Contains(addresses, "127.0.0.14:4172") || slices.Contains(addresses, "127.0.0.14:4173") {
+		t.Errorf("addresses learned by the bootstrap node: got %v", addresses)
+	}
+}
+
+// A signed request is accepted once, and only with the payload it was signed for.
+func TestPeerMessageSignature(t *testing.T) {
+	server := makeServer("127.0.0.19:4510", false)
+	server.Config.AccessControl = &AccessControl{PeerSecret: (&BasicCrypto{}).newEncryptionKey()}
+	ns := server.defaultNamespace()
+	from := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 19), Port: 4511}
+
+	// receive signs the message and decodes it like the peer does.
+	receive := func(payload StoreFileMessage, tamper func(*StoreFileMessage)) (*MessageAuth, StoreFileMessage) {
+		t.Helper()
+		message := Message{Payload: payload}
+		if err := server.signMessage(context.Background(), &message); err != nil {
+			t.Fatal(err)
+		}
+		buf := new(bytes.Buffer)
+		if err := gob.NewEncoder(buf).Encode(message); err != nil {
+			t.Fatal(err)
+		}
+		var received Message
+		if err := gob.NewDecoder(buf).Decode(&received); err != nil {
+			t.Fatal(err)
+		}
+		payload = received.Payload.(StoreFileMessage)
+		if tamper != nil {
+			tamper(&payload)
+		}
+		return received.Auth, payload
+	}
+	authorize := func(auth *MessageAuth, payload StoreFileMessage) error {
+		_, err := server.authorizePeer(context.Background(), from, auth, payload, PermissionWrite, ns, payload.Key)
+		return err
+	}
+
+	payload := StoreFileMessage{
+		Namespace: DefaultNamespace,
+		Key:       "signed",
+		SentAt:    time.Now(),
+		Attrs:     ObjectAttrs{Tags: map[string]string{"b": "2", "a": "1"}, Metadata: map[string]string{}},
+	}
+	auth, received := receive(payload, nil)
+	if err := authorize(auth, received); err != nil {
+		t.Fatalf("signed request refused: %v", err)
+	}
+	if err := authorize(auth, received); !errors.Is(err, ErrUnauthenticated) {
+		t.Errorf("replayed request: got %v, want ErrUnauthenticated", err)
+	}
+
+	for name, tamper := range map[string]func(*StoreFileMessage){
+		"key":  func(m *StoreFileMessage) { m.Key = "other" },
+		"tags": func(m *StoreFileMessage) { m.Attrs.Tags["a"] = "3" },
+		"ttl":  func(m *StoreFileMessage) { m.Attrs.ExpiresAt = time.Now() },
+	} {
+		auth, received := receive(payload, tamper)
+		if err := authorize(auth, received); !errors.Is(err, ErrUnauthenticated) {
+			t.Errorf("request with a modified %s: got %v, want ErrUnauthenticated", name, err)
+		}
+	}
+}
+
+// Control messages are only accepted when signed with the peer secret.
+func TestPeerControlMessages(t *testing.T) {
+	server := makeServer("127.0.0.19:4530", false)
+	server.Config.AccessControl = &AccessControl{PeerSecret: (&BasicCrypto{}).newEncryptionKey()}
+	from := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 19), Port: 4531}
+	payload := NodeLeavingMessage{Address: "127.0.0.19:4531"}
+
+	if err := server.authorizeControl(context.Background(), from, nil, payload); !errors.Is(err, ErrUnauthenticated) {
+		t.Errorf("unsigned control message: got %v, want ErrUnauthenticated", err)
+	}
+
+	other := makeServer("127.0.0.19:4532", false)
+	other.Config.AccessControl = &AccessControl{PeerSecret: (&BasicCrypto{}).newEncryptionKey()}
+	message := Message{Payload: payload}
+	if err := other.signMessage(context.Background(), &message); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.authorizeControl(context.Background(), from, message.Auth, payload); !errors.Is(err, ErrUnauthenticated) {
+		t.Errorf("control message signed with another secret: got %v, want ErrUnauthenticated", err)
+	}
+
+	message = Message{Payload: payload}
+	if err := server.signMessage(context.Background(), &message); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.authorizeControl(context.Background(), from, message.Auth, payload); err != nil {
+		t.Errorf("signed control message refused: %v", err)
+	}
+	if err := server.authorizeControl(context.Background(), from, message.Auth, NodeLeavingMessage{Address: "127.0.0.19:4533"}); !errors.Is(err, ErrUnauthenticated) {
+		t.Errorf("control message with another address: got %v, want ErrUnauthenticated", err)
+	}
+}
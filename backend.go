@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Backend stores the blobs of a Storage along with their metadata. Keys are
+// the keys given to the FileServer; how they are laid out is up to the backend.
+//
+// Errors for missing keys wrap fs.ErrNotExist.
+type Backend interface {
+	// Put stores everything read from r under key, replacing any previous
+	// blob, and returns the metadata recorded for it, which holds attrs. When
+	// r is an AttrsReader, the attributes it holds once it has been read to
+	// the end are recorded instead.
+	Put(key string, r io.Reader, attrs ObjectAttrs) (ObjectMeta, error)
+	// Get opens the blob stored under key.
+	Get(key string) (Blob, error)
+	// Delete removes the blob stored under key and its metadata.
+	Delete(key string) error
+	// Stat returns the metadata recorded when the blob was stored.
+	Stat(key string) (ObjectMeta, error)
+	// List returns the metadata of the blobs whose key starts with prefix, sorted by key.
+	List(prefix string) ([]ObjectMeta, error)
+	// Walk calls fn for every stored blob. Returning an error from fn stops the walk.
+	Walk(fn func(ObjectMeta) error) error
+}
+
+// AttrsReader is a reader whose attributes are only complete once it has been
+// read to the end, such as the size of a file before compression.
+type AttrsReader interface {
+	io.Reader
+	Attrs() ObjectAttrs
+}
+
+// Blob is a stored blob opened for reading. ReadAt lets range reads skip the
+// bytes before the range.
+type Blob interface {
+	io.ReadCloser
+	io.ReaderAt
+	Size() int64
+}
+
+// quarantiner is implemented by backends that can move a blob out of the way
+// while keeping it around for inspection.
+type quarantiner interface {
+	Quarantine(key string) error
+}
+
+// clearer is implemented by backends that can remove everything they store at once.
+type clearer interface {
+	Clear() error
+}
+
+// metaRecorder computes the metadata of a blob from the bytes written to it.
+type metaRecorder struct {
+	key    string
+	r      io.Reader
+	attrs  ObjectAttrs
+	hasher hash.Hash
+	size   int64
+}
+
+// newMetaRecorder records the metadata of the blob read from r, which is
+// given to Backend.Put along with attrs.
+func newMetaRecorder(key string, r io.Reader, attrs ObjectAttrs) *metaRecorder {
+	return &metaRecorder{
+		key:    key,
+		r:      r,
+		attrs:  attrs,
+		hasher: sha256.New(),
+	}
+}
+
+func (m *metaRecorder) Write(p []byte) (int, error) {
+	m.size += int64(len(p))
+	return m.hasher.Write(p)
+}
+
+// meta returns the metadata of the bytes written so far.
+func (m *metaRecorder) meta() ObjectMeta {
+	if r, ok := m.r.(AttrsReader); ok {
+		m.attrs = r.Attrs()
+	}
+	return ObjectMeta{
+		Key:      m.key,
+		Size:     m.size,
+		Checksum: hex.EncodeToString(m.hasher.Sum(nil)),
+		ModTime:  time.Now().UTC(),
+
+		ObjectAttrs: m.attrs,
+	}
+}
+
+// listByWalking implements Backend.List on top of Backend.Walk.
+func listByWalking(b Backend, prefix string) ([]ObjectMeta, error) {
+	var metas []ObjectMeta
+	err := b.Walk(func(meta ObjectMeta) error {
+		if strings.HasPrefix(meta.Key, prefix) {
+			metas = append(metas, meta)
+		}
+		return nil
+	})
+	sort.Slice(metas, func(i, j int) bool {
+		return metas[i].Key < metas[j].Key
+	})
+	return metas, err
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DiskBackend stores every blob as a file under RootDir, at the path given by
+// PathTranformFunc, with its metadata in a JSON sidecar next to it.
+type DiskBackend struct {
+	RootDir          string
+	PathTranformFunc PathTranformSignature
+	Logger           *slog.Logger
+}
+
+// NewDiskBackend returns a backend storing blobs under rootDir. A nil
+// pathTransform means DefaultPathBuilder, a nil logger slog.Default().
+func NewDiskBackend(rootDir string, pathTransform PathTranformSignature, logger *slog.Logger) *DiskBackend {
+	if pathTransform == nil {
+		pathTransform = DefaultPathBuilder
+	}
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &DiskBackend{
+		RootDir:          rootDir,
+		PathTranformFunc: pathTransform,
+		Logger:           logger,
+	}
+}
+
+// Dir returns the root directory, whose file system is watched for free space.
+func (d *DiskBackend) Dir() string {
+	return d.RootDir
+}
+
+func (d *DiskBackend) prependTheRoot(path string) string {
+	return fmt.Sprintf("%s/%s", d.RootDir, path)
+}
+
+// blobPath returns the path of the blob stored under key.
+func (d *DiskBackend) blobPath(key string) string {
+	fileIdentifier := d.PathTranformFunc(key)
+	return d.prependTheRoot(fileIdentifier.BuildFilePath())
+}
+
+// Put writes the blob to its path, creating the directories it needs, and
+// writes its metadata sidecar. On error the blob is removed.
+func (d *DiskBackend) Put(key string, r io.Reader, attrs ObjectAttrs) (ObjectMeta, error) {
+	// Transform and prepare the file path
+	fileIdentifier := d.PathTranformFunc(key)
+	fullPathWithRoot := d.prependTheRoot(fileIdentifier.BuildFilePath())
+
+	// Ensure the directory structure exists, including the directories of a
+	// file name holding slashes
+	if err := os.MkdirAll(filepath.Dir(fullPathWithRoot), os.ModePerm); err != nil {
+		return ObjectMeta{}, err
+	}
+
+	// Create the destination file
+	destinationFile, err := os.Create(fullPathWithRoot)
+	if err != nil {
+		return ObjectMeta{}, err
+	}
+	defer destinationFile.Close()
+
+	// Hash the bytes that actually land on disk.
+	recorder := newMetaRecorder(key, r, attrs)
+	if _, err := io.Copy(io.MultiWriter(destinationFile, recorder), r); err != nil {
+		// Do not leave a partial blob behind, e.g. when the disk is full.
+		os.Remove(fullPathWithRoot)
+		os.Remove(fullPathWithRoot + metaFileSuffix)
+		return ObjectMeta{}, err
+	}
+
+	meta := recorder.meta()
+	return meta, d.writeMeta(fullPathWithRoot, meta)
+}
+
+// Get opens the blob file.
+func (d *DiskBackend) Get(key string) (Blob, error) {
+	f, err := os.Open(d.blobPath(key))
+	if err != nil {
+		return nil, err
+	}
+
+	fileInfo, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &diskBlob{File: f, size: fileInfo.Size()}, nil
+}
+
+// diskBlob is an open blob file.
+type diskBlob struct {
+	*os.File
+	size int64
+}
+
+func (b *diskBlob) Size() int64 {
+	return b.size
+}
+
+// Delete removes the blob file and its metadata sidecar, then the directories
+// of the blob path left empty. Other blobs under the same directories are kept.
+func (d *DiskBackend) Delete(key string) error {
+	fileIdentifier := d.PathTranformFunc(key)
+	blobPath := d.prependTheRoot(fileIdentifier.BuildFilePath())
+
+	for _, path := range []string{blobPath, blobPath + metaFileSuffix} {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	// Remove the empty directories from the deepest one up, stopping at the
+	// first one that still holds something.
+	for dir := filepath.Dir(fileIdentifier.BuildFilePath()); dir != "." && dir != "/" && dir != ""; dir = filepath.Dir(dir) {
+		if err := os.Remove(d.prependTheRoot(dir)); err != nil {
+			break
+		}
+	}
+
+	d.Logger.Debug("Deleted file", "key", key, "path", fileIdentifier.BuildFilePath())
+	return nil
+}
+
+// Stat reads the metadata sidecar of the blob. For a blob stored without a
+// sidecar, only the key, size and modification time are known.
+func (d *DiskBackend) Stat(key string) (ObjectMeta, error) {
+	blobPath := d.blobPath(key)
+	info, err := os.Stat(blobPath)
+	if err != nil {
+		return ObjectMeta{}, err
+	}
+
+	meta, err := d.readMeta(blobPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return ObjectMeta{Key: key, Size: info.Size(), ModTime: info.ModTime().UTC()}, nil
+	}
+	return meta, err
+}
+
+func (d *DiskBackend) List(prefix string) ([]ObjectMeta, error) {
+	return listByWalking(d, prefix)
+}
+
+// Walk calls fn for every blob under the root directory that has a metadata
+// sidecar. Quarantined blobs and the folders of the namespaces are skipped.
+func (d *DiskBackend) Walk(fn func(ObjectMeta) error) error {
+	err := filepath.WalkDir(d.RootDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			if entry.Name() == QuarantineFolderName || entry.Name() == NamespaceFolderName {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasSuffix(path, metaFileSuffix) {
+			return nil
+		}
+
+		meta, err := d.readMeta(strings.TrimSuffix(path, metaFileSuffix))
+		if err != nil {
+			d.Logger.Warn("Skipping unreadable metadata", "path", path, "error", err)
+			return nil
+		}
+		return fn(meta)
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Quarantine moves the blob and its sidecar into the quarantine folder and
+// removes it from the storage layout.
+func (d *DiskBackend) Quarantine(key string) error {
+	fileIdentifier := d.PathTranformFunc(key)
+	fullPathWithRoot := d.prependTheRoot(fileIdentifier.BuildFilePath())
+
+	quarantineDir := d.prependTheRoot(QuarantineFolderName)
+	if err := os.MkdirAll(quarantineDir, os.ModePerm); err != nil {
+		return err
+	}
+
+	quarantinePath := fmt.Sprintf("%s/%s-%d", quarantineDir, fileIdentifier.FileName, time.Now().UnixNano())
+	if err := os.Rename(fullPathWithRoot, quarantinePath); err != nil {
+		return err
+	}
+	if err := os.Rename(fullPathWithRoot+metaFileSuffix, quarantinePath+metaFileSuffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return d.Delete(key)
+}
+
+// Namespace returns a backend laying out the blobs of the namespace the same
+// way, under its own folder of the root directory.
+func (d *DiskBackend) Namespace(name string) (Backend, error) {
+	return NewDiskBackend(filepath.Join(d.RootDir, NamespaceFolderName, name), d.PathTranformFunc, d.Logger), nil
+}
+
+// Clear removes the root directory, along with the folders of the namespaces.
+func (d *DiskBackend) Clear() error {
+	return os.RemoveAll(d.RootDir)
+}
+
+// writeMeta persists the metadata sidecar for the blob at the given path.
+func (d *DiskBackend) writeMeta(blobPath string, meta ObjectMeta) error {
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(blobPath+metaFileSuffix, b, 0o644)
+}
+
+// readMeta loads the metadata sidecar for the blob at the given path.
+func (d *DiskBackend) readMeta(blobPath string) (ObjectMeta, error) {
+	var meta ObjectMeta
+	b, err := os.ReadFile(blobPath + metaFileSuffix)
+	if err != nil {
+		return meta, err
+	}
+	err = json.Unmarshal(b, &meta)
+	return meta, err
+}
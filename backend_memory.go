@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+// MemoryBackend keeps every blob in memory. It is meant for tests and for
+// nodes that cache data they can fetch again from their peers.
+type MemoryBackend struct {
+	mu    sync.RWMutex
+	blobs map[string]memoryBlob
+}
+
+type memoryBlob struct {
+	data []byte
+	meta ObjectMeta
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		blobs: make(map[string]memoryBlob),
+	}
+}
+
+// Put reads the whole blob before storing it, so a failed Put leaves the
+// previous blob in place.
+func (m *MemoryBackend) Put(key string, r io.Reader, attrs ObjectAttrs) (ObjectMeta, error) {
+	recorder := newMetaRecorder(key, r, attrs)
+	data, err := io.ReadAll(io.TeeReader(r, recorder))
+	if err != nil {
+		return ObjectMeta{}, err
+	}
+
+	meta := recorder.meta()
+	m.mu.Lock()
+	m.blobs[key] = memoryBlob{data: data, meta: meta}
+	m.mu.Unlock()
+	return meta, nil
+}
+
+func (m *MemoryBackend) Get(key string) (Blob, error) {
+	m.mu.RLock()
+	blob, ok := m.blobs[key]
+	m.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("blob %s: %w", key, os.ErrNotExist)
+	}
+	return &memoryReader{Reader: bytes.NewReader(blob.data)}, nil
+}
+
+// memoryReader reads a blob held in memory.
+type memoryReader struct {
+	*bytes.Reader
+}
+
+func (r *memoryReader) Close() error {
+	return nil
+}
+
+func (m *MemoryBackend) Delete(key string) error {
+	m.mu.Lock()
+	delete(m.blobs, key)
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *MemoryBackend) Stat(key string) (ObjectMeta, error) {
+	m.mu.RLock()
+	blob, ok := m.blobs[key]
+	m.mu.RUnlock()
+	if !ok {
+		return ObjectMeta{}, fmt.Errorf("blob %s: %w", key, os.ErrNotExist)
+	}
+	return blob.meta, nil
+}
+
+func (m *MemoryBackend) List(prefix string) ([]ObjectMeta, error) {
+	return listByWalking(m, prefix)
+}
+
+// Walk calls fn for a snapshot of the blobs, sorted by key, so fn may modify
+// the backend.
+func (m *MemoryBackend) Walk(fn func(ObjectMeta) error) error {
+	m.mu.RLock()
+	metas := make([]ObjectMeta, 0, len(m.blobs))
+	for _, blob := range m.blobs {
+		metas = append(metas, blob.meta)
+	}
+	m.mu.RUnlock()
+
+	sort.Slice(metas, func(i, j int) bool {
+		return metas[i].Key < metas[j].Key
+	})
+	for _, meta := range metas {
+		if err := fn(meta); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Clear removes every blob.
+func (m *MemoryBackend) Clear() error {
+	m.mu.Lock()
+	m.blobs = make(map[string]memoryBlob)
+	m.mu.Unlock()
+	return nil
+}
+
+// Namespace returns a new empty backend for the namespace.
+func (m *MemoryBackend) Namespace(name string) (Backend, error) {
+	return NewMemoryBackend(), nil
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+)
+
+// ObjectStoreClient is the subset of the S3 API used by ObjectStoreBackend.
+// *s3.Client implements it.
+type ObjectStoreClient interface {
+	PutObject(context.Context, *s3.PutObjectInput, ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	GetObject(context.Context, *s3.GetObjectInput, ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	DeleteObject(context.Context, *s3.DeleteObjectInput, ...func(*s3.Options)) (*s3.DeleteObjectOutput, error)
+	ListObjectsV2(context.Context, *s3.ListObjectsV2Input, ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
+}
+
+// ObjectStoreBackend stores every blob as an object of an S3 compatible
+// bucket, under Prefix followed by the key, with its metadata in a JSON
+// object next to it, like the sidecars of DiskBackend.
+type ObjectStoreBackend struct {
+	Client ObjectStoreClient
+	Bucket string
+	// Prefix is prepended to the keys, so several nodes can share a bucket.
+	Prefix string
+	Logger *slog.Logger
+}
+
+// NewObjectStoreBackend returns a backend storing blobs in bucket. A nil
+// logger means slog.Default().
+func NewObjectStoreBackend(client ObjectStoreClient, bucket, prefix string, logger *slog.Logger) *ObjectStoreBackend {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &ObjectStoreBackend{
+		Client: client,
+		Bucket: bucket,
+		Prefix: prefix,
+		Logger: logger,
+	}
+}
+
+// Namespace returns a backend storing the blobs of the namespace in the same
+// bucket, under their own prefix.
+func (o *ObjectStoreBackend) Namespace(name string) (Backend, error) {
+	return NewObjectStoreBackend(o.Client, o.Bucket, o.Prefix+NamespaceFolderName+"/"+name+"/", o.Logger), nil
+}
+
+func (o *ObjectStoreBackend) objectKey(key string) *string {
+	return aws.String(o.Prefix + key)
+}
+
+func (o *ObjectStoreBackend) metaKey(key string) *string {
+	return aws.String(o.Prefix + key + metaFileSuffix)
+}
+
+// Put spools the blob to a temporary file, since the object store needs its
+// size upfront, then uploads it and its metadata.
+func (o *ObjectStoreBackend) Put(key string, r io.Reader, attrs ObjectAttrs) (ObjectMeta, error) {
+	spool, err := os.CreateTemp("", "fs-put-*")
+	if err != nil {
+		return ObjectMeta{}, err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	recorder := newMetaRecorder(key, r, attrs)
+	if _, err := io.Copy(io.MultiWriter(spool, recorder), r); err != nil {
+		return ObjectMeta{}, err
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return ObjectMeta{}, err
+	}
+
+	meta := recorder.meta()
+	metaJSON, err := json.Marshal(meta)
+	if err != nil {
+		return ObjectMeta{}, err
+	}
+
+	ctx := context.Background()
+	if _, err := o.Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(o.Bucket),
+		Key:    o.objectKey(key),
+		Body:   spool,
+	}); err != nil {
+		return ObjectMeta{}, objectStoreError(key, err)
+	}
+	if _, err := o.Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(o.Bucket),
+		Key:         o.metaKey(key),
+		Body:        bytes.NewReader(metaJSON),
+		ContentType: aws.String("application/json"),
+	}); err != nil {
+		return ObjectMeta{}, objectStoreError(key, err)
+	}
+	return meta, nil
+}
+
+// Get returns a blob that reads the object sequentially, and with ranged
+// requests for ReadAt.
+func (o *ObjectStoreBackend) Get(key string) (Blob, error) {
+	meta, err := o.Stat(key)
+	if err != nil {
+		return nil, err
+	}
+	return &objectBlob{backend: o, key: key, size: meta.Size}, nil
+}
+
+// objectBlob is an object opened for reading. The object is only requested
+// once it is read.
+type objectBlob struct {
+	backend *ObjectStoreBackend
+	key     string
+	size    int64
+	body    io.ReadCloser
+}
+
+func (b *objectBlob) Size() int64 {
+	return b.size
+}
+
+func (b *objectBlob) Read(p []byte) (int, error) {
+	if b.body == nil {
+		body, err := b.backend.get(b.key, "")
+		if err != nil {
+			return 0, err
+		}
+		b.body = body
+	}
+	return b.body.Read(p)
+}
+
+func (b *objectBlob) ReadAt(p []byte, off int64) (int, error) {
+	if off >= b.size {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	body, err := b.backend.get(b.key, fmt.Sprintf("bytes=%d-%d", off, off+int64(len(p))-1))
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+
+	n, err := io.ReadFull(body, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (b *objectBlob) Close() error {
+	if b.body == nil {
+		return nil
+	}
+	return b.body.Close()
+}
+
+// get requests the object, or a range of it when rangeHeader is set.
+func (o *ObjectStoreBackend) get(key, rangeHeader string) (io.ReadCloser, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(o.Bucket),
+		Key:    o.objectKey(key),
+	}
+	if rangeHeader != "" {
+		input.Range = aws.String(rangeHeader)
+	}
+
+	out, err := o.Client.GetObject(context.Background(), input)
+	if err != nil {
+		return nil, objectStoreError(key, err)
+	}
+	return out.Body, nil
+}
+
+func (o *ObjectStoreBackend) Delete(key string) error {
+	ctx := context.Background()
+	for _, objectKey := range []*string{o.objectKey(key), o.metaKey(key)} {
+		if _, err := o.Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(o.Bucket),
+			Key:    objectKey,
+		}); err != nil && !errors.Is(objectStoreError(key, err), os.ErrNotExist) {
+			return objectStoreError(key, err)
+		}
+	}
+	return nil
+}
+
+// Stat downloads the metadata object of the blob.
+func (o *ObjectStoreBackend) Stat(key string) (ObjectMeta, error) {
+	out, err := o.Client.GetObject(context.Background(), &s3.GetObjectInput{
+		Bucket: aws.String(o.Bucket),
+		Key:    o.metaKey(key),
+	})
+	if err != nil {
+		return ObjectMeta{}, objectStoreError(key, err)
+	}
+	defer out.Body.Close()
+
+	var meta ObjectMeta
+	err = json.NewDecoder(out.Body).Decode(&meta)
+	return meta, err
+}
+
+// List lists the metadata objects under the prefix and downloads them.
+func (o *ObjectStoreBackend) List(prefix string) ([]ObjectMeta, error) {
+	var metas []ObjectMeta
+	err := o.walk(prefix, func(meta ObjectMeta) error {
+		metas = append(metas, meta)
+		return nil
+	})
+	sort.Slice(metas, func(i, j int) bool {
+		return metas[i].Key < metas[j].Key
+	})
+	return metas, err
+}
+
+func (o *ObjectStoreBackend) Walk(fn func(ObjectMeta) error) error {
+	return o.walk("", fn)
+}
+
+func (o *ObjectStoreBackend) walk(prefix string, fn func(ObjectMeta) error) error {
+	paginator := s3.NewListObjectsV2Paginator(o.Client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(o.Bucket),
+		Prefix: aws.String(o.Prefix + prefix),
+	})
+	ctx := context.Background()
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return objectStoreError(prefix, err)
+		}
+
+		for _, object := range page.Contents {
+			objectKey := aws.ToString(object.Key)
+			if !strings.HasSuffix(objectKey, metaFileSuffix) {
+				continue
+			}
+
+			key := strings.TrimSuffix(strings.TrimPrefix(objectKey, o.Prefix), metaFileSuffix)
+			meta, err := o.Stat(key)
+			if err != nil {
+				o.Logger.Warn("Skipping unreadable metadata", "bucket", o.Bucket, "object", objectKey, "error", err)
+				continue
+			}
+			if err := fn(meta); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// objectStoreError wraps fs.ErrNotExist into the errors of missing objects.
+func objectStoreError(key string, err error) error {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "NoSuchKey", "NotFound":
+			return fmt.Errorf("object %s: %w", key, os.ErrNotExist)
+		}
+	}
+	return fmt.Errorf("object %s: %w", key, err)
+}
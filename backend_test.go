@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+func TestBackends(t *testing.T) {
+	server := makeServer("127.0.0.12:4150", true)
+	go func() {
+		if err := server.Start(); err != nil {
+			log.Fatalf("Failed to start server on 127.0.0.12:4150: %v", err)
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	t.Cleanup(func() {
+		server.Stop()
+		server.Storage.Clear()
+	})
+
+	gateway := httptest.NewServer(NewS3Gateway(server, map[string]string{"AKIDTEST": "secret"}))
+	defer gateway.Close()
+	client := s3.New(s3.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(gateway.URL),
+		UsePathStyle: true,
+		Credentials:  credentials.NewStaticCredentialsProvider("AKIDTEST", "secret", ""),
+	})
+
+	logBackend, err := NewLogBackend(LogBackendOPT{Dir: t.TempDir(), SegmentSize: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logBackend.Close()
+
+	backends := map[string]Backend{
+		"disk":       NewDiskBackend(t.TempDir(), HashPathBuilder, nil),
+		"disk-plain": NewDiskBackend(t.TempDir(), DefaultPathBuilder, nil),
+		"log":        logBackend,
+		"memory":     NewMemoryBackend(),
+		"s3":         NewObjectStoreBackend(client, "blobs", "node/", nil),
+	}
+	for name, backend := range backends {
+		t.Run(name, func(t *testing.T) {
+			testBackend(t, backend)
+		})
+	}
+}
+
+// testBackend checks the behavior every Backend must have.
+func testBackend(t *testing.T, b Backend) {
+	blobs := map[string][]byte{
+		"docs/a": generateRandomData(4096),
+		"docs/b": []byte("the second document"),
+		"other":  {},
+	}
+	for key, data := range blobs {
+		meta, err := b.Put(key, bytes.NewReader(data), ObjectAttrs{})
+		if err != nil {
+			t.Fatalf("Put %s: %v", key, err)
+		}
+		sum := sha256.Sum256(data)
+		if meta.Key != key || meta.Size != int64(len(data)) || meta.Checksum != hex.EncodeToString(sum[:]) {
+			t.Errorf("Put %s: got %+v", key, meta)
+		}
+	}
+
+	blob, err := b.Get("docs/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blob.Size() != 4096 {
+		t.Errorf("Size: got %d", blob.Size())
+	}
+	part := make([]byte, 100)
+	if _, err := blob.ReadAt(part, 1000); err != nil || !bytes.Equal(part, blobs["docs/a"][1000:1100]) {
+		t.Errorf("ReadAt: got %v", err)
+	}
+	got, err := io.ReadAll(blob)
+	if err != nil || !bytes.Equal(got, blobs["docs/a"]) {
+		t.Errorf("Read: got %d bytes, %v", len(got), err)
+	}
+	blob.Close()
+
+	// Put replaces the previous blob.
+	if _, err := b.Put("docs/b", bytes.NewReader([]byte("replaced")), ObjectAttrs{}); err != nil {
+		t.Fatal(err)
+	}
+	if meta, err := b.Stat("docs/b"); err != nil || meta.Size != int64(len("replaced")) {
+		t.Errorf("Stat after replacing: got %+v, %v", meta, err)
+	}
+
+	metas, err := b.List("docs/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metas) != 2 || metas[0].Key != "docs/a" || metas[1].Key != "docs/b" {
+		t.Errorf("List: got %+v", metas)
+	}
+
+	walked := 0
+	if err := b.Walk(func(ObjectMeta) error { walked++; return nil }); err != nil || walked != 3 {
+		t.Errorf("Walk: visited %d blobs, %v", walked, err)
+	}
+	stop := errors.New("stop")
+	if err := b.Walk(func(ObjectMeta) error { return stop }); err != stop {
+		t.Errorf("Walk: got %v, want the error of fn", err)
+	}
+
+	if err := b.Delete("docs/a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Stat("docs/a"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Stat after Delete: got %v, want os.ErrNotExist", err)
+	}
+	if _, err := b.Get("docs/a"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Get after Delete: got %v, want os.ErrNotExist", err)
+	}
+	if _, err := b.Stat("docs/b"); err != nil {
+		t.Errorf("Stat of a sibling after Delete: got %v", err)
+	}
+	if err := b.Delete("missing"); err != nil {
+		t.Errorf("Delete of a missing blob: got %v", err)
+	}
+}
+
+func TestLogBackendRecovery(t *testing.T) {
+	dir := t.TempDir()
+	opt := LogBackendOPT{Dir: dir, SegmentSize: 1024, CompactRatio: -1}
+	b, err := NewLogBackend(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kept := generateRandomData(700)
+	for i, data := range [][]byte{generateRandomData(700), kept} {
+		if _, err := b.Put("kept", bytes.NewReader(data), ObjectAttrs{}); err != nil {
+			t.Fatalf("Put %d: %v", i, err)
+		}
+	}
+	if _, err := b.Put("deleted", bytes.NewReader([]byte("gone")), ObjectAttrs{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Delete("deleted"); err != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+
+	// A crash in the middle of an append leaves a partial record behind.
+	segments, _ := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	if len(segments) < 2 {
+		t.Fatalf("expected the records to span several segments, got %v", segments)
+	}
+	last := segments[len(segments)-1]
+	info, _ := os.Stat(last)
+	f, _ := os.OpenFile(last, os.O_WRONLY|os.O_APPEND, 0)
+	f.Write(encodeRecordHeader(recordPut, "torn", []byte("{}"), 1000)[:10])
+	f.Close()
+
+	b, err = NewLogBackend(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	if _, err := b.Stat("deleted"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("deleted blob came back: %v", err)
+	}
+	if _, err := b.Stat("torn"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("partial record was indexed: %v", err)
+	}
+	if after, _ := os.Stat(last); after.Size() != info.Size() {
+		t.Errorf("partial record was not truncated: got %d bytes, want %d", after.Size(), info.Size())
+	}
+
+	blob, err := b.Get("kept")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blob.Close()
+	if got, _ := io.ReadAll(blob); !bytes.Equal(got, kept) {
+		t.Error("got the replaced blob after recovery")
+	}
+
+	// Appending resumes after the last complete record.
+	if _, err := b.Put("next", bytes.NewReader([]byte("next")), ObjectAttrs{}); err != nil {
+		t.Fatal(err)
+	}
+	if metas, _ := b.List(""); len(metas) != 2 {
+		t.Errorf("List: got %+v", metas)
+	}
+}
+
+func TestLogBackendCompaction(t *testing.T) {
+	dir := t.TempDir()
+	opt := LogBackendOPT{Dir: dir, SegmentSize: 4096, CompactRatio: -1}
+	b, err := NewLogBackend(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blobs := make(map[string][]byte)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("small/%03d", i)
+		blobs[key] = generateRandomData(200)
+		if _, err := b.Put(key, bytes.NewReader(blobs[key]), ObjectAttrs{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 100; i += 2 {
+		key := fmt.Sprintf("small/%03d", i)
+		if err := b.Delete(key); err != nil {
+			t.Fatal(err)
+		}
+		delete(blobs, key)
+	}
+
+	// A reader opened before the compaction keeps reading the old segment.
+	open, err := b.Get("small/001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer open.Close()
+
+	before := dirSize(t, dir)
+	if err := b.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if after := dirSize(t, dir); after >= before/2+4096 {
+		t.Errorf("compaction reclaimed too little: %d bytes before, %d after", before, after)
+	}
+	if got, _ := io.ReadAll(open); !bytes.Equal(got, blobs["small/001"]) {
+		t.Error("reader opened before the compaction got corrupted data")
+	}
+	b.Close()
+
+	// The compacted segments hold the same blobs once reloaded.
+	b, err = NewLogBackend(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	metas, err := b.List("small/")
+	if err != nil || len(metas) != len(blobs) {
+		t.Fatalf("List after compaction: got %d blobs, %v", len(metas), err)
+	}
+	for key, data := range blobs {
+		blob, err := b.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := io.ReadAll(blob)
+		blob.Close()
+		if !bytes.Equal(got, data) {
+			t.Errorf("%s: got different data after compaction", key)
+		}
+	}
+}
+
+func dirSize(t *testing.T, dir string) int64 {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var size int64
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			t.Fatal(err)
+		}
+		size += info.Size()
+	}
+	return size
+}
+
+func TestFileServerOnMemoryBackend(t *testing.T) {
+	server1 := makeServer("127.0.0.12:4151", true)
+	server1.Storage.Config.Backend = NewMemoryBackend()
+	go func() {
+		if err := server1.Start(); err != nil {
+			log.Fatalf("Failed to start server on 127.0.0.12:4151: %v", err)
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	t.Cleanup(func() { server1.Stop() })
+
+	server2 := makeServer("127.0.0.12:4152", false, "127.0.0.12:4151")
+	go func() {
+		if err := server2.Start(); err != nil {
+			log.Fatalf("Failed to start server on 127.0.0.12:4152: %v", err)
+		}
+	}()
+	time.Sleep(30 * time.Millisecond)
+	t.Cleanup(func() {
+		server2.Stop()
+		server2.Storage.Clear()
+	})
+
+	data := generateRandomData(64 * 1024)
+	if err := server2.Store("memory/data", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	// The replica lives in memory only.
+	if !server1.Storage.HasKey("memory/data") {
+		t.Fatal("the replica was not stored")
+	}
+	if _, err := os.Stat(server1.Storage.Config.RootDir); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("the memory node wrote to its root directory: %v", err)
+	}
+
+	if err := server2.Delete("memory/data"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if server1.Storage.HasKey("memory/data") {
+		t.Fatal("expected the replica to be deleted")
+	}
+
+	if err := server1.Store("memory/local", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	r, err := server1.Get("memory/local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	got, err := io.ReadAll(r)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("Get: got %d bytes, %v", len(got), err)
+	}
+}
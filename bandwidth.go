@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"go-distributed-storage/p2p"
+)
+
+// ErrBandwidthUnsupported is returned when the transport of the server does
+// not limit its bandwidth.
+var ErrBandwidthUnsupported = errors.New("the transport does not limit its bandwidth")
+
+type priorityKey struct{}
+
+// WithPriority returns a context whose transfers to the peers are made in the
+// priority class. Without it, transfers are made as p2p.PriorityClient.
+func WithPriority(ctx context.Context, priority p2p.Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, priority)
+}
+
+// PriorityFromContext returns the priority class set by WithPriority, or
+// p2p.PriorityClient.
+func PriorityFromContext(ctx context.Context) p2p.Priority {
+	priority, _ := ctx.Value(priorityKey{}).(p2p.Priority)
+	return priority
+}
+
+// bandwidth returns the bandwidth limits of the transport, if it has any.
+func (s *FileServer) bandwidth() (*p2p.Bandwidth, error) {
+	transport, ok := s.Config.Transport.(interface{ Bandwidth() *p2p.Bandwidth })
+	if !ok {
+		return nil, ErrBandwidthUnsupported
+	}
+	return transport.Bandwidth(), nil
+}
+
+// BandwidthLimits returns the limits of the writes of the node to its peers.
+func (s *FileServer) BandwidthLimits() (p2p.BandwidthLimits, error) {
+	bandwidth, err := s.bandwidth()
+	if err != nil {
+		return p2p.BandwidthLimits{}, err
+	}
+	return bandwidth.Limits(), nil
+}
+
+// SetBandwidthLimits changes the limits of the writes of the node to its
+// peers, including the transfers in flight.
+func (s *FileServer) SetBandwidthLimits(limits p2p.BandwidthLimits) error {
+	bandwidth, err := s.bandwidth()
+	if err != nil {
+		return err
+	}
+	if err := bandwidth.SetLimits(limits); err != nil {
+		return err
+	}
+	s.logger().Info("Changed bandwidth limits", "total", limits.Total, "perPeer", limits.PerPeer, "client", limits.Client, "background", limits.Background)
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"go-distributed-storage/p2p"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBandwidthLimits(t *testing.T) {
+	servers := make([]*FileServer, 2)
+	for i, address := range []string{"127.0.0.18:4400", "127.0.0.18:4401"} {
+		var server *FileServer
+		if i == 0 {
+			server = makeServer(address, true)
+		} else {
+			server = makeServer(address, false, "127.0.0.18:4400")
+		}
+		startServer(t, server)
+		t.Cleanup(func() {
+			server.Stop()
+			server.Storage.Clear()
+		})
+		servers[i] = server
+	}
+	time.Sleep(30 * time.Millisecond)
+
+	// The replicas of a store are limited by the rate per peer.
+	if err := servers[1].SetBandwidthLimits(p2p.BandwidthLimits{PerPeer: 256 * 1024}); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err := servers[1].Store("big", bytes.NewReader(generateRandomData(192*1024))); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed, want := time.Since(start), 500*time.Millisecond; elapsed < want {
+		t.Errorf("storing 192 KiB at 256 KiB/s per peer took %s, want at least %s", elapsed, want)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if !servers[0].Storage.HasKey("big") {
+		t.Error("the replica was not stored")
+	}
+
+	// Rebalancing is background traffic.
+	if err := servers[1].SetBandwidthLimits(p2p.BandwidthLimits{Background: 128 * 1024}); err != nil {
+		t.Fatal(err)
+	}
+	if err := servers[0].Storage.DeleteFile("big"); err != nil {
+		t.Fatal(err)
+	}
+	start = time.Now()
+	if report, err := servers[1].Rebalance(t.Context()); err != nil || report.Files != 1 {
+		t.Fatalf("Rebalance: got %+v, error %v", report, err)
+	}
+	if elapsed, want := time.Since(start), time.Second; elapsed < want {
+		t.Errorf("rebalancing 192 KiB at 128 KiB/s of background traffic took %s, want at least %s", elapsed, want)
+	}
+}
+
+func TestAdminBandwidth(t *testing.T) {
+	server := makeServer("127.0.0.18:4402", true)
+	startServer(t, server)
+	t.Cleanup(func() {
+		server.Stop()
+		server.Storage.Clear()
+	})
+
+	admin := httptest.NewServer(NewAdminHandler(server))
+	defer admin.Close()
+
+	put := func(body string) int {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPut, admin.URL+"/bandwidth", strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if status := put(`{"total": 10485760, "background": 1048576}`); status != http.StatusOK {
+		t.Fatalf("PUT /bandwidth: got status %d", status)
+	}
+	resp, err := http.Get(admin.URL + "/bandwidth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var limits p2p.BandwidthLimits
+	json.NewDecoder(resp.Body).Decode(&limits)
+	resp.Body.Close()
+	if want := (p2p.BandwidthLimits{Total: 10 << 20, Background: 1 << 20}); limits != want {
+		t.Errorf("GET /bandwidth: got %+v, want %+v", limits, want)
+	}
+
+	if status := put(`{"perPeer": -1}`); status != http.StatusBadRequest {
+		t.Errorf("PUT /bandwidth with a negative rate: got status %d, want 400", status)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"crypto/cipher"
 	"crypto/rand"
 	"io"
+	"math/big"
 )
 
 type BasicCrypto struct {
@@ -87,3 +88,47 @@ func (b *BasicCrypto) Decrypt(encryptionKey []byte, dst io.Writer, src io.Reader
 	stream := cipher.NewCTR(cipherBlock, iv)
 	return b.copyStream(stream, dst, src)
 }
+
+// HeaderSize returns the number of bytes Encrypt writes before the ciphertext,
+// which is the size of the IV.
+func (b *BasicCrypto) HeaderSize() int64 {
+	return aes.BlockSize
+}
+
+// DecryptRange decrypts a range of a file encrypted with Encrypt. src must hold
+// the IV followed by the ciphertext starting at the plaintext offset. Since CTR
+// mode encrypts each block with IV+blockIndex, the keystream can be positioned
+// at offset without decrypting the preceding bytes.
+func (b *BasicCrypto) DecryptRange(encryptionKey []byte, dst io.Writer, src io.Reader, offset int64) (int64, error) {
+	cipherBlock, err := aes.NewCipher(encryptionKey)
+	if err != nil {
+		return 0, err
+	}
+
+	iv := make([]byte, cipherBlock.BlockSize())
+	if _, err := io.ReadFull(src, iv); err != nil {
+		return 0, err
+	}
+
+	// Advance the counter by the number of whole blocks before offset.
+	blockSize := int64(cipherBlock.BlockSize())
+	counter := new(big.Int).SetBytes(iv)
+	counter.Add(counter, big.NewInt(offset/blockSize))
+	counterBytes := counter.Bytes()
+	if len(counterBytes) > len(iv) {
+		// The counter wraps around like it does in cipher.NewCTR.
+		counterBytes = counterBytes[len(counterBytes)-len(iv):]
+	}
+	for i := range iv {
+		iv[i] = 0
+	}
+	copy(iv[len(iv)-len(counterBytes):], counterBytes)
+
+	stream := cipher.NewCTR(cipherBlock, iv)
+
+	// Discard the keystream bytes of the first block that precede offset.
+	skip := make([]byte, offset%blockSize)
+	stream.XORKeyStream(skip, skip)
+
+	return b.copyStream(stream, dst, src)
+}
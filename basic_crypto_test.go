@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestBasicCryptoDecryptRange(t *testing.T) {
+	crypto := &BasicCrypto{}
+	key := crypto.newEncryptionKey()
+	plaintext := generateRandomData(1000)
+
+	encrypted := new(bytes.Buffer)
+	if _, err := crypto.Encrypt(key, encrypted, bytes.NewReader(plaintext)); err != nil {
+		t.Fatal(err)
+	}
+	ciphertext := encrypted.Bytes()
+	headerSize := crypto.HeaderSize()
+
+	ranges := []struct{ offset, length int64 }{
+		{0, 10},
+		{15, 2},
+		{16, 16},
+		{17, 100},
+		{333, 667},
+		{999, 1},
+	}
+	for _, rg := range ranges {
+		src := io.MultiReader(
+			bytes.NewReader(ciphertext[:headerSize]),
+			bytes.NewReader(ciphertext[headerSize+rg.offset:headerSize+rg.offset+rg.length]),
+		)
+
+		decrypted := new(bytes.Buffer)
+		if _, err := crypto.DecryptRange(key, decrypted, src, rg.offset); err != nil {
+			t.Fatal(err)
+		}
+		if want := plaintext[rg.offset : rg.offset+rg.length]; !bytes.Equal(decrypted.Bytes(), want) {
+			t.Errorf("range [%d, +%d) mismatch", rg.offset, rg.length)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go-distributed-storage/p2p"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// ErrInsufficientStorage is returned when a node is over its capacity or its
+// file system is below the free space watermark.
+var ErrInsufficientStorage = errors.New("insufficient storage")
+
+// Capacity describes how much a node stores and can still store.
+type Capacity struct {
+	// Limit is the configured capacity. Zero means unlimited.
+	Limit int64 `json:"limit,omitempty"`
+	// Used is the size of the stored blobs.
+	Used int64 `json:"used"`
+	// Free is the free space of the file system holding the blobs, or -1
+	// when the backend does not live on a local file system.
+	Free int64 `json:"free"`
+	// Available is how many more bytes the node accepts, or -1 when it is
+	// not limited.
+	Available int64 `json:"available"`
+}
+
+// fullHeadroom is the available space under which a node counts as full: it
+// refuses new files from clients, and peers stop replicating to it.
+const fullHeadroom = 1024 * 1024 // 1 MB
+
+// Full reports whether the node is too close to its limits to take new files.
+func (c Capacity) Full() bool {
+	return c.Available >= 0 && c.Available < fullHeadroom
+}
+
+// CapacityMessage advertises the capacity of a node to its peers, which do not
+// replicate files to it while it is full.
+type CapacityMessage struct {
+	Capacity Capacity
+}
+
+// storageUsage counts the bytes stored by a Storage. It is shared by the
+// copies of the Storage and computed from the backend on first use.
+type storageUsage struct {
+	once  sync.Once
+	bytes atomic.Int64
+}
+
+// localDir is implemented by backends that store their blobs under a local
+// directory, whose file system is watched for free space.
+type localDir interface {
+	Dir() string
+}
+
+// usage returns the byte counter, walking the backend the first time.
+func (s *Storage) usage() *atomic.Int64 {
+	s.used.once.Do(func() {
+		var total int64
+		if err := s.walkAll(func(meta ObjectMeta) error {
+			total += meta.Size
+			return nil
+		}); err != nil {
+			s.Config.Logger.Warn("Failed to measure storage usage", "error", err)
+		}
+		s.used.bytes.Add(total)
+	})
+	return &s.used.bytes
+}
+
+// Capacity returns the usage of the storage against its limits.
+func (s *Storage) Capacity() Capacity {
+	c := Capacity{
+		Limit:     s.Config.Capacity,
+		Used:      s.usage().Load(),
+		Free:      -1,
+		Available: -1,
+	}
+	if c.Limit > 0 {
+		c.Available = max(c.Limit-c.Used, 0)
+	}
+	if dir, ok := s.Config.Backend.(localDir); ok {
+		if free, err := freeSpace(dir.Dir()); err == nil {
+			c.Free = free
+			if headroom := max(free-s.Config.MinFreeSpace, 0); c.Available < 0 || headroom < c.Available {
+				c.Available = headroom
+			}
+		}
+	}
+	return c
+}
+
+// capacityWriter fails once more than budget bytes are written to it. A
+// negative budget means unlimited.
+type capacityWriter struct {
+	w       io.Writer
+	key     string
+	budget  int64
+	written int64
+}
+
+func (c *capacityWriter) Write(p []byte) (int, error) {
+	if c.budget >= 0 && c.written+int64(len(p)) > c.budget {
+		return 0, fmt.Errorf("storing %s: %w: %d bytes left", c.key, ErrInsufficientStorage, c.budget)
+	}
+	n, err := c.w.Write(p)
+	c.written += int64(n)
+	return n, err
+}
+
+// storageError tells the caller that the file system is full.
+func storageError(err error) error {
+	if errors.Is(err, syscall.ENOSPC) && !errors.Is(err, ErrInsufficientStorage) {
+		return fmt.Errorf("%w: %w", ErrInsufficientStorage, err)
+	}
+	return err
+}
+
+// Capacity returns the usage of the node against its limits, counting the
+// blobs of every namespace.
+func (s *FileServer) Capacity() Capacity {
+	c := s.Storage.Capacity()
+	for _, ns := range s.openNamespaces() {
+		if ns.name != DefaultNamespace {
+			c.Used += ns.storage.usage().Load()
+		}
+	}
+	if c.Limit > 0 {
+		if headroom := max(c.Limit-c.Used, 0); c.Available < 0 || headroom < c.Available {
+			c.Available = headroom
+		}
+	}
+	return c
+}
+
+// sendCapacity tells a peer about the capacity of the node.
+func (s *FileServer) sendCapacity(ctx context.Context, peer p2p.Peer) error {
+	message := Message{
+		Payload: CapacityMessage{
+			Capacity: s.Capacity(),
+		},
+	}
+	return s.sendTo(ctx, &message, []p2p.Peer{peer})
+}
+
+// capacityChanged tells the peers when the node becomes full or stops being
+// full. It is called after the stored blobs change.
+func (s *FileServer) capacityChanged(ctx context.Context) {
+	capacity := s.Capacity()
+	if s.full.Swap(capacity.Full()) == capacity.Full() {
+		return
+	}
+
+	if capacity.Full() {
+		s.logger().Warn("Storage is full, refusing new files", "used", capacity.Used, "limit", capacity.Limit, "free", capacity.Free)
+	} else {
+		s.logger().Info("Storage accepts new files again", "available", capacity.Available)
+	}
+
+	message := Message{
+		Payload: CapacityMessage{
+			Capacity: capacity,
+		},
+	}
+	// Give the peers time to read the message sent just before, so that the
+	// two are not read as one.
+	time.Sleep(time.Millisecond * 5)
+	if err := s.broadcast(ctx, &message); err != nil {
+		s.logger().Warn("Failed to advertise capacity", "error", err)
+	}
+}
+
+func (s *FileServer) handleCapacityMessage(from net.Addr, message CapacityMessage) error {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	if _, ok := s.peers[from.String()]; !ok {
+		return fmt.Errorf("peer %s not found in peer map", from.String())
+	}
+	s.peerCapacity[from.String()] = message.Capacity
+
+	s.logger().Debug("Peer advertised its capacity", "peer", from.String(), "available", message.Capacity.Available)
+	return nil
+}
+
+// replicaPeers returns the connected peers that accept new files.
+func (s *FileServer) replicaPeers() []p2p.Peer {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	peers := make([]p2p.Peer, 0, len(s.peers))
+	for address, peer := range s.peers {
+		if capacity, ok := s.peerCapacity[address]; ok && capacity.Full() {
+			s.logger().Debug("Skipping full peer", "peer", address)
+			continue
+		}
+		peers = append(peers, peer)
+	}
+	return peers
+}
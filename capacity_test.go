@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestStorageCapacity(t *testing.T) {
+	storage := NewStorage(StoreOPT{Backend: NewMemoryBackend(), Capacity: 100})
+
+	if _, err := storage.StoreFile("first", bytes.NewReader(generateRandomData(60)), ObjectAttrs{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.StoreFile("second", bytes.NewReader(generateRandomData(60)), ObjectAttrs{}); !errors.Is(err, ErrInsufficientStorage) {
+		t.Fatalf("store over capacity: got %v, want ErrInsufficientStorage", err)
+	}
+	if storage.HasKey("second") {
+		t.Error("the refused file was stored")
+	}
+
+	// Replacing a file frees the space of the previous version.
+	if _, err := storage.StoreFile("first", bytes.NewReader(generateRandomData(90)), ObjectAttrs{}); err != nil {
+		t.Fatal(err)
+	}
+	if c := storage.Capacity(); c.Used != 90 || c.Available != 10 || c.Free != -1 {
+		t.Errorf("capacity: got %+v", c)
+	}
+
+	if err := storage.DeleteFile("first"); err != nil {
+		t.Fatal(err)
+	}
+	if c := storage.Capacity(); c.Used != 0 || c.Available != 100 {
+		t.Errorf("capacity after delete: got %+v", c)
+	}
+}
+
+func TestStorageCapacityRemovesPartialFiles(t *testing.T) {
+	storage := NewStorage(StoreOPT{RootDir: t.TempDir(), PathTranformFunc: HashPathBuilder, Capacity: 1000})
+	defer storage.Clear()
+
+	if _, err := storage.StoreFile("big", bytes.NewReader(generateRandomData(64*1024)), ObjectAttrs{}); !errors.Is(err, ErrInsufficientStorage) {
+		t.Fatalf("got %v, want ErrInsufficientStorage", err)
+	}
+	if storage.HasKey("big") {
+		t.Error("the partial file was left behind")
+	}
+	if c := storage.Capacity(); c.Used != 0 || c.Free <= 0 {
+		t.Errorf("capacity: got %+v", c)
+	}
+}
+
+func TestCapacityPlacement(t *testing.T) {
+	server1 := makeServer("127.0.0.12:4160", true)
+	server1.Storage.Config.Capacity = 2 * fullHeadroom
+	startServer(t, server1)
+	t.Cleanup(func() {
+		server1.Stop()
+		server1.Storage.Clear()
+	})
+
+	server2 := makeServer("127.0.0.12:4161", false, "127.0.0.12:4160")
+	startServer(t, server2)
+	time.Sleep(30 * time.Millisecond)
+	t.Cleanup(func() {
+		server2.Stop()
+		server2.Storage.Clear()
+	})
+
+	// The replica leaves server1 with less than fullHeadroom available.
+	if err := server2.Store("capacity/first", bytes.NewReader(generateRandomData(fullHeadroom+fullHeadroom/2))); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if !server1.Storage.HasKey("capacity/first") {
+		t.Fatal("the first file was not replicated")
+	}
+	if !server1.Capacity().Full() {
+		t.Fatalf("server1 is not full: %+v", server1.Capacity())
+	}
+
+	if err := server1.Store("capacity/local", bytes.NewReader([]byte("no room"))); !errors.Is(err, ErrInsufficientStorage) {
+		t.Errorf("store on a full node: got %v, want ErrInsufficientStorage", err)
+	}
+
+	peers := server2.Peers()
+	if len(peers) != 1 || peers[0].Capacity == nil || !peers[0].Capacity.Full() {
+		t.Fatalf("server2 does not know server1 is full: %+v", peers)
+	}
+
+	// The full node is left out of the replication.
+	if err := server2.Store("capacity/second", bytes.NewReader([]byte("small"))); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if server1.Storage.HasKey("capacity/second") {
+		t.Error("the file was replicated to the full node")
+	}
+
+	// Deleting the first file makes room again.
+	if err := server2.Delete("capacity/first"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if peers := server2.Peers(); len(peers) != 1 || peers[0].Capacity == nil || peers[0].Capacity.Full() {
+		t.Fatalf("server2 still thinks server1 is full: %+v", peers)
+	}
+	if err := server2.Store("capacity/third", bytes.NewReader([]byte("small"))); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if !server1.Storage.HasKey("capacity/third") {
+		t.Error("the file was not replicated once server1 had room again")
+	}
+}
@@ -5,4 +5,13 @@ import "io"
 type Cipher interface {
 	Encrypt([]byte, io.Writer, io.Reader) (int64, error)
 	Decrypt([]byte, io.Writer, io.Reader) (int64, error)
-}
\ No newline at end of file
+}
+
+// RangeCipher is implemented by ciphers with a seekable keystream. DecryptRange
+// decrypts src, which holds the cipher header (e.g. the IV) followed by the
+// ciphertext starting at the given plaintext offset, so a range of a file can
+// be decrypted without reading what comes before it.
+type RangeCipher interface {
+	HeaderSize() int64
+	DecryptRange([]byte, io.Writer, io.Reader, int64) (int64, error)
+}
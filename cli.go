@@ -0,0 +1,644 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"go-distributed-storage/p2p"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// adminClient talks to a running node over its local admin socket.
+type adminClient struct {
+	http *http.Client
+	// namespace is sent in NamespaceHeader when set.
+	namespace string
+	// token is sent as a bearer token when set.
+	token string
+	// header is added to every request.
+	header http.Header
+}
+
+func newAdminClient(socketPath string) *adminClient {
+	return &adminClient{
+		http: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var dialer net.Dialer
+					return dialer.DialContext(ctx, "unix", socketPath)
+				},
+			},
+		},
+	}
+}
+
+// do sends a request to the node and returns the response if its status is
+// successful. Otherwise the error reported by the node is returned.
+func (c *adminClient) do(method, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, "http://fs"+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if c.namespace != "" {
+		req.Header.Set(NamespaceHeader, c.namespace)
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	for k, v := range c.header {
+		req.Header[k] = v
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("contacting node: %w", err)
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&apiErr) == nil && apiErr.Error != "" {
+			return nil, fmt.Errorf("%s: %s", resp.Status, apiErr.Error)
+		}
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+	return resp, nil
+}
+
+func objectPath(key string) string {
+	return "/objects/" + (&url.URL{Path: key}).EscapedPath()
+}
+
+// clientFlags registers the flags shared by the client commands and returns
+// the socket path flag.
+func clientFlags(fs *flag.FlagSet) *string {
+	socket := os.Getenv("FS_ADMIN_SOCKET")
+	if socket == "" {
+		socket = DefaultAdminSocket
+	}
+	return fs.String("socket", socket, "admin socket of the node (env FS_ADMIN_SOCKET)")
+}
+
+// namespaceFlag registers the flag selecting the namespace of the object
+// commands and returns it.
+func namespaceFlag(fs *flag.FlagSet) *string {
+	return fs.String("namespace", os.Getenv("FS_NAMESPACE"), "namespace of the files, the default one when empty (env FS_NAMESPACE)")
+}
+
+// tokenFlag registers the flag holding the API token of the object commands
+// and returns it.
+func tokenFlag(fs *flag.FlagSet) *string {
+	return fs.String("token", os.Getenv("FS_TOKEN"), "API token, required when the node has access control (env FS_TOKEN)")
+}
+
+// objectClient returns a client for the object commands in the given
+// namespace, authenticated with token.
+func objectClient(socket, namespace, token string) *adminClient {
+	c := newAdminClient(socket)
+	c.namespace = namespace
+	c.token = token
+	return c
+}
+
+// adminTokenFlag registers the flag holding the API token of the commands
+// that change the node and returns it.
+func adminTokenFlag(fs *flag.FlagSet) *string {
+	return fs.String("token", os.Getenv("FS_TOKEN"), "API token of a principal with the admin permission, required when the node has access control (env FS_TOKEN)")
+}
+
+// adminActionClient returns a client for the commands that change the node,
+// authenticated with token.
+func adminActionClient(socket, token string) *adminClient {
+	c := newAdminClient(socket)
+	c.token = token
+	return c
+}
+
+// keyValueFlag collects the name=value pairs of a flag given several times.
+type keyValueFlag map[string]string
+
+func (f keyValueFlag) String() string {
+	return FormatTags(f)
+}
+
+func (f keyValueFlag) Set(s string) error {
+	name, value, ok := strings.Cut(s, "=")
+	if !ok || name == "" {
+		return fmt.Errorf("expected name=value, got %q", s)
+	}
+	f[name] = value
+	return nil
+}
+
+// runPut stores a local file, or stdin, under key.
+func runPut(args []string) error {
+	fs := flag.NewFlagSet("put", flag.ExitOnError)
+	socket := clientFlags(fs)
+	namespace := namespaceFlag(fs)
+	token := tokenFlag(fs)
+	ttl := fs.Duration("ttl", 0, "delete the file once this long has passed, kept until deleted when 0")
+	contentType := fs.String("content-type", "", "media type of the file")
+	compression := fs.String("compression", "", "compression of the file: zstd, gzip, auto or none, the node default when empty")
+	tags := keyValueFlag{}
+	fs.Var(tags, "tag", "tag of the file as name=value, can be repeated")
+	metadata := keyValueFlag{}
+	fs.Var(metadata, "meta", "custom metadata of the file as name=value, can be repeated")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: fs put [flags] <key> [file]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var body io.Reader = os.Stdin
+	if fs.NArg() == 2 && fs.Arg(1) != "-" {
+		f, err := os.Open(fs.Arg(1))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		body = f
+	}
+
+	c := objectClient(*socket, *namespace, *token)
+	c.header = http.Header{}
+	if *ttl > 0 {
+		c.header.Set(TTLHeader, ttl.String())
+	}
+	if *contentType != "" {
+		c.header.Set("Content-Type", *contentType)
+	}
+	if *compression != "" {
+		c.header.Set(CompressionHeader, *compression)
+	}
+	if len(tags) > 0 {
+		c.header.Set(TagsHeader, FormatTags(tags))
+	}
+	for name, value := range metadata {
+		c.header.Set(MetaHeaderPrefix+name, value)
+	}
+	resp, err := c.do(http.MethodPut, objectPath(fs.Arg(0)), body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// runGet writes the file stored under key to a local file, or stdout.
+func runGet(args []string) error {
+	fs := flag.NewFlagSet("get", flag.ExitOnError)
+	socket := clientFlags(fs)
+	namespace := namespaceFlag(fs)
+	token := tokenFlag(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: fs get [flags] <key> [file]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	resp, err := objectClient(*socket, *namespace, *token).do(http.MethodGet, objectPath(fs.Arg(0)), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var out io.Writer = os.Stdout
+	if fs.NArg() == 2 && fs.Arg(1) != "-" {
+		f, err := os.Create(fs.Arg(1))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+
+	_, err = io.Copy(out, resp.Body)
+	return err
+}
+
+// runRm deletes the file stored under key from the cluster.
+func runRm(args []string) error {
+	fs := flag.NewFlagSet("rm", flag.ExitOnError)
+	socket := clientFlags(fs)
+	namespace := namespaceFlag(fs)
+	token := tokenFlag(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: fs rm [flags] <key>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	resp, err := objectClient(*socket, *namespace, *token).do(http.MethodDelete, objectPath(fs.Arg(0)), nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// runLs lists the files stored on the node, optionally filtered by a key prefix.
+func runLs(args []string) error {
+	fs := flag.NewFlagSet("ls", flag.ExitOnError)
+	socket := clientFlags(fs)
+	namespace := namespaceFlag(fs)
+	token := tokenFlag(fs)
+	tag := fs.String("tag", "", "only list the files carrying this tag, as name=value")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: fs ls [flags] [prefix]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	query := url.Values{"prefix": {fs.Arg(0)}}
+	if *tag != "" {
+		query.Set("tag", *tag)
+	}
+	resp, err := objectClient(*socket, *namespace, *token).do(http.MethodGet, "/objects?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var list struct {
+		Objects []ObjectInfo `json:"objects"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, object := range list.Objects {
+		fmt.Fprintf(w, "%d\t%s\t%s\n", object.Size, object.ModTime.Format("2006-01-02 15:04:05"), object.Key)
+	}
+	return w.Flush()
+}
+
+// runStat prints the metadata of the file stored under key, without its body.
+func runStat(args []string) error {
+	fs := flag.NewFlagSet("stat", flag.ExitOnError)
+	socket := clientFlags(fs)
+	namespace := namespaceFlag(fs)
+	token := tokenFlag(fs)
+	asJSON := fs.Bool("json", false, "print the metadata as JSON")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: fs stat [flags] <key>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	resp, err := objectClient(*socket, *namespace, *token).do(http.MethodGet, objectPath(fs.Arg(0))+"?stat", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if *asJSON {
+		_, err := io.Copy(os.Stdout, resp.Body)
+		return err
+	}
+
+	var info ObjectInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Key:\t%s\n", info.Key)
+	fmt.Fprintf(w, "Size:\t%d\n", info.Size)
+	fmt.Fprintf(w, "Checksum:\t%s\n", info.Checksum)
+	if info.Compression != "" {
+		fmt.Fprintf(w, "Compression:\t%s (%d bytes stored)\n", info.Compression, info.StoredSize)
+	}
+	if info.ContentType != "" {
+		fmt.Fprintf(w, "Content type:\t%s\n", info.ContentType)
+	}
+	if !info.CreatedAt.IsZero() {
+		fmt.Fprintf(w, "Created:\t%s\n", info.CreatedAt.Local().Format("2006-01-02 15:04:05"))
+	}
+	if info.Uploader != "" {
+		fmt.Fprintf(w, "Uploader:\t%s\n", info.Uploader)
+	}
+	if !info.ExpiresAt.IsZero() {
+		fmt.Fprintf(w, "Expires:\t%s\n", info.ExpiresAt.Local().Format("2006-01-02 15:04:05"))
+	}
+	for _, name := range slices.Sorted(maps.Keys(info.Tags)) {
+		fmt.Fprintf(w, "Tag:\t%s=%s\n", name, info.Tags[name])
+	}
+	for _, name := range slices.Sorted(maps.Keys(info.Metadata)) {
+		fmt.Fprintf(w, "Metadata:\t%s: %s\n", name, info.Metadata[name])
+	}
+	return w.Flush()
+}
+
+// runPeers lists the peers the node is connected to and the addresses it knows about.
+func runPeers(args []string) error {
+	fs := flag.NewFlagSet("peers", flag.ExitOnError)
+	socket := clientFlags(fs)
+	fs.Parse(args)
+
+	resp, err := newAdminClient(*socket).do(http.MethodGet, "/peers", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var peers struct {
+		Peers          []PeerInfo `json:"peers"`
+		PeersAddresses []string   `json:"peersAddresses"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&peers); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ADDRESS\tDIRECTION\tLOCAL ADDRESS")
+	for _, peer := range peers.Peers {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", peer.Address, peer.Direction, peer.LocalAddress)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if len(peers.PeersAddresses) > 0 {
+		fmt.Printf("\nKnown peer addresses: %s\n", strings.Join(peers.PeersAddresses, ", "))
+	}
+	return nil
+}
+
+// runStatus prints the state of the node, or the raw NodeStatus with -json.
+func runStatus(args []string) error {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	socket := clientFlags(fs)
+	raw := fs.Bool("json", false, "print the status as JSON")
+	fs.Parse(args)
+
+	resp, err := newAdminClient(*socket).do(http.MethodGet, "/status", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if *raw {
+		_, err := io.Copy(os.Stdout, resp.Body)
+		return err
+	}
+
+	var status NodeStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Node:\t%s\n", status.ID)
+	fmt.Fprintf(w, "Version:\t%s\n", status.Version)
+	fmt.Fprintf(w, "Uptime:\t%s\n", status.Uptime.Round(time.Second))
+	fmt.Fprintf(w, "Root dir:\t%s\n", status.Storage.RootDir)
+	fmt.Fprintf(w, "Files:\t%d (%d bytes, %d bytes on disk)\n", len(status.Storage.Keys), status.Storage.Bytes, status.Storage.DiskUsage)
+	fmt.Fprintf(w, "Capacity:\t%s\n", formatCapacity(status.Storage.Capacity))
+	fmt.Fprintf(w, "Transfers:\t%d\n", len(status.Transfers))
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if len(status.Peers) > 0 {
+		fmt.Println()
+		fmt.Fprintln(w, "PEER\tSTATE\tDIRECTION\tAVAILABLE")
+		for _, peer := range status.Peers {
+			available := ""
+			if peer.Capacity != nil {
+				available = formatAvailable(*peer.Capacity)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", peer.Address, peer.State, peer.Direction, available)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+
+	if len(status.Namespaces) > 0 {
+		fmt.Println()
+		fmt.Fprintln(w, "NAMESPACE\tPOLICY\tFILES\tBYTES\tAVAILABLE")
+		for _, namespace := range status.Namespaces {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\n", namespace.Name, namespace.Policy, namespace.Files, namespace.Bytes, formatAvailable(namespace.Capacity))
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+
+	if len(status.Transfers) > 0 {
+		fmt.Println()
+		fmt.Fprintln(w, "TRANSFER\tDIRECTION\tPEERS\tSINCE")
+		for _, transfer := range status.Transfers {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", transfer.Key, transfer.Direction, strings.Join(transfer.Peers, ","), time.Since(transfer.StartedAt).Round(time.Millisecond))
+		}
+		return w.Flush()
+	}
+	return nil
+}
+
+// formatCapacity describes the usage of a node against its limits.
+func formatCapacity(c Capacity) string {
+	limit := "unlimited"
+	if c.Limit > 0 {
+		limit = fmt.Sprintf("%d bytes", c.Limit)
+	}
+	return fmt.Sprintf("%d bytes used of %s, %s", c.Used, limit, formatAvailable(c))
+}
+
+// formatAvailable describes how much more a node accepts.
+func formatAvailable(c Capacity) string {
+	switch {
+	case c.Full():
+		return fmt.Sprintf("full, %d bytes available", c.Available)
+	case c.Available < 0:
+		return "unlimited"
+	default:
+		return fmt.Sprintf("%d bytes available", c.Available)
+	}
+}
+
+// runDisconnect closes the connection of the node to a peer.
+func runDisconnect(args []string) error {
+	fs := flag.NewFlagSet("disconnect", flag.ExitOnError)
+	socket := clientFlags(fs)
+	token := adminTokenFlag(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: fs disconnect [flags] <peer address>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	resp, err := adminActionClient(*socket, *token).do(http.MethodDelete, "/peers/"+url.PathEscape(fs.Arg(0)), nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// runRebalance sends every file stored on the node to its peers.
+func runRebalance(args []string) error {
+	fs := flag.NewFlagSet("rebalance", flag.ExitOnError)
+	socket := clientFlags(fs)
+	token := adminTokenFlag(fs)
+	fs.Parse(args)
+
+	resp, err := adminActionClient(*socket, *token).do(http.MethodPost, "/rebalance", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var report RebalanceReport
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		return err
+	}
+
+	fmt.Printf("Sent %d files (%d bytes) to %d peers\n", report.Files, report.Bytes, report.Peers)
+	for key, err := range report.Errors {
+		fmt.Printf("%s: %s\n", key, err)
+	}
+	if len(report.Errors) > 0 {
+		return fmt.Errorf("%d files could not be sent", len(report.Errors))
+	}
+	return nil
+}
+
+// runBandwidth prints the bandwidth limits of the node, or changes those
+// given as flags. The others are left as they are.
+func runBandwidth(args []string) error {
+	fs := flag.NewFlagSet("bandwidth", flag.ExitOnError)
+	socket := clientFlags(fs)
+	token := adminTokenFlag(fs)
+	fs.String("total", "", "bytes per second sent to all the peers together, e.g. 100MB, 0 for unlimited")
+	fs.String("per-peer", "", "bytes per second sent to each peer, 0 for unlimited")
+	fs.String("client", "", "bytes per second of the transfers clients wait on, 0 for unlimited")
+	fs.String("background", "", "bytes per second of rebalancing and repairs, 0 for unlimited")
+	fs.Parse(args)
+
+	c := adminActionClient(*socket, *token)
+	resp, err := c.do(http.MethodGet, "/bandwidth", nil)
+	if err != nil {
+		return err
+	}
+	var limits p2p.BandwidthLimits
+	err = json.NewDecoder(resp.Body).Decode(&limits)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	rates := map[string]*int64{
+		"total":      &limits.Total,
+		"per-peer":   &limits.PerPeer,
+		"client":     &limits.Client,
+		"background": &limits.Background,
+	}
+	changed := false
+	fs.Visit(func(f *flag.Flag) {
+		rate, ok := rates[f.Name]
+		if !ok || err != nil {
+			return
+		}
+		var size ByteSize
+		if size, err = ParseByteSize(f.Value.String()); err != nil {
+			err = fmt.Errorf("-%s: %w", f.Name, err)
+			return
+		}
+		*rate, changed = int64(size), true
+	})
+	if err != nil {
+		return err
+	}
+
+	if changed {
+		body, err := json.Marshal(limits)
+		if err != nil {
+			return err
+		}
+		resp, err := c.do(http.MethodPut, "/bandwidth", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, name := range []string{"total", "per-peer", "client", "background"} {
+		rate := "unlimited"
+		if *rates[name] > 0 {
+			rate = fmt.Sprintf("%d bytes/s", *rates[name])
+		}
+		fmt.Fprintf(w, "%s:\t%s\n", name, rate)
+	}
+	return w.Flush()
+}
+
+// runToken generates an API token. The token goes to the client, the SHA-256
+// into the token_sha256 of its principal in the config of every node.
+func runToken(args []string) error {
+	fs := flag.NewFlagSet("token", flag.ExitOnError)
+	fs.Parse(args)
+
+	token, sha := NewToken()
+	fmt.Printf("token:        %s\ntoken_sha256: %s\n", token, sha)
+	return nil
+}
+
+// runAudit verifies the hash chain of an audit log.
+func runAudit(args []string) error {
+	fs := flag.NewFlagSet("audit", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: fs audit verify <audit dir>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 || fs.Arg(0) != "verify" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	report, err := VerifyAuditLog(fs.Arg(1))
+	if err != nil {
+		return fmt.Errorf("audit log is not intact after %d records: %w", report.Records, err)
+	}
+	fmt.Printf("OK: %d records (%d to %d) in %d files\n", report.Records, report.FirstSeq, report.LastSeq, report.Files)
+	return nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// The choices of StoreOptions.Compression and FileServerOPT.Compression, on
+// top of the algorithms of compressors.
+const (
+	// CompressionNone stores the file as is.
+	CompressionNone = "none"
+	// CompressionAuto compresses the file with zstd when a sample of it compresses well.
+	CompressionAuto = "auto"
+
+	CompressionZstd = "zstd"
+	CompressionGzip = "gzip"
+)
+
+const (
+	// compressionSampleSize is how much of a file CompressionAuto compresses
+	// to decide whether to compress the rest.
+	compressionSampleSize = 64 * 1024
+	// minAutoCompressionSize is the size under which CompressionAuto leaves
+	// files as they are, since the frame would outweigh the savings.
+	minAutoCompressionSize = 512
+	// maxAutoCompressionRatio is the largest compressed to original size ratio
+	// of the sample for which CompressionAuto compresses the file.
+	maxAutoCompressionRatio = 0.9
+)
+
+// ErrUnknownCompression is returned when a file is stored with a compression
+// that is not one of the choices.
+var ErrUnknownCompression = errors.New("unknown compression")
+
+// compressor writes and reads one compression format.
+type compressor struct {
+	newWriter func(io.Writer) (io.WriteCloser, error)
+	newReader func(io.Reader) (io.ReadCloser, error)
+}
+
+// compressors are the compression algorithms recorded in ObjectAttrs.Compression.
+var compressors = map[string]compressor{
+	CompressionZstd: {
+		newWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+			if err != nil {
+				return nil, err
+			}
+			return d.IOReadCloser(), nil
+		},
+	},
+	CompressionGzip: {
+		newWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriter(w), nil
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	},
+}
+
+// compressionChoices are the valid values of StoreOptions.Compression and
+// FileServerOPT.Compression, the empty string excepted.
+var compressionChoices = map[string]bool{
+	CompressionNone: true,
+	CompressionAuto: true,
+	CompressionZstd: true,
+	CompressionGzip: true,
+}
+
+// validateCompression checks that compression is one of the choices or empty.
+func validateCompression(compression string) error {
+	if compression != "" && !compressionChoices[compression] {
+		return fmt.Errorf("%w %q, expected one of %s", ErrUnknownCompression, compression, choices(compressionChoices))
+	}
+	return nil
+}
+
+// sampleEncoder compresses the samples of CompressionAuto. EncodeAll may be
+// called concurrently.
+var sampleEncoder = sync.OnceValue(func() *zstd.Encoder {
+	encoder, _ := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1))
+	return encoder
+})
+
+// chooseCompression resolves the compression asked for a file into the
+// algorithm to record in its attributes, empty to store it as is. With
+// CompressionAuto, the start of r is read to compress a sample of it, so r
+// must no longer be used: the returned reader yields all of it instead.
+func chooseCompression(compression string, r io.Reader) (string, io.Reader, error) {
+	switch compression {
+	case "", CompressionNone:
+		return "", r, nil
+	case CompressionAuto:
+	default:
+		if _, ok := compressors[compression]; !ok {
+			return "", r, validateCompression(compression)
+		}
+		return compression, r, nil
+	}
+
+	sample := make([]byte, compressionSampleSize)
+	n, err := io.ReadFull(r, sample)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", nil, err
+	}
+	sample = sample[:n]
+	r = io.MultiReader(bytes.NewReader(sample), r)
+
+	if n < minAutoCompressionSize {
+		return "", r, nil
+	}
+	compressed := sampleEncoder().EncodeAll(sample, make([]byte, 0, n))
+	if float64(len(compressed)) > maxAutoCompressionRatio*float64(n) {
+		return "", r, nil
+	}
+	return CompressionZstd, r, nil
+}
+
+// compressingReader compresses src with the algorithm in the background,
+// writing into a pipe, and returns the read side of it. Closing the returned
+// reader stops the compression.
+func compressingReader(algorithm string, src io.Reader) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		w, err := compressors[algorithm].newWriter(pw)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		_, err = io.Copy(w, src)
+		if closeErr := w.Close(); err == nil {
+			err = closeErr
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// decompressingReader returns a reader over the decompressed contents of src,
+// which it closes along with itself.
+func decompressingReader(algorithm string, src io.ReadCloser) (io.ReadCloser, error) {
+	c, ok := compressors[algorithm]
+	if !ok {
+		src.Close()
+		return nil, fmt.Errorf("%w %q", ErrUnknownCompression, algorithm)
+	}
+	r, err := c.newReader(src)
+	if err != nil {
+		src.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{r, multiCloser{r, src}}, nil
+}
+
+// multiCloser closes all its closers and returns the first error.
+type multiCloser []io.Closer
+
+func (m multiCloser) Close() error {
+	var err error
+	for _, c := range m {
+		if closeErr := c.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// uncompressedSizer is implemented by the readers that know the size of the
+// file before compression once they have been read to the end, such as the
+// streams of the replicas.
+type uncompressedSizer interface {
+	UncompressedSize() int64
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// sliceReader skips the first offset bytes of r and limits it to length
+// bytes, or to the rest of r when length is negative. It returns
+// ErrInvalidRange when r ends before offset.
+func sliceReader(r io.ReadCloser, offset, length int64) (io.ReadCloser, error) {
+	if _, err := io.CopyN(io.Discard, r, offset); err != nil {
+		r.Close()
+		return nil, ErrInvalidRange
+	}
+	if length < 0 {
+		return r, nil
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(r, length), r}, nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// compressibleData returns size bytes of log lines.
+func compressibleData(size int) []byte {
+	var buf bytes.Buffer
+	for i := 0; buf.Len() < size; i++ {
+		fmt.Fprintf(&buf, "2026-10-18T12:00:%02d level=INFO msg=\"Stored file\" key=logs/%d bytes=%d\n", i%60, i, i*37)
+	}
+	return buf.Bytes()[:size]
+}
+
+func TestCompression(t *testing.T) {
+	servers := make([]*FileServer, 2)
+	for i, address := range []string{"127.0.0.17:4300", "127.0.0.17:4301"} {
+		var server *FileServer
+		if i == 0 {
+			server = makeServer(address, true)
+		} else {
+			server = makeServer(address, false, "127.0.0.17:4300")
+		}
+		startServer(t, server)
+		t.Cleanup(func() {
+			server.Stop()
+			server.Storage.Clear()
+		})
+		servers[i] = server
+	}
+	time.Sleep(30 * time.Millisecond)
+
+	data := compressibleData(256 * 1024)
+	for _, tc := range []struct {
+		compression string
+		want        string
+	}{
+		{CompressionZstd, CompressionZstd},
+		{CompressionGzip, CompressionGzip},
+		{CompressionAuto, CompressionZstd},
+	} {
+		key := "logs/" + tc.compression + ".log"
+		if err := servers[1].StoreWithOptions(t.Context(), key, bytes.NewReader(data), StoreOptions{Compression: tc.compression}); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(50 * time.Millisecond)
+
+		// The replica is compressed like the original.
+		for i, server := range servers {
+			info, err := server.Stat(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Compression != tc.want || info.Size != int64(len(data)) || info.StoredSize >= int64(len(data))/2 {
+				t.Errorf("%s: Stat on node %d: got compression %q, size %d, stored size %d", tc.compression, i, info.Compression, info.Size, info.StoredSize)
+			}
+
+			r, err := server.Get(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(r)
+			r.Close()
+			if err != nil || !bytes.Equal(got, data) {
+				t.Errorf("%s: Get on node %d: got %d bytes, error %v", tc.compression, i, len(got), err)
+			}
+		}
+
+		// A node without the file gets the range from a compressed blob of a peer.
+		if err := servers[0].Storage.DeleteFile(key); err != nil {
+			t.Fatal(err)
+		}
+		for i, server := range servers {
+			r, err := server.GetRange(key, 100_000, 5000)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(r)
+			r.Close()
+			if err != nil || !bytes.Equal(got, data[100_000:105_000]) {
+				t.Errorf("%s: GetRange on node %d: got %d bytes, error %v", tc.compression, i, len(got), err)
+			}
+		}
+	}
+
+	// Random data does not compress, so auto stores it as is.
+	random := generateRandomData(64 * 1024)
+	if err := servers[1].StoreWithOptions(t.Context(), "random", bytes.NewReader(random), StoreOptions{Compression: CompressionAuto}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if info, err := servers[1].Stat("random"); err != nil || info.Compression != "" || info.Size != int64(len(random)) {
+		t.Errorf("Stat of random data stored with auto: got %+v, error %v", info, err)
+	}
+
+	if err := servers[1].StoreWithOptions(t.Context(), "bad", bytes.NewReader(data), StoreOptions{Compression: "brotli"}); !errors.Is(err, ErrUnknownCompression) {
+		t.Errorf("store with an unknown compression: got %v, want ErrUnknownCompression", err)
+	}
+}
+
+func TestGatewayCompression(t *testing.T) {
+	server := makeServer("127.0.0.17:4302", true)
+	server.Config.Compression = CompressionGzip
+	startServer(t, server)
+	t.Cleanup(func() {
+		server.Stop()
+		server.Storage.Clear()
+	})
+
+	gateway := httptest.NewServer(NewGateway(server))
+	defer gateway.Close()
+
+	put := func(key, compression string) int {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPut, gateway.URL+"/objects/"+key, bytes.NewReader(compressibleData(4096)))
+		if compression != "" {
+			req.Header.Set(CompressionHeader, compression)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	stat := func(key string) ObjectInfo {
+		t.Helper()
+		resp, err := http.Get(gateway.URL + "/objects/" + key + "?stat")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var info ObjectInfo
+		json.NewDecoder(resp.Body).Decode(&info)
+		return info
+	}
+
+	// Without the header, the default of the node applies.
+	if status := put("default.log", ""); status != http.StatusCreated {
+		t.Fatalf("PUT: got status %d", status)
+	}
+	if info := stat("default.log"); info.Compression != CompressionGzip || info.Size != 4096 {
+		t.Errorf("GET ?stat: got compression %q, size %d, want gzip and 4096", info.Compression, info.Size)
+	}
+
+	if status := put("plain.log", CompressionNone); status != http.StatusCreated {
+		t.Fatalf("PUT: got status %d", status)
+	}
+	if info := stat("plain.log"); info.Compression != "" {
+		t.Errorf("GET ?stat: got compression %q, want none", info.Compression)
+	}
+
+	if status := put("bad.log", "brotli"); status != http.StatusBadRequest {
+		t.Errorf("PUT with an unknown compression: got status %d, want 400", status)
+	}
+}
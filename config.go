@@ -0,0 +1,950 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"go-distributed-storage/p2p"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"gopkg.in/yaml.v3"
+)
+
+// Config describes a node. It is read from a YAML file by LoadConfig, and every
+// setting can be overridden by an FS_* environment variable (see configEnv).
+//
+//	listen: ":3000"
+//	bootstrap: [":4000", ":5000"]
+//	bootstrap_node: false
+//	root_dir: /var/lib/fs
+//	path_transform: hash        # hash or plain
+//	backend:
+//	  type: disk                # disk, log, memory or s3
+//	  log:                      # for type log
+//	    segment_size: 256MiB
+//	  s3:                       # for type s3
+//	    endpoint: https://s3.example.com
+//	    bucket: fs-blobs
+//	    prefix: node-1/
+//	    region: us-east-1
+//	    access_key: AKID...     # defaults to AWS_ACCESS_KEY_ID
+//	    secret_key: ...         # defaults to AWS_SECRET_ACCESS_KEY
+//	cipher: aes-ctr
+//	compression: auto           # zstd, gzip, auto or none, before encryption
+//	key:                        # generated under root_dir for this node only when unset
+//	  file: /etc/fs/cluster.key # or hex: <64 hex digits>, or env: <variable name>
+//	admin_socket: fs.sock
+//	metrics_address: ":9100"    # serves /metrics, disabled when empty
+//	log:
+//	  level: info               # debug, info, warn or error
+//	  format: text              # text or json
+//	limits:
+//	  max_file_size: 100MiB
+//	  capacity: 500GiB          # most bytes stored by the node, unlimited when 0
+//	  min_free_space: 1GiB      # free space kept on the file system
+//	timeouts:
+//	  dial: 10s
+//	  peer_response: 5s
+//	  shutdown: 10s             # time given to in-flight requests on shutdown
+//	scrub:
+//	  interval: 24h
+//	  rate: 10MB
+//	expiry:
+//	  interval: 1m              # pause between two deletions of expired files
+//	bandwidth:                  # bytes per second sent to peers, unlimited when 0
+//	  total: 100MB              # all the peers together
+//	  per_peer: 20MB            # each peer
+//	  client: 0                 # replicas of stores and files fetched for gets
+//	  background: 10MB          # rebalancing and repairs, which yield to clients
+//	namespaces:
+//	  team-a:
+//	    key:
+//	      file: /etc/fs/team-a.key  # required, like the key of the node
+//	    quota: 100GiB               # most bytes stored per node, unlimited when 0
+//	    policy: read-write          # read-write, read-only or write-once
+//	audit:
+//	  dir: /var/lib/fs/audit        # hash-chained audit log, disabled when empty
+//	  max_size: 100MiB              # size past which a new file is started
+//	auth:                           # access control, off without a peer secret
+//	  peer_secret:
+//	    file: /etc/fs/peer.key      # signs the requests between nodes, like a key
+//	  principals:
+//	    - name: ci                  # also the access key ID for the S3 gateway
+//	      token_sha256: 9f86d0...   # SHA-256 of the API token, see "fs token"
+//	      grants:
+//	        - namespace: team-a     # "*" for every namespace, empty for the default one
+//	          prefix: builds/       # every key when empty
+//	          permissions: [read, write, delete]
+type Config struct {
+	Listen        string    `yaml:"listen"`
+	Bootstrap     []string  `yaml:"bootstrap"`
+	BootstrapNode bool      `yaml:"bootstrap_node"`
+	RootDir       string    `yaml:"root_dir"`
+	PathTransform string    `yaml:"path_transform"`
+	Cipher        string    `yaml:"cipher"`
+	Compression   string    `yaml:"compression"`
+	Key           KeySource `yaml:"key"`
+	AdminSocket   string    `yaml:"admin_socket"`
+	// MetricsAddress is the address /metrics is served on. Empty disables it.
+	MetricsAddress string `yaml:"metrics_address"`
+
+	Backend struct {
+		Type string `yaml:"type"`
+		Log  struct {
+			SegmentSize ByteSize `yaml:"segment_size"`
+		} `yaml:"log"`
+		S3 ObjectStoreConfig `yaml:"s3"`
+	} `yaml:"backend"`
+
+	Limits struct {
+		MaxFileSize  ByteSize `yaml:"max_file_size"`
+		Capacity     ByteSize `yaml:"capacity"`
+		MinFreeSpace ByteSize `yaml:"min_free_space"`
+	} `yaml:"limits"`
+
+	Timeouts struct {
+		Dial         time.Duration `yaml:"dial"`
+		PeerResponse time.Duration `yaml:"peer_response"`
+		Shutdown     time.Duration `yaml:"shutdown"`
+	} `yaml:"timeouts"`
+
+	Scrub struct {
+		Interval time.Duration `yaml:"interval"`
+		Rate     ByteSize      `yaml:"rate"`
+	} `yaml:"scrub"`
+
+	Expiry struct {
+		Interval time.Duration `yaml:"interval"`
+	} `yaml:"expiry"`
+
+	Bandwidth struct {
+		Total      ByteSize `yaml:"total"`
+		PerPeer    ByteSize `yaml:"per_peer"`
+		Client     ByteSize `yaml:"client"`
+		Background ByteSize `yaml:"background"`
+	} `yaml:"bandwidth"`
+
+	Log struct {
+		Level  string `yaml:"level"`
+		Format string `yaml:"format"`
+	} `yaml:"log"`
+
+	Namespaces map[string]NamespaceConfig `yaml:"namespaces"`
+
+	Audit struct {
+		Dir     string   `yaml:"dir"`
+		MaxSize ByteSize `yaml:"max_size"`
+	} `yaml:"audit"`
+
+	Auth AuthConfig `yaml:"auth"`
+}
+
+// AuthConfig enables access control once PeerSecret is set.
+type AuthConfig struct {
+	// PeerSecret is where the hex encoded 32 byte secret signing the
+	// requests between nodes is read from.
+	PeerSecret KeySource         `yaml:"peer_secret"`
+	Principals []PrincipalConfig `yaml:"principals"`
+}
+
+// PrincipalConfig describes a client and what it may do.
+type PrincipalConfig struct {
+	Name        string        `yaml:"name"`
+	TokenSHA256 string        `yaml:"token_sha256"`
+	Grants      []GrantConfig `yaml:"grants"`
+}
+
+// GrantConfig allows operations on the keys of a namespace starting with Prefix.
+type GrantConfig struct {
+	Namespace   string   `yaml:"namespace"`
+	Prefix      string   `yaml:"prefix"`
+	Permissions []string `yaml:"permissions"`
+}
+
+// NamespaceConfig describes a namespace served besides the default one.
+type NamespaceConfig struct {
+	// Key is where the encryption key of the namespace is read from.
+	Key    KeySource `yaml:"key"`
+	Quota  ByteSize  `yaml:"quota"`
+	Policy string    `yaml:"policy"`
+}
+
+// KeySource tells where the encryption key is read from. At most one field
+// may be set. Without any, a random key is generated, which only works for a
+// single node since every node of a cluster must decrypt the same ciphertext.
+type KeySource struct {
+	// Hex is the hex encoded key itself.
+	Hex string `yaml:"hex"`
+	// File is a file holding the hex encoded key.
+	File string `yaml:"file"`
+	// Env is the name of an environment variable holding the hex encoded key.
+	Env string `yaml:"env"`
+}
+
+// ObjectStoreConfig locates the bucket of the s3 backend.
+type ObjectStoreConfig struct {
+	// Endpoint is the URL of an S3 compatible service. Empty means AWS.
+	Endpoint  string `yaml:"endpoint"`
+	Bucket    string `yaml:"bucket"`
+	Prefix    string `yaml:"prefix"`
+	Region    string `yaml:"region"`
+	AccessKey string `yaml:"access_key"`
+	SecretKey string `yaml:"secret_key"`
+}
+
+// backends are the choices of Config.Backend.Type. A nil Backend means the
+// default DiskBackend under the root directory.
+var backends = map[string]func(c *Config, rootDir string, logger *slog.Logger) (Backend, error){
+	"disk": func(*Config, string, *slog.Logger) (Backend, error) { return nil, nil },
+	"log": func(c *Config, rootDir string, logger *slog.Logger) (Backend, error) {
+		return NewLogBackend(LogBackendOPT{
+			Dir:         storageRootDir(rootDir),
+			SegmentSize: int64(c.Backend.Log.SegmentSize),
+			Logger:      logger,
+		})
+	},
+	"memory": func(*Config, string, *slog.Logger) (Backend, error) {
+		return NewMemoryBackend(), nil
+	},
+	"s3": func(c *Config, _ string, logger *slog.Logger) (Backend, error) {
+		opt := c.Backend.S3
+		accessKey, secretKey := opt.AccessKey, opt.SecretKey
+		if accessKey == "" && secretKey == "" {
+			accessKey, secretKey = os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+		}
+
+		client := s3.New(s3.Options{
+			Region:       opt.Region,
+			UsePathStyle: opt.Endpoint != "",
+			Credentials:  credentials.NewStaticCredentialsProvider(accessKey, secretKey, ""),
+		}, func(o *s3.Options) {
+			if opt.Endpoint != "" {
+				o.BaseEndpoint = aws.String(opt.Endpoint)
+			}
+		})
+		return NewObjectStoreBackend(client, opt.Bucket, opt.Prefix, logger), nil
+	},
+}
+
+// pathTransforms are the choices of Config.PathTransform.
+var pathTransforms = map[string]PathTranformSignature{
+	"hash":  HashPathBuilder,
+	"plain": DefaultPathBuilder,
+}
+
+// logFormats are the choices of Config.Log.Format.
+var logFormats = map[string]func(io.Writer, *slog.HandlerOptions) slog.Handler{
+	"text": func(w io.Writer, opts *slog.HandlerOptions) slog.Handler { return slog.NewTextHandler(w, opts) },
+	"json": func(w io.Writer, opts *slog.HandlerOptions) slog.Handler { return slog.NewJSONHandler(w, opts) },
+}
+
+// ciphers are the choices of Config.Cipher.
+var ciphers = map[string]func() Cipher{
+	"aes-ctr": func() Cipher { return &BasicCrypto{} },
+}
+
+// DefaultConfig returns the settings used for what a config file leaves out.
+func DefaultConfig() *Config {
+	c := &Config{
+		Listen:        ":3000",
+		PathTransform: "hash",
+		Cipher:        "aes-ctr",
+		Compression:   CompressionNone,
+		AdminSocket:   DefaultAdminSocket,
+	}
+	c.Backend.Type = "disk"
+	c.Backend.Log.SegmentSize = defaultSegmentSize
+	c.Backend.S3.Region = "us-east-1"
+	c.Limits.MaxFileSize = defaultMaxFileSize
+	c.Timeouts.Dial = 10 * time.Second
+	c.Timeouts.PeerResponse = defaultPeerResponseTimeout
+	c.Timeouts.Shutdown = defaultShutdownTimeout
+	c.Expiry.Interval = defaultExpiryInterval
+	c.Audit.MaxSize = defaultAuditMaxSize
+	c.Log.Level = "info"
+	c.Log.Format = "text"
+	return c
+}
+
+// LoadConfig reads the config file at path on top of DefaultConfig, applies
+// the environment overrides and validates the result. Without a path only the
+// defaults and the environment are used.
+func LoadConfig(path string) (*Config, error) {
+	c := DefaultConfig()
+
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading config file: %w", err)
+		}
+		defer f.Close()
+
+		decoder := yaml.NewDecoder(f)
+		decoder.KnownFields(true)
+		if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("parsing config file %s: %w", path, err)
+		}
+	}
+
+	if err := c.applyEnv(os.LookupEnv); err != nil {
+		return nil, err
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// configEnv maps the environment variables that override a config file to
+// the setting they replace. Lists are comma separated.
+var configEnv = map[string]func(c *Config, value string) error{
+	"FS_LISTEN": func(c *Config, v string) error {
+		c.Listen = v
+		return nil
+	},
+	"FS_BOOTSTRAP": func(c *Config, v string) error {
+		c.Bootstrap = splitList(v)
+		return nil
+	},
+	"FS_BOOTSTRAP_NODE": func(c *Config, v string) (err error) {
+		c.BootstrapNode, err = strconv.ParseBool(v)
+		return err
+	},
+	"FS_ROOT_DIR": func(c *Config, v string) error {
+		c.RootDir = v
+		return nil
+	},
+	"FS_PATH_TRANSFORM": func(c *Config, v string) error {
+		c.PathTransform = v
+		return nil
+	},
+	"FS_BACKEND": func(c *Config, v string) error {
+		c.Backend.Type = v
+		return nil
+	},
+	"FS_BACKEND_LOG_SEGMENT_SIZE": func(c *Config, v string) (err error) {
+		c.Backend.Log.SegmentSize, err = ParseByteSize(v)
+		return err
+	},
+	"FS_BACKEND_S3_ENDPOINT": func(c *Config, v string) error {
+		c.Backend.S3.Endpoint = v
+		return nil
+	},
+	"FS_BACKEND_S3_BUCKET": func(c *Config, v string) error {
+		c.Backend.S3.Bucket = v
+		return nil
+	},
+	"FS_BACKEND_S3_PREFIX": func(c *Config, v string) error {
+		c.Backend.S3.Prefix = v
+		return nil
+	},
+	"FS_BACKEND_S3_REGION": func(c *Config, v string) error {
+		c.Backend.S3.Region = v
+		return nil
+	},
+	"FS_BACKEND_S3_ACCESS_KEY": func(c *Config, v string) error {
+		c.Backend.S3.AccessKey = v
+		return nil
+	},
+	"FS_BACKEND_S3_SECRET_KEY": func(c *Config, v string) error {
+		c.Backend.S3.SecretKey = v
+		return nil
+	},
+	"FS_CIPHER": func(c *Config, v string) error {
+		c.Cipher = v
+		return nil
+	},
+	"FS_COMPRESSION": func(c *Config, v string) error {
+		c.Compression = v
+		return nil
+	},
+	"FS_KEY_HEX": func(c *Config, v string) error {
+		c.Key = KeySource{Hex: v}
+		return nil
+	},
+	"FS_KEY_FILE": func(c *Config, v string) error {
+		c.Key = KeySource{File: v}
+		return nil
+	},
+	"FS_KEY_ENV": func(c *Config, v string) error {
+		c.Key = KeySource{Env: v}
+		return nil
+	},
+	"FS_AUDIT_DIR": func(c *Config, v string) error {
+		c.Audit.Dir = v
+		return nil
+	},
+	"FS_AUDIT_MAX_SIZE": func(c *Config, v string) (err error) {
+		c.Audit.MaxSize, err = ParseByteSize(v)
+		return err
+	},
+	"FS_PEER_SECRET_HEX": func(c *Config, v string) error {
+		c.Auth.PeerSecret = KeySource{Hex: v}
+		return nil
+	},
+	"FS_PEER_SECRET_FILE": func(c *Config, v string) error {
+		c.Auth.PeerSecret = KeySource{File: v}
+		return nil
+	},
+	"FS_PEER_SECRET_ENV": func(c *Config, v string) error {
+		c.Auth.PeerSecret = KeySource{Env: v}
+		return nil
+	},
+	"FS_ADMIN_SOCKET": func(c *Config, v string) error {
+		c.AdminSocket = v
+		return nil
+	},
+	"FS_METRICS_ADDRESS": func(c *Config, v string) error {
+		c.MetricsAddress = v
+		return nil
+	},
+	"FS_LOG_LEVEL": func(c *Config, v string) error {
+		c.Log.Level = v
+		return nil
+	},
+	"FS_LOG_FORMAT": func(c *Config, v string) error {
+		c.Log.Format = v
+		return nil
+	},
+	"FS_MAX_FILE_SIZE": func(c *Config, v string) (err error) {
+		c.Limits.MaxFileSize, err = ParseByteSize(v)
+		return err
+	},
+	"FS_CAPACITY": func(c *Config, v string) (err error) {
+		c.Limits.Capacity, err = ParseByteSize(v)
+		return err
+	},
+	"FS_MIN_FREE_SPACE": func(c *Config, v string) (err error) {
+		c.Limits.MinFreeSpace, err = ParseByteSize(v)
+		return err
+	},
+	"FS_DIAL_TIMEOUT": func(c *Config, v string) (err error) {
+		c.Timeouts.Dial, err = time.ParseDuration(v)
+		return err
+	},
+	"FS_PEER_RESPONSE_TIMEOUT": func(c *Config, v string) (err error) {
+		c.Timeouts.PeerResponse, err = time.ParseDuration(v)
+		return err
+	},
+	"FS_SHUTDOWN_TIMEOUT": func(c *Config, v string) (err error) {
+		c.Timeouts.Shutdown, err = time.ParseDuration(v)
+		return err
+	},
+	"FS_SCRUB_INTERVAL": func(c *Config, v string) (err error) {
+		c.Scrub.Interval, err = time.ParseDuration(v)
+		return err
+	},
+	"FS_SCRUB_RATE": func(c *Config, v string) (err error) {
+		c.Scrub.Rate, err = ParseByteSize(v)
+		return err
+	},
+	"FS_EXPIRY_INTERVAL": func(c *Config, v string) (err error) {
+		c.Expiry.Interval, err = time.ParseDuration(v)
+		return err
+	},
+	"FS_BANDWIDTH_TOTAL": func(c *Config, v string) (err error) {
+		c.Bandwidth.Total, err = ParseByteSize(v)
+		return err
+	},
+	"FS_BANDWIDTH_PER_PEER": func(c *Config, v string) (err error) {
+		c.Bandwidth.PerPeer, err = ParseByteSize(v)
+		return err
+	},
+	"FS_BANDWIDTH_CLIENT": func(c *Config, v string) (err error) {
+		c.Bandwidth.Client, err = ParseByteSize(v)
+		return err
+	},
+	"FS_BANDWIDTH_BACKGROUND": func(c *Config, v string) (err error) {
+		c.Bandwidth.Background, err = ParseByteSize(v)
+		return err
+	},
+}
+
+// applyEnv applies the overrides of the environment variables that are set.
+func (c *Config) applyEnv(lookup func(string) (string, bool)) error {
+	names := make([]string, 0, len(configEnv))
+	for name := range configEnv {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		value, ok := lookup(name)
+		if !ok {
+			continue
+		}
+		if err := configEnv[name](c, value); err != nil {
+			return fmt.Errorf("invalid %s=%q: %w", name, value, err)
+		}
+	}
+	return nil
+}
+
+// Validate reports every invalid setting of the config at once.
+func (c *Config) Validate() error {
+	var errs []error
+	invalid := func(setting, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("config: %s: %s", setting, fmt.Sprintf(format, args...)))
+	}
+
+	if c.Listen == "" {
+		invalid("listen", "must not be empty")
+	}
+	for _, address := range c.Bootstrap {
+		if strings.TrimSpace(address) == "" {
+			invalid("bootstrap", "must not hold empty addresses")
+			break
+		}
+	}
+	if _, ok := pathTransforms[c.PathTransform]; !ok {
+		invalid("path_transform", "unknown value %q, expected one of %s", c.PathTransform, choices(pathTransforms))
+	}
+	if _, ok := backends[c.Backend.Type]; !ok {
+		invalid("backend.type", "unknown value %q, expected one of %s", c.Backend.Type, choices(backends))
+	}
+	if c.Backend.Log.SegmentSize <= 0 {
+		invalid("backend.log.segment_size", "must be positive")
+	}
+	if c.Backend.Type == "s3" {
+		if c.Backend.S3.Bucket == "" {
+			invalid("backend.s3.bucket", "must not be empty")
+		}
+		if c.Backend.S3.Region == "" {
+			invalid("backend.s3.region", "must not be empty")
+		}
+		if (c.Backend.S3.AccessKey == "") != (c.Backend.S3.SecretKey == "") {
+			invalid("backend.s3", "set both access_key and secret_key, or neither")
+		}
+	}
+	if _, ok := ciphers[c.Cipher]; !ok {
+		invalid("cipher", "unknown value %q, expected one of %s", c.Cipher, choices(ciphers))
+	}
+	if !compressionChoices[c.Compression] {
+		invalid("compression", "unknown value %q, expected one of %s", c.Compression, choices(compressionChoices))
+	}
+
+	if c.Key.sources() > 1 {
+		invalid("key", "set only one of hex, file and env")
+	}
+	if c.Key.Hex != "" {
+		if _, err := decodeKey(c.Key.Hex); err != nil {
+			invalid("key.hex", "%v", err)
+		}
+	}
+
+	if c.Limits.MaxFileSize <= 0 {
+		invalid("limits.max_file_size", "must be positive")
+	}
+	if c.Limits.Capacity < 0 {
+		invalid("limits.capacity", "must not be negative")
+	}
+	if c.Limits.MinFreeSpace < 0 {
+		invalid("limits.min_free_space", "must not be negative")
+	}
+	if c.Timeouts.Dial < 0 {
+		invalid("timeouts.dial", "must not be negative")
+	}
+	if c.Timeouts.PeerResponse <= 0 {
+		invalid("timeouts.peer_response", "must be positive")
+	}
+	if c.Timeouts.Shutdown <= 0 {
+		invalid("timeouts.shutdown", "must be positive")
+	}
+	if c.Scrub.Interval < 0 {
+		invalid("scrub.interval", "must not be negative")
+	}
+	if c.Scrub.Rate < 0 {
+		invalid("scrub.rate", "must not be negative")
+	}
+	if c.Expiry.Interval <= 0 {
+		invalid("expiry.interval", "must be positive")
+	}
+	if c.Bandwidth.Total < 0 {
+		invalid("bandwidth.total", "must not be negative")
+	}
+	if c.Bandwidth.PerPeer < 0 {
+		invalid("bandwidth.per_peer", "must not be negative")
+	}
+	if c.Bandwidth.Client < 0 {
+		invalid("bandwidth.client", "must not be negative")
+	}
+	if c.Bandwidth.Background < 0 {
+		invalid("bandwidth.background", "must not be negative")
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Log.Level)); err != nil {
+		invalid("log.level", "unknown value %q, expected one of debug, info, warn, error", c.Log.Level)
+	}
+	if _, ok := logFormats[c.Log.Format]; !ok {
+		invalid("log.format", "unknown value %q, expected one of %s", c.Log.Format, choices(logFormats))
+	}
+
+	names := make([]string, 0, len(c.Namespaces))
+	for name := range c.Namespaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		namespace := c.Namespaces[name]
+		setting := "namespaces." + name
+		if err := validateNamespaceName(name); err != nil {
+			invalid(setting, "%v", err)
+		}
+		if namespace.Key.sources() != 1 {
+			invalid(setting+".key", "set one of hex, file and env")
+		}
+		if namespace.Key.Hex != "" {
+			if _, err := decodeKey(namespace.Key.Hex); err != nil {
+				invalid(setting+".key.hex", "%v", err)
+			}
+		}
+		if namespace.Quota < 0 {
+			invalid(setting+".quota", "must not be negative")
+		}
+		if namespace.Policy != "" && !namespacePolicies[NamespacePolicy(namespace.Policy)] {
+			invalid(setting+".policy", "unknown value %q, expected one of %s", namespace.Policy, choices(namespacePolicies))
+		}
+	}
+
+	if c.Audit.MaxSize <= 0 {
+		invalid("audit.max_size", "must be positive")
+	}
+
+	if c.Auth.PeerSecret.sources() > 1 {
+		invalid("auth.peer_secret", "set only one of hex, file and env")
+	}
+	if c.Auth.PeerSecret.Hex != "" {
+		if _, err := decodeKey(c.Auth.PeerSecret.Hex); err != nil {
+			invalid("auth.peer_secret.hex", "%v", err)
+		}
+	}
+	if len(c.Auth.Principals) > 0 && c.Auth.PeerSecret.sources() == 0 {
+		invalid("auth.principals", "require auth.peer_secret")
+	}
+	principals := make(map[string]bool, len(c.Auth.Principals))
+	for i, principal := range c.Auth.Principals {
+		setting := fmt.Sprintf("auth.principals[%d]", i)
+		switch {
+		case principal.Name == "":
+			invalid(setting+".name", "must not be empty")
+		case principals[principal.Name]:
+			invalid(setting+".name", "duplicate principal %q", principal.Name)
+		}
+		principals[principal.Name] = true
+		if principal.TokenSHA256 != "" {
+			if sum, err := hex.DecodeString(principal.TokenSHA256); err != nil || len(sum) != 32 {
+				invalid(setting+".token_sha256", "must hold a hex encoded SHA-256")
+			}
+		}
+		for j, grant := range principal.Grants {
+			setting := fmt.Sprintf("%s.grants[%d]", setting, j)
+			if _, ok := c.Namespaces[grant.Namespace]; !ok && grant.Namespace != DefaultNamespace && grant.Namespace != AnyNamespace {
+				invalid(setting+".namespace", "unknown namespace %q", grant.Namespace)
+			}
+			if len(grant.Permissions) == 0 {
+				invalid(setting+".permissions", "must not be empty")
+			}
+			for _, permission := range grant.Permissions {
+				if !permissions[Permission(permission)] {
+					invalid(setting+".permissions", "unknown value %q, expected one of %s", permission, choices(permissions))
+				}
+				if Permission(permission) == PermissionAdmin && (grant.Namespace != AnyNamespace || grant.Prefix != "") {
+					invalid(setting+".permissions", "admin is only granted for namespace %q without a prefix", AnyNamespace)
+				}
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// generatedKeyFileName is the file under the root directory holding the key
+// generated for a node started without one.
+const generatedKeyFileName = ".encryption.key"
+
+// EncryptionKey reads the key from its configured source. Without one, it
+// reads the key generated for this node under rootDir, generating it the first
+// time, so that the node can still read its files after a restart.
+func (c *Config) EncryptionKey(rootDir string, logger *slog.Logger) ([]byte, error) {
+	if c.Key.sources() > 0 {
+		return c.Key.read()
+	}
+
+	path := filepath.Join(storageRootDir(rootDir), generatedKeyFileName)
+	b, err := os.ReadFile(path)
+	if err == nil {
+		key, err := decodeKey(string(b))
+		if err != nil {
+			return nil, fmt.Errorf("key file %s: %w", path, err)
+		}
+		return key, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("reading key file: %w", err)
+	}
+
+	logger.Warn("No encryption key configured, generating a key for this node only", "path", path)
+	key := (&BasicCrypto{}).newEncryptionKey()
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, fmt.Errorf("writing key file: %w", err)
+	}
+	if err := os.WriteFile(path, []byte(hex.EncodeToString(key)+"\n"), 0o600); err != nil {
+		return nil, fmt.Errorf("writing key file: %w", err)
+	}
+	return key, nil
+}
+
+// sources returns how many of the sources of the key are set.
+func (k KeySource) sources() int {
+	n := 0
+	for _, source := range []string{k.Hex, k.File, k.Env} {
+		if source != "" {
+			n++
+		}
+	}
+	return n
+}
+
+// read reads the key from the source that is set.
+func (k KeySource) read() ([]byte, error) {
+	switch {
+	case k.Hex != "":
+		return decodeKey(k.Hex)
+	case k.File != "":
+		b, err := os.ReadFile(k.File)
+		if err != nil {
+			return nil, fmt.Errorf("reading key file: %w", err)
+		}
+		key, err := decodeKey(string(b))
+		if err != nil {
+			return nil, fmt.Errorf("key file %s: %w", k.File, err)
+		}
+		return key, nil
+	case k.Env != "":
+		value, ok := os.LookupEnv(k.Env)
+		if !ok {
+			return nil, fmt.Errorf("key environment variable %s is not set", k.Env)
+		}
+		key, err := decodeKey(value)
+		if err != nil {
+			return nil, fmt.Errorf("key environment variable %s: %w", k.Env, err)
+		}
+		return key, nil
+	default:
+		return nil, errors.New("no key source set")
+	}
+}
+
+// NewLogger returns a logger writing to w in the configured format, at the
+// configured level.
+func (c *Config) NewLogger(w io.Writer) (*slog.Logger, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Log.Level)); err != nil {
+		return nil, fmt.Errorf("config: log.level: %w", err)
+	}
+	newHandler, ok := logFormats[c.Log.Format]
+	if !ok {
+		return nil, fmt.Errorf("config: log.format: unknown value %q", c.Log.Format)
+	}
+	return slog.New(newHandler(w, &slog.HandlerOptions{Level: level})), nil
+}
+
+// Build validates the config and returns a FileServer wired to a TCP
+// transport, both logging to stderr. The server still has to be started.
+func (c *Config) Build() (*FileServer, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	logger, err := c.NewLogger(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+
+	tcptransportOpts := &p2p.TCPTransportOPT{
+		ListenAddress: c.Listen,
+		HandshakeFunc: p2p.NOPHandshakeFunc,
+		Decoder:       p2p.DefaultDecoder{},
+		DialTimeout:   c.Timeouts.Dial,
+		Logger:        logger,
+		Bandwidth: p2p.NewBandwidth(p2p.BandwidthLimits{
+			Total:      int64(c.Bandwidth.Total),
+			PerPeer:    int64(c.Bandwidth.PerPeer),
+			Client:     int64(c.Bandwidth.Client),
+			Background: int64(c.Bandwidth.Background),
+		}),
+	}
+	tcpTransport := p2p.NewTCPTransport(tcptransportOpts)
+
+	rootDir := c.RootDir
+	if rootDir == "" {
+		rootDir = c.Listen + "_network"
+	}
+
+	encryptionKey, err := c.EncryptionKey(rootDir, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	backend, err := backends[c.Backend.Type](c, rootDir, logger)
+	if err != nil {
+		return nil, fmt.Errorf("config: backend: %w", err)
+	}
+
+	namespaces := make(map[string]NamespaceOPT, len(c.Namespaces))
+	for name, namespace := range c.Namespaces {
+		key, err := namespace.Key.read()
+		if err != nil {
+			return nil, fmt.Errorf("config: namespaces.%s.key: %w", name, err)
+		}
+		namespaces[name] = NamespaceOPT{
+			EncryptionKey: key,
+			Quota:         int64(namespace.Quota),
+			Policy:        NamespacePolicy(namespace.Policy),
+		}
+	}
+
+	var accessControl *AccessControl
+	if c.Auth.PeerSecret.sources() > 0 {
+		secret, err := c.Auth.PeerSecret.read()
+		if err != nil {
+			return nil, fmt.Errorf("config: auth.peer_secret: %w", err)
+		}
+		accessControl = &AccessControl{PeerSecret: secret}
+		for _, principal := range c.Auth.Principals {
+			grants := make([]Grant, 0, len(principal.Grants))
+			for _, grant := range principal.Grants {
+				g := Grant{Namespace: grant.Namespace, Prefix: grant.Prefix}
+				for _, permission := range grant.Permissions {
+					g.Permissions = append(g.Permissions, Permission(permission))
+				}
+				grants = append(grants, g)
+			}
+			accessControl.Principals = append(accessControl.Principals, Principal{
+				Name:        principal.Name,
+				TokenSHA256: principal.TokenSHA256,
+				Grants:      grants,
+			})
+		}
+	}
+
+	var auditLog *AuditLog
+	if c.Audit.Dir != "" {
+		auditLog, err = NewAuditLog(AuditLogOPT{Dir: c.Audit.Dir, MaxSize: int64(c.Audit.MaxSize)})
+		if err != nil {
+			return nil, fmt.Errorf("config: audit: %w", err)
+		}
+	}
+
+	server := NewFileServer(FileServerOPT{
+		EncryptionKey:       encryptionKey,
+		Crypto:              ciphers[c.Cipher](),
+		Compression:         c.Compression,
+		RootDir:             rootDir,
+		PathTranformFunc:    pathTransforms[c.PathTransform],
+		Backend:             backend,
+		Transport:           tcpTransport,
+		BootstrapNodes:      c.Bootstrap,
+		IsBootstrapNode:     c.BootstrapNode,
+		ScrubInterval:       c.Scrub.Interval,
+		ScrubRate:           int64(c.Scrub.Rate),
+		ExpiryInterval:      c.Expiry.Interval,
+		MaxFileSize:         int64(c.Limits.MaxFileSize),
+		Capacity:            int64(c.Limits.Capacity),
+		MinFreeSpace:        int64(c.Limits.MinFreeSpace),
+		Namespaces:          namespaces,
+		AccessControl:       accessControl,
+		AuditLog:            auditLog,
+		PeerResponseTimeout: c.Timeouts.PeerResponse,
+		ShutdownTimeout:     c.Timeouts.Shutdown,
+		Logger:              logger,
+	})
+
+	tcptransportOpts.OnPeer = server.OnPeer
+	tcptransportOpts.OnPeerDisconnect = server.OnPeerDisconnect
+
+	return server, nil
+}
+
+// decodeKey decodes a hex encoded 32 byte key, ignoring surrounding whitespace.
+func decodeKey(s string) ([]byte, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("must hold a hex encoded key: %w", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("must hold a 32 byte key, got %d bytes", len(key))
+	}
+	return key, nil
+}
+
+// ByteSize is a number of bytes. In config files and environment variables it
+// is written as a plain number or with a unit, e.g. "512KiB" or "10MB".
+type ByteSize int64
+
+var byteSizeUnits = []struct {
+	suffix string
+	size   int64
+}{
+	// Longer suffixes first, so that "MiB" is not taken for "B".
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+	{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+	{"B", 1},
+}
+
+// ParseByteSize parses a size such as "100MiB", "10MB" or "4096".
+func ParseByteSize(s string) (ByteSize, error) {
+	number := strings.TrimSpace(s)
+	multiplier := int64(1)
+	for _, unit := range byteSizeUnits {
+		if n, ok := strings.CutSuffix(number, unit.suffix); ok {
+			number, multiplier = strings.TrimSpace(n), unit.size
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return ByteSize(n * multiplier), nil
+}
+
+func (b *ByteSize) UnmarshalYAML(value *yaml.Node) error {
+	size, err := ParseByteSize(value.Value)
+	if err != nil {
+		return fmt.Errorf("line %d: %w", value.Line, err)
+	}
+	*b = size
+	return nil
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func choices[K ~string, V any](m map[K]V) string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, string(name))
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "fs.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := writeConfig(t, `
+listen: ":4070"
+bootstrap: [":3000", ":4000"]
+root_dir: /tmp/fs-4070
+path_transform: plain
+key:
+  hex: 0e025d3db7b1f1fadbcd1b8ec9a45f99a10a3f1f2731abfa689f9142754628ec
+limits:
+  max_file_size: 1GiB
+timeouts:
+  peer_response: 2s
+scrub:
+  interval: 1h
+  rate: 10MB
+namespaces:
+  team-a:
+    key:
+      hex: a10a3f1f2731abfa689f9142754628ec0e025d3db7b1f1fadbcd1b8ec9a45f99
+    quota: 10GiB
+    policy: read-only
+auth:
+  peer_secret:
+    hex: 5f1a3f1f2731abfa689f9142754628ec0e025d3db7b1f1fadbcd1b8ec9a45f00
+  principals:
+    - name: ci
+      token_sha256: 9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08
+      grants:
+        - namespace: team-a
+          prefix: builds/
+          permissions: [read, write]
+`)
+	t.Setenv("FS_LISTEN", ":4071")
+	t.Setenv("FS_DIAL_TIMEOUT", "3s")
+
+	c, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Listen != ":4071" {
+		t.Errorf("listen: got %q, want the environment override", c.Listen)
+	}
+	if len(c.Bootstrap) != 2 || c.RootDir != "/tmp/fs-4070" || c.PathTransform != "plain" || c.Cipher != "aes-ctr" {
+		t.Errorf("got %+v", c)
+	}
+	if c.Limits.MaxFileSize != 1<<30 || c.Scrub.Rate != 10e6 {
+		t.Errorf("sizes: got %d and %d", c.Limits.MaxFileSize, c.Scrub.Rate)
+	}
+	if c.Timeouts.Dial != 3*time.Second || c.Timeouts.PeerResponse != 2*time.Second || c.Scrub.Interval != time.Hour {
+		t.Errorf("durations: got %+v and %v", c.Timeouts, c.Scrub.Interval)
+	}
+
+	server, err := c.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.Config.RootDir != "/tmp/fs-4070" || len(server.Config.EncryptionKey) != 32 || server.Config.MaxFileSize != 1<<30 {
+		t.Errorf("built server with %+v", server.Config)
+	}
+	if ns := server.Config.Namespaces["team-a"]; len(ns.EncryptionKey) != 32 || ns.Quota != 10<<30 || ns.Policy != PolicyReadOnly {
+		t.Errorf("built namespace with %+v", ns)
+	}
+	ac := server.Config.AccessControl
+	if ac == nil || len(ac.PeerSecret) != 32 || len(ac.Principals) != 1 {
+		t.Fatalf("built access control with %+v", ac)
+	}
+	if principal, err := ac.Authenticate("test"); err != nil || !principal.Allows(PermissionWrite, "team-a", "builds/1") {
+		t.Errorf("built principal %+v, %v", principal, err)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		env     map[string]string
+		want    []string
+	}{
+		{
+			name:    "unknown field",
+			content: "listen: \":3000\"\nlisten_address: \":4000\"\n",
+			want:    []string{"field listen_address not found"},
+		},
+		{
+			name: "invalid settings",
+			content: `
+path_transform: md5
+cipher: rot13
+compression: brotli
+key:
+  hex: abcd
+  file: cluster.key
+limits:
+  capacity: -1
+timeouts:
+  peer_response: 0s
+expiry:
+  interval: 0s
+bandwidth:
+  per_peer: -1
+log:
+  level: loud
+  format: xml
+`,
+			want: []string{
+				`path_transform: unknown value "md5", expected one of hash, plain`,
+				`cipher: unknown value "rot13", expected one of aes-ctr`,
+				`compression: unknown value "brotli", expected one of auto, gzip, none, zstd`,
+				"key: set only one of hex, file and env",
+				"key.hex: must hold a 32 byte key, got 2 bytes",
+				"limits.capacity: must not be negative",
+				"timeouts.peer_response: must be positive",
+				"expiry.interval: must be positive",
+				"bandwidth.per_peer: must not be negative",
+				`log.level: unknown value "loud"`,
+				`log.format: unknown value "xml", expected one of json, text`,
+			},
+		},
+		{
+			name:    "s3 backend without bucket",
+			content: "backend:\n  type: s3\n  s3:\n    access_key: AKID\n",
+			want: []string{
+				"backend.s3.bucket: must not be empty",
+				"backend.s3: set both access_key and secret_key, or neither",
+			},
+		},
+		{
+			name: "invalid namespaces",
+			content: `
+namespaces:
+  Team_A:
+    key:
+      env: TEAM_A_KEY
+  team-b:
+    quota: -1
+    policy: append-only
+`,
+			want: []string{
+				`namespaces.Team_A: invalid name "Team_A"`,
+				"namespaces.team-b.key: set one of hex, file and env",
+				"namespaces.team-b.quota: must not be negative",
+				`namespaces.team-b.policy: unknown value "append-only", expected one of read-only, read-write, write-once`,
+			},
+		},
+		{
+			name: "invalid auth",
+			content: `
+auth:
+  principals:
+    - name: ci
+      token_sha256: not-a-hash
+      grants:
+        - namespace: missing
+          permissions: [read, owner, admin]
+    - name: ci
+`,
+			want: []string{
+				"auth.principals: require auth.peer_secret",
+				"auth.principals[0].token_sha256: must hold a hex encoded SHA-256",
+				`auth.principals[0].grants[0].namespace: unknown namespace "missing"`,
+				`auth.principals[0].grants[0].permissions: unknown value "owner", expected one of admin, delete, read, write`,
+				`auth.principals[0].grants[0].permissions: admin is only granted for namespace "*" without a prefix`,
+				`auth.principals[1].name: duplicate principal "ci"`,
+			},
+		},
+		{
+			name:    "unknown backend",
+			content: "listen: \":3000\"\n",
+			env:     map[string]string{"FS_BACKEND": "tape"},
+			want:    []string{`backend.type: unknown value "tape", expected one of disk, log, memory, s3`},
+		},
+		{
+			name:    "invalid environment",
+			content: "listen: \":3000\"\n",
+			env:     map[string]string{"FS_MAX_FILE_SIZE": "lots"},
+			want:    []string{`invalid FS_MAX_FILE_SIZE="lots"`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+
+			_, err := LoadConfig(writeConfig(t, tt.content))
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q does not mention %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+// A node without a configured key keeps the key generated the first time.
+func TestGeneratedEncryptionKey(t *testing.T) {
+	c := DefaultConfig()
+	c.Listen = ":4520"
+	c.RootDir = t.TempDir()
+
+	first, err := c.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Join(c.RootDir, generatedKeyFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o600 {
+		t.Errorf("key file mode: got %v, want 0600", info.Mode().Perm())
+	}
+
+	second, err := c.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first.Config.EncryptionKey) != 32 || string(first.Config.EncryptionKey) != string(second.Config.EncryptionKey) {
+		t.Error("the generated key changed when the node was built again")
+	}
+}
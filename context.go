@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	// defaultPeerResponseTimeout is how long a peer is given to announce the
+	// size of a requested file when FileServerOPT.PeerResponseTimeout is not set.
+	defaultPeerResponseTimeout = 5 * time.Second
+
+	// defaultMaxFileSize is the largest file accepted from a peer when
+	// FileServerOPT.MaxFileSize is not set.
+	defaultMaxFileSize = 100 * 1024 * 1024 // 100 MB
+
+	// defaultShutdownTimeout is how long Stop waits for in-flight requests
+	// when FileServerOPT.ShutdownTimeout is not set.
+	defaultShutdownTimeout = 10 * time.Second
+
+	// defaultExpiryInterval is the pause between two passes of the reaper
+	// when FileServerOPT.ExpiryInterval is not set.
+	defaultExpiryInterval = time.Minute
+)
+
+// contextReader stops reading from r once its context is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	n, err := c.r.Read(p)
+	// The read may have been unblocked by the context being done.
+	if ctxErr := c.ctx.Err(); ctxErr != nil {
+		return n, ctxErr
+	}
+	return n, err
+}
+
+// interruptOnDone sets a deadline in the past on conn once ctx is done, which
+// unblocks any read or write pending on it. The returned function must be
+// called once the transfer is over. It returns false if the connection was
+// interrupted, in which case its stream is in an unknown state.
+func interruptOnDone(ctx context.Context, conn net.Conn) func() bool {
+	return context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+}
+
+// sleepContext pauses for d or until the context is done, whichever comes first.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// runReaper deletes the expired files every interval until quitCh is closed.
+func (s *FileServer) runReaper(interval time.Duration, quitCh <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.DeleteExpired()
+		case <-quitCh:
+			return
+		}
+	}
+}
+
+// DeleteExpired deletes the expired files of every namespace from this node
+// and returns how many were deleted. Expired files are no longer served even
+// before they are deleted.
+//
+// Every replica records the same expiry time, so each node deletes its own
+// replicas and the file disappears from the whole cluster without the nodes
+// having to agree on it.
+func (s *FileServer) DeleteExpired() int {
+	ctx, done, err := s.begin(context.Background())
+	if err != nil {
+		return 0
+	}
+	defer done()
+
+	var deleted int
+	now := time.Now()
+	for _, ns := range s.openNamespaces() {
+		metas, err := ns.storage.DeleteExpired(now)
+		if err != nil {
+			s.logger().Warn("Failed to delete expired files", "namespace", ns.name, "error", err)
+		}
+		for _, meta := range metas {
+			s.audit(ctx, AuditRecord{Action: "expire", Namespace: ns.name, Key: meta.Key, Size: s.objectInfo(meta).Size}, nil)
+			s.logger().Debug("Deleted expired file", "key", ns.qualify(meta.Key), "expiredAt", meta.ExpiresAt)
+		}
+		deleted += len(metas)
+	}
+	if deleted == 0 {
+		return 0
+	}
+
+	s.metrics.filesExpired.Add(float64(deleted))
+	s.capacityChanged(ctx)
+	s.logger().Info("Deleted expired files", "files", deleted)
+	return deleted
+}
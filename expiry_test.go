@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestExpiry(t *testing.T) {
+	servers := make([]*FileServer, 2)
+	for i, address := range []string{"127.0.0.15:4190", "127.0.0.15:4191"} {
+		var server *FileServer
+		if i == 0 {
+			server = makeServer(address, true)
+		} else {
+			server = makeServer(address, false, "127.0.0.15:4190")
+		}
+		startServer(t, server)
+		t.Cleanup(func() {
+			server.Stop()
+			server.Storage.Clear()
+		})
+		servers[i] = server
+	}
+	time.Sleep(30 * time.Millisecond)
+
+	data := generateRandomData(16 * 1024)
+	if err := servers[1].StoreWithOptions(t.Context(), "artifact", bytes.NewReader(data), StoreOptions{TTL: 300 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	if err := servers[1].Store("kept", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	// The replica records the same expiry time as the original.
+	local, err := servers[1].Storage.Stat("artifact")
+	if err != nil {
+		t.Fatal(err)
+	}
+	replica, err := servers[0].Storage.Stat("artifact")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if local.ExpiresAt.IsZero() || !replica.ExpiresAt.Equal(local.ExpiresAt) {
+		t.Errorf("expiry time: got %v on the replica, want %v", replica.ExpiresAt, local.ExpiresAt)
+	}
+	if info, err := servers[0].Stat("artifact"); err != nil || !info.ExpiresAt.Equal(local.ExpiresAt) {
+		t.Errorf("Stat: got %+v, %v", info, err)
+	}
+
+	time.Sleep(time.Until(local.ExpiresAt))
+
+	// Expired files are not found even before the reaper deleted them.
+	for i, server := range servers {
+		if _, err := server.Get("artifact"); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Get on node %d: got %v, want fs.ErrNotExist", i, err)
+		}
+		if server.Storage.HasKey("artifact") {
+			t.Errorf("HasKey on node %d: the expired file is still reported", i)
+		}
+		if objects, _ := server.List(""); len(objects) != 1 || objects[0].Key != "kept" {
+			t.Errorf("List on node %d: got %+v", i, objects)
+		}
+	}
+
+	for i, server := range servers {
+		if n := server.DeleteExpired(); n != 1 {
+			t.Errorf("DeleteExpired on node %d: deleted %d files, want 1", i, n)
+		}
+		if _, err := server.Storage.Config.Backend.Stat("artifact"); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("the expired file is still stored on node %d: %v", i, err)
+		}
+		if !server.Storage.HasKey("kept") {
+			t.Errorf("the file without a TTL was deleted on node %d", i)
+		}
+	}
+}
+
+func TestGatewayTTL(t *testing.T) {
+	server := makeServer("127.0.0.15:4192", true)
+	startServer(t, server)
+	t.Cleanup(func() {
+		server.Stop()
+		server.Storage.Clear()
+	})
+
+	httpServer := httptest.NewServer(NewGateway(server))
+	defer httpServer.Close()
+
+	put := func(ttl string) int {
+		req, _ := http.NewRequest(http.MethodPut, httpServer.URL+"/objects/build.tar", bytes.NewReader([]byte("artifact")))
+		req.Header.Set(TTLHeader, ttl)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	for _, ttl := range []string{"soon", "-1h", "0s"} {
+		if status := put(ttl); status != http.StatusBadRequest {
+			t.Errorf("PUT with %s %q: got status %d, want 400", TTLHeader, ttl, status)
+		}
+	}
+
+	start := time.Now()
+	if status := put("1h"); status != http.StatusCreated {
+		t.Fatalf("PUT: got status %d", status)
+	}
+	info, err := server.Stat("build.tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := start.Add(time.Hour); info.ExpiresAt.Before(want) || info.ExpiresAt.After(want.Add(time.Minute)) {
+		t.Errorf("expiry time: got %v, want about %v", info.ExpiresAt, want)
+	}
+}
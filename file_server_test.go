@@ -2,11 +2,19 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"go-distributed-storage/p2p"
 	"io"
 	"log"
+	"log/slog"
 	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
 	"testing"
 	"time"
 )
@@ -21,7 +29,7 @@ func makeServer(listenAddress string, isBootstrapNode bool, bootstrapNode ...str
 	tcpTransport := p2p.NewTCPTransport(tcptransportOpts)
 
 	fileServerOpts := FileServerOPT{
-		encryptionKey:    []byte{0x0e, 0x02, 0x5d, 0x3d, 0xb7, 0xb1, 0xf1, 0xfa, 0xdb, 0xcd, 0x1b, 0x8e, 0xc9, 0xa4, 0x5f, 0x99, 0xa1, 0x0a, 0x3f, 0x1f, 0x27, 0x31, 0xab, 0xfa, 0x68, 0x9f, 0x91, 0x42, 0x75, 0x46, 0x28, 0xec},
+		EncryptionKey:    []byte{0x0e, 0x02, 0x5d, 0x3d, 0xb7, 0xb1, 0xf1, 0xfa, 0xdb, 0xcd, 0x1b, 0x8e, 0xc9, 0xa4, 0x5f, 0x99, 0xa1, 0x0a, 0x3f, 0x1f, 0x27, 0x31, 0xab, 0xfa, 0x68, 0x9f, 0x91, 0x42, 0x75, 0x46, 0x28, 0xec},
 		Crypto:           &BasicCrypto{},
 		RootDir:          listenAddress + "_network",
 		PathTranformFunc: HashPathBuilder,
@@ -33,6 +41,7 @@ func makeServer(listenAddress string, isBootstrapNode bool, bootstrapNode ...str
 	server := NewFileServer(fileServerOpts)
 
 	tcptransportOpts.OnPeer = server.OnPeer
+	tcptransportOpts.OnPeerDisconnect = server.OnPeerDisconnect
 
 	return server
 }
@@ -60,6 +69,12 @@ func TestFileServer(t *testing.T) {
 	addresses := []string{"127.0.0.5:5000", "127.0.0.5:7000", "127.0.0.5:9000"}
 	var servers []*FileServer
 	servers = append(servers, server) // Include the initial server
+	t.Cleanup(func() {
+		for _, s := range servers {
+			s.Stop()
+			s.Storage.Clear()
+		}
+	})
 
 	for _, addr := range addresses {
 		s := makeServer(addr, false, initialPeer)
@@ -114,6 +129,339 @@ func TestFileServer(t *testing.T) {
 	})
 }
 
+func TestGetRange(t *testing.T) {
+	nodeA := makeServer("127.0.0.5:4010", true)
+	go func() {
+		if err := nodeA.Start(); err != nil {
+			log.Fatalf("Failed to start server on 127.0.0.5:4010: %v", err)
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	nodeB := makeServer("127.0.0.5:4011", false, "127.0.0.5:4010")
+	go func() {
+		if err := nodeB.Start(); err != nil {
+			log.Fatalf("Failed to start server on 127.0.0.5:4011: %v", err)
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	defer nodeA.Storage.Clear()
+	defer nodeB.Storage.Clear()
+
+	key := "ranged_file"
+	content := generateRandomData(4096)
+	if err := nodeA.Store(key, bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	// Remove the replica so nodeB has to request the range from nodeA.
+	if err := nodeB.Storage.DeleteFile(key); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, node := range []*FileServer{nodeA, nodeB} {
+		r, err := node.GetRange(key, 1000, 123)
+		if err != nil {
+			t.Fatalf("%s: %v", node.Config.Transport.RemoteAddr(), err)
+		}
+		got, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, content[1000:1123]) {
+			t.Errorf("%s: range content mismatch", node.Config.Transport.RemoteAddr())
+		}
+	}
+
+	if nodeB.Storage.HasKey(key) {
+		t.Error("expected a remote range read not to store the file locally")
+	}
+
+	// A remote range closed before the end does not break the next requests.
+	r, err := nodeB.GetRange(key, 0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(r, make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	if _, err := nodeB.Stat(key); err != nil {
+		t.Errorf("stat after closing a remote range: %v", err)
+	}
+
+	// The peer refuses a range past the end of the file without making nodeB
+	// wait for its response timeout.
+	start := time.Now()
+	if _, err := nodeB.GetRange(key, 5000, 10); !errors.Is(err, ErrInvalidRange) {
+		t.Errorf("remote range past the end: got error %v, want ErrInvalidRange", err)
+	}
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Errorf("remote range past the end took %s", elapsed)
+	}
+
+	r, err = nodeA.GetRange(key, 4000, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	got, _ := io.ReadAll(r)
+	if !bytes.Equal(got, content[4000:]) {
+		t.Error("open ended range content mismatch")
+	}
+}
+
+func TestStoreReplicasAreIdentical(t *testing.T) {
+	nodeA := makeServer("127.0.0.5:4020", true)
+	go func() {
+		if err := nodeA.Start(); err != nil {
+			log.Fatalf("Failed to start server on 127.0.0.5:4020: %v", err)
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	nodeB := makeServer("127.0.0.5:4021", false, "127.0.0.5:4020")
+	go func() {
+		if err := nodeB.Start(); err != nil {
+			log.Fatalf("Failed to start server on 127.0.0.5:4021: %v", err)
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	defer nodeA.Storage.Clear()
+	defer nodeB.Storage.Clear()
+
+	key := "replicated_file"
+	if err := nodeA.Store(key, bytes.NewReader(generateRandomData(1024*1024))); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	metaA, err := nodeA.Storage.Stat(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metaB, err := nodeB.Storage.Stat(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metaA.Checksum != metaB.Checksum || metaA.Size != metaB.Size {
+		t.Errorf("replica differs from the local copy: %+v != %+v", metaB, metaA)
+	}
+}
+
+func TestConcurrentStores(t *testing.T) {
+	nodeA := makeServer("127.0.0.5:4060", true)
+	startServer(t, nodeA)
+	defer nodeA.Stop()
+	defer nodeA.Storage.Clear()
+
+	nodeB := makeServer("127.0.0.5:4061", false, "127.0.0.5:4060")
+	startServer(t, nodeB)
+	defer nodeB.Stop()
+	defer nodeB.Storage.Clear()
+	time.Sleep(30 * time.Millisecond)
+
+	// The stores share the connection to the peer.
+	files := make([][]byte, 4)
+	errs := make(chan error, len(files))
+	for i := range files {
+		files[i] = generateRandomData(512 * 1024)
+		go func() {
+			errs <- nodeB.Store(fmt.Sprintf("concurrent_%d", i), bytes.NewReader(files[i]))
+		}()
+	}
+	for range files {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	for i, data := range files {
+		key := fmt.Sprintf("concurrent_%d", i)
+		metaB, err := nodeB.Storage.Stat(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		metaA, err := nodeA.Storage.Stat(key)
+		if err != nil {
+			t.Fatalf("replica of %s: %v", key, err)
+		}
+		if metaA.Checksum != metaB.Checksum {
+			t.Errorf("replica of %s differs from the local copy", key)
+		}
+
+		r, err := nodeA.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("replica of %s: got %d bytes that differ from the %d bytes stored", key, len(got), len(data))
+		}
+	}
+}
+
+func TestInvalidKeys(t *testing.T) {
+	// With the plain path transform, keys are used as paths under the root.
+	root := t.TempDir()
+	server := makeServer("127.0.0.5:4070", true)
+	server.Storage = *NewStorage(StoreOPT{RootDir: filepath.Join(root, "data"), PathTranformFunc: DefaultPathBuilder})
+	startServer(t, server)
+	defer server.Stop()
+
+	for _, key := range []string{"docs/a", "docs/b"} {
+		if err := server.Store(key, bytes.NewReader([]byte(key))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := server.Delete("docs/a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Stat("docs/a"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Stat after Delete: got %v, want os.ErrNotExist", err)
+	}
+	if !server.Storage.HasKey("docs/b") {
+		t.Error("deleting docs/a removed docs/b")
+	}
+
+	for _, key := range []string{"", "../escape", "docs/../../escape", "/etc/escape", "docs//a", "docs/", "./docs/b"} {
+		if err := server.Store(key, bytes.NewReader([]byte("data"))); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Store(%q): got %v, want ErrInvalidKey", key, err)
+		}
+		if _, err := server.Get(key); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Get(%q): got %v, want ErrInvalidKey", key, err)
+		}
+		if _, err := server.Stat(key); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Stat(%q): got %v, want ErrInvalidKey", key, err)
+		}
+		if err := server.Delete(key); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Delete(%q): got %v, want ErrInvalidKey", key, err)
+		}
+	}
+
+	entries, _ := os.ReadDir(root)
+	if len(entries) != 1 || entries[0].Name() != "data" {
+		t.Errorf("files were written outside of the root directory: %v", entries)
+	}
+	if !server.Storage.HasKey("docs/b") {
+		t.Error("an invalid key removed docs/b")
+	}
+}
+
+// blockingReader yields a few bytes and then blocks until it is closed.
+type blockingReader struct {
+	sent    bool
+	closeCh chan struct{}
+}
+
+func (b *blockingReader) Read(p []byte) (int, error) {
+	if !b.sent {
+		b.sent = true
+		return copy(p, "partial"), nil
+	}
+	<-b.closeCh
+	return 0, io.EOF
+}
+
+func TestContextCancellation(t *testing.T) {
+	nodeA := makeServer("127.0.0.5:4030", true)
+	go func() {
+		if err := nodeA.Start(); err != nil {
+			log.Fatalf("Failed to start server on 127.0.0.5:4030: %v", err)
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	nodeB := makeServer("127.0.0.5:4031", false, "127.0.0.5:4030")
+	go func() {
+		if err := nodeB.Start(); err != nil {
+			log.Fatalf("Failed to start server on 127.0.0.5:4031: %v", err)
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	defer nodeA.Storage.Clear()
+	defer nodeB.Storage.Clear()
+
+	t.Run("GetMissing", func(t *testing.T) {
+		// The peer answers that it does not hold the file instead of letting
+		// the request wait for PeerResponseTimeout.
+		start := time.Now()
+		_, err := nodeB.Get("missing_file")
+		if !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("expected a missing file, got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("Get waited for the peer that does not hold the file, took %s", elapsed)
+		}
+	})
+
+	t.Run("GetDeadline", func(t *testing.T) {
+		// A peer that never answers.
+		listener, err := net.Listen("tcp", "127.0.0.5:4032")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		go func() {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			io.Copy(io.Discard, conn)
+		}()
+		if err := nodeB.Config.Transport.Dial("127.0.0.5:4032"); err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		_, err = nodeB.GetContext(ctx, "missing_file")
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected deadline exceeded, got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("GetContext did not honor the deadline, took %s", elapsed)
+		}
+	})
+
+	t.Run("StoreDeadline", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		r := &blockingReader{closeCh: make(chan struct{})}
+		go func() {
+			<-ctx.Done()
+			close(r.closeCh)
+		}()
+
+		err := nodeA.StoreContext(ctx, "cancelled_file", r)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected deadline exceeded, got %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+
+		if nodeA.Storage.HasKey("cancelled_file") {
+			t.Error("expected the partial local copy to be removed")
+		}
+		if nodeB.Storage.HasKey("cancelled_file") {
+			t.Error("expected the peer to discard the aborted stream")
+		}
+	})
+}
+
 func TestMultiHopFileRequest(t *testing.T) {
 	// This test simulates a multi-hop file request in a peer-to-peer network.
 	// NodeA acts as the bootstrap node, while NodeB and NodeC represent other nodes in the network.
@@ -152,6 +500,12 @@ func TestMultiHopFileRequest(t *testing.T) {
 
 	// Create NodeB (the requester node)
 	nodeB := makeServer("127.0.0.5:5000", false, initialPeer)
+	t.Cleanup(func() {
+		for _, node := range []*FileServer{nodeA, nodeB, nodeC} {
+			node.Stop()
+			node.Storage.Clear()
+		}
+	})
 
 	// Store a file in NodeC
 	fileName := "mybigfile"
@@ -160,13 +514,23 @@ func TestMultiHopFileRequest(t *testing.T) {
 		t.Error(err)
 	}
 
+	// NodeA tells NodeB about NodeC once NodeC has introduced itself, which it
+	// may do after the store.
+	for start := time.Now(); !slices.Contains(nodeA.PeersAddresses(), "127.0.0.5:7000"); {
+		if time.Since(start) > time.Second {
+			t.Fatal("NodeA did not learn NodeC's address")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
 	// Start NodeB after the file has been stored
 	go func() {
 		if err := nodeB.Start(); err != nil {
 			log.Fatalf("Failed to start server on 127.0.0.5:5000: %v", err)
 		}
 	}()
-	time.Sleep(5 * time.Millisecond)
+	// Give NodeB time to learn NodeC's address from NodeA and connect to it.
+	time.Sleep(50 * time.Millisecond)
 
 	// Simulate NodeA deleting the file from its storage
 	if err := nodeA.Storage.DeleteFile(fileName); err != nil {
@@ -192,6 +556,12 @@ func TestComplexDFSScenario(t *testing.T) {
 		"127.0.0.5:6000",
 		"127.0.0.5:7000",
 	}
+	t.Cleanup(func() {
+		for _, node := range nodes {
+			node.Stop()
+			node.Storage.Clear()
+		}
+	})
 
 	// Start all nodes
 	for i, addr := range addresses {
@@ -330,3 +700,35 @@ func TestComplexDFSScenario(t *testing.T) {
 
 	fmt.Println("Complex DFS test completed successfully")
 }
+
+func TestFileServerLogger(t *testing.T) {
+	var buf bytes.Buffer
+	server := makeServer("127.0.0.5:4110", true)
+	server.Config.Logger = slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	go func() {
+		if err := server.Start(); err != nil {
+			log.Fatalf("Failed to start server on 127.0.0.5:4110: %v", err)
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	defer server.Storage.Clear()
+
+	if err := server.Store("logged_file", bytes.NewReader(generateRandomData(100))); err != nil {
+		t.Fatal(err)
+	}
+
+	var found bool
+	for _, line := range bytes.Split(buf.Bytes(), []byte("\n")) {
+		var record map[string]any
+		if json.Unmarshal(line, &record) != nil || record["msg"] != "Stored file" {
+			continue
+		}
+		found = true
+		if record["level"] != "DEBUG" || record["node"] != "127.0.0.5:4110" || record["key"] != "logged_file" || record["bytes"] == nil || record["duration"] == nil {
+			t.Errorf("got record %v", record)
+		}
+	}
+	if !found {
+		t.Errorf("no record for the stored file in:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import "errors"
+
+// freeSpace is not supported on this platform, so only the configured
+// capacity limits the storage.
+func freeSpace(dir string) (int64, error) {
+	return 0, errors.ErrUnsupported
+}
@@ -0,0 +1,27 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// freeSpace returns the bytes available to unprivileged users on the file
+// system holding dir, or on its closest existing parent.
+func freeSpace(dir string) (int64, error) {
+	for {
+		var stat syscall.Statfs_t
+		err := syscall.Statfs(dir, &stat)
+		if err == nil {
+			return int64(stat.Bavail) * int64(stat.Bsize), nil
+		}
+		parent := filepath.Dir(dir)
+		if !errors.Is(err, os.ErrNotExist) || parent == dir {
+			return 0, err
+		}
+		dir = parent
+	}
+}
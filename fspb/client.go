@@ -0,0 +1,86 @@
+// Package fspb holds the gRPC API of a storage node: the generated
+// FileService client and server stubs, and helpers that turn its streams into
+// io.Reader based calls.
+package fspb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative fs.proto
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// UploadChunkSize is the size of the chunks Upload sends.
+const UploadChunkSize = 64 * 1024
+
+// Upload stores the content of r under key through a Put stream.
+func Upload(ctx context.Context, client FileServiceClient, key string, r io.Reader) (*ObjectInfo, error) {
+	stream, err := client.Put(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, UploadChunkSize)
+	req := &PutRequest{Key: key}
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 || req.Key != "" {
+			req.Chunk = buf[:n]
+			if err := stream.Send(req); err != nil {
+				// The server ended the stream, its error is returned by CloseAndRecv.
+				break
+			}
+			req = &PutRequest{}
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			stream.CloseSend()
+			return nil, err
+		}
+	}
+
+	resp, err := stream.CloseAndRecv()
+	if err != nil {
+		return nil, err
+	}
+	return resp.GetObject(), nil
+}
+
+// Download requests a file, or a range of it, and returns its info along with
+// a reader of its content. The download is cancelled with the context.
+func Download(ctx context.Context, client FileServiceClient, req *GetRequest) (*ObjectInfo, io.Reader, error) {
+	stream, err := client.Get(ctx, req)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The first message carries the object info, or the error of the call.
+	first, err := stream.Recv()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return first.GetObject(), &downloadReader{stream: stream, chunk: first.GetChunk()}, nil
+}
+
+type downloadReader struct {
+	stream FileService_GetClient
+	chunk  []byte
+}
+
+func (r *downloadReader) Read(p []byte) (int, error) {
+	for len(r.chunk) == 0 {
+		msg, err := r.stream.Recv()
+		if err != nil {
+			return 0, err
+		}
+		r.chunk = msg.GetChunk()
+	}
+
+	n := copy(p, r.chunk)
+	r.chunk = r.chunk[n:]
+	return n, nil
+}
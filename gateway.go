@@ -0,0 +1,395 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-distributed-storage/p2p"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Gateway exposes a FileServer over HTTP so that it can be used by services
+// that do not link the Go package. Request and response bodies are streamed
+// straight into Store and out of Get.
+//
+// Routes:
+//   - PUT    /objects/{key}  stores the request body under key, expiring after the X-FS-TTL header when set.
+//     Its Content-Type, X-FS-Tags and X-FS-Meta-* headers are recorded and returned by GET and HEAD.
+//   - GET    /objects/{key}  returns the file, honoring a single "Range: bytes=" header.
+//   - GET    /objects/{key}?stat returns the metadata of the file in JSON, without its body.
+//   - HEAD   /objects/{key}  returns the size of the file without its body.
+//   - DELETE /objects/{key}  deletes the file on this node and its peers.
+//   - GET    /objects        lists the stored files, optionally filtered by ?prefix= and ?tag=name=value.
+//   - GET    /metrics        serves the metrics of the node in the Prometheus format.
+//
+// The object routes act on the namespace named by the X-FS-Namespace header,
+// or on DefaultNamespace without it. When the server has an AccessControl,
+// they require an "Authorization: Bearer <token>" header.
+type Gateway struct {
+	server *FileServer
+	mux    *http.ServeMux
+}
+
+func NewGateway(server *FileServer) *Gateway {
+	g := &Gateway{
+		server: server,
+		mux:    http.NewServeMux(),
+	}
+
+	g.mux.HandleFunc("PUT /objects/{key...}", g.authenticated(g.handlePut))
+	g.mux.HandleFunc("GET /objects/{key...}", g.authenticated(g.handleGet))
+	g.mux.HandleFunc("HEAD /objects/{key...}", g.authenticated(g.handleHead))
+	g.mux.HandleFunc("DELETE /objects/{key...}", g.authenticated(g.handleDelete))
+	g.mux.HandleFunc("GET /objects", g.authenticated(g.handleList))
+	g.mux.Handle("GET /metrics", server.MetricsHandler())
+
+	return g
+}
+
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.mux.ServeHTTP(w, r)
+}
+
+// NamespaceHeader names the namespace a request of the Gateway acts on.
+const NamespaceHeader = "X-FS-Namespace"
+
+// TTLHeader sets the time-to-live of an object stored by a PUT of the Gateway,
+// as a Go duration such as "36h".
+const TTLHeader = "X-FS-TTL"
+
+// CompressionHeader sets the compression of an object stored by a PUT of the
+// Gateway, one of the choices of StoreOptions.Compression.
+const CompressionHeader = "X-FS-Compression"
+
+// TagsHeader holds the tags of an object, written as a URL query such as
+// "env=ci&team=build". Headers starting with MetaHeaderPrefix, in its
+// canonical form, are custom metadata, recorded under their lower case name.
+// Both are recorded by a PUT and returned by GET and HEAD.
+const (
+	TagsHeader       = "X-FS-Tags"
+	MetaHeaderPrefix = "X-Fs-Meta-"
+)
+
+// namespace returns the namespace named by the request. On error the response
+// is written and nil is returned.
+func (g *Gateway) namespace(w http.ResponseWriter, r *http.Request) *Namespace {
+	ns, err := g.server.Namespace(r.Header.Get(NamespaceHeader))
+	if err != nil {
+		writeError(w, g.server.logger(), err)
+		return nil
+	}
+	return ns
+}
+
+// authenticated makes the requests passed to next for the principal holding
+// their bearer token. Requests without a valid token are refused when the
+// server has an AccessControl.
+func (g *Gateway) authenticated(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ac := g.server.Config.AccessControl
+		if ac == nil {
+			next(w, r)
+			return
+		}
+
+		principal, err := ac.Authenticate(bearerToken(r.Header.Get("Authorization")))
+		if err != nil {
+			g.server.auditDenied(r.Context(), "authenticate", r.Header.Get(NamespaceHeader), r.PathValue("key"), err)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="fs"`)
+			if r.Method == http.MethodHead {
+				w.WriteHeader(errorStatus(err))
+				return
+			}
+			writeError(w, g.server.logger(), err)
+			return
+		}
+		next(w, r.WithContext(WithPrincipal(r.Context(), principal)))
+	}
+}
+
+func (g *Gateway) handlePut(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	if key == "" {
+		http.Error(w, "missing object key", http.StatusBadRequest)
+		return
+	}
+	ns := g.namespace(w, r)
+	if ns == nil {
+		return
+	}
+
+	var opts StoreOptions
+	if ttl := r.Header.Get(TTLHeader); ttl != "" {
+		d, err := time.ParseDuration(ttl)
+		if err != nil || d <= 0 {
+			http.Error(w, "invalid "+TTLHeader+" header", http.StatusBadRequest)
+			return
+		}
+		opts.TTL = d
+	}
+	opts.ContentType = r.Header.Get("Content-Type")
+	opts.Compression = r.Header.Get(CompressionHeader)
+	if tags := r.Header.Get(TagsHeader); tags != "" {
+		var err error
+		if opts.Tags, err = ParseTags(tags); err != nil {
+			writeError(w, g.server.logger(), err)
+			return
+		}
+	}
+	for name, values := range r.Header {
+		if metaName, ok := strings.CutPrefix(name, MetaHeaderPrefix); ok {
+			if opts.Metadata == nil {
+				opts.Metadata = make(map[string]string)
+			}
+			opts.Metadata[strings.ToLower(metaName)] = values[0]
+		}
+	}
+
+	if err := ns.StoreWithOptions(r.Context(), key, r.Body, opts); err != nil {
+		writeError(w, g.server.logger(), err)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (g *Gateway) handleGet(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	if key == "" {
+		// GET /objects/ lists like GET /objects.
+		g.handleList(w, r)
+		return
+	}
+	ns := g.namespace(w, r)
+	if ns == nil {
+		return
+	}
+
+	info, err := ns.StatContext(r.Context(), key)
+	if err != nil {
+		writeError(w, g.server.logger(), err)
+		return
+	}
+	if r.URL.Query().Has("stat") {
+		writeJSON(w, g.server.logger(), http.StatusOK, info)
+		return
+	}
+
+	setObjectHeaders(w, info)
+
+	rangeHeader := r.Header.Get("Range")
+	if rangeHeader == "" {
+		body, err := ns.GetContext(r.Context(), key)
+		if err != nil {
+			writeError(w, g.server.logger(), err)
+			return
+		}
+		defer body.Close()
+
+		w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+		w.WriteHeader(http.StatusOK)
+		copyBody(w, g.server.logger(), body, key)
+		return
+	}
+
+	offset, length, err := parseRange(rangeHeader, info.Size)
+	if err != nil {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", info.Size))
+		http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+
+	body, err := ns.GetRangeContext(r.Context(), key, offset, length)
+	if err != nil {
+		writeError(w, g.server.logger(), err)
+		return
+	}
+	defer body.Close()
+
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, info.Size))
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	w.WriteHeader(http.StatusPartialContent)
+	copyBody(w, g.server.logger(), body, key)
+}
+
+func (g *Gateway) handleHead(w http.ResponseWriter, r *http.Request) {
+	ns, err := g.server.Namespace(r.Header.Get(NamespaceHeader))
+	if err != nil {
+		w.WriteHeader(errorStatus(err))
+		return
+	}
+
+	info, err := ns.StatContext(r.Context(), r.PathValue("key"))
+	if err != nil {
+		w.WriteHeader(errorStatus(err))
+		return
+	}
+
+	setObjectHeaders(w, info)
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	w.WriteHeader(http.StatusOK)
+}
+
+// setObjectHeaders sets the headers describing the object in a response to GET or HEAD.
+func setObjectHeaders(w http.ResponseWriter, info ObjectInfo) {
+	w.Header().Set("Accept-Ranges", "bytes")
+	contentType := info.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	if len(info.Tags) > 0 {
+		w.Header().Set(TagsHeader, FormatTags(info.Tags))
+	}
+	for name, value := range info.Metadata {
+		w.Header().Set(MetaHeaderPrefix+name, value)
+	}
+}
+
+func (g *Gateway) handleDelete(w http.ResponseWriter, r *http.Request) {
+	ns := g.namespace(w, r)
+	if ns == nil {
+		return
+	}
+
+	if err := ns.DeleteContext(r.Context(), r.PathValue("key")); err != nil {
+		writeError(w, g.server.logger(), err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (g *Gateway) handleList(w http.ResponseWriter, r *http.Request) {
+	ns := g.namespace(w, r)
+	if ns == nil {
+		return
+	}
+
+	var (
+		objects []ObjectInfo
+		err     error
+	)
+	prefix := r.URL.Query().Get("prefix")
+	if tag := r.URL.Query().Get("tag"); tag != "" {
+		// ?tag=name=value lists the objects carrying the tag.
+		name, value, _ := strings.Cut(tag, "=")
+		objects, err = ns.ListByTagContext(r.Context(), name, value)
+		objects = slices.DeleteFunc(objects, func(info ObjectInfo) bool {
+			return !strings.HasPrefix(info.Key, prefix)
+		})
+	} else {
+		objects, err = ns.ListContext(r.Context(), prefix)
+	}
+	if err != nil {
+		writeError(w, g.server.logger(), err)
+		return
+	}
+
+	writeJSON(w, g.server.logger(), http.StatusOK, map[string]any{
+		"objects": objects,
+	})
+}
+
+// parseRange parses a single range of an HTTP Range header ("bytes=a-b",
+// "bytes=a-" or "bytes=-n") and returns its offset and length within a file
+// of the given size.
+func parseRange(header string, size int64) (int64, int64, error) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return 0, 0, fmt.Errorf("unsupported range %q", header)
+	}
+
+	startStr, endStr, ok := strings.Cut(spec, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid range %q", header)
+	}
+
+	if size == 0 {
+		// An empty file has no byte to satisfy any range with.
+		return 0, 0, fmt.Errorf("invalid range %q", header)
+	}
+
+	if startStr == "" {
+		// Suffix range: the last n bytes.
+		n, err := strconv.ParseInt(endStr, 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, fmt.Errorf("invalid range %q", header)
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, n, nil
+	}
+
+	start, err := strconv.ParseInt(startStr, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, fmt.Errorf("invalid range %q", header)
+	}
+
+	end := size - 1
+	if endStr != "" {
+		end, err = strconv.ParseInt(endStr, 10, 64)
+		if err != nil || end < start {
+			return 0, 0, fmt.Errorf("invalid range %q", header)
+		}
+		if end > size-1 {
+			end = size - 1
+		}
+	}
+
+	return start, end - start + 1, nil
+}
+
+// copyBody streams a file to the response. Once the status line has been
+// written errors can only be logged.
+func copyBody(w io.Writer, logger *slog.Logger, body io.Reader, key string) {
+	if _, err := io.Copy(w, body); err != nil {
+		logger.Warn("Failed to stream file to client", "key", key, "error", err)
+	}
+}
+
+// errorStatus maps an error returned by the FileServer to an HTTP status code.
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, fs.ErrNotExist), errors.Is(err, ErrUnknownNamespace):
+		return http.StatusNotFound
+	case errors.Is(err, ErrUnauthenticated):
+		return http.StatusUnauthorized
+	case errors.Is(err, ErrAccessDenied):
+		return http.StatusForbidden
+	case errors.Is(err, ErrInvalidRange):
+		return http.StatusRequestedRangeNotSatisfiable
+	case errors.Is(err, ErrInvalidKey), errors.Is(err, ErrInvalidAttrs), errors.Is(err, ErrUnknownCompression), errors.Is(err, p2p.ErrInvalidBandwidthLimits):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrBandwidthUnsupported):
+		return http.StatusNotImplemented
+	case errors.Is(err, ErrServerClosed):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, ErrInsufficientStorage):
+		return http.StatusInsufficientStorage
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func writeError(w http.ResponseWriter, logger *slog.Logger, err error) {
+	writeJSON(w, logger, errorStatus(err), map[string]string{
+		"error": err.Error(),
+	})
+}
+
+func writeJSON(w http.ResponseWriter, logger *slog.Logger, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Warn("Failed to encode response", "error", err)
+	}
+}
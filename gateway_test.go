@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestGateway(t *testing.T) {
+	server := makeServer("127.0.0.5:4040", true)
+	go func() {
+		if err := server.Start(); err != nil {
+			log.Fatalf("Failed to start server on 127.0.0.5:4040: %v", err)
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	defer server.Storage.Clear()
+
+	gateway := httptest.NewServer(NewGateway(server))
+	defer gateway.Close()
+
+	content := generateRandomData(2048)
+	do := func(method, path string, body io.Reader, header http.Header) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(method, gateway.URL+path, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := do(http.MethodPut, "/objects/videos/clip.mp4", bytes.NewReader(content), nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("PUT: got status %d", resp.StatusCode)
+	}
+
+	resp = do(http.MethodGet, "/objects/videos/clip.mp4", nil, nil)
+	got, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(got, content) {
+		t.Errorf("GET: got status %d and %d bytes", resp.StatusCode, len(got))
+	}
+
+	resp = do(http.MethodGet, "/objects/videos/clip.mp4", nil, http.Header{"Range": {"bytes=100-199"}})
+	got, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent || !bytes.Equal(got, content[100:200]) {
+		t.Errorf("GET range: got status %d and %d bytes", resp.StatusCode, len(got))
+	}
+	if cr := resp.Header.Get("Content-Range"); cr != "bytes 100-199/2048" {
+		t.Errorf("GET range: got Content-Range %q", cr)
+	}
+
+	resp = do(http.MethodGet, "/objects/videos/clip.mp4", nil, http.Header{"Range": {"bytes=-48"}})
+	got, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !bytes.Equal(got, content[2000:]) {
+		t.Errorf("GET suffix range: got %d bytes", len(got))
+	}
+
+	resp = do(http.MethodGet, "/objects/videos/clip.mp4", nil, http.Header{"Range": {"bytes=5000-"}})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("GET out of range: got status %d", resp.StatusCode)
+	}
+
+	resp = do(http.MethodPut, "/objects/empty.txt", bytes.NewReader(nil), nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("PUT empty: got status %d", resp.StatusCode)
+	}
+	resp = do(http.MethodGet, "/objects/empty.txt", nil, http.Header{"Range": {"bytes=-48"}})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable || resp.Header.Get("Content-Range") != "bytes */0" {
+		t.Errorf("GET suffix range of an empty file: got status %d and Content-Range %q", resp.StatusCode, resp.Header.Get("Content-Range"))
+	}
+
+	resp = do(http.MethodHead, "/objects/videos/clip.mp4", nil, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.ContentLength != int64(len(content)) {
+		t.Errorf("HEAD: got status %d and length %d", resp.StatusCode, resp.ContentLength)
+	}
+
+	resp = do(http.MethodGet, "/objects?prefix=videos/", nil, nil)
+	var list struct {
+		Objects []ObjectInfo `json:"objects"`
+	}
+	json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if len(list.Objects) != 1 || list.Objects[0].Key != "videos/clip.mp4" || list.Objects[0].Size != int64(len(content)) {
+		t.Errorf("LIST: got %+v", list.Objects)
+	}
+
+	resp = do(http.MethodDelete, "/objects/videos/clip.mp4", nil, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("DELETE: got status %d", resp.StatusCode)
+	}
+
+	resp = do(http.MethodHead, "/objects/videos/clip.mp4", nil, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("HEAD after DELETE: got status %d", resp.StatusCode)
+	}
+}
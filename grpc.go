@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"go-distributed-storage/fspb"
+	"io"
+	"io/fs"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// grpcChunkSize is the size of the chunks Get streams to clients.
+const grpcChunkSize = 64 * 1024
+
+// GRPCService implements fspb.FileServiceServer on top of a FileServer. Uploads
+// and downloads are streamed straight into StoreContext and out of GetContext.
+// Calls act on the namespace named by the fs-namespace metadata, or on
+// DefaultNamespace without it. When the server has an AccessControl, they
+// require an "authorization: Bearer <token>" metadata.
+type GRPCService struct {
+	fspb.UnimplementedFileServiceServer
+	server *FileServer
+}
+
+func NewGRPCService(server *FileServer) *GRPCService {
+	return &GRPCService{server: server}
+}
+
+// namespaceMetadata is the metadata key naming the namespace of a call.
+const namespaceMetadata = "fs-namespace"
+
+// authorizationMetadata is the metadata key carrying the API token of a call.
+const authorizationMetadata = "authorization"
+
+// authenticate returns the context of the call made for the principal holding
+// its token, and the namespace named by its metadata.
+func (g *GRPCService) authenticate(ctx context.Context) (context.Context, *Namespace, error) {
+	var name string
+	if values := metadata.ValueFromIncomingContext(ctx, namespaceMetadata); len(values) > 0 {
+		name = values[0]
+	}
+
+	if ac := g.server.Config.AccessControl; ac != nil {
+		var token string
+		if values := metadata.ValueFromIncomingContext(ctx, authorizationMetadata); len(values) > 0 {
+			token = bearerToken(values[0])
+		}
+		principal, err := ac.Authenticate(token)
+		if err != nil {
+			g.server.auditDenied(ctx, "authenticate", name, "", err)
+			return nil, nil, grpcError(err)
+		}
+		ctx = WithPrincipal(ctx, principal)
+	}
+
+	ns, err := g.server.Namespace(name)
+	if err != nil {
+		return nil, nil, grpcError(err)
+	}
+	return ctx, ns, nil
+}
+
+func (g *GRPCService) Put(stream fspb.FileService_PutServer) error {
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	key := first.GetKey()
+	if key == "" {
+		return status.Error(codes.InvalidArgument, "the first message must carry the object key")
+	}
+
+	ctx, ns, err := g.authenticate(stream.Context())
+	if err != nil {
+		return err
+	}
+
+	body := &putStreamReader{stream: stream, chunk: first.GetChunk()}
+	if err := ns.StoreContext(ctx, key, body); err != nil {
+		return grpcError(err)
+	}
+
+	info, err := ns.StatContext(ctx, key)
+	if err != nil {
+		return grpcError(err)
+	}
+	return stream.SendAndClose(&fspb.PutResponse{Object: objectInfoProto(info)})
+}
+
+// putStreamReader reads the chunks of a Put stream.
+type putStreamReader struct {
+	stream fspb.FileService_PutServer
+	chunk  []byte
+}
+
+func (r *putStreamReader) Read(p []byte) (int, error) {
+	for len(r.chunk) == 0 {
+		msg, err := r.stream.Recv()
+		if err != nil {
+			return 0, err
+		}
+		r.chunk = msg.GetChunk()
+	}
+
+	n := copy(p, r.chunk)
+	r.chunk = r.chunk[n:]
+	return n, nil
+}
+
+func (g *GRPCService) Get(req *fspb.GetRequest, stream fspb.FileService_GetServer) error {
+	ctx, ns, err := g.authenticate(stream.Context())
+	if err != nil {
+		return err
+	}
+
+	info, err := ns.StatContext(ctx, req.GetKey())
+	if err != nil {
+		return grpcError(err)
+	}
+
+	var body io.ReadCloser
+	if req.GetOffset() > 0 || req.GetLength() > 0 {
+		length := req.GetLength()
+		if length <= 0 {
+			length = -1
+		}
+		body, err = ns.GetRangeContext(ctx, req.GetKey(), req.GetOffset(), length)
+	} else {
+		body, err = ns.GetContext(ctx, req.GetKey())
+	}
+	if err != nil {
+		return grpcError(err)
+	}
+	defer body.Close()
+
+	resp := &fspb.GetResponse{Object: objectInfoProto(info)}
+	buf := make([]byte, grpcChunkSize)
+	for {
+		n, err := io.ReadFull(body, buf)
+		if n > 0 || resp.Object != nil {
+			resp.Chunk = buf[:n]
+			if err := stream.Send(resp); err != nil {
+				return err
+			}
+			resp = &fspb.GetResponse{}
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil
+		}
+		if err != nil {
+			return grpcError(err)
+		}
+	}
+}
+
+func (g *GRPCService) Delete(ctx context.Context, req *fspb.DeleteRequest) (*fspb.DeleteResponse, error) {
+	ctx, ns, err := g.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := ns.DeleteContext(ctx, req.GetKey()); err != nil {
+		return nil, grpcError(err)
+	}
+	return &fspb.DeleteResponse{}, nil
+}
+
+func (g *GRPCService) Stat(ctx context.Context, req *fspb.StatRequest) (*fspb.ObjectInfo, error) {
+	ctx, ns, err := g.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	info, err := ns.StatContext(ctx, req.GetKey())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return objectInfoProto(info), nil
+}
+
+func (g *GRPCService) List(ctx context.Context, req *fspb.ListRequest) (*fspb.ListResponse, error) {
+	ctx, ns, err := g.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	objects, err := ns.ListContext(ctx, req.GetPrefix())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	resp := &fspb.ListResponse{Objects: make([]*fspb.ObjectInfo, len(objects))}
+	for i, info := range objects {
+		resp.Objects[i] = objectInfoProto(info)
+	}
+	return resp, nil
+}
+
+func (g *GRPCService) WatchMembership(req *fspb.WatchMembershipRequest, stream fspb.FileService_WatchMembershipServer) error {
+	if _, _, err := g.authenticate(stream.Context()); err != nil {
+		return err
+	}
+	events := g.server.WatchMembership(stream.Context())
+	for event := range events {
+		eventType := fspb.MembershipEvent_LEFT
+		if event.Joined {
+			eventType = fspb.MembershipEvent_JOINED
+		}
+		if err := stream.Send(&fspb.MembershipEvent{
+			Type:    eventType,
+			Address: event.Address,
+			Time:    timestamppb.New(event.Time),
+		}); err != nil {
+			return err
+		}
+	}
+
+	if err := stream.Context().Err(); err != nil {
+		return status.FromContextError(err).Err()
+	}
+	return status.Error(codes.ResourceExhausted, "membership watcher fell behind, watch again")
+}
+
+func objectInfoProto(info ObjectInfo) *fspb.ObjectInfo {
+	return &fspb.ObjectInfo{
+		Key:      info.Key,
+		Size:     info.Size,
+		Checksum: info.Checksum,
+		ModTime:  timestamppb.New(info.ModTime),
+	}
+}
+
+// grpcError maps an error returned by the FileServer to a gRPC status.
+func grpcError(err error) error {
+	switch {
+	case errors.Is(err, fs.ErrNotExist), errors.Is(err, ErrUnknownNamespace):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, ErrUnauthenticated):
+		return status.Error(codes.Unauthenticated, err.Error())
+	case errors.Is(err, ErrAccessDenied):
+		return status.Error(codes.PermissionDenied, err.Error())
+	case errors.Is(err, ErrInvalidRange):
+		return status.Error(codes.OutOfRange, err.Error())
+	case errors.Is(err, ErrInvalidKey):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, ErrServerClosed):
+		return status.Error(codes.Unavailable, err.Error())
+	case errors.Is(err, ErrInsufficientStorage):
+		return status.Error(codes.ResourceExhausted, err.Error())
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return status.FromContextError(err).Err()
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"go-distributed-storage/fspb"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// startGRPC serves the FileServer over gRPC on an in-process listener and
+// returns a client connected to it.
+func startGRPC(t *testing.T, server *FileServer) fspb.FileServiceClient {
+	t.Helper()
+
+	listener := bufconn.Listen(1024 * 1024)
+	grpcServer := grpc.NewServer()
+	fspb.RegisterFileServiceServer(grpcServer, NewGRPCService(server))
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return fspb.NewFileServiceClient(conn)
+}
+
+func TestGRPCService(t *testing.T) {
+	server := makeServer("127.0.0.7:4080", true)
+	go func() {
+		if err := server.Start(); err != nil {
+			log.Fatalf("Failed to start server on 127.0.0.7:4080: %v", err)
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	defer server.Storage.Clear()
+
+	client := startGRPC(t, server)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Larger than a chunk, so that both directions stream several messages.
+	content := generateRandomData(3*fspb.UploadChunkSize + 100)
+
+	info, err := fspb.Upload(ctx, client, "images/cat.png", bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if info.GetKey() != "images/cat.png" || info.GetSize() != int64(len(content)) {
+		t.Errorf("Put: got %v", info)
+	}
+
+	info, body, err := fspb.Download(ctx, client, &fspb.GetRequest{Key: "images/cat.png"})
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	got, err := io.ReadAll(body)
+	if err != nil || !bytes.Equal(got, content) {
+		t.Errorf("Get: got %d bytes and error %v", len(got), err)
+	}
+	if info.GetSize() != int64(len(content)) {
+		t.Errorf("Get: got info %v", info)
+	}
+
+	_, body, err = fspb.Download(ctx, client, &fspb.GetRequest{Key: "images/cat.png", Offset: 1000, Length: 500})
+	if err != nil {
+		t.Fatalf("ranged Get: %v", err)
+	}
+	got, _ = io.ReadAll(body)
+	if !bytes.Equal(got, content[1000:1500]) {
+		t.Errorf("ranged Get: got %d bytes", len(got))
+	}
+
+	stat, err := client.Stat(ctx, &fspb.StatRequest{Key: "images/cat.png"})
+	if err != nil || stat.GetSize() != int64(len(content)) || stat.GetChecksum() == "" {
+		t.Errorf("Stat: got %v and error %v", stat, err)
+	}
+
+	list, err := client.List(ctx, &fspb.ListRequest{Prefix: "images/"})
+	if err != nil || len(list.GetObjects()) != 1 {
+		t.Errorf("List: got %v and error %v", list, err)
+	}
+
+	if _, err := client.Delete(ctx, &fspb.DeleteRequest{Key: "images/cat.png"}); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := client.Stat(ctx, &fspb.StatRequest{Key: "images/cat.png"}); status.Code(err) != codes.NotFound {
+		t.Errorf("Stat after Delete: got %v, want NotFound", err)
+	}
+	if _, _, err := fspb.Download(ctx, client, &fspb.GetRequest{Key: "images/cat.png"}); status.Code(err) != codes.NotFound {
+		t.Errorf("Get after Delete: got %v, want NotFound", err)
+	}
+
+	stream, err := client.Put(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.Send(&fspb.PutRequest{Chunk: []byte("no key")})
+	if _, err := stream.CloseAndRecv(); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Put without key: got %v, want InvalidArgument", err)
+	}
+}
+
+func TestGRPCWatchMembership(t *testing.T) {
+	server := makeServer("127.0.0.7:4090", true)
+	go func() {
+		if err := server.Start(); err != nil {
+			log.Fatalf("Failed to start server on 127.0.0.7:4090: %v", err)
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	defer server.Storage.Clear()
+
+	client := startGRPC(t, server)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	stream, err := client.WatchMembership(ctx, &fspb.WatchMembershipRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Wait for the watcher to be registered before the peer joins.
+	time.Sleep(50 * time.Millisecond)
+
+	peer := makeServer("127.0.0.7:4091", false, "127.0.0.7:4090")
+	go func() {
+		if err := peer.Start(); err != nil {
+			log.Fatalf("Failed to start server on 127.0.0.7:4091: %v", err)
+		}
+	}()
+	defer peer.Storage.Clear()
+
+	event, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.GetType() != fspb.MembershipEvent_JOINED || event.GetAddress() == "" {
+		t.Errorf("got event %v, want a joined peer", event)
+	}
+}
@@ -1,69 +1,345 @@
 package main
 
-// import (
-// 	"bytes"
-// 	"fmt"
-// 	"go-distributed-storage/p2p"
-// 	"io"
-// 	"log"
-// 	"time"
-// )
-
-// func makeServer(listenAddress string, nodes ...string) *FileServer {
-// 	tcptransportOpts := &p2p.TCPTransportOPT{
-// 		ListenAddress: listenAddress,
-// 		HandshakeFunc: p2p.NOPHandshakeFunc,
-// 		Decoder:       p2p.DefaultDecoder{},
-// 	}
-// 	tcpTransport := p2p.NewTCPTransport(tcptransportOpts)
-
-// 	fileServerOpts := FileServerOPT{
-// 		encryptionKey:    []byte{0x0e, 0x02, 0x5d, 0x3d, 0xb7, 0xb1, 0xf1, 0xfa, 0xdb, 0xcd, 0x1b, 0x8e, 0xc9, 0xa4, 0x5f, 0x99, 0xa1, 0x0a, 0x3f, 0x1f, 0x27, 0x31, 0xab, 0xfa, 0x68, 0x9f, 0x91, 0x42, 0x75, 0x46, 0x28, 0xec},
-// 		Crypto:           &BasicCrypto{},
-// 		RootDir:          listenAddress + "_network",
-// 		PathTranformFunc: HashPathBuilder,
-// 		Transport:        tcpTransport,
-// 		BootstrapNodes:   nodes,
-// 	}
-
-// 	server := NewFileServer(fileServerOpts)
-
-// 	tcptransportOpts.OnPeer = server.OnPeer
-
-// 	return server
-// }
-// func main() {
-// 	s1 := makeServer("127.0.0.5:3000")
-// 	s2 := makeServer("127.0.0.5:5000", "127.0.0.5:3000")
-// 	s3 := makeServer("127.0.0.5:7000", "127.0.0.5:3000")
-
-// 	go func() { log.Fatal(s1.Start()) }()
-// 	time.Sleep(5 * time.Millisecond)
-// 	go func() { log.Fatal(s2.Start()) }()
-// 	time.Sleep(5 * time.Millisecond)
-// 	go func() { log.Fatal(s3.Start()) }()
-// 	time.Sleep(5 * time.Millisecond)
-
-// 	data := bytes.NewReader([]byte("Hi my name is ahmed"))
-// 	key := "myfile"
-
-// 	// ////////////////////////////////////////////
-// 	fmt.Println("---------------- TESTING STORE ---------------- ")
-// 	if err := s1.Store(key, data); err != nil {
-// 		fmt.Print(err)
-// 	}
-// 	time.Sleep(2 * time.Second)
-
-// 	////////////////////////////////////////////
-// 	fmt.Println(" ---------------- TESTING GET ---------------- ")
-// 	r, err := s1.Get(key)
-// 	if err != nil {
-// 		fmt.Print(err)
-// 	}
-
-// 	buf, err := io.ReadAll(r)
-// 	if err != nil {
-// 		fmt.Print(err)
-// 	}
-// 	fmt.Println(string(buf))
-// }
+import (
+	"context"
+	"flag"
+	"fmt"
+	"go-distributed-storage/fspb"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+const usage = `Usage: fs <command> [flags]
+
+Node commands:
+  node        start a node
+  gateway     start a node and serve it over an HTTP gateway
+  s3          start a node and serve it over an S3 compatible API
+  grpc        start a node and serve it over gRPC
+
+Client commands, talking to a running node over its admin socket:
+  put         store a file, or stdin, under a key
+  get         write the file stored under a key to a file, or stdout
+  rm          delete the file stored under a key
+  ls          list the stored files
+  stat        show the metadata of the file stored under a key
+  peers       list the connected peers
+  status      show the state of the node
+  disconnect  close the connection to a peer
+  rebalance   send every stored file to the peers
+  bandwidth   show or change the bandwidth limits of the transfers to the peers
+
+Other commands:
+  token       generate an API token and the hash to configure for it
+  audit       verify the hash chain of an audit log
+
+Run "fs <command> -h" for the flags of a command.
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "node":
+		err = runNode(os.Args[2:])
+	case "gateway":
+		err = runGateway(os.Args[2:])
+	case "s3":
+		err = runS3(os.Args[2:])
+	case "grpc":
+		err = runGRPC(os.Args[2:])
+	case "put":
+		err = runPut(os.Args[2:])
+	case "get":
+		err = runGet(os.Args[2:])
+	case "rm":
+		err = runRm(os.Args[2:])
+	case "ls":
+		err = runLs(os.Args[2:])
+	case "stat":
+		err = runStat(os.Args[2:])
+	case "peers":
+		err = runPeers(os.Args[2:])
+	case "status":
+		err = runStatus(os.Args[2:])
+	case "disconnect":
+		err = runDisconnect(os.Args[2:])
+	case "rebalance":
+		err = runRebalance(os.Args[2:])
+	case "bandwidth":
+		err = runBandwidth(os.Args[2:])
+	case "token":
+		err = runToken(os.Args[2:])
+	case "audit":
+		err = runAudit(os.Args[2:])
+	case "-h", "-help", "--help", "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// nodeFlags holds the flags shared by the commands that start a node. Flags
+// given explicitly override the config file and the environment.
+type nodeFlags struct {
+	fs *flag.FlagSet
+
+	configFile      string
+	listenAddress   string
+	bootstrapNodes  string
+	isBootstrapNode bool
+	rootDir         string
+	keyFile         string
+	adminSocket     string
+	metricsAddress  string
+	logLevel        string
+	logFormat       string
+}
+
+func (f *nodeFlags) register(fs *flag.FlagSet) {
+	f.fs = fs
+	fs.StringVar(&f.configFile, "config", "", "YAML file holding the node settings")
+	fs.StringVar(&f.listenAddress, "listen", ":3000", "address the node listens on for peers")
+	fs.StringVar(&f.bootstrapNodes, "bootstrap", "", "comma separated addresses of the bootstrap nodes to join")
+	fs.BoolVar(&f.isBootstrapNode, "bootstrap-node", false, "share the addresses of known peers with joining nodes")
+	fs.StringVar(&f.rootDir, "root", "", "directory the files are stored in (default: <listen>_network)")
+	fs.StringVar(&f.keyFile, "key-file", "", "file holding the hex encoded 32 byte encryption key shared by the cluster")
+	fs.StringVar(&f.adminSocket, "admin-socket", DefaultAdminSocket, "unix socket the client commands talk to, empty to disable")
+	fs.StringVar(&f.metricsAddress, "metrics", "", "address /metrics is served on for Prometheus, empty to disable")
+	fs.StringVar(&f.logLevel, "log-level", "info", "minimum level of the logs: debug, info, warn or error")
+	fs.StringVar(&f.logFormat, "log-format", "text", "format of the logs: text or json")
+}
+
+// config loads the config file and environment, then applies the flags that
+// were given on the command line.
+func (f *nodeFlags) config() (*Config, error) {
+	c, err := LoadConfig(f.configFile)
+	if err != nil {
+		return nil, err
+	}
+
+	f.fs.Visit(func(fl *flag.Flag) {
+		switch fl.Name {
+		case "listen":
+			c.Listen = f.listenAddress
+		case "bootstrap":
+			c.Bootstrap = splitList(f.bootstrapNodes)
+		case "bootstrap-node":
+			c.BootstrapNode = f.isBootstrapNode
+		case "root":
+			c.RootDir = f.rootDir
+		case "key-file":
+			c.Key = KeySource{File: f.keyFile}
+		case "admin-socket":
+			c.AdminSocket = f.adminSocket
+		case "metrics":
+			c.MetricsAddress = f.metricsAddress
+		case "log-level":
+			c.Log.Level = f.logLevel
+		case "log-format":
+			c.Log.Format = f.logFormat
+		}
+	})
+	return c, nil
+}
+
+// start builds a node from the flags, starts it in the background and serves
+// its admin socket.
+func (f *nodeFlags) start() (*FileServer, error) {
+	config, err := f.config()
+	if err != nil {
+		return nil, err
+	}
+
+	logger, err := config.NewLogger(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	slog.SetDefault(logger)
+
+	server, err := config.Build()
+	if err != nil {
+		return nil, err
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- server.Start()
+	}()
+
+	// Give the node time to listen and join the network before serving requests.
+	select {
+	case err := <-errCh:
+		return nil, err
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if config.AdminSocket != "" {
+		if _, err := ServeAdminSocket(server, config.AdminSocket); err != nil {
+			return nil, fmt.Errorf("serving admin socket: %w", err)
+		}
+	}
+
+	if config.MetricsAddress != "" {
+		mux := http.NewServeMux()
+		mux.Handle("GET /metrics", server.MetricsHandler())
+		listener, err := net.Listen("tcp", config.MetricsAddress)
+		if err != nil {
+			return nil, fmt.Errorf("serving metrics: %w", err)
+		}
+		logger.Info("Metrics listening", "address", listener.Addr().String())
+		go http.Serve(listener, mux)
+	}
+
+	return server, nil
+}
+
+// runUntilSignal runs serve, if any, until it fails or the process receives
+// SIGINT or SIGTERM. The front end is then stopped with shutdown, if any, and
+// the node is shut down, both within the shutdown timeout of the node.
+func runUntilSignal(server *FileServer, serve func() error, shutdown func(context.Context) error) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	errCh := make(chan error, 1)
+	if serve != nil {
+		go func() {
+			errCh <- serve()
+		}()
+	}
+
+	var err error
+	select {
+	case err = <-errCh:
+	case <-ctx.Done():
+		slog.Info("Shutting down", "timeout", server.Config.ShutdownTimeout)
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), server.Config.ShutdownTimeout)
+	defer cancel()
+
+	if shutdown != nil {
+		if err := shutdown(shutdownCtx); err != nil {
+			slog.Warn("Failed to stop serving requests", "error", err)
+		}
+	}
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Warn("Shut down without draining every request", "error", err)
+	}
+	return err
+}
+
+// runNode starts a node and runs it until the process is interrupted.
+func runNode(args []string) error {
+	fs := flag.NewFlagSet("node", flag.ExitOnError)
+	var node nodeFlags
+	node.register(fs)
+	fs.Parse(args)
+
+	server, err := node.start()
+	if err != nil {
+		return err
+	}
+
+	return runUntilSignal(server, nil, nil)
+}
+
+// runGateway starts a node and serves it over HTTP until the process is interrupted.
+func runGateway(args []string) error {
+	fs := flag.NewFlagSet("gateway", flag.ExitOnError)
+	var node nodeFlags
+	node.register(fs)
+	httpAddress := fs.String("http", ":8080", "address the HTTP gateway listens on")
+	fs.Parse(args)
+
+	server, err := node.start()
+	if err != nil {
+		return err
+	}
+
+	httpServer := &http.Server{Addr: *httpAddress, Handler: NewGateway(server)}
+	slog.Info("HTTP gateway listening", "address", *httpAddress)
+	return runUntilSignal(server, httpServer.ListenAndServe, httpServer.Shutdown)
+}
+
+// runS3 starts a node and serves it over the S3 compatible API until the process is interrupted.
+func runS3(args []string) error {
+	fs := flag.NewFlagSet("s3", flag.ExitOnError)
+	var node nodeFlags
+	node.register(fs)
+	httpAddress := fs.String("http", ":9000", "address the S3 API listens on")
+	credentialList := fs.String("credentials", os.Getenv("FS_S3_CREDENTIALS"), "comma separated ACCESS_KEY:SECRET pairs accepted for SigV4 authentication (env FS_S3_CREDENTIALS)")
+	fs.Parse(args)
+
+	credentials := make(map[string]string)
+	for _, pair := range strings.Split(*credentialList, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		accessKey, secret, ok := strings.Cut(pair, ":")
+		if !ok {
+			return fmt.Errorf("invalid credentials %q, expected ACCESS_KEY:SECRET", pair)
+		}
+		credentials[accessKey] = secret
+	}
+
+	server, err := node.start()
+	if err != nil {
+		return err
+	}
+
+	httpServer := &http.Server{Addr: *httpAddress, Handler: NewS3Gateway(server, credentials)}
+	slog.Info("S3 API listening", "address", *httpAddress)
+	return runUntilSignal(server, httpServer.ListenAndServe, httpServer.Shutdown)
+}
+
+// runGRPC starts a node and serves it over gRPC until the process is interrupted.
+func runGRPC(args []string) error {
+	fs := flag.NewFlagSet("grpc", flag.ExitOnError)
+	var node nodeFlags
+	node.register(fs)
+	grpcAddress := fs.String("grpc", ":9090", "address the gRPC API listens on")
+	fs.Parse(args)
+
+	server, err := node.start()
+	if err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("tcp", *grpcAddress)
+	if err != nil {
+		return err
+	}
+
+	grpcServer := grpc.NewServer()
+	fspb.RegisterFileServiceServer(grpcServer, NewGRPCService(server))
+
+	slog.Info("gRPC API listening", "address", listener.Addr().String())
+	return runUntilSignal(server, func() error {
+		return grpcServer.Serve(listener)
+	}, func(ctx context.Context) error {
+		// GracefulStop waits for the streams to end, Stop cancels them.
+		stopped := context.AfterFunc(ctx, grpcServer.Stop)
+		defer stopped()
+		grpcServer.GracefulStop()
+		return ctx.Err()
+	})
+}
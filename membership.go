@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"go-distributed-storage/p2p"
+	"time"
+)
+
+// membershipBuffer is how many events a watcher may fall behind before it is closed.
+const membershipBuffer = 64
+
+// MembershipEvent reports a peer joining or leaving the node.
+type MembershipEvent struct {
+	// Address is the remote address of the connection to the peer.
+	Address string
+	Joined  bool
+	Time    time.Time
+}
+
+// OnPeerDisconnect forgets about a peer whose connection was lost. It is meant
+// to be set as the OnPeerDisconnect callback of the transport.
+func (s *FileServer) OnPeerDisconnect(p p2p.Peer) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	if s.peers[p.RemoteAddr().String()] != p {
+		// Already dropped by dropPeer.
+		return
+	}
+	delete(s.peers, p.RemoteAddr().String())
+	delete(s.streamLocks, p)
+	s.notifyMembership(p, false)
+	if !s.isClosing() {
+		s.metrics.connectionErrors.WithLabelValues("lost").Inc()
+	}
+
+	s.logger().Info("Lost peer connection", "peer", p.RemoteAddr().String())
+}
+
+// WatchMembership returns a channel of the peers joining and leaving the node.
+// It starts with a joined event for every peer that is already connected. The
+// channel is closed once the context is done, or when the watcher falls too
+// far behind, in which case it should watch again to start from a fresh list.
+func (s *FileServer) WatchMembership(ctx context.Context) <-chan MembershipEvent {
+	s.peerLock.Lock()
+	ch := make(chan MembershipEvent, len(s.peers)+membershipBuffer)
+	now := time.Now()
+	for address := range s.peers {
+		ch <- MembershipEvent{Address: address, Joined: true, Time: now}
+	}
+	s.watchers[ch] = struct{}{}
+	s.peerLock.Unlock()
+
+	context.AfterFunc(ctx, func() {
+		s.peerLock.Lock()
+		defer s.peerLock.Unlock()
+		s.removeWatcher(ch)
+	})
+
+	return ch
+}
+
+// notifyMembership sends an event to every watcher and to the audit log, and
+// forgets the capacity advertised by a peer that left. The caller must hold
+// peerLock.
+func (s *FileServer) notifyMembership(p p2p.Peer, joined bool) {
+	if !joined {
+		delete(s.peerCapacity, p.RemoteAddr().String())
+	}
+
+	event := MembershipEvent{
+		Address: p.RemoteAddr().String(),
+		Joined:  joined,
+		Time:    time.Now(),
+	}
+	s.auditPeer(event.Address, joined)
+
+	for ch := range s.watchers {
+		select {
+		case ch <- event:
+		default:
+			s.logger().Warn("Closing membership watcher that fell behind", "events", membershipBuffer)
+			s.removeWatcher(ch)
+		}
+	}
+}
+
+// removeWatcher closes the channel of a watcher. The caller must hold peerLock.
+func (s *FileServer) removeWatcher(ch chan MembershipEvent) {
+	if _, ok := s.watchers[ch]; ok {
+		delete(s.watchers, ch)
+		close(ch)
+	}
+}
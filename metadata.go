@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+)
+
+const (
+	// maxObjectTags is the most tags a file can carry.
+	maxObjectTags = 50
+	// maxFileAttrsSize is the largest the attributes of a file can be once
+	// encoded in JSON.
+	maxFileAttrsSize = 64 * 1024
+)
+
+// ErrInvalidAttrs is returned when the attributes given to a file are invalid.
+var ErrInvalidAttrs = errors.New("invalid object attributes")
+
+// validate checks the attributes given by a client before the file is stored,
+// so that they fit in the header sent along with the replicas.
+func (a ObjectAttrs) validate() error {
+	if len(a.Tags) > maxObjectTags {
+		return fmt.Errorf("%w: %d tags, more than the maximum of %d", ErrInvalidAttrs, len(a.Tags), maxObjectTags)
+	}
+	for name := range a.Tags {
+		if name == "" || strings.Contains(name, "=") {
+			return fmt.Errorf("%w: invalid tag name %q", ErrInvalidAttrs, name)
+		}
+	}
+	for name := range a.Metadata {
+		if name == "" {
+			return fmt.Errorf("%w: empty metadata name", ErrInvalidAttrs)
+		}
+	}
+	b, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	if len(b) > maxFileAttrsSize {
+		return fmt.Errorf("%w: they take %d bytes, more than the maximum of %d", ErrInvalidAttrs, len(b), maxFileAttrsSize)
+	}
+	return nil
+}
+
+// ParseTags parses tags written as a URL query, such as "env=ci&team=build",
+// the format of the X-FS-Tags header and of the x-amz-tagging header of S3.
+func ParseTags(s string) (map[string]string, error) {
+	values, err := url.ParseQuery(s)
+	if err != nil {
+		return nil, fmt.Errorf("%w: parsing tags %q: %w", ErrInvalidAttrs, s, err)
+	}
+	tags := make(map[string]string, len(values))
+	for name, v := range values {
+		if len(v) > 1 {
+			return nil, fmt.Errorf("%w: parsing tags %q: tag %s is set more than once", ErrInvalidAttrs, s, name)
+		}
+		tags[name] = v[0]
+	}
+	return tags, nil
+}
+
+// FormatTags writes tags in the format read by ParseTags, sorted by name.
+func FormatTags(tags map[string]string) string {
+	values := make(url.Values, len(tags))
+	for name, value := range tags {
+		values.Set(name, value)
+	}
+	return values.Encode()
+}
+
+// tagIndex maps the tags of the stored blobs to their keys. It is shared by
+// the copies of the Storage, like storageUsage, and built from the backend on
+// first use.
+type tagIndex struct {
+	once sync.Once
+
+	mu sync.RWMutex
+	// keys maps "name=value" to the keys of the blobs carrying that tag.
+	keys map[string]map[string]struct{}
+	// tags maps the keys of the tagged blobs to their tags.
+	tags map[string]map[string]string
+}
+
+func tagIndexKey(name, value string) string {
+	return name + "=" + value
+}
+
+// set replaces the tags indexed for key.
+func (t *tagIndex) set(key string, tags map[string]string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.removeLocked(key)
+	if len(tags) == 0 {
+		return
+	}
+	t.tags[key] = tags
+	for name, value := range tags {
+		indexKey := tagIndexKey(name, value)
+		if t.keys[indexKey] == nil {
+			t.keys[indexKey] = make(map[string]struct{})
+		}
+		t.keys[indexKey][key] = struct{}{}
+	}
+}
+
+// remove drops key from the index.
+func (t *tagIndex) remove(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.removeLocked(key)
+}
+
+func (t *tagIndex) removeLocked(key string) {
+	for name, value := range t.tags[key] {
+		indexKey := tagIndexKey(name, value)
+		delete(t.keys[indexKey], key)
+		if len(t.keys[indexKey]) == 0 {
+			delete(t.keys, indexKey)
+		}
+	}
+	delete(t.tags, key)
+}
+
+// reset empties the index.
+func (t *tagIndex) reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.keys = make(map[string]map[string]struct{})
+	t.tags = make(map[string]map[string]string)
+}
+
+// lookup returns the keys carrying the tag, sorted.
+func (t *tagIndex) lookup(name, value string) []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	keys := make([]string, 0, len(t.keys[tagIndexKey(name, value)]))
+	for key := range t.keys[tagIndexKey(name, value)] {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// tagIndex returns the index of the tags, walking the backend the first time.
+func (s *Storage) tagIndex() *tagIndex {
+	s.tags.once.Do(func() {
+		s.tags.reset()
+		if err := s.walkAll(func(meta ObjectMeta) error {
+			s.tags.set(meta.Key, meta.Tags)
+			return nil
+		}); err != nil {
+			s.Config.Logger.Warn("Failed to index the tags of the storage", "error", err)
+		}
+	})
+	return s.tags
+}
+
+// ListByTag returns the metadata of the blobs carrying the tag, sorted by key.
+// Expired blobs are skipped.
+func (s *Storage) ListByTag(name, value string) ([]ObjectMeta, error) {
+	keys := s.tagIndex().lookup(name, value)
+	metas := make([]ObjectMeta, 0, len(keys))
+	for _, key := range keys {
+		meta, err := s.Stat(key)
+		if err != nil {
+			// Deleted or expired since the lookup.
+			continue
+		}
+		metas = append(metas, meta)
+	}
+	return metas, nil
+}
+
+// ListByTag returns the files stored locally that carry the tag name=value,
+// sorted by key.
+func (s *FileServer) ListByTag(name, value string) ([]ObjectInfo, error) {
+	return s.ListByTagContext(context.Background(), name, value)
+}
+
+// ListByTagContext is like ListByTag, but only returns the files the
+// principal of the context may read.
+func (s *FileServer) ListByTagContext(ctx context.Context, name, value string) ([]ObjectInfo, error) {
+	return s.listByTag(ctx, s.defaultNamespace(), name, value)
+}
+
+func (s *FileServer) listByTag(ctx context.Context, ns *Namespace, name, value string) ([]ObjectInfo, error) {
+	readable, err := s.authorizeList(ctx, ns, "")
+	if err != nil {
+		return nil, err
+	}
+	metas, err := ns.storage.ListByTag(name, value)
+	if err != nil {
+		return nil, err
+	}
+
+	objects := make([]ObjectInfo, 0, len(metas))
+	for _, meta := range metas {
+		if readable(meta.Key) {
+			objects = append(objects, s.objectInfo(meta))
+		}
+	}
+	return objects, nil
+}
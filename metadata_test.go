@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestObjectMetadata(t *testing.T) {
+	servers := make([]*FileServer, 2)
+	for i, address := range []string{"127.0.0.16:4200", "127.0.0.16:4201"} {
+		var server *FileServer
+		if i == 0 {
+			server = makeServer(address, true)
+		} else {
+			server = makeServer(address, false, "127.0.0.16:4200")
+		}
+		startServer(t, server)
+		t.Cleanup(func() {
+			server.Stop()
+			server.Storage.Clear()
+		})
+		servers[i] = server
+	}
+	time.Sleep(30 * time.Millisecond)
+
+	opts := StoreOptions{
+		ContentType: "application/x-tar",
+		Tags:        map[string]string{"pipeline": "nightly", "arch": "arm64"},
+		Metadata:    map[string]string{"commit": "4f2a9c1"},
+	}
+	start := time.Now()
+	if err := servers[1].StoreWithOptions(t.Context(), "builds/1.tar", bytes.NewReader(generateRandomData(4096)), opts); err != nil {
+		t.Fatal(err)
+	}
+	opts.Tags = map[string]string{"pipeline": "release"}
+	if err := servers[1].StoreWithOptions(t.Context(), "builds/2.tar", bytes.NewReader(generateRandomData(4096)), opts); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	// The replica carries the metadata of the original.
+	for i, server := range servers {
+		info, err := server.Stat("builds/1.tar")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.ContentType != "application/x-tar" || info.Tags["arch"] != "arm64" || info.Metadata["commit"] != "4f2a9c1" {
+			t.Errorf("Stat on node %d: got %+v", i, info)
+		}
+		if info.CreatedAt.Before(start.Add(-time.Second)) || info.CreatedAt.After(time.Now()) {
+			t.Errorf("Stat on node %d: got creation time %v", i, info.CreatedAt)
+		}
+
+		objects, err := server.ListByTag("pipeline", "nightly")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(objects) != 1 || objects[0].Key != "builds/1.tar" {
+			t.Errorf("ListByTag on node %d: got %+v", i, objects)
+		}
+	}
+
+	// Replacing a file replaces its tags in the index.
+	opts.Tags = map[string]string{"pipeline": "release"}
+	if err := servers[1].StoreWithOptions(t.Context(), "builds/1.tar", bytes.NewReader(generateRandomData(4096)), opts); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if objects, _ := servers[1].ListByTag("pipeline", "nightly"); len(objects) != 0 {
+		t.Errorf("ListByTag after replacing the tags: got %+v", objects)
+	}
+	if objects, _ := servers[1].ListByTag("pipeline", "release"); len(objects) != 2 {
+		t.Errorf("ListByTag of the new tag: got %+v", objects)
+	}
+
+	// A node without the file gets its metadata from a peer, without the body.
+	if err := servers[0].Storage.DeleteFile("builds/2.tar"); err != nil {
+		t.Fatal(err)
+	}
+	info, err := servers[0].Stat("builds/2.tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != 4096 || !maps.Equal(info.Tags, map[string]string{"pipeline": "release"}) {
+		t.Errorf("Stat from a peer: got %+v", info)
+	}
+	if servers[0].Storage.HasKey("builds/2.tar") {
+		t.Error("Stat transferred the file from the peer")
+	}
+	if objects, _ := servers[0].ListByTag("pipeline", "release"); len(objects) != 1 {
+		t.Errorf("ListByTag after deleting a file: got %+v", objects)
+	}
+
+	if err := servers[1].StoreWithOptions(t.Context(), "bad", bytes.NewReader(nil), StoreOptions{Tags: map[string]string{"a=b": "c"}}); !errors.Is(err, ErrInvalidAttrs) {
+		t.Errorf("store with an invalid tag: got %v, want ErrInvalidAttrs", err)
+	}
+}
+
+func TestGatewayObjectMetadata(t *testing.T) {
+	server := makeServer("127.0.0.16:4202", true)
+	startServer(t, server)
+	t.Cleanup(func() {
+		server.Stop()
+		server.Storage.Clear()
+	})
+
+	gateway := httptest.NewServer(NewGateway(server))
+	defer gateway.Close()
+
+	do := func(method, path string, body io.Reader, header http.Header) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(method, gateway.URL+path, body)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := do(http.MethodPut, "/objects/reports/q3.pdf", bytes.NewReader([]byte("%PDF-1.7")), http.Header{
+		"Content-Type":     {"application/pdf"},
+		TagsHeader:         {"team=finance&year=2026"},
+		"X-Fs-Meta-Author": {"ops"},
+	})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("PUT: got status %d", resp.StatusCode)
+	}
+
+	resp = do(http.MethodHead, "/objects/reports/q3.pdf", nil, nil)
+	resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "application/pdf" {
+		t.Errorf("HEAD: got Content-Type %q", ct)
+	}
+	if tags := resp.Header.Get(TagsHeader); tags != "team=finance&year=2026" {
+		t.Errorf("HEAD: got %s %q", TagsHeader, tags)
+	}
+	if author := resp.Header.Get("X-FS-Meta-Author"); author != "ops" {
+		t.Errorf("HEAD: got X-FS-Meta-Author %q", author)
+	}
+
+	resp = do(http.MethodGet, "/objects/reports/q3.pdf?stat", nil, nil)
+	var info ObjectInfo
+	json.NewDecoder(resp.Body).Decode(&info)
+	resp.Body.Close()
+	if info.Key != "reports/q3.pdf" || info.Tags["year"] != "2026" || info.Metadata["author"] != "ops" {
+		t.Errorf("GET ?stat: got %+v", info)
+	}
+
+	resp = do(http.MethodGet, "/objects?tag=team=finance", nil, nil)
+	var list struct {
+		Objects []ObjectInfo `json:"objects"`
+	}
+	json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if len(list.Objects) != 1 || list.Objects[0].Key != "reports/q3.pdf" {
+		t.Errorf("GET ?tag: got %+v", list.Objects)
+	}
+
+	resp = do(http.MethodPut, "/objects/bad", bytes.NewReader(nil), http.Header{TagsHeader: {"team=a&team=b"}})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("PUT with a repeated tag: got status %d, want 400", resp.StatusCode)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"io"
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metrics holds the Prometheus collectors of a FileServer. Every server has its
+// own registry, so that several servers can run in one process.
+type metrics struct {
+	registry *prometheus.Registry
+
+	bytesStored      *prometheus.CounterVec
+	bytesServed      *prometheus.CounterVec
+	storeDuration    prometheus.Histogram
+	getDuration      *prometheus.HistogramVec
+	connectionErrors *prometheus.CounterVec
+	decodeErrors     prometheus.Counter
+	replicationLag   prometheus.Histogram
+	inflightStreams  *prometheus.GaugeVec
+	accessDenied     *prometheus.CounterVec
+	filesExpired     prometheus.Counter
+}
+
+func newMetrics(s *FileServer) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+
+		bytesStored: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "fs_bytes_stored_total",
+			Help: "Bytes written to disk, by where they came from (client or peer).",
+		}, []string{"source"}),
+		bytesServed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "fs_bytes_served_total",
+			Help: "Bytes served, by who they were served to (client or peer).",
+		}, []string{"destination"}),
+		storeDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "fs_store_duration_seconds",
+			Help:    "Time taken by Store to write a file to disk and stream it to the peers.",
+			Buckets: prometheus.DefBuckets,
+		}),
+		getDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "fs_get_duration_seconds",
+			Help:    "Time taken by Get until the file can be read, by where it was found (local or peer).",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"source"}),
+		connectionErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "fs_connection_errors_total",
+			Help: "Peer connection errors, by reason (dial, lost or dropped).",
+		}, []string{"reason"}),
+		decodeErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "fs_decode_errors_total",
+			Help: "Messages from peers that could not be decoded.",
+		}),
+		replicationLag: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "fs_replication_lag_seconds",
+			Help:    "Time between a peer starting to store a file and its replica being written on this node. Includes the clock skew between the nodes.",
+			Buckets: prometheus.DefBuckets,
+		}),
+		inflightStreams: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "fs_inflight_streams",
+			Help: "Streams to and from peers being transferred, by direction (in or out).",
+		}, []string{"direction"}),
+		accessDenied: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "fs_access_denied_total",
+			Help: "Requests refused by access control or a namespace policy, by action (store, get, delete, list or authenticate).",
+		}, []string{"action"}),
+		filesExpired: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "fs_files_expired_total",
+			Help: "Expired files deleted by the reaper.",
+		}),
+	}
+
+	m.registry.MustRegister(
+		m.bytesStored,
+		m.bytesServed,
+		m.storeDuration,
+		m.getDuration,
+		m.connectionErrors,
+		m.decodeErrors,
+		m.replicationLag,
+		m.inflightStreams,
+		m.accessDenied,
+		m.filesExpired,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "fs_peers",
+			Help: "Number of connected peers.",
+		}, func() float64 {
+			return float64(len(s.Peers()))
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "fs_disk_usage_bytes",
+			Help: "Size of the files under the root directory, including metadata and quarantined blobs.",
+		}, func() float64 {
+			return float64(diskUsage(s.Storage.Config.RootDir))
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "fs_storage_available_bytes",
+			Help: "Bytes the node still accepts before refusing files, -1 when unlimited.",
+		}, func() float64 {
+			return float64(s.Capacity().Available)
+		}),
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	return m
+}
+
+// MetricsHandler serves the metrics of the server in the Prometheus text format.
+func (s *FileServer) MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(s.metrics.registry, promhttp.HandlerOpts{})
+}
+
+// trackStream counts a stream as in flight until the returned function is called.
+func (m *metrics) trackStream(direction string) func() {
+	gauge := m.inflightStreams.WithLabelValues(direction)
+	gauge.Inc()
+	return gauge.Dec
+}
+
+// observeSince records the time elapsed since start in a histogram.
+func observeSince(h prometheus.Observer, start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+// servedToClient observes the latency of a Get and counts the bytes the client
+// reads from the returned reader.
+func (s *FileServer) servedToClient(r io.ReadCloser, err error, source string, start time.Time) (io.ReadCloser, error) {
+	if err != nil {
+		return nil, err
+	}
+	observeSince(s.metrics.getDuration.WithLabelValues(source), start)
+	return &countingReadCloser{ReadCloser: r, counter: s.metrics.bytesServed.WithLabelValues("client")}, nil
+}
+
+// diskUsage returns the total size of the regular files under root.
+func diskUsage(root string) int64 {
+	var total int64
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total
+}
+
+// countingReadCloser adds the bytes read through it to a counter.
+type countingReadCloser struct {
+	io.ReadCloser
+	counter prometheus.Counter
+}
+
+func (c *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.counter.Add(float64(n))
+	return n, err
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	server1 := makeServer("127.0.0.8:4100", true)
+	go func() {
+		if err := server1.Start(); err != nil {
+			log.Fatalf("Failed to start server on 127.0.0.8:4100: %v", err)
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	defer server1.Storage.Clear()
+
+	server2 := makeServer("127.0.0.8:4101", false, "127.0.0.8:4100")
+	go func() {
+		if err := server2.Start(); err != nil {
+			log.Fatalf("Failed to start server on 127.0.0.8:4101: %v", err)
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+	defer server2.Storage.Clear()
+
+	content := generateRandomData(4096)
+	if err := server1.Store("metrics/data", bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	r, err := server1.Get("metrics/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, r)
+	r.Close()
+
+	scrape := func(server *FileServer) string {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		server.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		return rec.Body.String()
+	}
+
+	metrics1 := scrape(server1)
+	for _, want := range []string{
+		"fs_peers 1",
+		`fs_bytes_stored_total{source="client"} 4112`,
+		`fs_bytes_served_total{destination="client"} 4096`,
+		"fs_store_duration_seconds_count 1",
+		`fs_get_duration_seconds_count{source="local"} 1`,
+		`fs_inflight_streams{direction="out"} 0`,
+		"fs_disk_usage_bytes",
+	} {
+		if !strings.Contains(metrics1, want) {
+			t.Errorf("metrics of the storing node do not contain %q", want)
+		}
+	}
+
+	if strings.Contains(metrics1, "fs_disk_usage_bytes 0\n") {
+		t.Error("disk usage of the storing node is zero")
+	}
+
+	metrics2 := scrape(server2)
+	for _, want := range []string{
+		`fs_bytes_stored_total{source="peer"} 4112`,
+		"fs_replication_lag_seconds_count 1",
+		"fs_decode_errors_total 0",
+	} {
+		if !strings.Contains(metrics2, want) {
+			t.Errorf("metrics of the replica do not contain %q", want)
+		}
+	}
+}
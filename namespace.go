@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DefaultNamespace is the namespace of the files stored through the methods of
+// FileServer. Its blobs live at the root of the storage and are encrypted with
+// FileServerOPT.EncryptionKey.
+const DefaultNamespace = ""
+
+// NamespaceFolderName is the folder, or key prefix, under which the backend of
+// the node holds the blobs of the other namespaces.
+const NamespaceFolderName = ".namespaces"
+
+// ErrUnknownNamespace is returned for a namespace that is not configured on the node.
+var ErrUnknownNamespace = errors.New("unknown namespace")
+
+// ErrAccessDenied is returned when the policy of a namespace forbids an operation.
+var ErrAccessDenied = errors.New("access denied")
+
+// NamespacePolicy restricts what clients may do with the files of a namespace.
+type NamespacePolicy string
+
+const (
+	// PolicyReadWrite allows every operation.
+	PolicyReadWrite NamespacePolicy = "read-write"
+	// PolicyReadOnly only allows reading the files.
+	PolicyReadOnly NamespacePolicy = "read-only"
+	// PolicyWriteOnce allows storing new files, but not replacing or deleting them.
+	PolicyWriteOnce NamespacePolicy = "write-once"
+)
+
+// namespacePolicies are the valid values of NamespaceOPT.Policy.
+var namespacePolicies = map[NamespacePolicy]bool{
+	PolicyReadWrite: true,
+	PolicyReadOnly:  true,
+	PolicyWriteOnce: true,
+}
+
+// namespaceName is what a namespace may be called, since it names a folder.
+var namespaceName = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,62}$`)
+
+// NamespaceOPT configures a namespace. Every node of a cluster must use the
+// same settings for a namespace, since they hold the replicas of each other.
+type NamespaceOPT struct {
+	// EncryptionKey is the key the files of the namespace are encrypted with.
+	// A nil key means FileServerOPT.EncryptionKey.
+	EncryptionKey []byte
+	// Quota is the most bytes the namespace stores on a node. A zero value
+	// means it is only limited by the capacity of the node.
+	Quota int64
+	// Policy restricts the operations of clients. An empty Policy means
+	// PolicyReadWrite. Replicas sent by peers are always accepted.
+	Policy NamespacePolicy
+}
+
+// Namespace holds a separate set of files, encrypted with its own key and
+// stored under its own folder of the backend, so that tenants sharing a
+// cluster do not see each other's keys. It is returned by FileServer.Namespace.
+type Namespace struct {
+	server *FileServer
+	name   string
+	opt    NamespaceOPT
+
+	once    sync.Once
+	storage *Storage
+	err     error
+}
+
+// validateNamespaceName reports why name cannot name a namespace, if it cannot.
+func validateNamespaceName(name string) error {
+	if !namespaceName.MatchString(name) {
+		return fmt.Errorf("invalid name %q, expected up to 63 lowercase letters, digits, '.', '_' or '-'", name)
+	}
+	return nil
+}
+
+// namespacer is implemented by backends that can hold the blobs of a namespace
+// apart from their own.
+type namespacer interface {
+	Namespace(name string) (Backend, error)
+}
+
+// open creates the storage of the namespace on first use, on top of the
+// backend of the node.
+func (n *Namespace) open() (*Storage, error) {
+	n.once.Do(func() {
+		if n.name == DefaultNamespace {
+			n.storage = &n.server.Storage
+			return
+		}
+		if err := validateNamespaceName(n.name); err != nil {
+			n.err = fmt.Errorf("namespace %s: %w", n.name, err)
+			return
+		}
+
+		root := n.server.Storage.Config
+		b, ok := root.Backend.(namespacer)
+		if !ok {
+			n.err = fmt.Errorf("namespace %s: backend %T does not support namespaces", n.name, root.Backend)
+			return
+		}
+		backend, err := b.Namespace(n.name)
+		if err != nil {
+			n.err = fmt.Errorf("namespace %s: %w", n.name, err)
+			return
+		}
+
+		n.storage = NewStorage(StoreOPT{
+			PathTranformFunc: root.PathTranformFunc,
+			RootDir:          filepath.Join(root.RootDir, NamespaceFolderName, n.name),
+			Backend:          backend,
+			Capacity:         n.opt.Quota,
+			MinFreeSpace:     root.MinFreeSpace,
+			Logger:           root.Logger,
+		})
+	})
+	return n.storage, n.err
+}
+
+// Name returns the name of the namespace.
+func (n *Namespace) Name() string {
+	return n.name
+}
+
+// Policy returns the policy of the namespace.
+func (n *Namespace) Policy() NamespacePolicy {
+	if n.opt.Policy == "" {
+		return PolicyReadWrite
+	}
+	return n.opt.Policy
+}
+
+// encryptionKey returns the key the files of the namespace are encrypted with.
+func (n *Namespace) encryptionKey() []byte {
+	if n.opt.EncryptionKey != nil {
+		return n.opt.EncryptionKey
+	}
+	return n.server.Config.EncryptionKey
+}
+
+// qualify returns the key prefixed with the namespace, to tell the keys of the
+// namespaces apart in reports and logs.
+func (n *Namespace) qualify(key string) string {
+	if n.name == DefaultNamespace {
+		return key
+	}
+	return n.name + "/" + key
+}
+
+// checkStore returns ErrAccessDenied if the policy forbids storing key.
+func (n *Namespace) checkStore(key string) error {
+	switch n.Policy() {
+	case PolicyReadOnly:
+		return fmt.Errorf("storing %s: %w: namespace %s is read-only", key, ErrAccessDenied, n.name)
+	case PolicyWriteOnce:
+		if n.storage.HasKey(key) {
+			return fmt.Errorf("storing %s: %w: namespace %s does not allow replacing files", key, ErrAccessDenied, n.name)
+		}
+	}
+	return nil
+}
+
+// checkDelete returns ErrAccessDenied if the policy forbids deleting key.
+func (n *Namespace) checkDelete(key string) error {
+	switch n.Policy() {
+	case PolicyReadOnly, PolicyWriteOnce:
+		return fmt.Errorf("deleting %s: %w: namespace %s is %s", key, ErrAccessDenied, n.name, n.Policy())
+	}
+	return nil
+}
+
+// Store is like FileServer.Store within the namespace.
+func (n *Namespace) Store(key string, r io.Reader) error {
+	return n.StoreContext(context.Background(), key, r)
+}
+
+// StoreContext is like FileServer.StoreContext within the namespace.
+func (n *Namespace) StoreContext(ctx context.Context, key string, r io.Reader) error {
+	return n.server.store(ctx, n, key, r, StoreOptions{})
+}
+
+// StoreWithOptions is like FileServer.StoreWithOptions within the namespace.
+func (n *Namespace) StoreWithOptions(ctx context.Context, key string, r io.Reader, opts StoreOptions) error {
+	return n.server.store(ctx, n, key, r, opts)
+}
+
+// Get is like FileServer.Get within the namespace.
+func (n *Namespace) Get(key string) (io.ReadCloser, error) {
+	return n.GetContext(context.Background(), key)
+}
+
+// GetContext is like FileServer.GetContext within the namespace.
+func (n *Namespace) GetContext(ctx context.Context, key string) (io.ReadCloser, error) {
+	return n.server.get(ctx, n, key)
+}
+
+// GetRange is like FileServer.GetRange within the namespace.
+func (n *Namespace) GetRange(key string, offset, length int64) (io.ReadCloser, error) {
+	return n.GetRangeContext(context.Background(), key, offset, length)
+}
+
+// GetRangeContext is like FileServer.GetRangeContext within the namespace.
+func (n *Namespace) GetRangeContext(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	return n.server.getRange(ctx, n, key, offset, length)
+}
+
+// Delete is like FileServer.Delete within the namespace.
+func (n *Namespace) Delete(key string) error {
+	return n.DeleteContext(context.Background(), key)
+}
+
+// DeleteContext is like FileServer.DeleteContext within the namespace.
+func (n *Namespace) DeleteContext(ctx context.Context, key string) error {
+	return n.server.delete(ctx, n, key)
+}
+
+// Stat is like FileServer.Stat within the namespace.
+func (n *Namespace) Stat(key string) (ObjectInfo, error) {
+	return n.StatContext(context.Background(), key)
+}
+
+// StatContext is like FileServer.StatContext within the namespace.
+func (n *Namespace) StatContext(ctx context.Context, key string) (ObjectInfo, error) {
+	return n.server.stat(ctx, n, key)
+}
+
+// List is like FileServer.List within the namespace.
+func (n *Namespace) List(prefix string) ([]ObjectInfo, error) {
+	return n.ListContext(context.Background(), prefix)
+}
+
+// ListContext is like FileServer.ListContext within the namespace.
+func (n *Namespace) ListContext(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	return n.server.list(ctx, n, prefix)
+}
+
+// ListByTag is like FileServer.ListByTag within the namespace.
+func (n *Namespace) ListByTag(name, value string) ([]ObjectInfo, error) {
+	return n.ListByTagContext(context.Background(), name, value)
+}
+
+// ListByTagContext is like FileServer.ListByTagContext within the namespace.
+func (n *Namespace) ListByTagContext(ctx context.Context, name, value string) ([]ObjectInfo, error) {
+	return n.server.listByTag(ctx, n, name, value)
+}
+
+// Capacity returns the usage of the namespace on this node against its quota.
+func (n *Namespace) Capacity() Capacity {
+	return n.storage.Capacity()
+}
+
+// Namespace returns the namespace called name, or an error wrapping
+// ErrUnknownNamespace if it is not configured on the node. The empty name is
+// DefaultNamespace.
+func (s *FileServer) Namespace(name string) (*Namespace, error) {
+	n, ok := s.namespaces[name]
+	if !ok {
+		return nil, fmt.Errorf("namespace %q: %w", name, ErrUnknownNamespace)
+	}
+	if _, err := n.open(); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// defaultNamespace returns the namespace used by the methods of FileServer.
+func (s *FileServer) defaultNamespace() *Namespace {
+	return s.namespaces[DefaultNamespace]
+}
+
+// openNamespaces returns the namespaces whose storage could be opened,
+// sorted by name, starting with DefaultNamespace. Start fails on the others.
+func (s *FileServer) openNamespaces() []*Namespace {
+	namespaces := make([]*Namespace, 0, len(s.namespaces))
+	for _, n := range s.namespaces {
+		if _, err := n.open(); err != nil {
+			continue
+		}
+		namespaces = append(namespaces, n)
+	}
+	sort.Slice(namespaces, func(i, j int) bool {
+		return namespaces[i].name < namespaces[j].name
+	})
+	return namespaces
+}
+
+// isNamespaced reports whether the key is one of the blobs of another
+// namespace, seen through a backend that holds them under its own keys.
+func isNamespaced(key string) bool {
+	return strings.HasPrefix(key, NamespaceFolderName+"/")
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// addNamespace configures a namespace on a server made by makeServer, before it starts.
+func addNamespace(server *FileServer, name string, opt NamespaceOPT) {
+	server.Config.Namespaces[name] = opt
+	server.namespaces[name] = &Namespace{server: server, name: name, opt: opt}
+}
+
+func TestNamespaces(t *testing.T) {
+	teamKey := (&BasicCrypto{}).newEncryptionKey()
+	servers := make([]*FileServer, 2)
+	for i, address := range []string{"127.0.0.13:4170", "127.0.0.13:4171"} {
+		var server *FileServer
+		if i == 0 {
+			server = makeServer(address, true)
+		} else {
+			server = makeServer(address, false, "127.0.0.13:4170")
+		}
+		server.Config.Namespaces = make(map[string]NamespaceOPT)
+		addNamespace(server, "team-a", NamespaceOPT{EncryptionKey: teamKey, Quota: 100 * 1024})
+		addNamespace(server, "archive", NamespaceOPT{Policy: PolicyWriteOnce})
+		startServer(t, server)
+		t.Cleanup(func() {
+			server.Stop()
+			server.Storage.Clear()
+		})
+		servers[i] = server
+	}
+	time.Sleep(30 * time.Millisecond)
+
+	teamA, err := servers[1].Namespace("team-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := generateRandomData(32 * 1024)
+	if err := teamA.Store("report", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	// The replica is stored in the folder of the namespace, encrypted with its key.
+	replica, err := servers[0].Namespace("team-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !replica.storage.HasKey("report") {
+		t.Fatal("the replica was not stored in the namespace")
+	}
+	if servers[0].Storage.HasKey("report") {
+		t.Error("the file of the namespace is visible in the default namespace")
+	}
+	if objects, _ := servers[0].List(""); len(objects) != 0 {
+		t.Errorf("List of the default namespace: got %+v", objects)
+	}
+	wantDir := filepath.Join(servers[0].Storage.Config.RootDir, NamespaceFolderName, "team-a")
+	if dir := replica.storage.Config.RootDir; dir != wantDir {
+		t.Errorf("root dir of the namespace: got %s, want %s", dir, wantDir)
+	}
+	r, _, err := replica.storage.ReadFileDecrypted("report", servers[0].Config.Crypto.Decrypt, servers[0].Config.EncryptionKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypted, _ := io.ReadAll(r)
+	r.Close()
+	if bytes.Equal(decrypted, data) {
+		t.Error("the file of the namespace was encrypted with the key of the node")
+	}
+
+	got, err := replica.Get("report")
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypted, _ = io.ReadAll(got)
+	got.Close()
+	if !bytes.Equal(decrypted, data) {
+		t.Error("Get returned different data")
+	}
+
+	// The quota of the namespace is enforced on every node.
+	if err := teamA.Store("big", bytes.NewReader(generateRandomData(96*1024))); !errors.Is(err, ErrInsufficientStorage) {
+		t.Errorf("store over quota: got %v, want ErrInsufficientStorage", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if c := teamA.Capacity(); c.Limit != 100*1024 || c.Used == 0 {
+		t.Errorf("capacity of the namespace: got %+v", c)
+	}
+
+	// Write-once namespaces keep the first version of a file.
+	archive, err := servers[1].Namespace("archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := archive.Store("log", bytes.NewReader([]byte("first"))); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if err := archive.Store("log", bytes.NewReader([]byte("second"))); !errors.Is(err, ErrAccessDenied) {
+		t.Errorf("replacing a write-once file: got %v, want ErrAccessDenied", err)
+	}
+	if err := archive.Delete("log"); !errors.Is(err, ErrAccessDenied) {
+		t.Errorf("deleting a write-once file: got %v, want ErrAccessDenied", err)
+	}
+
+	if _, err := servers[1].Namespace("missing"); !errors.Is(err, ErrUnknownNamespace) {
+		t.Errorf("unknown namespace: got %v, want ErrUnknownNamespace", err)
+	}
+
+	if err := teamA.Delete("report"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if replica.storage.HasKey("report") {
+		t.Error("the replica of the namespace was not deleted")
+	}
+}
+
+func TestGatewayNamespaces(t *testing.T) {
+	server := makeServer("127.0.0.13:4172", true)
+	server.Config.Namespaces = make(map[string]NamespaceOPT)
+	addNamespace(server, "team-a", NamespaceOPT{EncryptionKey: (&BasicCrypto{}).newEncryptionKey()})
+	addNamespace(server, "public", NamespaceOPT{Policy: PolicyReadOnly})
+	startServer(t, server)
+	t.Cleanup(func() {
+		server.Stop()
+		server.Storage.Clear()
+	})
+
+	gateway := httptest.NewServer(NewGateway(server))
+	defer gateway.Close()
+
+	do := func(method, namespace, path string, body io.Reader) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(method, gateway.URL+path, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if namespace != "" {
+			req.Header.Set(NamespaceHeader, namespace)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	if resp := do(http.MethodPut, "team-a", "/objects/doc", bytes.NewReader([]byte("hello"))); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("PUT: got %s", resp.Status)
+	}
+	if resp := do(http.MethodGet, "team-a", "/objects/doc", nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("GET in the namespace: got %s", resp.Status)
+	}
+	if _, err := os.Stat(filepath.Join(server.Storage.Config.RootDir, NamespaceFolderName, "team-a")); err != nil {
+		t.Errorf("the namespace has no folder: %v", err)
+	}
+	if server.Storage.HasKey("doc") {
+		t.Error("the file was stored in the default namespace")
+	}
+	if resp := do(http.MethodPut, "public", "/objects/doc", bytes.NewReader([]byte("hello"))); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("PUT in a read-only namespace: got %s, want 403", resp.Status)
+	}
+	if resp := do(http.MethodGet, "missing", "/objects", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown namespace: got %s, want 404", resp.Status)
+	}
+}
@@ -0,0 +1,303 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Priority is the class of a transfer to a peer. Background transfers yield
+// to client transfers on the links they share.
+type Priority uint8
+
+const (
+	// PriorityClient is for the transfers a client waits on, such as the
+	// replicas of a store or a file fetched for a get. Writes to a peer are
+	// made in this class unless told otherwise.
+	PriorityClient Priority = iota
+	// PriorityBackground is for the transfers the node makes on its own, such
+	// as rebalancing, re-replication and the repairs of the scrubber.
+	PriorityBackground
+
+	numPriorities
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityClient:
+		return "client"
+	case PriorityBackground:
+		return "background"
+	default:
+		return fmt.Sprintf("Priority(%d)", uint8(p))
+	}
+}
+
+const (
+	// maxThrottledWrite is the most bytes written at once by a rate limited
+	// write, so that the transfers sharing a limiter take turns.
+	maxThrottledWrite = 32 * 1024
+	// limiterBurst is how long the tokens of a limiter build up while it is idle.
+	limiterBurst = 100 * time.Millisecond
+	// yieldInterval is how long a background write waits before checking
+	// again whether the client writes are done with a limiter.
+	yieldInterval = 10 * time.Millisecond
+)
+
+// ErrInvalidBandwidthLimits is returned when bandwidth limits are negative.
+var ErrInvalidBandwidthLimits = errors.New("invalid bandwidth limits")
+
+// BandwidthLimits are the rates, in bytes per second, that the writes to the
+// peers are limited to. A zero value means unlimited.
+type BandwidthLimits struct {
+	// Total limits the writes to all the peers together.
+	Total int64 `json:"total"`
+	// PerPeer limits the writes to each peer.
+	PerPeer int64 `json:"perPeer"`
+	// Client and Background limit the writes of each priority class.
+	Client     int64 `json:"client"`
+	Background int64 `json:"background"`
+}
+
+func (l BandwidthLimits) validate() error {
+	if l.Total < 0 || l.PerPeer < 0 || l.Client < 0 || l.Background < 0 {
+		return fmt.Errorf("%w: rates must not be negative, got %+v", ErrInvalidBandwidthLimits, l)
+	}
+	return nil
+}
+
+// Limiter is a token bucket refilled at a rate of bytes per second. Writes
+// may take more tokens than the bucket holds and wait for the debt to be
+// paid, so the average rate stays at the limit whatever their size.
+type Limiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+
+	// clients counts the client writes using the limiter, which background
+	// writes wait for.
+	clients atomic.Int32
+}
+
+// NewLimiter returns a limiter of rate bytes per second. A zero rate means unlimited.
+func NewLimiter(rate int64) *Limiter {
+	l := &Limiter{}
+	l.SetRate(rate)
+	return l
+}
+
+// SetRate changes the rate of the limiter. A zero rate means unlimited.
+func (l *Limiter) SetRate(rate int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = float64(rate)
+	l.tokens = l.burst()
+	l.last = time.Now()
+}
+
+// Rate returns the rate of the limiter in bytes per second.
+func (l *Limiter) Rate() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int64(l.rate)
+}
+
+func (l *Limiter) burst() float64 {
+	return l.rate * limiterBurst.Seconds()
+}
+
+// refillLocked adds the tokens earned since the last refill.
+func (l *Limiter) refillLocked(now time.Time) {
+	l.tokens = min(l.burst(), l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+}
+
+// reserve takes n tokens and returns how long to wait before they are earned.
+func (l *Limiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return 0
+	}
+	l.refillLocked(time.Now())
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// yield returns how long a background write should wait before using the
+// limiter: while client writes use it, or while they left it in debt.
+func (l *Limiter) yield() time.Duration {
+	if l.clients.Load() > 0 {
+		return yieldInterval
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return 0
+	}
+	l.refillLocked(time.Now())
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// Bandwidth limits the writes of a TCPTransport to its peers: globally, per
+// peer and per priority class. The limits can be changed at any time.
+type Bandwidth struct {
+	mu     sync.Mutex
+	limits BandwidthLimits
+
+	total   *Limiter
+	classes [numPriorities]*Limiter
+	// peers are the limiters of the connected peers.
+	peers map[*Limiter]struct{}
+}
+
+// NewBandwidth returns a Bandwidth enforcing limits. Invalid limits are
+// treated as unlimited.
+func NewBandwidth(limits BandwidthLimits) *Bandwidth {
+	b := &Bandwidth{
+		total: NewLimiter(0),
+		peers: make(map[*Limiter]struct{}),
+	}
+	for i := range b.classes {
+		b.classes[i] = NewLimiter(0)
+	}
+	b.SetLimits(limits)
+	return b
+}
+
+// Limits returns the current limits.
+func (b *Bandwidth) Limits() BandwidthLimits {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.limits
+}
+
+// SetLimits replaces the limits, including those of the connected peers. It
+// returns an error wrapping ErrInvalidBandwidthLimits if a rate is negative.
+func (b *Bandwidth) SetLimits(limits BandwidthLimits) error {
+	if err := limits.validate(); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.limits = limits
+	b.total.SetRate(limits.Total)
+	b.classes[PriorityClient].SetRate(limits.Client)
+	b.classes[PriorityBackground].SetRate(limits.Background)
+	for peer := range b.peers {
+		peer.SetRate(limits.PerPeer)
+	}
+	return nil
+}
+
+// addPeer returns the limiter of a newly connected peer.
+func (b *Bandwidth) addPeer() *Limiter {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	peer := NewLimiter(b.limits.PerPeer)
+	b.peers[peer] = struct{}{}
+	return peer
+}
+
+// removePeer forgets the limiter of a disconnected peer.
+func (b *Bandwidth) removePeer(peer *Limiter) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.peers, peer)
+}
+
+// write writes p to conn in pieces, waiting with wait before each of them for
+// the limiters of the node, of the priority class and of the peer. It returns
+// the error of wait if the wait was cut short.
+func (b *Bandwidth) write(conn net.Conn, peer *Limiter, p []byte, priority Priority, wait func(time.Duration) error) (int, error) {
+	if priority >= numPriorities {
+		priority = PriorityBackground
+	}
+	shared := []*Limiter{b.total, peer}
+	limiters := []*Limiter{b.total, b.classes[priority], peer}
+
+	if priority == PriorityClient {
+		for _, l := range shared {
+			l.clients.Add(1)
+			defer l.clients.Add(-1)
+		}
+	}
+
+	var written int
+	for len(p) > 0 {
+		piece := p[:min(len(p), maxThrottledWrite)]
+
+		if priority == PriorityBackground {
+			for {
+				var delay time.Duration
+				for _, l := range shared {
+					delay = max(delay, l.yield())
+				}
+				if delay == 0 {
+					break
+				}
+				if err := wait(delay); err != nil {
+					return written, err
+				}
+			}
+		}
+		var delay time.Duration
+		for _, l := range limiters {
+			delay = max(delay, l.reserve(len(piece)))
+		}
+		if err := wait(delay); err != nil {
+			return written, err
+		}
+
+		n, err := conn.Write(piece)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// priorityWriter is implemented by the peers whose writes are rate limited
+// by priority class.
+type priorityWriter interface {
+	WriteContext(context.Context, []byte, Priority) (int, error)
+}
+
+// WritePriority writes p to the peer in the priority class. A write waiting
+// for the bandwidth limits returns the error of the context once it is done.
+// Peers that do not limit their bandwidth are written to directly.
+func WritePriority(ctx context.Context, peer Peer, p []byte, priority Priority) (int, error) {
+	if w, ok := peer.(priorityWriter); ok {
+		return w.WriteContext(ctx, p, priority)
+	}
+	return peer.Write(p)
+}
+
+// PriorityWriter returns a writer to the peer in the priority class. See
+// WritePriority.
+func PriorityWriter(ctx context.Context, peer Peer, priority Priority) io.Writer {
+	return writerFunc(func(p []byte) (int, error) {
+		return WritePriority(ctx, peer, p, priority)
+	})
+}
+
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
@@ -0,0 +1,153 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// throttledPeer returns a peer limited by bandwidth whose writes are read and
+// discarded.
+func throttledPeer(t *testing.T, bandwidth *Bandwidth) *TCPPeer {
+	conn, remote := net.Pipe()
+	t.Cleanup(func() {
+		conn.Close()
+		remote.Close()
+	})
+	go io.Copy(io.Discard, remote)
+
+	peer := NewTCPPeer(conn, true)
+	peer.bandwidth = bandwidth
+	peer.limiter = bandwidth.addPeer()
+	return peer
+}
+
+func TestBandwidthLimits(t *testing.T) {
+	bandwidth := NewBandwidth(BandwidthLimits{PerPeer: 256 * 1024})
+	peer := throttledPeer(t, bandwidth)
+
+	start := time.Now()
+	if _, err := peer.Write(make([]byte, 128*1024)); err != nil {
+		t.Fatal(err)
+	}
+	// The burst of the limiter is sent right away, the rest at the rate.
+	if elapsed, want := time.Since(start), 300*time.Millisecond; elapsed < want {
+		t.Errorf("writing 128 KiB at 256 KiB/s took %s, want at least %s", elapsed, want)
+	}
+
+	// The limits of connected peers change at runtime.
+	if err := bandwidth.SetLimits(BandwidthLimits{}); err != nil {
+		t.Fatal(err)
+	}
+	start = time.Now()
+	if _, err := peer.Write(make([]byte, 1024*1024)); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Errorf("writing 1 MiB without limits took %s", elapsed)
+	}
+
+	if err := bandwidth.SetLimits(BandwidthLimits{Total: -1}); err == nil {
+		t.Error("SetLimits accepted a negative rate")
+	}
+}
+
+func TestBandwidthPriority(t *testing.T) {
+	bandwidth := NewBandwidth(BandwidthLimits{Total: 512 * 1024})
+	peers := []*TCPPeer{throttledPeer(t, bandwidth), throttledPeer(t, bandwidth)}
+
+	var (
+		sent [numPriorities]atomic.Int64
+		stop atomic.Bool
+		wg   sync.WaitGroup
+	)
+	for i, priority := range []Priority{PriorityClient, PriorityBackground} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, 8*1024)
+			for !stop.Load() {
+				n, err := peers[i].WritePriority(buf, priority)
+				sent[priority].Add(int64(n))
+				if err != nil {
+					return
+				}
+			}
+		}()
+		// Let the client traffic use up the burst of the limiter.
+		time.Sleep(50 * time.Millisecond)
+	}
+	time.Sleep(500 * time.Millisecond)
+	stop.Store(true)
+	wg.Wait()
+
+	// Background traffic yields to client traffic on the shared limit.
+	client, background := sent[PriorityClient].Load(), sent[PriorityBackground].Load()
+	if client < 10*background {
+		t.Errorf("sent %d bytes of client traffic and %d bytes of background traffic, want the client traffic to take most of the bandwidth", client, background)
+	}
+}
+
+func TestBandwidthWriteContext(t *testing.T) {
+	bandwidth := NewBandwidth(BandwidthLimits{PerPeer: 64 * 1024})
+	peer := throttledPeer(t, bandwidth)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := peer.WriteContext(ctx, make([]byte, 1024*1024), PriorityClient); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("throttled write with an expired context: got error %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("throttled write returned %s after its context expired", elapsed)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		peer.Close()
+	}()
+	if _, err := peer.Write(make([]byte, 1024*1024)); err == nil {
+		t.Error("throttled write to a closed peer succeeded")
+	}
+}
+
+func TestBandwidthWritesAreWhole(t *testing.T) {
+	conn, remote := net.Pipe()
+	t.Cleanup(func() {
+		conn.Close()
+		remote.Close()
+	})
+	bandwidth := NewBandwidth(BandwidthLimits{PerPeer: 1024 * 1024})
+	peer := NewTCPPeer(conn, true)
+	peer.bandwidth = bandwidth
+	peer.limiter = bandwidth.addPeer()
+
+	// Every write is split in pieces by the limiter.
+	const size = 8 * maxThrottledWrite
+	var wg sync.WaitGroup
+	for _, b := range []byte("ab") {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			peer.Write(bytes.Repeat([]byte{b}, size))
+		}()
+	}
+
+	received := make([]byte, 2*size)
+	if _, err := io.ReadFull(remote, received); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	for _, write := range [][]byte{received[:size], received[size:]} {
+		if n := bytes.Count(write, write[:1]); n != size {
+			t.Errorf("writes were interleaved: got %d bytes of a write in a row of %d", n, size)
+			break
+		}
+	}
+}
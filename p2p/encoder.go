@@ -1,7 +1,9 @@
 package p2p
 
 import (
+	"encoding/binary"
 	"encoding/gob"
+	"fmt"
 	"io"
 )
 
@@ -27,26 +29,39 @@ type DefaultDecoder struct{}
 // Decode reads data from the provided io.Reader and decodes it into the given RPC message.
 // It first peeks at the first byte to determine if the incoming data is a stream.
 // If it is a stream, it sets the Stream field of the RPC message to true and returns without further reading.
-// Otherwise, it reads up to 1024 bytes from the reader into the Payload field of the RPC message.
+// Otherwise, it reads the payload framed by EncodeMessage into the Payload field of the RPC message, and
+// sets Stream as well for a payload framed by EncodeStreamMessage.
 func (Decoder DefaultDecoder) Decode(reader io.Reader, msg *RPC) error {
 	peekBuf := make([]byte, 1)
-	if _, err := reader.Read(peekBuf); err != nil {
-		return nil
+	if _, err := io.ReadFull(reader, peekBuf); err != nil {
+		return err
 	}
 
 	// In case of a stream we are not decoding what is being sent over the network.
-	stream := peekBuf[0] == IncomingStream
-	if stream {
+	switch peekBuf[0] {
+	case IncomingStream:
 		msg.Stream = true
 		return nil
+	case IncomingMessage:
+	case IncomingStreamMessage:
+		msg.Stream = true
+	default:
+		return fmt.Errorf("unexpected message marker %#x", peekBuf[0])
+	}
+
+	var length uint32
+	if err := binary.Read(reader, binary.LittleEndian, &length); err != nil {
+		return err
+	}
+	if length > MaxMessageSize {
+		return fmt.Errorf("message of %d bytes exceeds the maximum of %d", length, MaxMessageSize)
 	}
 
-	buf := make([]byte, 1024)
-	n, err := reader.Read(buf)
-	if err != nil {
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(reader, buf); err != nil {
 		return err
 	}
 
-	msg.Payload = buf[:n]
+	msg.Payload = buf
 	return nil
 }
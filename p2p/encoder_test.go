@@ -0,0 +1,76 @@
+package p2p
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+func TestDefaultDecoder(t *testing.T) {
+	t.Run("message followed by a stream", func(t *testing.T) {
+		payload := bytes.Repeat([]byte("x"), 4096)
+		r := bytes.NewReader(append(append(EncodeMessage(payload), IncomingStream), "stream data"...))
+
+		var msg RPC
+		if err := (DefaultDecoder{}).Decode(r, &msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Stream || !bytes.Equal(msg.Payload, payload) {
+			t.Fatalf("got a message of %d bytes, stream %v, want %d bytes", len(msg.Payload), msg.Stream, len(payload))
+		}
+
+		msg = RPC{}
+		if err := (DefaultDecoder{}).Decode(r, &msg); err != nil {
+			t.Fatal(err)
+		}
+		if !msg.Stream {
+			t.Fatal("the stream marker was not decoded as a stream")
+		}
+		if rest, _ := io.ReadAll(r); string(rest) != "stream data" {
+			t.Errorf("the stream was read by the decoder, left %q", rest)
+		}
+	})
+
+	t.Run("stream message", func(t *testing.T) {
+		r := bytes.NewReader(append(EncodeStreamMessage([]byte("payload")), "stream data"...))
+
+		var msg RPC
+		if err := (DefaultDecoder{}).Decode(r, &msg); err != nil {
+			t.Fatal(err)
+		}
+		if !msg.Stream || string(msg.Payload) != "payload" {
+			t.Fatalf("got payload %q, stream %v, want a stream message", msg.Payload, msg.Stream)
+		}
+		if rest, _ := io.ReadAll(r); string(rest) != "stream data" {
+			t.Errorf("the stream was read by the decoder, left %q", rest)
+		}
+	})
+
+	t.Run("oversized message", func(t *testing.T) {
+		frame := make([]byte, 5)
+		frame[0] = IncomingMessage
+		binary.LittleEndian.PutUint32(frame[1:], MaxMessageSize+1)
+
+		var msg RPC
+		if err := (DefaultDecoder{}).Decode(bytes.NewReader(frame), &msg); err == nil {
+			t.Error("decoded a message larger than MaxMessageSize")
+		}
+	})
+
+	t.Run("truncated message", func(t *testing.T) {
+		frame := EncodeMessage([]byte("payload"))
+
+		var msg RPC
+		if err := (DefaultDecoder{}).Decode(bytes.NewReader(frame[:len(frame)-1]), &msg); err == nil {
+			t.Error("decoded a truncated message")
+		}
+	})
+
+	t.Run("unknown marker", func(t *testing.T) {
+		var msg RPC
+		if err := (DefaultDecoder{}).Decode(bytes.NewReader([]byte{0x7f, 0, 0, 0, 0}), &msg); err == nil {
+			t.Error("decoded a frame with an unknown marker")
+		}
+	})
+}
@@ -1,15 +1,48 @@
 package p2p
 
-import "net"
+import (
+	"encoding/binary"
+	"net"
+)
 
 const (
 	IncomingMessage = 0x1
 	IncomingStream  = 0x2
+	// IncomingStreamMessage frames a message whose handler reads the stream
+	// sent right after it. See EncodeStreamMessage.
+	IncomingStreamMessage = 0x3
 )
 
+// MaxMessageSize is the largest message payload accepted by DefaultDecoder.
+const MaxMessageSize = 1 << 20
+
+// EncodeMessage frames a message payload to be sent with Peer.Send: the
+// IncomingMessage marker, the length of the payload as a little endian uint32,
+// then the payload. The length lets the receiver stop reading at the end of the
+// message, so that a stream sent right after it is not taken for a part of it.
+func EncodeMessage(payload []byte) []byte {
+	return encodeFrame(IncomingMessage, payload)
+}
+
+// EncodeStreamMessage frames a message payload like EncodeMessage, for a
+// message followed by a stream. The transport stops reading the connection as
+// soon as it has read the message, so that the stream is left to its handler
+// without the sender having to wait in between.
+func EncodeStreamMessage(payload []byte) []byte {
+	return encodeFrame(IncomingStreamMessage, payload)
+}
+
+func encodeFrame(marker byte, payload []byte) []byte {
+	frame := make([]byte, 5, 5+len(payload))
+	frame[0] = marker
+	binary.LittleEndian.PutUint32(frame[1:5], uint32(len(payload)))
+	return append(frame, payload...)
+}
+
 // RPC represents a message in the peer-to-peer network.
 // It contains the address of the sender, the payload of the message, and a flag
-// to indicate wether the message is part of a stream.
+// to indicate wether the message is part of a stream. A message framed by
+// EncodeStreamMessage has both a Payload and Stream set.
 type RPC struct {
 	From    net.Addr
 	Payload []byte
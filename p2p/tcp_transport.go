@@ -1,9 +1,12 @@
 package p2p
 
 import (
-	"fmt"
+	"context"
+	"errors"
+	"log/slog"
 	"net"
 	"sync"
+	"time"
 )
 
 // TCPPeer represents a peer in the network using TCP for communication.
@@ -19,6 +22,22 @@ type TCPPeer struct {
 	// wg (WaitGroup) is used to block the handling loop while waiting for RPC streaming
 	// messages to complete processing.
 	wg *sync.WaitGroup
+	// streams receives a value once the handling loop is blocked on a stream
+	// that is not read by the handler of a message, for AwaitStream.
+	streams chan struct{}
+
+	// bandwidth limits the writes to the peer, along with limiter, the limiter
+	// of this peer. A nil bandwidth means unlimited.
+	bandwidth *Bandwidth
+	limiter   *Limiter
+
+	// writeLock keeps every write to the peer whole, even when it is sent in
+	// pieces to stay within the bandwidth limits.
+	writeLock sync.Mutex
+	// closed is closed by Close, which stops the writes waiting for the
+	// bandwidth limits.
+	closed    chan struct{}
+	closeOnce sync.Once
 }
 
 func NewTCPPeer(conn net.Conn, outbound bool) *TCPPeer {
@@ -26,6 +45,33 @@ func NewTCPPeer(conn net.Conn, outbound bool) *TCPPeer {
 		Conn:     conn,
 		outbound: outbound,
 		wg:       &sync.WaitGroup{},
+		streams:  make(chan struct{}, 1),
+		closed:   make(chan struct{}),
+	}
+}
+
+// Close closes the connection to the peer.
+func (p *TCPPeer) Close() error {
+	p.closeOnce.Do(func() { close(p.closed) })
+	return p.Conn.Close()
+}
+
+// Outbound reports whether the connection was dialed by this node.
+func (p *TCPPeer) Outbound() bool {
+	return p.outbound
+}
+
+// AwaitStream blocks until the handling loop has read the marker of a stream
+// sent by the peer and stopped reading the connection, so that the caller can
+// read the stream. It returns early once the context is done or the peer is closed.
+func (p *TCPPeer) AwaitStream(ctx context.Context) error {
+	select {
+	case <-p.streams:
+		return nil
+	case <-p.closed:
+		return net.ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 
@@ -35,21 +81,79 @@ func (p *TCPPeer) CloseStream() {
 }
 
 func (p *TCPPeer) Send(bytes []byte) error {
-	_, err := p.Conn.Write(bytes)
+	_, err := p.Write(bytes)
 	return err
 }
 
+// Write writes b to the peer as client traffic, within the bandwidth limits
+// of the transport.
+func (p *TCPPeer) Write(b []byte) (int, error) {
+	return p.WriteContext(context.Background(), b, PriorityClient)
+}
+
+// WritePriority writes b to the peer in the priority class, within the
+// bandwidth limits of the transport.
+func (p *TCPPeer) WritePriority(b []byte, priority Priority) (int, error) {
+	return p.WriteContext(context.Background(), b, priority)
+}
+
+// WriteContext is like WritePriority, but stops waiting for the bandwidth
+// limits once the context is done. The writes from other goroutines are not
+// interleaved with b.
+func (p *TCPPeer) WriteContext(ctx context.Context, b []byte, priority Priority) (int, error) {
+	p.writeLock.Lock()
+	defer p.writeLock.Unlock()
+
+	if p.bandwidth == nil {
+		return p.Conn.Write(b)
+	}
+	return p.bandwidth.write(p.Conn, p.limiter, b, priority, func(d time.Duration) error {
+		return p.wait(ctx, d)
+	})
+}
+
+// errPeerClosed is returned by the writes to a peer closed while they waited
+// for the bandwidth limits.
+var errPeerClosed = errors.New("peer connection closed")
+
+// wait pauses for d, or until the context is done or the peer is closed.
+func (p *TCPPeer) wait(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-p.closed:
+		return errPeerClosed
+	}
+}
+
 // TCPTransportOPT holds the configuration options for the TCP transport layer.
 // It includes the address to listen on and a function for handling handshakes.
 //
 // Fields:
 // - ListenAddress: The address on which the TCP transport will listen for incoming connections.
 // - HandshakeFunc: A function that defines the handshake process for establishing connections.
+// - DialTimeout: How long Dial waits for a connection to be established. Zero means no timeout.
+// - OnPeerDisconnect: Called once the connection to a peer accepted by OnPeer is lost.
+// - Logger: Receives the logs of the transport. A nil Logger means slog.Default().
+// - Bandwidth: Limits the writes to the peers. A nil Bandwidth means unlimited,
+// with limits that can be set later through TCPTransport.Bandwidth.
 type TCPTransportOPT struct {
-	ListenAddress string
-	HandshakeFunc HandshakeFunc
-	Decoder       Decoder
-	OnPeer        func(Peer) error
+	ListenAddress    string
+	HandshakeFunc    HandshakeFunc
+	Decoder          Decoder
+	OnPeer           func(Peer) error
+	OnPeerDisconnect func(Peer)
+	DialTimeout      time.Duration
+	Logger           *slog.Logger
+	Bandwidth        *Bandwidth
 }
 
 // TCPTransport represents a transport layer for peer-to-peer communication over TCP.
@@ -60,15 +164,35 @@ type TCPTransport struct {
 	tcpTransportOPT *TCPTransportOPT
 	listener        net.Listener
 	rpcCh           chan RPC
+	logger          *slog.Logger
+	bandwidth       *Bandwidth
 }
 
 func NewTCPTransport(tcpTransportOPT *TCPTransportOPT) *TCPTransport {
+	logger := tcpTransportOPT.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	bandwidth := tcpTransportOPT.Bandwidth
+	if bandwidth == nil {
+		bandwidth = NewBandwidth(BandwidthLimits{})
+	}
+
 	return &TCPTransport{
 		tcpTransportOPT: tcpTransportOPT,
 		rpcCh:           make(chan RPC, 1024),
+		logger:          logger.With("node", tcpTransportOPT.ListenAddress),
+		bandwidth:       bandwidth,
 	}
 }
 
+// Bandwidth returns the limits of the writes to the peers, which can be
+// changed while the transport runs.
+func (t *TCPTransport) Bandwidth() *Bandwidth {
+	return t.bandwidth
+}
+
 // Implements the transport interface
 func (t *TCPTransport) Close() error {
 	return t.listener.Close()
@@ -80,16 +204,28 @@ func (t *TCPTransport) RemoteAddr() string {
 }
 
 // Dial establishes a TCP connection to the specified address.
-// Once connected, it spawns a goroutine to handle the connection asynchronously.
-// Returns an error if the connection cannot be established.
+// Once the peer is accepted, it spawns a goroutine to read its messages.
+// Returns an error if the connection cannot be established or the peer is refused.
 func (t *TCPTransport) Dial(address string) error {
-	conn, err := net.Dial("tcp", address)
+	return t.DialContext(context.Background(), address)
+}
+
+// DialContext is like Dial but gives up connecting once the context is done.
+// It returns once the handshake is done and OnPeer accepted the peer, so the
+// peer is known to the caller when it returns.
+func (t *TCPTransport) DialContext(ctx context.Context, address string) error {
+	dialer := net.Dialer{Timeout: t.tcpTransportOPT.DialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
 
 	if err != nil {
 		return err
 	}
 
-	go t.handleConn(conn, true)
+	peer, err := t.acceptPeer(conn, true)
+	if err != nil {
+		return err
+	}
+	go t.readLoop(peer)
 
 	return nil
 }
@@ -110,7 +246,7 @@ func (t *TCPTransport) ListenAndAccept() error {
 
 	go t.startAcceptLoop()
 
-	fmt.Printf("TCPTransport listening on address: %s\n", t.listener.Addr())
+	t.logger.Info("TCPTransport listening", "address", t.listener.Addr().String())
 	return nil
 }
 
@@ -122,12 +258,12 @@ func (t *TCPTransport) startAcceptLoop() {
 			// Check if the error is due to the listener being closed
 			// if it's stop the for loop.
 			if opErr, ok := err.(*net.OpError); ok && !opErr.Temporary() {
-				fmt.Println("TCP listener closed, stopping accept loop")
+				t.logger.Info("TCP listener closed, stopping accept loop")
 				return
 			}
 
 			// For other errors, log and continue to try accepting connections
-			fmt.Printf("TCP accept error: %s\n", err)
+			t.logger.Warn("TCP accept error", "error", err)
 			continue
 		}
 
@@ -135,46 +271,74 @@ func (t *TCPTransport) startAcceptLoop() {
 	}
 }
 
-// handleConn handles an incoming TCP connection. It performs a handshake
-// with the peer, invokes the OnPeer callback if set, and continuously decodes
-// incoming RPC messages, sending them to the rpcCh channel.
-//
-// If the message is part of a stream, the read is blocked by using the peer's
-// WaitGroup (wg). This allows the server to directly use the net.Conn for reading
-// streaming data without sending the message to the RPC channel.
+// handleConn handles an incoming TCP connection. It accepts the peer, then
+// reads its messages until the connection is closed.
 func (t *TCPTransport) handleConn(conn net.Conn, outbound bool) {
-	var err error
-	defer func() {
-		fmt.Printf("Dropping peer connection due to error: %v\n", err)
-	}()
+	if peer, err := t.acceptPeer(conn, outbound); err == nil {
+		t.readLoop(peer)
+	}
+}
 
+// acceptPeer performs a handshake with the peer and invokes the OnPeer
+// callback if set. The connection is closed when either fails.
+func (t *TCPTransport) acceptPeer(conn net.Conn, outbound bool) (*TCPPeer, error) {
 	peer := NewTCPPeer(conn, outbound)
+	peer.bandwidth = t.bandwidth
+	peer.limiter = t.bandwidth.addPeer()
 
-	if err = t.tcpTransportOPT.HandshakeFunc(peer); err != nil {
-		return
+	err := t.tcpTransportOPT.HandshakeFunc(peer)
+	if err == nil && t.tcpTransportOPT.OnPeer != nil {
+		err = t.tcpTransportOPT.OnPeer(peer)
 	}
+	if err != nil {
+		t.bandwidth.removePeer(peer.limiter)
+		t.logger.Debug("Dropping peer connection", "peer", conn.RemoteAddr().String(), "error", err)
+		peer.Close()
+		return nil, err
+	}
+	return peer, nil
+}
 
-	if t.tcpTransportOPT.OnPeer != nil {
-		if err = t.tcpTransportOPT.OnPeer(peer); err != nil {
-			return
+// readLoop continuously decodes the incoming RPC messages of an accepted
+// peer, sending them to the rpcCh channel.
+//
+// If the message is part of a stream, the read is blocked by using the peer's
+// WaitGroup (wg). This allows the server to directly use the net.Conn for reading
+// streaming data without sending the message to the RPC channel. A message framed
+// by EncodeStreamMessage is sent to the RPC channel once the read is blocked, and
+// its handler reads the stream that follows it. Other streams are handed to
+// AwaitStream.
+func (t *TCPTransport) readLoop(peer *TCPPeer) {
+	var err error
+	defer func() {
+		t.bandwidth.removePeer(peer.limiter)
+		t.logger.Debug("Dropping peer connection", "peer", peer.RemoteAddr().String(), "error", err)
+		peer.Close()
+		if t.tcpTransportOPT.OnPeerDisconnect != nil {
+			t.tcpTransportOPT.OnPeerDisconnect(peer)
 		}
-	}
+	}()
 
-	// Continuously decode the incoming RPC messages.
 	for {
 		rpc := RPC{}
-		rpc.From = conn.RemoteAddr()
+		rpc.From = peer.RemoteAddr()
 
-		err = t.tcpTransportOPT.Decoder.Decode(conn, &rpc)
+		err = t.tcpTransportOPT.Decoder.Decode(peer.Conn, &rpc)
 		if err != nil {
 			return
 		}
 
 		if rpc.Stream {
 			peer.wg.Add(1)
-			fmt.Printf("%s Received streaming RPC message from %v\n", t.RemoteAddr(), rpc.From)
+			if rpc.Payload != nil {
+				// The handler of the message reads the stream that follows it.
+				t.rpcCh <- rpc
+			} else {
+				peer.streams <- struct{}{}
+			}
+			t.logger.Debug("Received streaming RPC message", "peer", rpc.From.String())
 			peer.wg.Wait()
-			fmt.Printf("Finished processing stream from peer %v\n", rpc.From)
+			t.logger.Debug("Finished processing stream", "peer", rpc.From.String())
 			continue
 		}
 
@@ -3,12 +3,19 @@
 
 package p2p
 
-import "net"
+import (
+	"context"
+	"net"
+)
 
 // Peer represents a node in the network.
 type Peer interface{
 	net.Conn
 	Send([]byte) error
+	// AwaitStream blocks until the transport has read the marker of a stream
+	// sent by the peer, which is then read from the connection and ended with
+	// CloseStream.
+	AwaitStream(context.Context) error
 	CloseStream()
 }
 
@@ -16,7 +23,10 @@ type Peer interface{
 // It can be implemented using various protocols such as TCP, UDP, etc.
 type Transport interface{
 	RemoteAddr() string
+	// Dial connects to the node at the address. It returns once the
+	// handshake is done and the peer is accepted.
 	Dial(string) error
+	DialContext(context.Context, string) error
 	ListenAndAccept() error
 	Consume() <-chan RPC
 	Close() error
@@ -0,0 +1,764 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MultipartFolderName is the folder under the root directory where the parts
+// of multipart uploads are staged until the upload is completed.
+const MultipartFolderName = ".multipart"
+
+// uploadManifestName is the file of a staged upload that records its key,
+// owner and options, so that the upload survives a restart of the gateway.
+const uploadManifestName = "upload.json"
+
+// s3MaxKeys is the default and maximum number of keys returned by ListObjectsV2.
+const s3MaxKeys = 1000
+
+var (
+	errNoSuchKey          = &s3Error{"NoSuchKey", "The specified key does not exist.", http.StatusNotFound}
+	errNoSuchUpload       = &s3Error{"NoSuchUpload", "The specified multipart upload does not exist.", http.StatusNotFound}
+	errInvalidPart        = &s3Error{"InvalidPart", "One or more of the specified parts could not be found.", http.StatusBadRequest}
+	errInvalidPartOrder   = &s3Error{"InvalidPartOrder", "The list of parts was not in ascending order.", http.StatusBadRequest}
+	errInvalidRange       = &s3Error{"InvalidRange", "The requested range is not satisfiable.", http.StatusRequestedRangeNotSatisfiable}
+	errMalformedXML       = &s3Error{"MalformedXML", "The XML you provided was not well-formed.", http.StatusBadRequest}
+	errBucketNotEmpty     = &s3Error{"BucketNotEmpty", "The bucket you tried to delete is not empty.", http.StatusConflict}
+	errNotImplemented     = &s3Error{"NotImplemented", "A header or operation you provided implies functionality that is not implemented.", http.StatusNotImplemented}
+	errInternalError      = &s3Error{"InternalError", "We encountered an internal error. Please try again.", http.StatusInternalServerError}
+	errMethodNotAllowed   = &s3Error{"MethodNotAllowed", "The specified method is not allowed against this resource.", http.StatusMethodNotAllowed}
+	errInvalidArgument    = &s3Error{"InvalidArgument", "Invalid argument.", http.StatusBadRequest}
+	errEntityTooSmall     = &s3Error{"EntityTooSmall", "Your proposed upload is smaller than the minimum allowed object size.", http.StatusBadRequest}
+	errInvalidContinToken = &s3Error{"InvalidArgument", "The continuation token provided is incorrect.", http.StatusBadRequest}
+	errServiceUnavailable = &s3Error{"ServiceUnavailable", "Please reduce your request rate.", http.StatusServiceUnavailable}
+	errStorageFull        = &s3Error{"StorageFull", "The node does not have enough storage left for this object.", http.StatusInsufficientStorage}
+)
+
+// S3Gateway exposes a FileServer through a subset of the S3 API, so that
+// existing S3 clients can use the cluster without code changes.
+//
+// Buckets are key prefixes: the object "key" of bucket "bucket" is stored
+// under "bucket/key". Requests must use path-style addressing and, when
+// credentials are configured, be signed with AWS Signature Version 4. When the
+// server has an AccessControl, the access key ID names the principal whose
+// grants apply, and requests of other access keys are denied.
+//
+// Supported operations: ListBuckets, CreateBucket, HeadBucket, DeleteBucket,
+// PutObject, GetObject (with Range), HeadObject, DeleteObject, ListObjectsV2,
+// CreateMultipartUpload, UploadPart, CompleteMultipartUpload and AbortMultipartUpload.
+// A multipart upload can only be used by the access key that created it, and
+// the uploads staged on disk are restored when the gateway is created again.
+type S3Gateway struct {
+	server *FileServer
+
+	// credentials maps access key IDs to their secret. When empty, requests are not authenticated.
+	credentials map[string]string
+
+	uploadLock sync.Mutex
+	uploads    map[string]*multipartUpload
+}
+
+// multipartUpload tracks an upload whose parts are staged on local disk. It is
+// saved as the manifest of the upload.
+type multipartUpload struct {
+	Key string
+	// Owner is the access key ID that created the upload, which names the
+	// principal with access control. Only the owner may use the upload.
+	Owner string
+	// Options are the content type, metadata and tags given when the upload was created.
+	Options StoreOptions
+
+	dir string
+}
+
+func NewS3Gateway(server *FileServer, credentials map[string]string) *S3Gateway {
+	if len(credentials) == 0 {
+		server.logger().Warn("S3 gateway has no credentials configured, requests are not authenticated")
+	}
+
+	g := &S3Gateway{
+		server:      server,
+		credentials: credentials,
+		uploads:     make(map[string]*multipartUpload),
+	}
+	g.loadUploads()
+	return g
+}
+
+// loadUploads restores the uploads staged before the gateway was restarted.
+// Staged folders without a readable manifest are removed.
+func (g *S3Gateway) loadUploads() {
+	root := filepath.Join(g.server.Storage.Config.RootDir, MultipartFolderName)
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			g.server.logger().Warn("Failed to read staged multipart uploads", "error", err)
+		}
+		return
+	}
+
+	for _, entry := range entries {
+		dir := filepath.Join(root, entry.Name())
+		upload, err := readUploadManifest(dir)
+		if err != nil {
+			g.server.logger().Warn("Removing staged multipart upload", "upload", entry.Name(), "error", err)
+			if err := os.RemoveAll(dir); err != nil {
+				g.server.logger().Warn("Failed to remove staged parts of upload", "upload", entry.Name(), "error", err)
+			}
+			continue
+		}
+		g.uploads[entry.Name()] = upload
+	}
+	if len(g.uploads) > 0 {
+		g.server.logger().Info("Restored staged multipart uploads", "uploads", len(g.uploads))
+	}
+}
+
+// readUploadManifest reads the manifest of the upload staged in dir.
+func readUploadManifest(dir string) (*multipartUpload, error) {
+	data, err := os.ReadFile(filepath.Join(dir, uploadManifestName))
+	if err != nil {
+		return nil, err
+	}
+	upload := &multipartUpload{dir: dir}
+	if err := json.Unmarshal(data, upload); err != nil {
+		return nil, fmt.Errorf("invalid upload manifest: %w", err)
+	}
+	return upload, nil
+}
+
+func (g *S3Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var accessKey string
+	if len(g.credentials) > 0 {
+		var err error
+		var chunks *sigV4ChunkSigner
+		if accessKey, chunks, err = verifySigV4(r, g.credentials); err != nil {
+			g.writeS3Error(w, r, err)
+			return
+		}
+		if chunks != nil {
+			r = r.WithContext(withChunkSigner(r.Context(), chunks))
+		}
+	}
+
+	// With access control, the access key ID names the principal.
+	if ac := g.server.Config.AccessControl; ac != nil {
+		principal, ok := ac.Principal(accessKey)
+		if !ok {
+			g.server.auditDenied(r.Context(), "authenticate", DefaultNamespace, strings.TrimPrefix(r.URL.Path, "/"),
+				fmt.Errorf("%w: no principal for access key %q", ErrUnauthenticated, accessKey))
+			g.writeS3Error(w, r, errAccessDenied)
+			return
+		}
+		r = r.WithContext(WithPrincipal(r.Context(), principal))
+	}
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	query := r.URL.Query()
+
+	var err error
+	switch {
+	case bucket == "":
+		if r.Method != http.MethodGet {
+			err = errMethodNotAllowed
+			break
+		}
+		err = g.listBuckets(w, r)
+	case key == "":
+		err = g.serveBucket(w, r, bucket)
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		err = g.createMultipartUpload(w, r, bucket, key, accessKey)
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		err = g.completeMultipartUpload(w, r, bucket, key, query.Get("uploadId"), accessKey)
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		err = g.uploadPart(w, r, bucket+"/"+key, query.Get("uploadId"), query.Get("partNumber"), accessKey)
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		err = g.abortMultipartUpload(w, r, bucket+"/"+key, query.Get("uploadId"), accessKey)
+	case r.Method == http.MethodPut:
+		err = g.putObject(w, r, bucket+"/"+key)
+	case r.Method == http.MethodGet:
+		err = g.getObject(w, r, bucket+"/"+key)
+	case r.Method == http.MethodHead:
+		err = g.headObject(w, r, bucket+"/"+key)
+	case r.Method == http.MethodDelete:
+		err = g.deleteObject(w, r, bucket+"/"+key)
+	default:
+		err = errMethodNotAllowed
+	}
+
+	if err != nil {
+		g.writeS3Error(w, r, err)
+	}
+}
+
+func (g *S3Gateway) serveBucket(w http.ResponseWriter, r *http.Request, bucket string) error {
+	switch r.Method {
+	case http.MethodPut, http.MethodHead:
+		// Buckets are key prefixes, so they always exist.
+		w.WriteHeader(http.StatusOK)
+		return nil
+	case http.MethodDelete:
+		objects, err := g.server.ListContext(r.Context(), bucket+"/")
+		if err != nil {
+			return err
+		}
+		if len(objects) > 0 {
+			return errBucketNotEmpty
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	case http.MethodGet:
+		if r.URL.Query().Get("list-type") != "2" {
+			return errNotImplemented
+		}
+		return g.listObjectsV2(w, r, bucket)
+	default:
+		return errMethodNotAllowed
+	}
+}
+
+type s3Bucket struct {
+	Name         string `xml:"Name"`
+	CreationDate string `xml:"CreationDate"`
+}
+
+type listAllMyBucketsResult struct {
+	XMLName xml.Name   `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListAllMyBucketsResult"`
+	Owner   s3Owner    `xml:"Owner"`
+	Buckets []s3Bucket `xml:"Buckets>Bucket"`
+}
+
+type s3Owner struct {
+	ID          string `xml:"ID"`
+	DisplayName string `xml:"DisplayName"`
+}
+
+// listBuckets reports every first key segment as a bucket.
+func (g *S3Gateway) listBuckets(w http.ResponseWriter, r *http.Request) error {
+	objects, err := g.server.ListContext(r.Context(), "")
+	if err != nil {
+		return err
+	}
+
+	created := make(map[string]time.Time)
+	for _, object := range objects {
+		bucket, _, ok := strings.Cut(object.Key, "/")
+		if !ok {
+			continue
+		}
+		if t, exists := created[bucket]; !exists || object.ModTime.Before(t) {
+			created[bucket] = object.ModTime
+		}
+	}
+
+	result := listAllMyBucketsResult{
+		Owner: s3Owner{ID: "go-distributed-storage", DisplayName: "go-distributed-storage"},
+	}
+	for name, t := range created {
+		result.Buckets = append(result.Buckets, s3Bucket{Name: name, CreationDate: t.UTC().Format(time.RFC3339)})
+	}
+	sort.Slice(result.Buckets, func(i, j int) bool {
+		return result.Buckets[i].Name < result.Buckets[j].Name
+	})
+
+	return g.writeXML(w, http.StatusOK, result)
+}
+
+type s3Object struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type s3CommonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+type listBucketV2Result struct {
+	XMLName               xml.Name         `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+	Name                  string           `xml:"Name"`
+	Prefix                string           `xml:"Prefix"`
+	Delimiter             string           `xml:"Delimiter,omitempty"`
+	StartAfter            string           `xml:"StartAfter,omitempty"`
+	MaxKeys               int              `xml:"MaxKeys"`
+	KeyCount              int              `xml:"KeyCount"`
+	IsTruncated           bool             `xml:"IsTruncated"`
+	ContinuationToken     string           `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string           `xml:"NextContinuationToken,omitempty"`
+	Contents              []s3Object       `xml:"Contents"`
+	CommonPrefixes        []s3CommonPrefix `xml:"CommonPrefixes"`
+}
+
+func (g *S3Gateway) listObjectsV2(w http.ResponseWriter, r *http.Request, bucket string) error {
+	query := r.URL.Query()
+	result := listBucketV2Result{
+		Name:              bucket,
+		Prefix:            query.Get("prefix"),
+		Delimiter:         query.Get("delimiter"),
+		StartAfter:        query.Get("start-after"),
+		MaxKeys:           s3MaxKeys,
+		ContinuationToken: query.Get("continuation-token"),
+	}
+
+	if maxKeys := query.Get("max-keys"); maxKeys != "" {
+		n, err := strconv.Atoi(maxKeys)
+		if err != nil || n < 0 {
+			return errInvalidArgument
+		}
+		if n < s3MaxKeys {
+			result.MaxKeys = n
+		}
+	}
+
+	// Keys strictly greater than marker are returned.
+	marker := result.StartAfter
+	if result.ContinuationToken != "" {
+		b, err := base64.URLEncoding.DecodeString(result.ContinuationToken)
+		if err != nil {
+			return errInvalidContinToken
+		}
+		marker = string(b)
+	}
+
+	objects, err := g.server.ListContext(r.Context(), bucket+"/"+result.Prefix)
+	if err != nil {
+		return err
+	}
+	if result.MaxKeys == 0 {
+		// No key is listed, so there is nothing to continue from either.
+		objects = nil
+	}
+
+	seenPrefixes := make(map[string]bool)
+	last := ""
+	for _, object := range objects {
+		key := strings.TrimPrefix(object.Key, bucket+"/")
+		entry := key
+		if result.Delimiter != "" {
+			if i := strings.Index(key[len(result.Prefix):], result.Delimiter); i >= 0 {
+				entry = key[:len(result.Prefix)+i+len(result.Delimiter)]
+			}
+		}
+		if entry <= marker || seenPrefixes[entry] {
+			continue
+		}
+
+		if result.KeyCount == result.MaxKeys {
+			result.IsTruncated = true
+			result.NextContinuationToken = base64.URLEncoding.EncodeToString([]byte(last))
+			break
+		}
+
+		if entry != key {
+			seenPrefixes[entry] = true
+			result.CommonPrefixes = append(result.CommonPrefixes, s3CommonPrefix{Prefix: entry})
+		} else {
+			result.Contents = append(result.Contents, s3Object{
+				Key:          key,
+				LastModified: object.ModTime.UTC().Format(time.RFC3339),
+				ETag:         s3ETag(object),
+				Size:         object.Size,
+				StorageClass: "STANDARD",
+			})
+		}
+		result.KeyCount++
+		last = entry
+	}
+
+	return g.writeXML(w, http.StatusOK, result)
+}
+
+func (g *S3Gateway) putObject(w http.ResponseWriter, r *http.Request, key string) error {
+	if r.Header.Get("X-Amz-Copy-Source") != "" {
+		return errNotImplemented
+	}
+
+	opts, err := s3StoreOptions(r)
+	if err != nil {
+		return err
+	}
+	if err := g.server.StoreWithOptions(r.Context(), key, s3Body(r), opts); err != nil {
+		return err
+	}
+
+	info, err := g.server.StatContext(r.Context(), key)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("ETag", s3ETag(info))
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (g *S3Gateway) headObject(w http.ResponseWriter, r *http.Request, key string) error {
+	info, err := g.server.StatContext(r.Context(), key)
+	if err != nil {
+		return err
+	}
+
+	setS3ObjectHeaders(w, info)
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (g *S3Gateway) getObject(w http.ResponseWriter, r *http.Request, key string) error {
+	info, err := g.server.StatContext(r.Context(), key)
+	if err != nil {
+		return err
+	}
+	setS3ObjectHeaders(w, info)
+
+	rangeHeader := r.Header.Get("Range")
+	if rangeHeader == "" {
+		body, err := g.server.GetContext(r.Context(), key)
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+
+		w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+		w.WriteHeader(http.StatusOK)
+		copyBody(w, g.server.logger(), body, key)
+		return nil
+	}
+
+	offset, length, err := parseRange(rangeHeader, info.Size)
+	if err != nil {
+		return errInvalidRange
+	}
+
+	body, err := g.server.GetRangeContext(r.Context(), key, offset, length)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, info.Size))
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	w.WriteHeader(http.StatusPartialContent)
+	copyBody(w, g.server.logger(), body, key)
+	return nil
+}
+
+// deleteObject deletes the object. Like S3, deleting a missing object succeeds.
+func (g *S3Gateway) deleteObject(w http.ResponseWriter, r *http.Request, key string) error {
+	if err := g.server.DeleteContext(r.Context(), key); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+type initiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ InitiateMultipartUploadResult"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	UploadID string   `xml:"UploadId"`
+}
+
+func (g *S3Gateway) createMultipartUpload(w http.ResponseWriter, r *http.Request, bucket, key, owner string) error {
+	// Refuse to stage parts that could not be stored.
+	if err := g.server.authorize(r.Context(), g.server.defaultNamespace(), PermissionWrite, bucket+"/"+key); err != nil {
+		return err
+	}
+	opts, err := s3StoreOptions(r)
+	if err != nil {
+		return err
+	}
+
+	id := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		return err
+	}
+	uploadID := hex.EncodeToString(id)
+
+	dir := filepath.Join(g.server.Storage.Config.RootDir, MultipartFolderName, uploadID)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	upload := &multipartUpload{Key: bucket + "/" + key, Owner: owner, Options: opts, dir: dir}
+	manifest, err := json.Marshal(upload)
+	if err == nil {
+		err = os.WriteFile(filepath.Join(dir, uploadManifestName), manifest, 0o644)
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+
+	g.uploadLock.Lock()
+	g.uploads[uploadID] = upload
+	g.uploadLock.Unlock()
+
+	return g.writeXML(w, http.StatusOK, initiateMultipartUploadResult{
+		Bucket:   bucket,
+		Key:      key,
+		UploadID: uploadID,
+	})
+}
+
+// upload returns the upload of the given key, refusing it to the access keys
+// other than its owner.
+func (g *S3Gateway) upload(r *http.Request, key, uploadID, owner string) (*multipartUpload, error) {
+	g.uploadLock.Lock()
+	upload, ok := g.uploads[uploadID]
+	g.uploadLock.Unlock()
+
+	if !ok || upload.Key != key {
+		return nil, errNoSuchUpload
+	}
+	if upload.Owner != owner {
+		err := fmt.Errorf("%w: upload %s belongs to another access key", ErrAccessDenied, uploadID)
+		g.server.auditDenied(r.Context(), "store", DefaultNamespace, key, err)
+		return nil, err
+	}
+	return upload, nil
+}
+
+// uploadPart stages a part on local disk. Parts are only replicated once the
+// upload is completed.
+func (g *S3Gateway) uploadPart(w http.ResponseWriter, r *http.Request, key, uploadID, partNumber, owner string) error {
+	upload, err := g.upload(r, key, uploadID, owner)
+	if err != nil {
+		return err
+	}
+
+	n, err := strconv.Atoi(partNumber)
+	if err != nil || n < 1 || n > 10000 {
+		return errInvalidArgument
+	}
+
+	partPath := filepath.Join(upload.dir, strconv.Itoa(n))
+	f, err := os.Create(partPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hasher := md5.New()
+	if _, err := io.Copy(io.MultiWriter(f, hasher), s3Body(r)); err != nil {
+		os.Remove(partPath)
+		return err
+	}
+
+	etag := fmt.Sprintf("%q", hex.EncodeToString(hasher.Sum(nil)))
+	if err := os.WriteFile(partPath+".etag", []byte(etag), 0o644); err != nil {
+		return err
+	}
+
+	w.Header().Set("ETag", etag)
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+type completeMultipartUpload struct {
+	Parts []struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	} `xml:"Part"`
+}
+
+type completeMultipartUploadResult struct {
+	XMLName xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ CompleteMultipartUploadResult"`
+	Bucket  string   `xml:"Bucket"`
+	Key     string   `xml:"Key"`
+	ETag    string   `xml:"ETag"`
+}
+
+// completeMultipartUpload stores the concatenation of the listed parts as a
+// single object, streaming the staged parts into Store one after the other.
+func (g *S3Gateway) completeMultipartUpload(w http.ResponseWriter, r *http.Request, bucket, key, uploadID, owner string) error {
+	upload, err := g.upload(r, bucket+"/"+key, uploadID, owner)
+	if err != nil {
+		return err
+	}
+
+	var request completeMultipartUpload
+	if err := xml.NewDecoder(r.Body).Decode(&request); err != nil {
+		return errMalformedXML
+	}
+	if len(request.Parts) == 0 {
+		return errEntityTooSmall
+	}
+
+	var readers []io.Reader
+	for i, part := range request.Parts {
+		if i > 0 && part.PartNumber <= request.Parts[i-1].PartNumber {
+			return errInvalidPartOrder
+		}
+
+		partPath := filepath.Join(upload.dir, strconv.Itoa(part.PartNumber))
+		etag, err := os.ReadFile(partPath + ".etag")
+		if err != nil || strings.Trim(string(etag), `"`) != strings.Trim(part.ETag, `"`) {
+			return errInvalidPart
+		}
+
+		f, err := os.Open(partPath)
+		if err != nil {
+			return errInvalidPart
+		}
+		defer f.Close()
+		readers = append(readers, f)
+	}
+
+	if err := g.server.StoreWithOptions(r.Context(), upload.Key, io.MultiReader(readers...), upload.Options); err != nil {
+		return err
+	}
+
+	info, err := g.server.StatContext(r.Context(), upload.Key)
+	if err != nil {
+		return err
+	}
+
+	g.removeUpload(uploadID)
+
+	return g.writeXML(w, http.StatusOK, completeMultipartUploadResult{
+		Bucket: bucket,
+		Key:    key,
+		ETag:   s3ETag(info),
+	})
+}
+
+func (g *S3Gateway) abortMultipartUpload(w http.ResponseWriter, r *http.Request, key, uploadID, owner string) error {
+	if _, err := g.upload(r, key, uploadID, owner); err != nil {
+		return err
+	}
+
+	g.removeUpload(uploadID)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (g *S3Gateway) removeUpload(uploadID string) {
+	g.uploadLock.Lock()
+	upload := g.uploads[uploadID]
+	delete(g.uploads, uploadID)
+	g.uploadLock.Unlock()
+
+	if upload != nil {
+		if err := os.RemoveAll(upload.dir); err != nil {
+			g.server.logger().Warn("Failed to remove staged parts of upload", "upload", uploadID, "error", err)
+		}
+	}
+}
+
+// s3ETag derives an ETag from the checksum of the stored ciphertext, which is
+// identical on every replica.
+func s3ETag(info ObjectInfo) string {
+	etag := info.Checksum
+	if len(etag) > 32 {
+		etag = etag[:32]
+	}
+	return fmt.Sprintf("%q", etag)
+}
+
+func setS3ObjectHeaders(w http.ResponseWriter, info ObjectInfo) {
+	w.Header().Set("ETag", s3ETag(info))
+	w.Header().Set("Last-Modified", info.ModTime.UTC().Format(http.TimeFormat))
+	w.Header().Set("Accept-Ranges", "bytes")
+	contentType := info.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	for name, value := range info.Metadata {
+		w.Header().Set("X-Amz-Meta-"+name, value)
+	}
+	if len(info.Tags) > 0 {
+		w.Header().Set("X-Amz-Tagging-Count", strconv.Itoa(len(info.Tags)))
+	}
+}
+
+// s3StoreOptions returns the content type, user metadata (x-amz-meta-*) and
+// tags (x-amz-tagging) of a PutObject or CreateMultipartUpload request.
+func s3StoreOptions(r *http.Request) (StoreOptions, error) {
+	opts := StoreOptions{ContentType: r.Header.Get("Content-Type")}
+	for name, values := range r.Header {
+		if metaName, ok := strings.CutPrefix(name, "X-Amz-Meta-"); ok {
+			if opts.Metadata == nil {
+				opts.Metadata = make(map[string]string)
+			}
+			opts.Metadata[strings.ToLower(metaName)] = values[0]
+		}
+	}
+	if tagging := r.Header.Get("X-Amz-Tagging"); tagging != "" {
+		tags, err := ParseTags(tagging)
+		if err != nil {
+			return opts, err
+		}
+		opts.Tags = tags
+	}
+	return opts, nil
+}
+
+type s3ErrorResponse struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string   `xml:"Code"`
+	Message  string   `xml:"Message"`
+	Resource string   `xml:"Resource"`
+}
+
+// writeS3Error reports err in the S3 error format. Errors that are not S3
+// errors are mapped from the errors returned by the FileServer.
+func (g *S3Gateway) writeS3Error(w http.ResponseWriter, r *http.Request, err error) {
+	var s3Err *s3Error
+	switch {
+	case errors.As(err, &s3Err):
+	case errors.Is(err, fs.ErrNotExist):
+		s3Err = errNoSuchKey
+	case errors.Is(err, ErrInvalidRange):
+		s3Err = errInvalidRange
+	case errors.Is(err, ErrInvalidAttrs), errors.Is(err, ErrInvalidKey):
+		s3Err = errInvalidArgument
+	case errors.Is(err, ErrServerClosed):
+		s3Err = errServiceUnavailable
+	case errors.Is(err, ErrInsufficientStorage):
+		s3Err = errStorageFull
+	case errors.Is(err, ErrAccessDenied), errors.Is(err, ErrUnauthenticated):
+		s3Err = errAccessDenied
+	default:
+		g.server.logger().Error("S3 request failed", "method", r.Method, "path", r.URL.Path, "error", err)
+		s3Err = errInternalError
+	}
+
+	if r.Method == http.MethodHead {
+		w.WriteHeader(s3Err.Status)
+		return
+	}
+	g.writeXML(w, s3Err.Status, s3ErrorResponse{
+		Code:     s3Err.Code,
+		Message:  s3Err.Message,
+		Resource: r.URL.Path,
+	})
+}
+
+func (g *S3Gateway) writeXML(w http.ResponseWriter, status int, v any) error {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	io.WriteString(w, xml.Header)
+	if err := xml.NewEncoder(w).Encode(v); err != nil {
+		g.server.logger().Warn("Failed to encode response", "error", err)
+	}
+	return nil
+}
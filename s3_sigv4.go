@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	sigV4Algorithm      = "AWS4-HMAC-SHA256"
+	sigV4TimeFormat     = "20060102T150405Z"
+	unsignedPayload     = "UNSIGNED-PAYLOAD"
+	streamingPayloadPfx = "STREAMING-"
+
+	// streamingSignedPayload marks a streaming upload whose chunks are signed
+	// one after the other, starting from the signature of the request.
+	streamingSignedPayload = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	// streamingUnsignedTrailer marks a streaming upload whose chunks are not
+	// signed, like UNSIGNED-PAYLOAD.
+	streamingUnsignedTrailer = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+	// sigV4ChunkAlgorithm starts the string to sign of a chunk.
+	sigV4ChunkAlgorithm = "AWS4-HMAC-SHA256-PAYLOAD"
+
+	// sigV4MaxClockSkew is how far the request date may be from the server clock.
+	sigV4MaxClockSkew = 15 * time.Minute
+)
+
+// s3Error is an error that is reported to S3 clients with the given code and status.
+type s3Error struct {
+	Code    string
+	Message string
+	Status  int
+}
+
+func (e *s3Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+var (
+	errAccessDenied          = &s3Error{"AccessDenied", "Access Denied", http.StatusForbidden}
+	errInvalidAccessKeyID    = &s3Error{"InvalidAccessKeyId", "The AWS access key Id you provided does not exist in our records.", http.StatusForbidden}
+	errSignatureDoesNotMatch = &s3Error{"SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided.", http.StatusForbidden}
+	errRequestTimeTooSkewed  = &s3Error{"RequestTimeTooSkewed", "The difference between the request time and the server's time is too large.", http.StatusForbidden}
+	errContentSHA256Mismatch = &s3Error{"XAmzContentSHA256Mismatch", "The provided 'x-amz-content-sha256' header does not match what was computed.", http.StatusBadRequest}
+	errIncompleteBody        = &s3Error{"IncompleteBody", "The request body could not be decoded.", http.StatusBadRequest}
+)
+
+// verifySigV4 checks the AWS Signature Version 4 of the request against the
+// secret of the access key it was signed with, and returns the access key ID. Only signatures carried in the
+// Authorization header are supported, and they must cover the host and the
+// x-amz-content-sha256 header. For streaming uploads with signed chunks, it
+// also returns the signer that verifies the chunks as the body is read; other
+// streaming uploads are refused, except the ones with unsigned chunks.
+func verifySigV4(r *http.Request, credentials map[string]string) (string, *sigV4ChunkSigner, error) {
+	authorization := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, sigV4Algorithm+" ") {
+		return "", nil, errAccessDenied
+	}
+
+	fields := make(map[string]string)
+	for _, field := range strings.Split(strings.TrimPrefix(authorization, sigV4Algorithm+" "), ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(field), "=")
+		if ok {
+			fields[name] = value
+		}
+	}
+
+	// Credential=<access key>/<date>/<region>/<service>/aws4_request
+	credential := strings.Split(fields["Credential"], "/")
+	if len(credential) != 5 || credential[4] != "aws4_request" {
+		return "", nil, errAccessDenied
+	}
+	secret, ok := credentials[credential[0]]
+	if !ok {
+		return "", nil, errInvalidAccessKeyID
+	}
+
+	amzDate := r.Header.Get("X-Amz-Date")
+	requestTime, err := time.Parse(sigV4TimeFormat, amzDate)
+	if err != nil || !strings.HasPrefix(amzDate, credential[1]) {
+		return "", nil, errAccessDenied
+	}
+	if skew := time.Since(requestTime); skew > sigV4MaxClockSkew || skew < -sigV4MaxClockSkew {
+		return "", nil, errRequestTimeTooSkewed
+	}
+
+	signedHeaders := strings.Split(fields["SignedHeaders"], ";")
+	if !slices.Contains(signedHeaders, "host") || !slices.Contains(signedHeaders, "x-amz-content-sha256") || r.Header.Get("X-Amz-Content-Sha256") == "" {
+		return "", nil, errAccessDenied
+	}
+	scope := strings.Join(credential[1:], "/")
+
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		sigV4EncodePath(r.URL.Path),
+		sigV4CanonicalQuery(r),
+		sigV4CanonicalHeaders(r, signedHeaders),
+		strings.Join(signedHeaders, ";"),
+		payloadHash(r),
+	}, "\n")
+
+	stringToSign := strings.Join([]string{
+		sigV4Algorithm,
+		amzDate,
+		scope,
+		hexSHA256([]byte(canonicalRequest)),
+	}, "\n")
+
+	signingKey := hmacSHA256([]byte("AWS4"+secret), credential[1])
+	for _, part := range credential[2:] {
+		signingKey = hmacSHA256(signingKey, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	if !hmac.Equal([]byte(signature), []byte(fields["Signature"])) {
+		return "", nil, errSignatureDoesNotMatch
+	}
+
+	var chunks *sigV4ChunkSigner
+	switch contentHash := payloadHash(r); {
+	case contentHash == streamingSignedPayload:
+		chunks = &sigV4ChunkSigner{key: signingKey, amzDate: amzDate, scope: scope, previous: signature}
+	case contentHash == streamingUnsignedTrailer:
+	case strings.HasPrefix(contentHash, streamingPayloadPfx):
+		return "", nil, errNotImplemented
+	}
+	return credential[0], chunks, nil
+}
+
+// sigV4ChunkSigner verifies the signatures of the chunks of a streaming
+// upload. Each chunk is signed over the signature of the chunk before it,
+// starting from the signature of the request, so the chunks cannot be
+// altered, dropped or reordered.
+type sigV4ChunkSigner struct {
+	key      []byte
+	amzDate  string
+	scope    string
+	previous string
+}
+
+// sigV4ChunkSignerKey is the context key of the chunk signer of a request.
+type sigV4ChunkSignerKey struct{}
+
+// withChunkSigner returns ctx with the signer of the chunks of the request body.
+func withChunkSigner(ctx context.Context, chunks *sigV4ChunkSigner) context.Context {
+	return context.WithValue(ctx, sigV4ChunkSignerKey{}, chunks)
+}
+
+// verify reports whether signature is the signature of the next chunk, whose
+// data hashes to chunkHash.
+func (s *sigV4ChunkSigner) verify(chunkHash []byte, signature string) bool {
+	stringToSign := strings.Join([]string{
+		sigV4ChunkAlgorithm,
+		s.amzDate,
+		s.scope,
+		s.previous,
+		hexSHA256(nil),
+		hex.EncodeToString(chunkHash),
+	}, "\n")
+	expected := hex.EncodeToString(hmacSHA256(s.key, stringToSign))
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return false
+	}
+	s.previous = expected
+	return true
+}
+
+// payloadHash returns the value of the x-amz-content-sha256 header, which S3
+// requires on every signed request. Unsigned requests default to UNSIGNED-PAYLOAD.
+func payloadHash(r *http.Request) string {
+	if h := r.Header.Get("X-Amz-Content-Sha256"); h != "" {
+		return h
+	}
+	return unsignedPayload
+}
+
+func sigV4CanonicalHeaders(r *http.Request, signedHeaders []string) string {
+	var b strings.Builder
+	for _, name := range signedHeaders {
+		var values []string
+		if name == "host" {
+			values = []string{r.Host}
+		} else {
+			values = r.Header.Values(name)
+		}
+		for i, v := range values {
+			values[i] = strings.Join(strings.Fields(v), " ")
+		}
+		b.WriteString(name)
+		b.WriteString(":")
+		b.WriteString(strings.Join(values, ","))
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+func sigV4CanonicalQuery(r *http.Request) string {
+	var pairs []string
+	for key, values := range r.URL.Query() {
+		for _, value := range values {
+			pairs = append(pairs, sigV4Encode(key, true)+"="+sigV4Encode(value, true))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+func sigV4EncodePath(path string) string {
+	if path == "" {
+		return "/"
+	}
+	return sigV4Encode(path, false)
+}
+
+// sigV4Encode URI-encodes s the way SigV4 expects: every byte except the
+// unreserved characters is percent-encoded, and '/' is kept as is in paths.
+func sigV4Encode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func hexSHA256(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// s3Body returns the decoded payload of a request. Streaming uploads are
+// decoded from the aws-chunked encoding, with the signatures of their chunks
+// checked against the chunk signer of the request context, and signed payloads
+// are checked against their x-amz-content-sha256 header once fully read.
+func s3Body(r *http.Request) io.Reader {
+	contentHash := payloadHash(r)
+	switch {
+	case strings.HasPrefix(contentHash, streamingPayloadPfx):
+		chunks, _ := r.Context().Value(sigV4ChunkSignerKey{}).(*sigV4ChunkSigner)
+		return newAWSChunkedReader(r.Body, chunks)
+	case contentHash == unsignedPayload:
+		return r.Body
+	default:
+		return &sha256VerifyingReader{r: r.Body, hasher: sha256.New(), expected: contentHash}
+	}
+}
+
+// sha256VerifyingReader returns errContentSHA256Mismatch instead of io.EOF if
+// what was read does not hash to the expected value.
+type sha256VerifyingReader struct {
+	r        io.Reader
+	hasher   hash.Hash
+	expected string
+}
+
+func (v *sha256VerifyingReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.hasher.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(v.hasher.Sum(nil)) != v.expected {
+		return n, errContentSHA256Mismatch
+	}
+	return n, err
+}
+
+// awsChunkedReader decodes the aws-chunked content encoding used by streaming
+// uploads: a sequence of "<hex size>[;chunk-signature=...]\r\n<data>\r\n"
+// chunks ending with a zero sized chunk, optionally followed by trailing headers.
+//
+// With a chunk signer, every chunk must carry a valid signature. A chunk is
+// verified once it is read to the end, so its data is returned before a bad
+// signature is reported.
+type awsChunkedReader struct {
+	r         *bufio.Reader
+	remaining int64
+	done      bool
+
+	chunks    *sigV4ChunkSigner
+	hasher    hash.Hash
+	signature string
+}
+
+func newAWSChunkedReader(r io.Reader, chunks *sigV4ChunkSigner) *awsChunkedReader {
+	return &awsChunkedReader{r: bufio.NewReader(r), chunks: chunks, hasher: sha256.New()}
+}
+
+func (c *awsChunkedReader) Read(p []byte) (int, error) {
+	if c.done {
+		return 0, io.EOF
+	}
+
+	if c.remaining == 0 {
+		line, err := c.readLine()
+		if err != nil {
+			return 0, err
+		}
+		sizeStr, extension, _ := strings.Cut(line, ";")
+		size, err := strconv.ParseInt(strings.TrimSpace(sizeStr), 16, 64)
+		if err != nil || size < 0 {
+			return 0, errIncompleteBody
+		}
+		c.signature, _ = strings.CutPrefix(extension, "chunk-signature=")
+		c.hasher.Reset()
+
+		if size == 0 {
+			if err := c.verifyChunk(); err != nil {
+				return 0, err
+			}
+			// Skip the trailing headers up to the final empty line.
+			for {
+				line, err := c.readLine()
+				if err != nil && !errors.Is(err, io.EOF) {
+					return 0, err
+				}
+				if line == "" {
+					break
+				}
+			}
+			c.done = true
+			return 0, io.EOF
+		}
+		c.remaining = size
+	}
+
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.r.Read(p)
+	c.hasher.Write(p[:n])
+	c.remaining -= int64(n)
+	if c.remaining == 0 && err == nil {
+		if err := c.verifyChunk(); err != nil {
+			return n, err
+		}
+		if _, err := c.readLine(); err != nil {
+			return n, err
+		}
+	}
+	if err == io.EOF {
+		err = errIncompleteBody
+	}
+	return n, err
+}
+
+// verifyChunk checks the signature of the chunk read to the end.
+func (c *awsChunkedReader) verifyChunk() error {
+	if c.chunks != nil && !c.chunks.verify(c.hasher.Sum(nil), c.signature) {
+		return errSignatureDoesNotMatch
+	}
+	return nil
+}
+
+func (c *awsChunkedReader) readLine() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		if errors.Is(err, io.EOF) && line == "" {
+			return "", io.EOF
+		}
+		if !errors.Is(err, io.EOF) {
+			return "", err
+		}
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+func TestS3GatewayWithAWSSDK(t *testing.T) {
+	server := makeServer("127.0.0.5:4050", true)
+	go func() {
+		if err := server.Start(); err != nil {
+			log.Fatalf("Failed to start server on 127.0.0.5:4050: %v", err)
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	defer server.Storage.Clear()
+
+	gateway := httptest.NewServer(NewS3Gateway(server, map[string]string{"AKIDTEST": "secret"}))
+	defer gateway.Close()
+
+	newClient := func(secret string) *s3.Client {
+		return s3.New(s3.Options{
+			Region:       "us-east-1",
+			BaseEndpoint: aws.String(gateway.URL),
+			UsePathStyle: true,
+			Credentials:  credentials.NewStaticCredentialsProvider("AKIDTEST", secret, ""),
+		})
+	}
+	client := newClient("secret")
+	ctx := context.Background()
+	bucket := aws.String("artifacts")
+
+	if _, err := client.CreateBucket(ctx, &s3.CreateBucketInput{Bucket: bucket}); err != nil {
+		t.Fatal(err)
+	}
+
+	content := generateRandomData(64 * 1024)
+	if _, err := client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: bucket,
+		Key:    aws.String("builds/app.tar"),
+		Body:   bytes.NewReader(content),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	head, err := client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: bucket, Key: aws.String("builds/app.tar")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aws.ToInt64(head.ContentLength) != int64(len(content)) {
+		t.Errorf("HeadObject: got length %d", aws.ToInt64(head.ContentLength))
+	}
+
+	get, err := client.GetObject(ctx, &s3.GetObjectInput{Bucket: bucket, Key: aws.String("builds/app.tar")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.ReadAll(get.Body)
+	get.Body.Close()
+	if !bytes.Equal(got, content) {
+		t.Error("GetObject: content mismatch")
+	}
+
+	ranged, err := client.GetObject(ctx, &s3.GetObjectInput{Bucket: bucket, Key: aws.String("builds/app.tar"), Range: aws.String("bytes=10-19")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ = io.ReadAll(ranged.Body)
+	ranged.Body.Close()
+	if !bytes.Equal(got, content[10:20]) {
+		t.Error("GetObject with range: content mismatch")
+	}
+
+	// Multipart upload of two parts.
+	upload, err := client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{Bucket: bucket, Key: aws.String("builds/big.tar")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := [][]byte{generateRandomData(5 * 1024 * 1024), generateRandomData(1024)}
+	var completed []types.CompletedPart
+	for i, part := range parts {
+		out, err := client.UploadPart(ctx, &s3.UploadPartInput{
+			Bucket:     bucket,
+			Key:        aws.String("builds/big.tar"),
+			UploadId:   upload.UploadId,
+			PartNumber: aws.Int32(int32(i + 1)),
+			Body:       bytes.NewReader(part),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		completed = append(completed, types.CompletedPart{ETag: out.ETag, PartNumber: aws.Int32(int32(i + 1))})
+	}
+	if _, err := client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          bucket,
+		Key:             aws.String("builds/big.tar"),
+		UploadId:        upload.UploadId,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: completed},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	get, err = client.GetObject(ctx, &s3.GetObjectInput{Bucket: bucket, Key: aws.String("builds/big.tar")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ = io.ReadAll(get.Body)
+	get.Body.Close()
+	if !bytes.Equal(got, append(parts[0], parts[1]...)) {
+		t.Error("GetObject after multipart upload: content mismatch")
+	}
+
+	list, err := client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{Bucket: bucket, Prefix: aws.String("builds/"), MaxKeys: aws.Int32(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Contents) != 1 || aws.ToString(list.Contents[0].Key) != "builds/app.tar" || !aws.ToBool(list.IsTruncated) {
+		t.Errorf("ListObjectsV2: unexpected first page %+v", list.Contents)
+	}
+	list, err = client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{Bucket: bucket, Prefix: aws.String("builds/"), ContinuationToken: list.NextContinuationToken})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Contents) != 1 || aws.ToString(list.Contents[0].Key) != "builds/big.tar" || aws.ToBool(list.IsTruncated) {
+		t.Errorf("ListObjectsV2: unexpected second page %+v", list.Contents)
+	}
+	list, err = client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{Bucket: bucket, Prefix: aws.String("builds/"), MaxKeys: aws.Int32(0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Contents) != 0 || aws.ToBool(list.IsTruncated) || aws.ToString(list.NextContinuationToken) != "" {
+		t.Errorf("ListObjectsV2 with max-keys=0: got %+v, truncated %v", list.Contents, aws.ToBool(list.IsTruncated))
+	}
+
+	list, err = client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{Bucket: bucket, Delimiter: aws.String("/")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.CommonPrefixes) != 1 || aws.ToString(list.CommonPrefixes[0].Prefix) != "builds/" {
+		t.Errorf("ListObjectsV2 with delimiter: unexpected prefixes %+v", list.CommonPrefixes)
+	}
+
+	if _, err := client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: bucket, Key: aws.String("builds/app.tar")}); err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.GetObject(ctx, &s3.GetObjectInput{Bucket: bucket, Key: aws.String("builds/app.tar")})
+	var noSuchKey *types.NoSuchKey
+	if !errors.As(err, &noSuchKey) {
+		t.Errorf("GetObject after DeleteObject: expected NoSuchKey, got %v", err)
+	}
+
+	_, err = newClient("wrong secret").HeadBucket(ctx, &s3.HeadBucketInput{Bucket: bucket})
+	if err == nil {
+		t.Error("expected a request signed with the wrong secret to be rejected")
+	}
+}
+
+func TestS3MultipartUploadOwner(t *testing.T) {
+	server := makeServer("127.0.0.5:4051", true)
+	server.Config.AccessControl = &AccessControl{
+		PeerSecret: (&BasicCrypto{}).newEncryptionKey(),
+		Principals: []Principal{
+			{Name: "alice", Grants: []Grant{{Namespace: DefaultNamespace, Permissions: []Permission{PermissionRead, PermissionWrite}}}},
+			{Name: "bob", Grants: []Grant{{Namespace: DefaultNamespace, Permissions: []Permission{PermissionRead, PermissionWrite}}}},
+		},
+	}
+	startServer(t, server)
+	t.Cleanup(func() {
+		server.Stop()
+		server.Storage.Clear()
+		os.RemoveAll(server.Storage.Config.RootDir)
+	})
+
+	secrets := map[string]string{"alice": "alice-secret", "bob": "bob-secret"}
+	gateway := httptest.NewServer(NewS3Gateway(server, secrets))
+	defer gateway.Close()
+
+	newClient := func(url, accessKey string) *s3.Client {
+		return s3.New(s3.Options{
+			Region:       "us-east-1",
+			BaseEndpoint: aws.String(url),
+			UsePathStyle: true,
+			Credentials:  credentials.NewStaticCredentialsProvider(accessKey, secrets[accessKey], ""),
+		})
+	}
+	alice, bob := newClient(gateway.URL, "alice"), newClient(gateway.URL, "bob")
+	ctx := context.Background()
+	bucket, key := aws.String("shared"), aws.String("report.csv")
+
+	upload, err := alice.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{Bucket: bucket, Key: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := generateRandomData(1024)
+	part, err := alice.UploadPart(ctx, &s3.UploadPartInput{Bucket: bucket, Key: key, UploadId: upload.UploadId, PartNumber: aws.Int32(1), Body: bytes.NewReader(content)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	completed := &types.CompletedMultipartUpload{Parts: []types.CompletedPart{{ETag: part.ETag, PartNumber: aws.Int32(1)}}}
+
+	// Another principal allowed to write the key still cannot use the upload.
+	isAccessDenied := func(err error) bool {
+		var apiErr smithy.APIError
+		return errors.As(err, &apiErr) && apiErr.ErrorCode() == "AccessDenied"
+	}
+	if _, err := bob.UploadPart(ctx, &s3.UploadPartInput{Bucket: bucket, Key: key, UploadId: upload.UploadId, PartNumber: aws.Int32(1), Body: bytes.NewReader([]byte("replaced"))}); !isAccessDenied(err) {
+		t.Errorf("UploadPart by another principal: got %v, want AccessDenied", err)
+	}
+	if _, err := bob.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{Bucket: bucket, Key: key, UploadId: upload.UploadId, MultipartUpload: completed}); !isAccessDenied(err) {
+		t.Errorf("CompleteMultipartUpload by another principal: got %v, want AccessDenied", err)
+	}
+	if _, err := bob.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{Bucket: bucket, Key: key, UploadId: upload.UploadId}); !isAccessDenied(err) {
+		t.Errorf("AbortMultipartUpload by another principal: got %v, want AccessDenied", err)
+	}
+
+	// A restarted gateway restores the staged upload and removes the staged
+	// folders it cannot restore.
+	gateway.Close()
+	stale := filepath.Join(server.Storage.Config.RootDir, MultipartFolderName, "stale")
+	if err := os.MkdirAll(stale, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	restarted := httptest.NewServer(NewS3Gateway(server, secrets))
+	defer restarted.Close()
+	if _, err := os.Stat(stale); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("staged folder without a manifest: got %v, want it removed", err)
+	}
+
+	alice = newClient(restarted.URL, "alice")
+	if _, err := alice.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{Bucket: bucket, Key: key, UploadId: upload.UploadId, MultipartUpload: completed}); err != nil {
+		t.Fatalf("CompleteMultipartUpload after a restart: %v", err)
+	}
+	get, err := alice.GetObject(ctx, &s3.GetObjectInput{Bucket: bucket, Key: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.ReadAll(get.Body)
+	get.Body.Close()
+	if !bytes.Equal(got, content) {
+		t.Error("GetObject after completing a restored upload: content mismatch")
+	}
+	if entries, _ := os.ReadDir(filepath.Join(server.Storage.Config.RootDir, MultipartFolderName)); len(entries) != 0 {
+		t.Errorf("staged folders left after completing the upload: %v", entries)
+	}
+}
+
+// The chunks of a streaming upload are checked against the chain of chunk
+// signatures, using the example of the SigV4 documentation for a 66560 byte
+// object uploaded in chunks of 64KiB.
+func TestAWSChunkedSignatures(t *testing.T) {
+	newSigner := func() *sigV4ChunkSigner {
+		key := hmacSHA256([]byte("AWS4wJalrXUtnFEMI/K7MDENG/bPxRfiCYEXAMPLEKEY"), "20130524")
+		for _, part := range []string{"us-east-1", "s3", "aws4_request"} {
+			key = hmacSHA256(key, part)
+		}
+		return &sigV4ChunkSigner{
+			key:      key,
+			amzDate:  "20130524T000000Z",
+			scope:    "20130524/us-east-1/s3/aws4_request",
+			previous: "4f232c4386841ef735655705268965c44a0e4690baa4adea153f7db9fa80a0a9",
+		}
+	}
+	body := func(first, second string) string {
+		return "10000;chunk-signature=ad80c730a21e5b8d04586a2213dd63b9a0e99e0e2307b0ade35a65485a288648\r\n" + first + "\r\n" +
+			"400;chunk-signature=0055627c9e194cb4542bae2aa5492e3c1575bbb81b612b7d234b86a503ef5497\r\n" + second + "\r\n" +
+			"0;chunk-signature=b6c6ea8a5354eaf15b3cb7646744f4275b71ea724fed81ceb9323e279d449df9\r\n\r\n"
+	}
+	first, second := strings.Repeat("a", 65536), strings.Repeat("a", 1024)
+
+	got, err := io.ReadAll(newAWSChunkedReader(strings.NewReader(body(first, second)), newSigner()))
+	if err != nil {
+		t.Fatalf("valid chunks: %v", err)
+	}
+	if string(got) != first+second {
+		t.Errorf("valid chunks: got %d bytes, want %d", len(got), len(first+second))
+	}
+
+	tampered := strings.Repeat("a", 1023) + "b"
+	if _, err := io.ReadAll(newAWSChunkedReader(strings.NewReader(body(first, tampered)), newSigner())); !errors.Is(err, errSignatureDoesNotMatch) {
+		t.Errorf("tampered chunk: got %v, want errSignatureDoesNotMatch", err)
+	}
+
+	// The second chunk cannot be dropped, since the last one is signed over it.
+	dropped := strings.Replace(body(first, second), "400;chunk-signature=0055627c9e194cb4542bae2aa5492e3c1575bbb81b612b7d234b86a503ef5497\r\n"+second+"\r\n", "", 1)
+	if _, err := io.ReadAll(newAWSChunkedReader(strings.NewReader(dropped), newSigner())); !errors.Is(err, errSignatureDoesNotMatch) {
+		t.Errorf("dropped chunk: got %v, want errSignatureDoesNotMatch", err)
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"go-distributed-storage/p2p"
+	"io"
+	"sync"
+	"time"
+)
+
+// ScrubReport describes the progress and outcome of a scrub pass.
+type ScrubReport struct {
+	Running    bool
+	StartedAt  time.Time
+	FinishedAt time.Time
+
+	// TotalFiles is the number of blobs found when the pass started.
+	TotalFiles   int
+	FilesScanned int
+	BytesScanned int64
+
+	// Corrupted lists the keys whose checksum did not match.
+	Corrupted []string
+	// Healed lists the corrupted keys for which a copy matching the recorded
+	// checksum was fetched from a peer.
+	Healed []string
+	// Errors maps keys to the error that prevented verifying or healing them.
+	Errors map[string]string
+}
+
+// Scrubber walks the storage of a FileServer at a low priority, recomputes the
+// checksum of every blob, quarantines blobs that do not match their recorded
+// checksum and re-fetches a healthy copy from the peers.
+type Scrubber struct {
+	server *FileServer
+
+	mu     sync.Mutex
+	report ScrubReport
+	// runLock makes sure only one pass runs at a time.
+	runLock sync.Mutex
+}
+
+func NewScrubber(server *FileServer) *Scrubber {
+	return &Scrubber{
+		server: server,
+	}
+}
+
+// Report returns a copy of the current (or last finished) scrub report.
+func (sc *Scrubber) Report() ScrubReport {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	report := sc.report
+	report.Corrupted = append([]string(nil), sc.report.Corrupted...)
+	report.Healed = append([]string(nil), sc.report.Healed...)
+	report.Errors = make(map[string]string, len(sc.report.Errors))
+	for k, v := range sc.report.Errors {
+		report.Errors[k] = v
+	}
+	return report
+}
+
+// Run starts a scrub pass every interval until quitCh is closed.
+func (sc *Scrubber) Run(interval time.Duration, quitCh <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			sc.Scrub()
+		case <-quitCh:
+			return
+		}
+	}
+}
+
+// Scrub performs a single pass over every stored blob and returns its report.
+// The pass stops early once the server shuts down.
+func (sc *Scrubber) Scrub() ScrubReport {
+	sc.runLock.Lock()
+	defer sc.runLock.Unlock()
+
+	type scrubTarget struct {
+		ns  *Namespace
+		key string
+	}
+	var targets []scrubTarget
+	for _, ns := range sc.server.openNamespaces() {
+		if err := ns.storage.Walk(func(meta ObjectMeta) error {
+			targets = append(targets, scrubTarget{ns, meta.Key})
+			return nil
+		}); err != nil {
+			sc.server.logger().Error("Scrubber failed to walk the storage", "path", ns.storage.Config.RootDir, "error", err)
+		}
+	}
+
+	sc.mu.Lock()
+	sc.report = ScrubReport{
+		Running:    true,
+		StartedAt:  time.Now(),
+		TotalFiles: len(targets),
+		Errors:     make(map[string]string),
+	}
+	sc.mu.Unlock()
+
+	ctx := sc.server.abort
+	for _, target := range targets {
+		if ctx.Err() != nil || sc.server.isClosing() {
+			break
+		}
+		sc.scrubKey(ctx, target.ns, target.key)
+	}
+
+	sc.mu.Lock()
+	sc.report.Running = false
+	sc.report.FinishedAt = time.Now()
+	sc.mu.Unlock()
+
+	report := sc.Report()
+	sc.server.logger().Info("Scrub finished", "files", report.FilesScanned, "bytes", report.BytesScanned, "corrupted", len(report.Corrupted), "healed", len(report.Healed), "duration", report.FinishedAt.Sub(report.StartedAt))
+	return report
+}
+
+// scrubKey verifies a single blob of the namespace and heals it when its
+// checksum does not match. The report lists the key qualified by the namespace.
+func (sc *Scrubber) scrubKey(ctx context.Context, ns *Namespace, key string) {
+	ok, n, err := ns.storage.VerifyFile(key, sc.throttle(ctx))
+	name := ns.qualify(key)
+
+	sc.mu.Lock()
+	sc.report.FilesScanned++
+	sc.report.BytesScanned += n
+	if err != nil {
+		sc.report.Errors[name] = err.Error()
+	}
+	sc.mu.Unlock()
+
+	if err != nil || ok {
+		return
+	}
+
+	sc.server.logger().Warn("Scrubber detected a corrupted blob, quarantining it", "key", name)
+
+	sc.mu.Lock()
+	sc.report.Corrupted = append(sc.report.Corrupted, name)
+	sc.mu.Unlock()
+
+	meta, err := ns.storage.Stat(key)
+	if err != nil {
+		sc.setError(name, err)
+		return
+	}
+	if err := ns.storage.QuarantineFile(key); err != nil {
+		sc.setError(name, err)
+		return
+	}
+
+	healed, err := sc.heal(ctx, ns, key, meta.Checksum)
+	if err != nil {
+		sc.setError(name, err)
+		return
+	}
+	if !healed {
+		sc.server.logger().Error("Scrubber could not find a healthy copy on any peer", "key", name)
+		sc.mu.Lock()
+		sc.report.Errors[name] = "no healthy copy available from peers"
+		sc.mu.Unlock()
+		return
+	}
+
+	sc.mu.Lock()
+	sc.report.Healed = append(sc.report.Healed, name)
+	sc.mu.Unlock()
+}
+
+// heal fetches the copies of the key held by the peers until one matches the
+// checksum recorded for the quarantined blob. The copies that do not match
+// are quarantined too, and the next peer is tried.
+func (sc *Scrubber) heal(ctx context.Context, ns *Namespace, key, checksum string) (bool, error) {
+	var healed bool
+	name := ns.qualify(key)
+
+	// The healthy copy is sent as background traffic.
+	ctx = WithPriority(ctx, p2p.PriorityBackground)
+	err := sc.server.requestFromPeers(ctx, GetFileMessage{Namespace: ns.name, Key: key}, func(peer p2p.Peer, stream io.Reader, _ int64, meta ObjectMeta) error {
+		if healed {
+			_, err := io.Copy(io.Discard, stream)
+			return err
+		}
+		if _, err := ns.storage.StoreFile(key, stream, meta.ObjectAttrs); err != nil {
+			ns.storage.DeleteFile(key)
+			return err
+		}
+
+		ok, _, err := ns.storage.VerifyFile(key, sc.throttle(ctx))
+		if err != nil {
+			return err
+		}
+		if ok {
+			stored, err := ns.storage.Stat(key)
+			if err != nil {
+				return err
+			}
+			ok = stored.Checksum == checksum
+		}
+		if !ok {
+			sc.server.logger().Warn("Scrubber received a corrupted copy from a peer, quarantining it", "key", name, "peer", peer.RemoteAddr().String())
+			return ns.storage.QuarantineFile(key)
+		}
+
+		healed = true
+		return nil
+	})
+	return healed, err
+}
+
+func (sc *Scrubber) setError(key string, err error) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.report.Errors[key] = err.Error()
+}
+
+// throttle returns a wrapper for VerifyFile so that reads do not exceed the
+// configured scrub rate. The reads stop waiting once ctx is done.
+func (sc *Scrubber) throttle(ctx context.Context) func(io.Reader) io.Reader {
+	return func(r io.Reader) io.Reader {
+		if sc.server.Config.ScrubRate <= 0 {
+			return r
+		}
+		return &throttledReader{
+			ctx:   ctx,
+			r:     r,
+			rate:  sc.server.Config.ScrubRate,
+			start: time.Now(),
+		}
+	}
+}
+
+// throttledReader delays reads so that the average throughput stays under rate bytes per second.
+type throttledReader struct {
+	ctx   context.Context
+	r     io.Reader
+	rate  int64
+	start time.Time
+	read  int64
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > t.rate {
+		p = p[:t.rate]
+	}
+
+	n, err := t.r.Read(p)
+	t.read += int64(n)
+
+	expected := time.Duration(float64(t.read) / float64(t.rate) * float64(time.Second))
+	if elapsed := time.Since(t.start); expected > elapsed {
+		if sleepErr := sleepContext(t.ctx, expected-elapsed); sleepErr != nil {
+			return n, sleepErr
+		}
+	}
+
+	return n, err
+}
+
+// Scrub runs a scrub pass immediately and returns its report.
+func (s *FileServer) Scrub() ScrubReport {
+	return s.scrubber.Scrub()
+}
+
+// ScrubReport returns the progress of the running scrub pass, or the result
+// of the last finished one.
+func (s *FileServer) ScrubReport() ScrubReport {
+	return s.scrubber.Report()
+}
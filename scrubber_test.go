@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScrubberHealsCorruptedBlob(t *testing.T) {
+	nodeA := makeServer("127.0.0.5:4000", true)
+	go func() {
+		if err := nodeA.Start(); err != nil {
+			log.Fatalf("Failed to start server on 127.0.0.5:4000: %v", err)
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	nodeB := makeServer("127.0.0.5:4001", false, "127.0.0.5:4000")
+	go func() {
+		if err := nodeB.Start(); err != nil {
+			log.Fatalf("Failed to start server on 127.0.0.5:4001: %v", err)
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	defer nodeA.Storage.Clear()
+	defer nodeB.Storage.Clear()
+
+	key := "scrubbed_file"
+	content := []byte("bytes that are about to rot")
+	if err := nodeA.Store(key, bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	if report := nodeB.Scrub(); len(report.Corrupted) != 0 || report.FilesScanned != 1 {
+		t.Fatalf("expected one healthy file, got %+v", report)
+	}
+
+	// Flip a byte of the blob stored on nodeB.
+	disk := nodeB.Storage.Config.Backend.(*DiskBackend)
+	blobPath := disk.blobPath(key)
+	blob, err := os.ReadFile(blobPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob[len(blob)-1] ^= 0xff
+	if err := os.WriteFile(blobPath, blob, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	report := nodeB.Scrub()
+	if len(report.Corrupted) != 1 || report.Corrupted[0] != key {
+		t.Fatalf("expected %s to be reported as corrupted, got %+v", key, report)
+	}
+	if len(report.Healed) != 1 {
+		t.Fatalf("expected %s to be healed, got %+v", key, report)
+	}
+
+	quarantined, err := os.ReadDir(disk.prependTheRoot(QuarantineFolderName))
+	if err != nil || len(quarantined) == 0 {
+		t.Fatalf("expected corrupted blob to be quarantined: %v", err)
+	}
+
+	r, err := nodeB.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("healed content mismatch: got %q, want %q", got, content)
+	}
+}
+
+// The node that stored a file finds its own blob healthy, even with no peer
+// to heal it from.
+func TestScrubberKeepsOriginalBlob(t *testing.T) {
+	server := makeServer("127.0.0.5:4002", true)
+	startServer(t, server)
+	t.Cleanup(func() {
+		server.Stop()
+		server.Storage.Clear()
+	})
+
+	key := "original_file"
+	content := []byte("hello world")
+	if err := server.Store(key, bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+
+	if report := server.Scrub(); len(report.Corrupted) != 0 || report.FilesScanned != 1 {
+		t.Fatalf("expected one healthy file, got %+v", report)
+	}
+
+	r, err := server.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if got, err := io.ReadAll(r); err != nil || !bytes.Equal(got, content) {
+		t.Errorf("Get after the scrub: got %q, error %v", got, err)
+	}
+}
+
+// A copy fetched from a peer whose own blob rotted is not taken as healed: it
+// is quarantined as well and the key is reported as not healed.
+func TestScrubberRejectsCorruptedPeerCopy(t *testing.T) {
+	nodeA := makeServer("127.0.0.19:4500", true)
+	startServer(t, nodeA)
+	nodeB := makeServer("127.0.0.19:4501", false, "127.0.0.19:4500")
+	startServer(t, nodeB)
+	t.Cleanup(func() {
+		for _, node := range []*FileServer{nodeA, nodeB} {
+			node.Stop()
+			node.Storage.Clear()
+		}
+	})
+
+	key := "rotten_everywhere"
+	if err := nodeA.Store(key, bytes.NewReader([]byte("bytes that rot on every node"))); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	// Flip a byte of the blob stored on both nodes.
+	for _, node := range []*FileServer{nodeA, nodeB} {
+		blobPath := node.Storage.Config.Backend.(*DiskBackend).blobPath(key)
+		blob, err := os.ReadFile(blobPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blob[len(blob)-1] ^= 0xff
+		if err := os.WriteFile(blobPath, blob, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report := nodeB.Scrub()
+	if len(report.Corrupted) != 1 || report.Corrupted[0] != key {
+		t.Fatalf("expected %s to be reported as corrupted, got %+v", key, report)
+	}
+	if len(report.Healed) != 0 {
+		t.Fatalf("expected the corrupted copy of the peer to be refused, got %+v", report)
+	}
+	if _, ok := report.Errors[key]; !ok {
+		t.Errorf("expected an error for %s, got %+v", key, report.Errors)
+	}
+	if nodeB.Storage.HasKey(key) {
+		t.Error("the corrupted copy of the peer is still served")
+	}
+
+	disk := nodeB.Storage.Config.Backend.(*DiskBackend)
+	quarantined, err := os.ReadDir(disk.prependTheRoot(QuarantineFolderName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var blobs int
+	for _, entry := range quarantined {
+		if !strings.HasSuffix(entry.Name(), metaFileSuffix) {
+			blobs++
+		}
+	}
+	if blobs != 2 {
+		t.Errorf("expected the local blob and the copy of the peer to be quarantined, got %d blobs", blobs)
+	}
+}
@@ -2,25 +2,88 @@ package main
 
 import (
 	"bytes"
-	"encoding/binary"
+	"context"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"go-distributed-storage/p2p"
 	"io"
-	"log"
+	"log/slog"
 	"net"
+	"os"
+	"slices"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type FileServerOPT struct {
-	Crypto           Cipher
-	encryptionKey    []byte
+	Crypto Cipher
+	// EncryptionKey is the key files are encrypted with. Every node of a
+	// cluster must use the same key to read the replicas of its peers.
+	EncryptionKey    []byte
 	RootDir          string
 	Transport        p2p.Transport
 	PathTranformFunc PathTranformSignature
 	BootstrapNodes   []string
 	IsBootstrapNode  bool
+
+	// Backend holds the blobs of the node. A nil Backend means a DiskBackend
+	// under RootDir.
+	Backend Backend
+
+	// ScrubInterval is the pause between two background scrub passes.
+	// A zero value disables the background scrubber.
+	ScrubInterval time.Duration
+	// ScrubRate limits how many bytes per second the scrubber reads from disk.
+	// A zero value means unlimited.
+	ScrubRate int64
+
+	// MaxFileSize is the largest file accepted from a peer. A zero value
+	// means defaultMaxFileSize.
+	MaxFileSize int64
+	// PeerResponseTimeout is how long a peer is given to announce the size of
+	// a requested file when the caller's context has no earlier deadline.
+	// A zero value means defaultPeerResponseTimeout.
+	PeerResponseTimeout time.Duration
+	// ShutdownTimeout is how long Stop waits for in-flight requests before
+	// cancelling them. A zero value means defaultShutdownTimeout.
+	ShutdownTimeout time.Duration
+	// ExpiryInterval is the pause between two passes of the reaper, which
+	// deletes the expired files of the node. A zero value means
+	// defaultExpiryInterval, a negative value disables the reaper.
+	ExpiryInterval time.Duration
+	// Compression is the compression of the files stored without one, see
+	// StoreOptions.Compression. A zero value stores them as they are.
+	Compression string
+
+	// Capacity is the most bytes the node stores. A zero value means unlimited.
+	Capacity int64
+	// MinFreeSpace is the free space kept on the file system of the node.
+	// Files that would go below it are refused.
+	MinFreeSpace int64
+
+	// Namespaces are the namespaces served besides DefaultNamespace, by name.
+	Namespaces map[string]NamespaceOPT
+	// AccessControl checks the grants of the principal of every request, and
+	// signs the requests sent to peers. A nil AccessControl allows everything.
+	AccessControl *AccessControl
+	// AuditLog records the data operations, denied requests and membership
+	// changes of the node. It is closed by Shutdown. A nil AuditLog disables
+	// auditing.
+	AuditLog *AuditLog
+
+	// Logger receives the logs of the server and its storage. Every record
+	// carries the address of the node. A nil Logger means slog.Default().
+	Logger *slog.Logger
+	// TracerProvider creates the spans of Store, Get and the peer messages.
+	// A nil TracerProvider means otel.GetTracerProvider().
+	TracerProvider trace.TracerProvider
 }
 
 type FileServer struct {
@@ -28,38 +91,168 @@ type FileServer struct {
 
 	peerLock sync.Mutex
 	peers    map[string]p2p.Peer
+	// watchers receive the membership events, guarded by peerLock.
+	watchers map[chan MembershipEvent]struct{}
+	// peerCapacity holds the capacity advertised by the peers, guarded by peerLock.
+	peerCapacity map[string]Capacity
+	// streamLocks holds the lock of the connection to every peer, guarded by
+	// peerLock. See lockStreams.
+	streamLocks map[p2p.Peer]chan struct{}
+	// full is whether the node last found itself full.
+	full atomic.Bool
 
 	Storage Storage
 	quitCh  chan struct{}
 
-	// PeersAddresses holds the addresses of peer nodes in the distributed network.
-	PeersAddresses []string
+	// namespaces holds the configured namespaces and DefaultNamespace, by name.
+	namespaces map[string]*Namespace
+
+	// nonces holds the nonces of the requests accepted from peers until they
+	// expire, guarded by nonceLock. See rememberNonce.
+	nonceLock    sync.Mutex
+	nonces       map[string]time.Time
+	noncesPruned time.Time
+
+	// fetchLock serializes requests for files held by peers.
+	fetchLock sync.Mutex
+
+	// scrubber periodically verifies stored blobs and heals corrupted ones.
+	scrubber *Scrubber
+
+	metrics *metrics
+
+	// startedAt is when Start began listening, in Unix nanoseconds.
+	startedAt atomic.Int64
+
+	lifecycleLock sync.Mutex
+	// closing is set by Shutdown, active counts the operations registered by
+	// begin, and idle is closed once closing is set and active drops to zero.
+	// They are guarded by lifecycleLock.
+	closing bool
+	active  int
+	idle    chan struct{}
+	// abort is cancelled when Shutdown stops waiting for the active operations.
+	abort       context.Context
+	abortCancel context.CancelFunc
+	// stopped is closed once Shutdown returns, loopDone once loop returns.
+	stopped  chan struct{}
+	loopDone chan struct{}
+
+	transferLock sync.Mutex
+	// transfers holds the streams to and from peers in flight, guarded by transferLock.
+	transfers map[*Transfer]struct{}
+
+	// log is Config.Logger with the node address, set once the node listens.
+	log atomic.Pointer[slog.Logger]
+
+	// peersAddresses holds the addresses of peer nodes in the distributed
+	// network, guarded by peerLock.
+	peersAddresses []string
 }
 
 func NewFileServer(opt FileServerOPT) *FileServer {
+	if opt.MaxFileSize == 0 {
+		opt.MaxFileSize = defaultMaxFileSize
+	}
+	if opt.PeerResponseTimeout == 0 {
+		opt.PeerResponseTimeout = defaultPeerResponseTimeout
+	}
+	if opt.ShutdownTimeout == 0 {
+		opt.ShutdownTimeout = defaultShutdownTimeout
+	}
+	if opt.ExpiryInterval == 0 {
+		opt.ExpiryInterval = defaultExpiryInterval
+	}
+	if opt.Logger == nil {
+		opt.Logger = slog.Default()
+	}
+	if opt.TracerProvider == nil {
+		opt.TracerProvider = otel.GetTracerProvider()
+	}
+
 	storageOPT := StoreOPT{
 		RootDir:          opt.RootDir,
 		PathTranformFunc: opt.PathTranformFunc,
+		Backend:          opt.Backend,
+		Capacity:         opt.Capacity,
+		MinFreeSpace:     opt.MinFreeSpace,
+		Logger:           opt.Logger,
 	}
-	return &FileServer{
+	s := &FileServer{
 		Config:  opt,
 		Storage: *NewStorage(storageOPT),
 		quitCh:  make(chan struct{}),
 		peers:   make(map[string]p2p.Peer),
+
+		watchers:     make(map[chan MembershipEvent]struct{}),
+		peerCapacity: make(map[string]Capacity),
+		streamLocks:  make(map[p2p.Peer]chan struct{}),
+		transfers:    make(map[*Transfer]struct{}),
+		nonces:       make(map[string]time.Time),
+
+		idle:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+		loopDone: make(chan struct{}),
+	}
+	s.namespaces = map[string]*Namespace{
+		DefaultNamespace: {server: s, name: DefaultNamespace},
+	}
+	for name, namespaceOPT := range opt.Namespaces {
+		if name != DefaultNamespace {
+			s.namespaces[name] = &Namespace{server: s, name: name, opt: namespaceOPT}
+		}
 	}
+	s.abort, s.abortCancel = context.WithCancel(context.Background())
+	s.scrubber = NewScrubber(s)
+	s.metrics = newMetrics(s)
+	s.log.Store(opt.Logger)
+	return s
+}
+
+// logger returns the logger of the server, which adds the node address to every
+// record once the node listens.
+func (s *FileServer) logger() *slog.Logger {
+	return s.log.Load()
 }
 
 type Message struct {
 	Payload any
+	// TraceContext carries the trace context of the sender, so that the spans
+	// of the peers handling the message join its trace.
+	TraceContext map[string]string
+	// Auth signs the requests for files, when access control is enabled.
+	Auth *MessageAuth
 }
 
+// StoreFileMessage announces a chunked stream carrying the encrypted file for Key
+// in Namespace. SentAt is when the sender started storing the file, and Attrs
+// are recorded with every replica, so that they all expire at the same time.
 type StoreFileMessage struct {
-	Key  string
-	Size int64
+	Namespace string
+	Key       string
+	SentAt    time.Time
+	Attrs     ObjectAttrs
 }
 
+// GetFileMessage requests a file of Namespace from the peers. When Ranged is
+// set, only Length bytes starting at the plaintext Offset are requested; a
+// negative Length reads until the end of the file. When MetaOnly is set, only
+// the metadata of the file is requested and the body sent back is empty.
 type GetFileMessage struct {
-	Key string
+	Namespace string
+	Key       string
+	Ranged    bool
+	Offset    int64
+	Length    int64
+	MetaOnly  bool
+	// Priority is the class the peer sends the file in.
+	Priority p2p.Priority
+}
+
+// DeleteFileMessage asks the peers to delete their replica of Key in Namespace.
+type DeleteFileMessage struct {
+	Namespace string
+	Key       string
 }
 
 type PeersInfoMessage struct {
@@ -68,20 +261,70 @@ type PeersInfoMessage struct {
 
 type NodeIntroductionMessage struct {
 	Address string
+	// Capacity is the capacity of the node when it joined.
+	Capacity Capacity
+}
+
+// broadcast sends the message to every peer, along with the trace context of ctx.
+func (s *FileServer) broadcast(ctx context.Context, message *Message) error {
+	return s.sendTo(ctx, message, s.connectedPeers())
 }
 
-func (s *FileServer) broadcast(message *Message) error {
+// connectedPeers returns the peers this node is connected to. The peer map
+// may change as soon as it returns.
+func (s *FileServer) connectedPeers() []p2p.Peer {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	peers := make([]p2p.Peer, 0, len(s.peers))
+	for _, peer := range s.peers {
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+// peer returns the connected peer with the given remote address.
+func (s *FileServer) peer(address string) (p2p.Peer, bool) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	peer, ok := s.peers[address]
+	return peer, ok
+}
+
+// sendTo sends the message to the given peers, once the transfers in flight
+// to them are over.
+func (s *FileServer) sendTo(ctx context.Context, message *Message, peers []p2p.Peer) error {
+	unlock, err := s.lockStreams(ctx, peers)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return s.sendLocked(ctx, message, p2p.EncodeMessage, peers)
+}
+
+// sendLocked sends the message framed by encode, p2p.EncodeMessage or
+// p2p.EncodeStreamMessage, to the given peers, whose streams the caller has
+// locked with lockStreams.
+func (s *FileServer) sendLocked(ctx context.Context, message *Message, encode func([]byte) []byte, peers []p2p.Peer) (err error) {
+	ctx, span := s.startSpan(ctx, "FileServer.broadcast",
+		attribute.String("fs.message", fmt.Sprintf("%T", message.Payload)),
+		attribute.Int("fs.peers", len(peers)))
+	defer func() { endSpan(span, err) }()
+
+	injectTraceContext(ctx, message)
+	if err := s.signMessage(ctx, message); err != nil {
+		return err
+	}
+
 	buf := new(bytes.Buffer)
 	if err := gob.NewEncoder(buf).Encode(message); err != nil {
 		return err
 	}
 
-	for _, peer := range s.peers {
-		if err := peer.Send([]byte{p2p.IncomingMessage}); err != nil {
-			return err
-		}
-
-		if err := peer.Send(buf.Bytes()); err != nil {
+	frame := encode(buf.Bytes())
+	for _, peer := range peers {
+		if err := peer.Send(frame); err != nil {
 			return err
 		}
 	}
@@ -89,35 +332,108 @@ func (s *FileServer) broadcast(message *Message) error {
 	return nil
 }
 
-func (s *FileServer) Stop() {
-	close(s.quitCh)
+func (s *FileServer) dropPeer(p p2p.Peer) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	if s.peers[p.RemoteAddr().String()] == p {
+		delete(s.peers, p.RemoteAddr().String())
+		delete(s.streamLocks, p)
+		s.notifyMembership(p, false)
+		s.metrics.connectionErrors.WithLabelValues("dropped").Inc()
+	}
+	p.Close()
+
+	s.logger().Info("Dropped peer connection", "peer", p.RemoteAddr().String())
 }
 
-func (s *FileServer) OnPeer(p p2p.Peer) error {
+// PeersAddresses returns the addresses of the nodes of the network learned
+// from their introductions.
+func (s *FileServer) PeersAddresses() []string {
 	s.peerLock.Lock()
 	defer s.peerLock.Unlock()
+	return slices.Clone(s.peersAddresses)
+}
+
+// PeerInfo describes a connected peer.
+type PeerInfo struct {
+	// Address is the remote address of the connection to the peer.
+	Address      string `json:"address"`
+	LocalAddress string `json:"localAddress"`
+	// Direction is "outbound" when this node dialed the peer, "inbound" when the
+	// peer dialed it, and empty when the transport does not tell.
+	Direction string `json:"direction,omitempty"`
+	// State is "connected" for the peers this node is connected to, and "known"
+	// for addresses learned from the network without a connection to them.
+	State string `json:"state"`
+	// Capacity is the capacity last advertised by the peer, if any.
+	Capacity *Capacity `json:"capacity,omitempty"`
+}
 
+// peerDirection returns the Direction of a PeerInfo for the peer.
+func peerDirection(p p2p.Peer) string {
+	peer, ok := p.(interface{ Outbound() bool })
+	switch {
+	case !ok:
+		return ""
+	case peer.Outbound():
+		return "outbound"
+	default:
+		return "inbound"
+	}
+}
+
+// Peers returns the peers this node is connected to, sorted by address.
+func (s *FileServer) Peers() []PeerInfo {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	peers := make([]PeerInfo, 0, len(s.peers))
+	for address, peer := range s.peers {
+		info := PeerInfo{
+			Address:      address,
+			LocalAddress: peer.LocalAddr().String(),
+			Direction:    peerDirection(peer),
+			State:        "connected",
+		}
+		if capacity, ok := s.peerCapacity[address]; ok {
+			info.Capacity = &capacity
+		}
+		peers = append(peers, info)
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].Address < peers[j].Address
+	})
+	return peers
+}
+
+func (s *FileServer) OnPeer(p p2p.Peer) error {
+	s.peerLock.Lock()
 	s.peers[p.RemoteAddr().String()] = p
+	s.streamLocks[p] = make(chan struct{}, 1)
+	s.notifyMembership(p, true)
+	addresses := slices.Clone(s.peersAddresses)
+	s.peerLock.Unlock()
 
-	log.Printf("%s accepted peer connection from: %s\n", p.LocalAddr(), p.RemoteAddr())
+	s.logger().Info("Accepted peer connection", "peer", p.RemoteAddr().String(), "local", p.LocalAddr().String())
 
+	// The messages are sent once peerLock is released, since sendTo takes it
+	// to lock the stream of the peer.
 	if s.Config.IsBootstrapNode {
 		msg := Message{
 			Payload: PeersInfoMessage{
-				Addresses: s.PeersAddresses,
+				Addresses: addresses,
 			},
 		}
-		
-		if err := p.Send([]byte{p2p.IncomingMessage}); err != nil {
-			return err
+		if err := s.sendTo(context.Background(), &msg, []p2p.Peer{p}); err != nil {
+			s.logger().Warn("Failed to send addresses to peer", "peer", p.RemoteAddr().String(), "error", err)
 		}
+	}
 
-		buf := new(bytes.Buffer)
-		if err := gob.NewEncoder(buf).Encode(msg); err != nil {
-			return err
-		}
-		if err := p.Send(buf.Bytes()); err != nil {
-			log.Printf("Failed to send addresses to peer %s: %v\n", p.RemoteAddr(), err)
+	// Peers assume a node has room until told otherwise.
+	if s.full.Load() {
+		if err := s.sendCapacity(context.Background(), p); err != nil {
+			s.logger().Warn("Failed to send capacity to peer", "peer", p.RemoteAddr().String(), "error", err)
 		}
 	}
 
@@ -125,8 +441,8 @@ func (s *FileServer) OnPeer(p p2p.Peer) error {
 }
 func (s *FileServer) loop() {
 	defer func() {
-		log.Println("FileServer has shut down and transport connection has been closed.")
-		s.Config.Transport.Close()
+		s.logger().Info("FileServer has shut down and transport connection has been closed")
+		close(s.loopDone)
 	}()
 
 	for {
@@ -135,11 +451,12 @@ func (s *FileServer) loop() {
 			var message Message
 
 			if err := gob.NewDecoder(bytes.NewReader(rpc.Payload)).Decode(&message); err != nil {
-				fmt.Println("Decoding error: ", err)
+				s.logger().Warn("Failed to decode message", "peer", rpc.From.String(), "error", err)
+				s.metrics.decodeErrors.Inc()
 			}
 
-			if err := s.handleMessage(rpc.From, message); err != nil {
-				fmt.Println("Handling message error: ", err)
+			if err := s.handleMessage(extractTraceContext(message), rpc.From, message); err != nil {
+				s.logger().Warn("Failed to handle message", "peer", rpc.From.String(), "error", err)
 			}
 
 		case <-s.quitCh:
@@ -156,138 +473,821 @@ func (s *FileServer) loop() {
 // Reads the file size from each peer and stores the file locally.
 // Logs the successful retrieval and storage of the file from a peer.
 // Sets a timeout for reading the file size. If the read operation times out, it proceeds to the next peer.
-func (s *FileServer) Get(key string) (io.Reader, error) {
-	if s.Storage.HasKey(key) {
-		fmt.Printf("[%s] file with key (%s) found locally\n", s.Config.Transport.RemoteAddr(), key)
-		// r, _, err := s.Storage.ReadFile(key)
-		r, _, err := s.Storage.ReadFileDecrypted(key, s.Config.Crypto.Decrypt, s.Config.encryptionKey)
-		return r, err
+//
+// The returned reader decrypts the file lazily as it is read, so memory use does
+// not depend on the file size. The caller must close it to release the file handle.
+func (s *FileServer) Get(key string) (io.ReadCloser, error) {
+	return s.GetContext(context.Background(), key)
+}
+
+// GetContext is like Get but stops waiting for peers and cancels an in-flight
+// transfer from a peer once the context is done. When the context has no
+// deadline, each peer is given Config.PeerResponseTimeout to answer.
+func (s *FileServer) GetContext(ctx context.Context, key string) (io.ReadCloser, error) {
+	return s.get(ctx, s.defaultNamespace(), key)
+}
+
+func (s *FileServer) get(ctx context.Context, ns *Namespace, key string) (_ io.ReadCloser, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := validateKey(key); err != nil {
+		return nil, err
 	}
+	start := time.Now()
 
-	fmt.Printf("[%s] file with key (%s) not found locally, broadcasting request to peers\n", s.Config.Transport.RemoteAddr(), key)
+	ctx, done, err := s.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
 
-	message := Message{
-		Payload: GetFileMessage{
-			Key: key,
-		},
+	ctx, span := s.startSpan(ctx, "FileServer.Get", attribute.String("fs.namespace", ns.name), attribute.String("fs.key", key))
+	defer func() { endSpan(span, err) }()
+	defer func() {
+		record := AuditRecord{Action: "get", Namespace: ns.name, Key: key}
+		if meta, err := ns.storage.Stat(key); err == nil {
+			record.Size = s.objectInfo(meta).Size
+		}
+		s.auditOperation(ctx, record, err)
+	}()
+
+	if err := s.authorize(ctx, ns, PermissionRead, key); err != nil {
+		return nil, err
 	}
 
-	if err := s.broadcast(&message); err != nil {
+	if ns.storage.HasKey(key) {
+		span.SetAttributes(attribute.String("fs.source", "local"))
+		s.logger().Debug("File found locally", "key", ns.qualify(key))
+		// r, _, err := ns.storage.ReadFile(key)
+		r, _, err := ns.storage.ReadFileDecrypted(key, s.Config.Crypto.Decrypt, ns.encryptionKey())
+		return s.servedToClient(r, err, "local", start)
+	}
+
+	span.SetAttributes(attribute.String("fs.source", "peer"))
+	s.logger().Debug("File not found locally, requesting it from peers", "key", ns.qualify(key))
+
+	if err := s.fetchFromPeers(ctx, ns, key); err != nil {
 		return nil, err
 	}
 
-	time.Sleep(5 * time.Millisecond)
+	// r, _, err := ns.storage.ReadFile(key)
+	r, _, err := ns.storage.ReadFileDecrypted(key, s.Config.Crypto.Decrypt, ns.encryptionKey())
+	return s.servedToClient(r, err, "peer", start)
+}
 
-	// Define a maximum file size threshold (e.g., 100MB)
-	const maxFileSize = 100 * 1024 * 1024 // 100 MB
-	
-	for _, peer := range s.peers {
-		if peer == nil {
-			fmt.Printf("Skipping nil peer: %s\n", peer)
-			continue
+// GetRange retrieves length bytes of the file starting at offset. A negative
+// length reads until the end of the file.
+//
+// When the cipher supports it, only the requested range is read from disk or
+// transferred from a peer and decrypted, using the seekable keystream of the
+// cipher. Remote ranges are not stored locally. The caller must close the
+// returned reader.
+func (s *FileServer) GetRange(key string, offset, length int64) (io.ReadCloser, error) {
+	return s.GetRangeContext(context.Background(), key, offset, length)
+}
+
+// GetRangeContext is like GetRange but honors the cancellation and deadline of the context.
+func (s *FileServer) GetRangeContext(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	return s.getRange(ctx, s.defaultNamespace(), key, offset, length)
+}
+
+func (s *FileServer) getRange(ctx context.Context, ns *Namespace, key string, offset, length int64) (_ io.ReadCloser, err error) {
+	if err := validateKey(key); err != nil {
+		return nil, err
+	}
+	ctx, done, err := s.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		// A range streamed from a peer ends the operation once it is transferred.
+		if done != nil {
+			done()
 		}
-		var fileSize int64
+	}()
 
-		// Set a timeout duration for reading the file size
-		readTimeout := 5 * time.Second
-		done := make(chan error) // Channel to signal completion of read operation
+	ctx, span := s.startSpan(ctx, "FileServer.GetRange",
+		attribute.String("fs.namespace", ns.name),
+		attribute.String("fs.key", key),
+		attribute.Int64("fs.offset", offset),
+		attribute.Int64("fs.length", length))
+	defer func() { endSpan(span, err) }()
+	if _, ok := s.Config.Crypto.(RangeCipher); ok {
+		// Without a RangeCipher, the range is read through get, which audits it.
+		defer func() {
+			s.auditOperation(ctx, AuditRecord{Action: "get", Namespace: ns.name, Key: key, Size: max(length, 0)}, err)
+		}()
+	}
 
-		go func(peer p2p.Peer) {
-			err := binary.Read(peer, binary.LittleEndian, &fileSize)
-			done <- err // Send the result (error or nil) back to the main routine
-		}(peer)
+	if err := s.authorize(ctx, ns, PermissionRead, key); err != nil {
+		return nil, err
+	}
 
-		select {
-		case err := <-done:
+	rangeCipher, ok := s.Config.Crypto.(RangeCipher)
+	if !ok {
+		// Fall back to decrypting the whole file and skipping to the range.
+		r, err := s.get(ctx, ns, key)
+		if err != nil {
+			return nil, err
+		}
+		return sliceReader(r, offset, length)
+	}
+
+	start := time.Now()
+
+	if ns.storage.HasKey(key) {
+		span.SetAttributes(attribute.String("fs.source", "local"))
+		s.logger().Debug("File range found locally", "key", ns.qualify(key), "offset", offset, "length", length)
+		r, _, err := ns.storage.ReadFileDecryptedRange(key, rangeCipher.DecryptRange, ns.encryptionKey(), rangeCipher.HeaderSize(), offset, length)
+		return s.servedToClient(r, err, "local", start)
+	}
+
+	span.SetAttributes(attribute.String("fs.source", "peer"))
+	s.logger().Debug("File not found locally, requesting range from peers", "key", ns.qualify(key), "offset", offset, "length", length)
+
+	body, meta, err := s.fetchRangeFromPeers(ctx, ns, key, offset, length, done)
+	done = nil
+	if err != nil {
+		return nil, err
+	}
+
+	if meta.Compression == "" {
+		r := decryptingReader(body, func(dst io.Writer, src io.Reader) (int64, error) {
+			return rangeCipher.DecryptRange(ns.encryptionKey(), dst, src, offset)
+		})
+		return s.servedToClient(r, nil, "peer", start)
+	}
+
+	// The peer sent the whole compressed file.
+	r, err := decompressingReader(meta.Compression, decryptingReader(body, func(dst io.Writer, src io.Reader) (int64, error) {
+		return rangeCipher.DecryptRange(ns.encryptionKey(), dst, src, 0)
+	}))
+	if err == nil {
+		r, err = sliceReader(r, offset, length)
+	}
+	return s.servedToClient(r, err, "peer", start)
+}
+
+// fetchFromPeers broadcasts a request for the given key and stores the file
+// sent back by the peers that hold it.
+//
+// Only one fetch runs at a time, since the responses are read straight from the
+// peer connections and concurrent fetches would interleave on the same streams.
+func (s *FileServer) fetchFromPeers(ctx context.Context, ns *Namespace, key string) error {
+	return s.requestFromPeers(ctx, GetFileMessage{Namespace: ns.name, Key: key}, func(peer p2p.Peer, stream io.Reader, fileSize int64, meta ObjectMeta) error {
+		start := time.Now()
+		if _, err := ns.storage.StoreFile(key, stream, meta.ObjectAttrs); err != nil {
+			ns.storage.DeleteFile(key)
+			return err
+		}
+
+		s.logger().Debug("Received and stored file from peer", "key", ns.qualify(key), "peer", peer.RemoteAddr().String(), "bytes", fileSize, "duration", time.Since(start))
+		return nil
+	})
+}
+
+// fetchRangeFromPeers requests a range of the file from the peers and streams
+// the raw bytes sent back by the first one that holds it, along with the
+// metadata of the file: the cipher header followed by the ciphertext of the
+// range, or of the whole file when it is compressed. The range is not stored
+// locally.
+//
+// The transfer goes on in the background once the metadata is received, and
+// release is called when it is over. Other requests to the peers wait until
+// the returned reader is read to the end or closed, since they share the
+// peer connections.
+func (s *FileServer) fetchRangeFromPeers(ctx context.Context, ns *Namespace, key string, offset, length int64, release func()) (io.ReadCloser, ObjectMeta, error) {
+	message := GetFileMessage{
+		Namespace: ns.name,
+		Key:       key,
+		Ranged:    true,
+		Offset:    offset,
+		Length:    length,
+	}
+
+	pr, pw := io.Pipe()
+	found := make(chan ObjectMeta, 1)
+	failed := make(chan error, 1)
+	go func() {
+		defer release()
+
+		var received bool
+		err := s.requestFromPeers(ctx, message, func(peer p2p.Peer, stream io.Reader, size int64, meta ObjectMeta) error {
+			if received {
+				// A range was already received from another peer, drain this one.
+				_, err := io.Copy(io.Discard, stream)
+				return err
+			}
+			received = true
+			found <- meta
+
+			n, err := io.Copy(pw, stream)
 			if err != nil {
-				fmt.Printf("Error reading file size from peer %s: %v\n", peer.RemoteAddr().String(), err)
-				continue
+				// Either the caller closed the reader or the peer stream failed.
+				// Drain what is left so the connection stays usable.
+				pw.CloseWithError(err)
+				_, err = io.Copy(io.Discard, stream)
+				return err
 			}
-			if fileSize < 0 {
-				fmt.Printf("Received negative file size from peer %s, skipping.\n", peer.RemoteAddr().String())
-				continue
+			pw.Close()
+
+			s.logger().Debug("Received file range from peer", "key", ns.qualify(key), "peer", peer.RemoteAddr().String(), "offset", offset, "bytes", n)
+			return nil
+		})
+		if !received {
+			if err == nil {
+				err = fmt.Errorf("file with key %s not found on any peer", key)
 			}
-			if fileSize > maxFileSize {
-				fmt.Printf("File size (%d bytes) from peer %s exceeds maximum limit of %d bytes, skipping.\n", fileSize, peer.RemoteAddr().String(), maxFileSize)
-				continue
+			failed <- err
+		}
+		pw.CloseWithError(err)
+	}()
+
+	select {
+	case meta := <-found:
+		return pr, meta, nil
+	case err := <-failed:
+		return nil, ObjectMeta{}, err
+	}
+}
+
+// statFromPeers requests the metadata of the file from the peers and returns
+// the one sent back by the first peer that holds it. The body of the file is
+// not transferred.
+func (s *FileServer) statFromPeers(ctx context.Context, ns *Namespace, key string) (ObjectMeta, error) {
+	var (
+		found bool
+		meta  ObjectMeta
+	)
+	message := GetFileMessage{
+		Namespace: ns.name,
+		Key:       key,
+		MetaOnly:  true,
+	}
+
+	err := s.requestFromPeers(ctx, message, func(peer p2p.Peer, stream io.Reader, _ int64, peerMeta ObjectMeta) error {
+		if !found {
+			found, meta = true, peerMeta
+			s.logger().Debug("Received file metadata from peer", "key", ns.qualify(key), "peer", peer.RemoteAddr().String())
+		}
+		_, err := io.Copy(io.Discard, stream)
+		return err
+	})
+	if err != nil {
+		return ObjectMeta{}, err
+	}
+	if !found {
+		return ObjectMeta{}, fmt.Errorf("file with key %s not found on any peer: %w", key, os.ErrNotExist)
+	}
+	return meta, nil
+}
+
+// requestFromPeers sends the request to every peer and calls handle with the
+// stream of every peer that answers with a file, limited to the announced
+// size, and the metadata of the file. The stream of the peer is closed once
+// handle returns. It returns ErrInvalidRange when the peers only refused the
+// range requested.
+//
+// Every peer answers the request, with a fileNotFoundSize header when it does
+// not hold the file. A peer that does not answer within PeerResponseTimeout,
+// or whose stream is not read to the end, is dropped, since the rest of its
+// stream could no longer be told apart from the next messages. When it returns
+// early, the answers of the peers not read yet are discarded in the background
+// before the next request is sent.
+func (s *FileServer) requestFromPeers(ctx context.Context, request GetFileMessage, handle func(p2p.Peer, io.Reader, int64, ObjectMeta) error) error {
+	s.fetchLock.Lock()
+	var pending []p2p.Peer
+	defer func() {
+		if len(pending) == 0 {
+			s.fetchLock.Unlock()
+			return
+		}
+		go func() {
+			defer s.fetchLock.Unlock()
+			s.discardAnswers(pending)
+		}()
+	}()
+
+	request.Priority = PriorityFromContext(ctx)
+	message := Message{
+		Payload: request,
+	}
+
+	peers := s.connectedPeers()
+	unlock, err := s.lockStreams(ctx, peers)
+	if err != nil {
+		return err
+	}
+	for _, peer := range peers {
+		if err := s.sendLocked(ctx, &message, p2p.EncodeMessage, []p2p.Peer{peer}); err != nil {
+			s.logger().Warn("Failed to send file request to peer", "peer", peer.RemoteAddr().String(), "error", err)
+			continue
+		}
+		pending = append(pending, peer)
+	}
+	unlock()
+
+	maxFileSize := s.Config.MaxFileSize
+	var handled, invalidRange bool
+
+	for len(pending) > 0 {
+		peer := pending[0]
+
+		// Wait for the file size at most PeerResponseTimeout, or less if the context has an earlier deadline
+		readCtx, cancel := context.WithTimeout(ctx, s.Config.PeerResponseTimeout)
+		if err := peer.AwaitStream(readCtx); err != nil {
+			cancel()
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
 			}
-		case <-time.After(readTimeout):
-			fmt.Printf("Timeout while waiting for file size from peer %s\n", peer.RemoteAddr().String())
+			pending = pending[1:]
+			s.logger().Warn("Dropping peer that did not answer a file request", "peer", peer.RemoteAddr().String(), "error", err)
+			s.dropPeer(peer)
 			continue
 		}
+		pending = pending[1:]
 
-		if _, err := s.Storage.StoreFile(key, io.LimitReader(peer, fileSize)); err != nil {
-			return nil, err
+		stop := interruptOnDone(readCtx, peer)
+		fileSize, meta, err := readFileHeader(peer)
+		if !stop() && err == nil {
+			err = readCtx.Err()
+		}
+		cancel()
+		if err != nil {
+			s.logger().Warn("Failed to read file size from peer", "peer", peer.RemoteAddr().String(), "error", err)
+			s.dropPeer(peer)
+			peer.CloseStream()
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
+			continue
 		}
 
-		fmt.Printf("[%s] successfully received and stored file with key (%s) of size %d bytes from peer %s\n", s.Config.Transport.RemoteAddr(), key, fileSize, peer.RemoteAddr().String())
+		switch {
+		case fileSize == fileNotFoundSize:
+			peer.CloseStream()
+			continue
+		case fileSize == invalidRangeSize && request.Ranged:
+			s.logger().Debug("Peer refused an invalid range", "peer", peer.RemoteAddr().String(), "offset", request.Offset)
+			invalidRange = true
+			peer.CloseStream()
+			continue
+		case fileSize < 0:
+			s.logger().Warn("Skipping peer that announced a negative file size", "peer", peer.RemoteAddr().String(), "bytes", fileSize)
+			s.dropPeer(peer)
+			peer.CloseStream()
+			continue
+		case fileSize > maxFileSize:
+			s.logger().Warn("Skipping peer whose file exceeds the maximum size", "peer", peer.RemoteAddr().String(), "bytes", fileSize, "max", maxFileSize)
+			s.dropPeer(peer)
+			peer.CloseStream()
+			continue
+		}
 
+		stop = interruptOnDone(ctx, peer)
+		untrack := s.trackTransfer("in", request.Key, peer)
+		_, span := s.startSpan(ctx, "FileServer.fetchFromPeer",
+			attribute.String("fs.key", request.Key),
+			attribute.String("fs.peer", peer.RemoteAddr().String()),
+			attribute.Int64("fs.bytes", fileSize))
+		handled = true
+		body := &io.LimitedReader{R: peer, N: fileSize}
+		err = handle(peer, &contextReader{ctx: ctx, r: body}, fileSize, meta)
+		endSpan(span, err)
+		untrack()
+		if !stop() || body.N > 0 {
+			s.dropPeer(peer)
+			peer.CloseStream()
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
+			if err == nil {
+				err = fmt.Errorf("%d bytes of the file sent by peer %s were not read", body.N, peer.RemoteAddr().String())
+			}
+			return err
+		}
 		peer.CloseStream()
+		if err != nil {
+			return err
+		}
 	}
 
-	// r, _, err := s.Storage.ReadFile(key)
-	r, _, err := s.Storage.ReadFileDecrypted(key, s.Config.Crypto.Decrypt, s.Config.encryptionKey)
-	return r, err
+	if invalidRange && !handled {
+		return fmt.Errorf("range at offset %d of %s: %w", request.Offset, request.Key, ErrInvalidRange)
+	}
+	return nil
 }
 
-// Store saves a file to storage and broadcasts the event.
+// discardAnswers reads the answers of the peers to a file request that was
+// given up, so that they are not taken for the answers to the next request.
+// The answers carrying a file are not read; the peers sending them are
+// dropped instead, like the peers that do not answer in time.
+func (s *FileServer) discardAnswers(peers []p2p.Peer) {
+	for _, peer := range peers {
+		ctx, cancel := context.WithTimeout(s.abort, s.Config.PeerResponseTimeout)
+		err := peer.AwaitStream(ctx)
+		if err != nil {
+			cancel()
+			s.dropPeer(peer)
+			continue
+		}
+
+		stop := interruptOnDone(ctx, peer)
+		size, _, err := readFileHeader(peer)
+		if !stop() || err != nil || size > 0 {
+			s.dropPeer(peer)
+		}
+		peer.CloseStream()
+		cancel()
+	}
+}
+
+// Store saves a file to storage and replicates it to all peers.
 //
-// Reads from the provided io.Reader while storing data in a buffer.
-// Stores the file with the specified key and retrieves its size.
-// Constructs a message with the key and size for broadcasting.
-// Sends the storage event to all peers and initiates data transfer.
+// Constructs a message with the key and broadcasts it to announce the stream.
+// Encrypts the input once while reading it, writing the ciphertext to the local
+// disk and to the stream of every peer at the same time, so memory use does not
+// depend on the file size and every replica holds byte-identical ciphertext.
+// The peer streams are chunked, since the size is not known upfront, and end
+// with the checksum of the ciphertext, which the peers verify.
 // Logs the total bytes received and written to disk.
 func (s *FileServer) Store(key string, r io.Reader) error {
-	var (
-		fileBuffer = new(bytes.Buffer)
-		tee        = io.TeeReader(r, fileBuffer)
-	)
-	// size, err := s.Storage.StoreFile(key, tee)
-	size, err := s.Storage.StoreFileEncrypted(key, tee, s.Config.Crypto.Encrypt, s.Config.encryptionKey)
+	return s.StoreContext(context.Background(), key, r)
+}
+
+// StoreContext is like Store but stops reading the input once the context is
+// done. The peers are told to discard what they received, and peers whose
+// stream was interrupted in the middle of a write are dropped. The partial
+// local copy is removed.
+func (s *FileServer) StoreContext(ctx context.Context, key string, r io.Reader) error {
+	return s.store(ctx, s.defaultNamespace(), key, r, StoreOptions{})
+}
+
+// StoreOptions are the optional settings of a file stored with StoreWithOptions.
+type StoreOptions struct {
+	// TTL is how long the file is kept. Once it has passed, the file is no
+	// longer served and the reaper of every node deletes its replica. A zero
+	// TTL keeps the file until it is deleted.
+	TTL time.Duration
+
+	// ContentType, Tags and Metadata are recorded with every replica and
+	// returned by Stat. Files can be listed by tag with ListByTag.
+	ContentType string
+	Tags        map[string]string
+	Metadata    map[string]string
+
+	// Compression compresses the file before it is encrypted: CompressionZstd
+	// or CompressionGzip, CompressionAuto to compress it with zstd only when a
+	// sample of it compresses well, or CompressionNone. The algorithm is
+	// recorded with the file, which Get decompresses. A zero value means the
+	// Compression of the server.
+	Compression string
+}
+
+// StoreWithOptions is like StoreContext, with the given options.
+func (s *FileServer) StoreWithOptions(ctx context.Context, key string, r io.Reader, opts StoreOptions) error {
+	return s.store(ctx, s.defaultNamespace(), key, r, opts)
+}
+
+func (s *FileServer) store(ctx context.Context, ns *Namespace, key string, r io.Reader, opts StoreOptions) (err error) {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := validateKey(key); err != nil {
+		return fmt.Errorf("storing: %w", err)
+	}
+	if opts.TTL < 0 {
+		return fmt.Errorf("storing %s: negative TTL %s", key, opts.TTL)
+	}
+	if err := (ObjectAttrs{ContentType: opts.ContentType, Tags: opts.Tags, Metadata: opts.Metadata}).validate(); err != nil {
+		return fmt.Errorf("storing %s: %w", key, err)
+	}
+	if opts.Compression == "" {
+		opts.Compression = s.Config.Compression
+	}
+	if err := validateCompression(opts.Compression); err != nil {
+		return fmt.Errorf("storing %s: %w", key, err)
+	}
+	start := time.Now()
+	defer observeSince(s.metrics.storeDuration, start)
+
+	ctx, done, err := s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	ctx, span := s.startSpan(ctx, "FileServer.Store", attribute.String("fs.namespace", ns.name), attribute.String("fs.key", key))
+	defer func() { endSpan(span, err) }()
+	defer func() {
+		record := AuditRecord{Action: "store", Namespace: ns.name, Key: key}
+		if meta, statErr := ns.storage.Stat(key); err == nil && statErr == nil {
+			record.Size = s.objectInfo(meta).Size
+		}
+		s.auditOperation(ctx, record, err)
+	}()
+
+	if err := s.authorize(ctx, ns, PermissionWrite, key); err != nil {
+		return err
+	}
+	if err := ns.checkStore(key); err != nil {
+		s.auditDenied(ctx, "store", ns.name, key, err)
+		return err
+	}
+	if capacity := s.Capacity(); capacity.Full() {
+		return fmt.Errorf("storing %s: %w: node %s is full (%d bytes used, %d bytes free)", key, ErrInsufficientStorage, s.Config.Transport.RemoteAddr(), capacity.Used, capacity.Free)
+	}
+	defer s.capacityChanged(ctx)
+
+	r = &contextReader{ctx: ctx, r: r}
+	compression, r, err := chooseCompression(opts.Compression, r)
 	if err != nil {
 		return err
 	}
 
+	// The replicas are given the same expiry time, rather than the TTL, so that
+	// they do not outlive the local copy.
+	attrs := ObjectAttrs{
+		ContentType: opts.ContentType,
+		Tags:        opts.Tags,
+		Metadata:    opts.Metadata,
+		CreatedAt:   start.UTC(),
+		Compression: compression,
+	}
+	if opts.TTL > 0 {
+		attrs.ExpiresAt = start.Add(opts.TTL).UTC()
+	}
+	if principal, ok := PrincipalFromContext(ctx); ok {
+		attrs.Uploader = principal.Name
+	}
+
 	message := Message{
 		Payload: StoreFileMessage{
-			Key: key,
-			// Total size includes 16 bytes for the Initialization Vector (IV) at the beginning of the file.
-			Size: 16 + size,
+			Namespace: ns.name,
+			Key:       key,
+			SentAt:    start,
+			Attrs:     attrs,
 		},
 	}
 
-	if err := s.broadcast(&message); err != nil {
+	// Full peers are left out of the replication. The connections to the
+	// replicas are held from the message until the end of the stream, so that
+	// the chunks of concurrent transfers are not interleaved.
+	replicas := &replicaWriter{ctx: ctx, logger: s.logger(), peers: s.replicaPeers(), priority: PriorityFromContext(ctx)}
+	unlock, err := s.lockStreams(ctx, replicas.peers)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	// The stream follows the message, which the peers hand to its handler.
+	if err := s.sendLocked(ctx, &message, p2p.EncodeStreamMessage, replicas.peers); err != nil {
 		return err
 	}
 
-	time.Sleep(time.Millisecond * 5)
+	stream := newChunkWriter(replicas)
+	if len(replicas.peers) > 0 {
+		defer s.trackTransfer("out", ns.qualify(key), replicas.peers...)()
+	}
 
-	peers := []io.Writer{}
-	for _, peer := range s.peers {
-		peers = append(peers, peer)
+	stops := make(map[p2p.Peer]func() bool, len(replicas.peers))
+	for _, peer := range replicas.peers {
+		stops[peer] = interruptOnDone(ctx, peer)
+	}
+
+	size, err := ns.storage.StoreFileEncrypted(key, r, attrs, func(encryptionKey []byte, dst io.Writer, src io.Reader) (int64, error) {
+		if attrs.Compression != "" {
+			compressed := compressingReader(attrs.Compression, src)
+			defer compressed.Close()
+			src = compressed
+		}
+		return s.Config.Crypto.Encrypt(encryptionKey, io.MultiWriter(dst, stream), src)
+	}, ns.encryptionKey())
+
+	for peer, stop := range stops {
+		if !stop() {
+			s.dropPeer(peer)
+		}
+	}
+
+	if err != nil {
+		stream.Abort()
+		ns.storage.DeleteFile(key)
+		return err
 	}
 
-	mw := io.MultiWriter(peers...)
-	mw.Write([]byte{p2p.IncomingStream})
-	// mw.Write(fileBuffer.Bytes())
-	s.Config.Crypto.Encrypt(s.Config.encryptionKey, mw, fileBuffer)
+	// The replicas learn the size before compression from the end of the stream.
+	var uncompressedSize int64
+	if meta, err := ns.storage.Stat(key); err == nil {
+		s.metrics.bytesStored.WithLabelValues("client").Add(float64(meta.Size))
+		uncompressedSize = meta.UncompressedSize
+	}
 
-	fmt.Printf("[%s] received and written (%d) bytes to disk\n", s.Config.Transport.RemoteAddr(), size)
+	if err := stream.Finish(uncompressedSize); err != nil {
+		return err
+	}
+
+	span.SetAttributes(attribute.Int64("fs.bytes", size), attribute.Int("fs.replicas", len(replicas.peers)))
+	s.logger().Debug("Stored file", "key", ns.qualify(key), "bytes", size, "duration", time.Since(start))
 	return nil
 }
 
+// Delete removes the file from local storage and asks every peer to delete its replica.
+// It returns an error wrapping os.ErrNotExist if the file is not stored locally.
+func (s *FileServer) Delete(key string) error {
+	return s.DeleteContext(context.Background(), key)
+}
+
+// DeleteContext is like Delete, made for the principal of the context.
+func (s *FileServer) DeleteContext(ctx context.Context, key string) error {
+	return s.delete(ctx, s.defaultNamespace(), key)
+}
+
+func (s *FileServer) delete(ctx context.Context, ns *Namespace, key string) (err error) {
+	if err := validateKey(key); err != nil {
+		return err
+	}
+	ctx, done, err := s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	var size int64
+	defer func() {
+		s.auditOperation(ctx, AuditRecord{Action: "delete", Namespace: ns.name, Key: key, Size: size}, err)
+	}()
+
+	if err := s.authorize(ctx, ns, PermissionDelete, key); err != nil {
+		return err
+	}
+	if !ns.storage.HasKey(key) {
+		return fmt.Errorf("file with key %s: %w", key, os.ErrNotExist)
+	}
+	if err := ns.checkDelete(key); err != nil {
+		s.auditDenied(ctx, "delete", ns.name, key, err)
+		return err
+	}
+	if meta, err := ns.storage.Stat(key); err == nil {
+		size = s.objectInfo(meta).Size
+	}
+
+	if err := ns.storage.DeleteFile(key); err != nil {
+		return err
+	}
+	defer s.capacityChanged(ctx)
+
+	message := Message{
+		Payload: DeleteFileMessage{
+			Namespace: ns.name,
+			Key:       key,
+		},
+	}
+	return s.broadcast(ctx, &message)
+}
+
+// ObjectInfo describes a file stored in the distributed file system.
+type ObjectInfo struct {
+	Key string `json:"key"`
+	// Size is the size of the decrypted file.
+	Size int64 `json:"size"`
+	// Checksum is the SHA-256 checksum of the stored ciphertext, which is the
+	// same on every replica.
+	Checksum string    `json:"checksum"`
+	ModTime  time.Time `json:"modTime"`
+	// ExpiresAt is when the file expires, if it was stored with a TTL.
+	ExpiresAt time.Time `json:"expiresAt,omitzero"`
+
+	ContentType string            `json:"contentType,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	// CreatedAt is when the file was stored by the client. Unlike ModTime,
+	// it is the same on every replica.
+	CreatedAt time.Time `json:"createdAt,omitzero"`
+	// Uploader is the principal that stored the file.
+	Uploader string `json:"uploader,omitempty"`
+	// Compression is the algorithm the file is compressed with, and
+	// StoredSize the size it takes once compressed and encrypted.
+	Compression string `json:"compression,omitempty"`
+	StoredSize  int64  `json:"storedSize,omitempty"`
+}
+
+// Stat returns information about the file. If the file is not stored locally,
+// its metadata is requested from the peers, without transferring its body.
+func (s *FileServer) Stat(key string) (ObjectInfo, error) {
+	return s.StatContext(context.Background(), key)
+}
+
+// StatContext is like Stat but honors the cancellation and deadline of the context.
+func (s *FileServer) StatContext(ctx context.Context, key string) (ObjectInfo, error) {
+	return s.stat(ctx, s.defaultNamespace(), key)
+}
+
+func (s *FileServer) stat(ctx context.Context, ns *Namespace, key string) (ObjectInfo, error) {
+	if err := validateKey(key); err != nil {
+		return ObjectInfo{}, err
+	}
+	if err := s.authorize(ctx, ns, PermissionRead, key); err != nil {
+		return ObjectInfo{}, err
+	}
+	meta, err := ns.storage.Stat(key)
+	if errors.Is(err, os.ErrNotExist) {
+		meta, err = s.statFromPeers(ctx, ns, key)
+	}
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return s.objectInfo(meta), nil
+}
+
+// List returns the files stored locally whose key starts with prefix, sorted by key.
+func (s *FileServer) List(prefix string) ([]ObjectInfo, error) {
+	return s.ListContext(context.Background(), prefix)
+}
+
+// ListContext is like List, but only returns the files the principal of the
+// context may read.
+func (s *FileServer) ListContext(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	return s.list(ctx, s.defaultNamespace(), prefix)
+}
+
+func (s *FileServer) list(ctx context.Context, ns *Namespace, prefix string) ([]ObjectInfo, error) {
+	readable, err := s.authorizeList(ctx, ns, prefix)
+	if err != nil {
+		return nil, err
+	}
+	metas, err := ns.storage.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	objects := make([]ObjectInfo, 0, len(metas))
+	for _, meta := range metas {
+		if readable(meta.Key) {
+			objects = append(objects, s.objectInfo(meta))
+		}
+	}
+	return objects, nil
+}
+
+// objectInfo converts the metadata of a stored blob to the information of the
+// decrypted file, by removing the header written by the cipher.
+func (s *FileServer) objectInfo(meta ObjectMeta) ObjectInfo {
+	size := meta.Size
+	if rangeCipher, ok := s.Config.Crypto.(RangeCipher); ok {
+		size -= rangeCipher.HeaderSize()
+	}
+	if meta.Compression != "" {
+		size = meta.UncompressedSize
+	}
+	return ObjectInfo{
+		Key:      meta.Key,
+		Size:     size,
+		Checksum: meta.Checksum,
+		ModTime:  meta.ModTime,
+
+		ExpiresAt:   meta.ExpiresAt,
+		ContentType: meta.ContentType,
+		Tags:        meta.Tags,
+		Metadata:    meta.Metadata,
+		CreatedAt:   meta.CreatedAt,
+		Uploader:    meta.Uploader,
+		Compression: meta.Compression,
+		StoredSize:  meta.Size,
+	}
+}
+
 // handleMessage processes incoming messages and delegates them to the appropriate handler
-// based on the type of the message payload.
-func (s *FileServer) handleMessage(from net.Addr, message Message) error {
+// based on the type of the message payload. ctx carries the trace context of the sender.
+func (s *FileServer) handleMessage(ctx context.Context, from net.Addr, message Message) error {
+	if controlMessage(message.Payload) {
+		if err := s.authorizeControl(ctx, from, message.Auth, message.Payload); err != nil {
+			return err
+		}
+	}
+
 	switch payloadType := message.Payload.(type) {
 	case GetFileMessage:
-		return s.handleGetFileMessage(from, payloadType)
+		// Serving the file waits for the transfers in flight to the peer, which
+		// may themselves wait for this loop to read a stream of the peer.
+		go func() {
+			if err := s.handleGetFileMessage(ctx, from, message.Auth, payloadType); err != nil {
+				s.logger().Warn("Failed to handle message", "peer", from.String(), "error", err)
+			}
+		}()
+		return nil
 	case StoreFileMessage:
-		return s.handleStoreFileMessage(from, payloadType)
+		return s.handleStoreFileMessage(ctx, from, message.Auth, payloadType)
+	case DeleteFileMessage:
+		return s.handleDeleteFileMessage(ctx, from, message.Auth, payloadType)
 	case PeersInfoMessage:
 		return s.handlePeersInfoMessage(from, payloadType)
 	case NodeIntroductionMessage:
-		return s.handleNodeIntroductionMessage(payloadType)
+		return s.handleNodeIntroductionMessage(from, payloadType)
+	case NodeLeavingMessage:
+		return s.handleNodeLeavingMessage(from, payloadType)
+	case CapacityMessage:
+		return s.handleCapacityMessage(from, payloadType)
 	}
 
 	return nil
@@ -302,73 +1302,258 @@ func (s *FileServer) handleMessage(from net.Addr, message Message) error {
 // Sends a stream initiation signal to the peer.
 // Writes the file size to the peer using binary format.
 // Copies the file data to the peer's stream and logs the transfer.
-func (s *FileServer) handleGetFileMessage(from net.Addr, message GetFileMessage) error {
-	if !s.Storage.HasKey(message.Key) {
-		return fmt.Errorf("file with key %s not found on %s disk", message.Key, s.Config.Transport.RemoteAddr())
+func (s *FileServer) handleGetFileMessage(ctx context.Context, from net.Addr, auth *MessageAuth, message GetFileMessage) (err error) {
+	_, span := s.startSpan(ctx, "FileServer.handleGetFileMessage",
+		attribute.String("fs.namespace", message.Namespace),
+		attribute.String("fs.key", message.Key),
+		attribute.String("fs.peer", from.String()))
+	defer func() { endSpan(span, err) }()
+
+	// The requester waits for an answer from every peer, so a file that is
+	// not served is answered with the fileNotFoundSize header.
+	var answered bool
+	defer func() {
+		if err != nil && !answered {
+			err = errors.Join(err, s.answerFile(s.abort, from, fileNotFoundSize, ObjectMeta{}))
+		}
+	}()
+
+	ctx, done, err := s.begin(ctx)
+	if err != nil {
+		return err
 	}
+	defer done()
 
-	fmt.Printf("[%s] serving file with key (%s) over the network\n", s.Config.Transport.RemoteAddr(), message.Key)
+	ns, err := s.Namespace(message.Namespace)
+	if err != nil {
+		return fmt.Errorf("file with key %s requested by peer %s: %w", message.Key, from.String(), err)
+	}
+	if err := validateKey(message.Key); err != nil {
+		return fmt.Errorf("file requested by peer %s: %w", from.String(), err)
+	}
+	if ctx, err = s.authorizePeer(ctx, from, auth, message, PermissionRead, ns, message.Key); err != nil {
+		return fmt.Errorf("file with key %s requested by peer %s: %w", message.Key, from.String(), err)
+	}
+	meta, err := ns.storage.Stat(message.Key)
+	if err != nil {
+		return fmt.Errorf("file with key %s not found on %s disk: %w", ns.qualify(message.Key), s.Config.Transport.RemoteAddr(), err)
+	}
+	if message.MetaOnly {
+		answered = true
+		return s.answerFile(ctx, from, 0, meta)
+	}
+	var n int64
+	defer func() {
+		s.auditOperation(ctx, AuditRecord{Action: "get", Namespace: ns.name, Key: message.Key, Size: n, Peer: from.String()}, err)
+	}()
 
-	r, fileSize, err := s.Storage.ReadFile(message.Key)
+	start := time.Now()
+	var (
+		r        io.ReadCloser
+		fileSize int64
+	)
+	// Offsets in a compressed file do not map to offsets in the blob, so the
+	// whole blob is sent for the requester to decompress.
+	if message.Ranged && meta.Compression == "" {
+		var headerSize int64
+		if rangeCipher, ok := s.Config.Crypto.(RangeCipher); ok {
+			headerSize = rangeCipher.HeaderSize()
+		}
+		r, fileSize, err = ns.storage.ReadFileRange(message.Key, headerSize, message.Offset, message.Length)
+	} else {
+		r, fileSize, err = ns.storage.ReadFile(message.Key)
+	}
+	if errors.Is(err, ErrInvalidRange) {
+		answered = true
+		return errors.Join(err, s.answerFile(ctx, from, invalidRangeSize, meta))
+	}
 	if err != nil {
 		return err
 	}
+	defer r.Close()
 
-	peer, isExist := s.peers[from.String()]
+	peer, isExist := s.peer(from.String())
 	if !isExist {
 		return fmt.Errorf("peer %s not found in peer map", from.String())
 	}
 
-	peer.Send([]byte{p2p.IncomingStream})
-	binary.Write(peer, binary.LittleEndian, fileSize)
-	n, err := io.Copy(peer, r)
+	unlock, err := s.lockStreams(ctx, []p2p.Peer{peer})
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	defer s.trackTransfer("out", ns.qualify(message.Key), peer)()
+	defer interruptOnDone(ctx, peer)()
+
+	answered = true
+	if err := peer.Send([]byte{p2p.IncomingStream}); err != nil {
+		return fmt.Errorf("error starting stream to peer: %w", err)
+	}
+	if err := writeFileHeader(peer, fileSize, meta); err != nil {
+		return fmt.Errorf("error writing file header to peer: %w", err)
+	}
+	n, err = io.Copy(p2p.PriorityWriter(ctx, peer, message.Priority), r)
+	span.SetAttributes(attribute.Int64("fs.bytes", n))
+	s.metrics.bytesServed.WithLabelValues("peer").Add(float64(n))
 	if err != nil {
 		return fmt.Errorf("error copying file data to peer: %v", err)
 	}
 
-	fmt.Printf("[%s] successfully written %d bytes to peer %s\n", s.Config.Transport.RemoteAddr(), n, from.String())
+	s.logger().Debug("Served file to peer", "key", ns.qualify(message.Key), "peer", from.String(), "bytes", n, "duration", time.Since(start))
 
 	return nil
 }
 
+// answerFile answers a GetFileMessage with a header announcing size and
+// carrying meta, with no body: the metadata of a file asked with MetaOnly,
+// the invalidRangeSize of a range that starts past the end of the file, or the
+// fileNotFoundSize of a file that is not served.
+func (s *FileServer) answerFile(ctx context.Context, from net.Addr, size int64, meta ObjectMeta) error {
+	peer, isExist := s.peer(from.String())
+	if !isExist {
+		return fmt.Errorf("peer %s not found in peer map", from.String())
+	}
+
+	unlock, err := s.lockStreams(ctx, []p2p.Peer{peer})
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := peer.Send([]byte{p2p.IncomingStream}); err != nil {
+		return err
+	}
+	return writeFileHeader(peer, size, meta)
+}
+
 // Handles the reception of a file storage message from a peer.
 //
 // Verifies the existence of the sending peer in the peer map.
-// Stores the file associated with the provided key from the peer's stream.
+// Stores the file associated with the provided key from the peer's chunked stream.
+// Removes the file again if the sender aborted the stream or if its checksum
+// does not match what was received.
 // Logs the successful storage of the file, including the key,
 // size, and peer address.
 // Closes the stream for the sending peer to manage resources.
-func (s *FileServer) handleStoreFileMessage(from net.Addr, message StoreFileMessage) error {
-	peer, isExist := s.peers[from.String()]
+func (s *FileServer) handleStoreFileMessage(ctx context.Context, from net.Addr, auth *MessageAuth, message StoreFileMessage) (err error) {
+	_, span := s.startSpan(ctx, "FileServer.handleStoreFileMessage",
+		attribute.String("fs.namespace", message.Namespace),
+		attribute.String("fs.key", message.Key),
+		attribute.String("fs.peer", from.String()))
+	defer func() { endSpan(span, err) }()
+
+	peer, isExist := s.peer(from.String())
 	if !isExist {
 		return fmt.Errorf("peer %s not found in peer map", from.String())
 	}
 
-	_, err := s.Storage.StoreFile(message.Key, io.LimitReader(peer, message.Size))
+	defer peer.CloseStream()
+
+	stream := newChunkReader(peer)
+	ns, err := s.Namespace(message.Namespace)
+	if err == nil {
+		err = validateKey(message.Key)
+	}
+	if err != nil {
+		// Consume the stream so the connection stays usable.
+		io.Copy(io.Discard, stream)
+		s.logger().Warn("Refused replica from peer", "namespace", message.Namespace, "key", message.Key, "peer", from.String(), "error", err)
+		return fmt.Errorf("refusing file with key %s from peer %s: %w", message.Key, from.String(), err)
+	}
+	if ctx, err = s.authorizePeer(ctx, from, auth, message, PermissionWrite, ns, message.Key); err != nil {
+		io.Copy(io.Discard, stream)
+		return fmt.Errorf("refusing file with key %s from peer %s: %w", message.Key, from.String(), err)
+	}
+	defer func() {
+		record := AuditRecord{Action: "store", Namespace: ns.name, Key: message.Key, Peer: from.String()}
+		if meta, statErr := ns.storage.Stat(message.Key); err == nil && statErr == nil {
+			record.Size = s.objectInfo(meta).Size
+		}
+		s.auditOperation(ctx, record, err)
+	}()
+
+	defer s.trackTransfer("in", ns.qualify(message.Key), peer)()
+
+	// A replica sent while shutting down is still read, so that the connection
+	// stays usable, but Shutdown does not wait for it.
+	if ctx, done, err := s.begin(ctx); err == nil {
+		defer done()
+		defer interruptOnDone(ctx, peer)()
+	}
+
+	defer s.capacityChanged(ctx)
+
+	n, err := ns.storage.StoreFile(message.Key, stream, message.Attrs)
+	if errors.Is(err, ErrInsufficientStorage) {
+		io.Copy(io.Discard, stream)
+		ns.storage.DeleteFile(message.Key)
+		s.logger().Warn("Refused replica from peer", "key", ns.qualify(message.Key), "peer", from.String(), "error", err)
+		return fmt.Errorf("refusing file with key %s from peer %s: %w", message.Key, from.String(), err)
+	}
 	if err != nil {
+		// Consume what is left of the stream so the connection stays usable.
+		io.Copy(io.Discard, stream)
+		ns.storage.DeleteFile(message.Key)
 		return fmt.Errorf("error storing file with key %s from peer %s: %v", message.Key, from.String(), err)
 	}
 
-	fmt.Printf("[%s] successfully stored file with key (%s) of size %d bytes from peer %s\n", s.Config.Transport.RemoteAddr(), message.Key, message.Size, from.String())
+	span.SetAttributes(attribute.Int64("fs.bytes", n))
+	s.metrics.bytesStored.WithLabelValues("peer").Add(float64(n))
+	if !message.SentAt.IsZero() {
+		observeSince(s.metrics.replicationLag, message.SentAt)
+	}
 
-	peer.CloseStream()
+	s.logger().Debug("Stored replica from peer", "key", ns.qualify(message.Key), "peer", from.String(), "bytes", n)
 
 	return nil
 }
 
+// handleDeleteFileMessage deletes the local replica of the file requested by a peer.
+func (s *FileServer) handleDeleteFileMessage(ctx context.Context, from net.Addr, auth *MessageAuth, message DeleteFileMessage) error {
+	ns, err := s.Namespace(message.Namespace)
+	if err != nil {
+		return fmt.Errorf("deleting file with key %s requested by peer %s: %w", message.Key, from.String(), err)
+	}
+	if err := validateKey(message.Key); err != nil {
+		return fmt.Errorf("deleting file requested by peer %s: %w", from.String(), err)
+	}
+	if ctx, err = s.authorizePeer(ctx, from, auth, message, PermissionDelete, ns, message.Key); err != nil {
+		return fmt.Errorf("deleting file with key %s requested by peer %s: %w", message.Key, from.String(), err)
+	}
+	if !ns.storage.HasKey(message.Key) {
+		return nil
+	}
+
+	record := AuditRecord{Action: "delete", Namespace: ns.name, Key: message.Key, Peer: from.String()}
+	if meta, err := ns.storage.Stat(message.Key); err == nil {
+		record.Size = s.objectInfo(meta).Size
+	}
+	err = ns.storage.DeleteFile(message.Key)
+	s.auditOperation(ctx, record, err)
+	if err != nil {
+		return fmt.Errorf("error deleting file with key %s requested by peer %s: %v", message.Key, from.String(), err)
+	}
+	s.capacityChanged(ctx)
+
+	s.logger().Debug("Deleted replica as requested by peer", "key", ns.qualify(message.Key), "peer", from.String())
+	return nil
+}
+
 // handlePeersInfoMessage handles incoming peer information messages, which contain a list of peer addresses.
 // When a new list of peer addresses is received, the function attempts to establish connections with each address.
 func (s *FileServer) handlePeersInfoMessage(from net.Addr, message PeersInfoMessage) error {
-	fmt.Printf("%s received peer address list %v from %s\n", s.Config.Transport.RemoteAddr(), message.Addresses, from)
+	s.logger().Debug("Received peer address list", "peer", from.String(), "addresses", message.Addresses)
 	for _, address := range message.Addresses {
 		if len(address) == 0 {
 			continue
 		}
 
 		go func() {
-			fmt.Printf("%s Attempting to broadcasted node: %s\n", s.Config.Transport.RemoteAddr(), address)
+			s.logger().Debug("Connecting to broadcasted node", "peer", address)
 			if err := s.Config.Transport.Dial(address); err != nil {
-				log.Printf("Failed to connect to broadcasted node %s: %v\n", address, err)
+				s.metrics.connectionErrors.WithLabelValues("dial").Inc()
+				s.logger().Warn("Failed to connect to broadcasted node", "peer", address, "error", err)
 			}
 		}()
 	}
@@ -378,52 +1563,76 @@ func (s *FileServer) handlePeersInfoMessage(from net.Addr, message PeersInfoMess
 
 // handleNodeIntroductionMessage processes a NodeIntroductionMessage by adding the
 // address from the message to the server's list of peer addresses.
-func (s *FileServer) handleNodeIntroductionMessage(message NodeIntroductionMessage) error {
-	fmt.Printf("Node %s received introduction message from Node %s\n", s.Config.Transport.RemoteAddr(), message.Address)
-	s.PeersAddresses = append(s.PeersAddresses, message.Address)
-	return nil
+func (s *FileServer) handleNodeIntroductionMessage(from net.Addr, message NodeIntroductionMessage) error {
+	s.logger().Debug("Received node introduction", "peer", message.Address)
+	s.peerLock.Lock()
+	s.peersAddresses = append(s.peersAddresses, message.Address)
+	s.peerLock.Unlock()
+	return s.handleCapacityMessage(from, CapacityMessage{Capacity: message.Capacity})
 }
 
 // connectToBootstrapNodes attempts to connect to all bootstrap nodes specified in the server's configuration.
-// It iterates over the list of bootstrap node addresses and spawns a goroutine for each non-empty address to
-// establish a connection using the server's transport mechanism. If a connection attempt fails, an error is logged.
+// It spawns a goroutine for each non-empty address to establish a connection using the server's transport
+// mechanism, and waits until every bootstrap node is accepted as a peer or failed to connect, or the server
+// is aborted. If a connection attempt fails, an error is logged.
 //
 // Returns an error if any issues occur during the connection process.
 func (s *FileServer) connectToBootstrapNodes() error {
+	var wg sync.WaitGroup
 	for _, address := range s.Config.BootstrapNodes {
 		if len(address) == 0 {
 			continue
 		}
 
+		wg.Add(1)
 		go func() {
-			fmt.Printf("%s Attempting to connect to bootstrap node: %s\n", s.Config.Transport.RemoteAddr(), address)
-			if err := s.Config.Transport.Dial(address); err != nil {
-				log.Printf("Failed to connect to bootstrap node %s: %v\n", address, err)
+			defer wg.Done()
+			s.logger().Debug("Connecting to bootstrap node", "peer", address)
+			if err := s.Config.Transport.DialContext(s.abort, address); err != nil {
+				s.metrics.connectionErrors.WithLabelValues("dial").Inc()
+				s.logger().Warn("Failed to connect to bootstrap node", "peer", address, "error", err)
 			}
 		}()
 	}
+	wg.Wait()
 
 	return nil
 }
 
 func (s *FileServer) Start() error {
+	for _, ns := range s.namespaces {
+		if _, err := ns.open(); err != nil {
+			return err
+		}
+	}
 	if err := s.Config.Transport.ListenAndAccept(); err != nil {
 		return err
 	}
+	s.startedAt.Store(time.Now().UnixNano())
+	s.log.Store(s.Config.Logger.With("node", s.Config.Transport.RemoteAddr()))
 
 	s.connectToBootstrapNodes()
 
-	time.Sleep(5 * time.Millisecond)
 	// After joining the network, send your address to all other nodes to share your real address
+	capacity := s.Capacity()
+	s.full.Store(capacity.Full())
 	message := Message{
 		Payload: NodeIntroductionMessage{
-			Address: s.Config.Transport.RemoteAddr(),
+			Address:  s.Config.Transport.RemoteAddr(),
+			Capacity: capacity,
 		},
 	}
-	if err := s.broadcast(&message); err != nil {
+	if err := s.broadcast(context.Background(), &message); err != nil {
 		return err
 	}
 
+	if s.Config.ScrubInterval > 0 {
+		go s.scrubber.Run(s.Config.ScrubInterval, s.quitCh)
+	}
+	if s.Config.ExpiryInterval > 0 {
+		go s.runReaper(s.Config.ExpiryInterval, s.quitCh)
+	}
+
 	s.loop()
 
 	return nil
@@ -432,6 +1641,9 @@ func (s *FileServer) Start() error {
 func init() {
 	gob.Register(StoreFileMessage{})
 	gob.Register(GetFileMessage{})
+	gob.Register(DeleteFileMessage{})
 	gob.Register(PeersInfoMessage{})
 	gob.Register(NodeIntroductionMessage{})
+	gob.Register(NodeLeavingMessage{})
+	gob.Register(CapacityMessage{})
 }
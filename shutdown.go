@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"go-distributed-storage/p2p"
+	"net"
+	"slices"
+)
+
+// ErrServerClosed is returned by the operations of a FileServer that is
+// shutting down or has shut down.
+var ErrServerClosed = errors.New("file server closed")
+
+// NodeLeavingMessage tells the peers that the node listening on Address is
+// shutting down, so that they close their connection to it and forget its address.
+type NodeLeavingMessage struct {
+	Address string
+}
+
+// begin registers an operation that Shutdown waits for. The returned context is
+// cancelled when Shutdown gives up waiting, and done must be called once the
+// operation is over. It returns ErrServerClosed once the server is shutting down.
+func (s *FileServer) begin(ctx context.Context) (context.Context, func(), error) {
+	s.lifecycleLock.Lock()
+	defer s.lifecycleLock.Unlock()
+
+	if s.closing {
+		return nil, nil, ErrServerClosed
+	}
+	s.active++
+
+	ctx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(s.abort, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+
+		s.lifecycleLock.Lock()
+		defer s.lifecycleLock.Unlock()
+		s.active--
+		if s.closing && s.active == 0 {
+			close(s.idle)
+		}
+	}, nil
+}
+
+// isClosing reports whether Shutdown was called.
+func (s *FileServer) isClosing() bool {
+	s.lifecycleLock.Lock()
+	defer s.lifecycleLock.Unlock()
+	return s.closing
+}
+
+// Stop shuts the server down, giving in-flight requests Config.ShutdownTimeout
+// to finish. See Shutdown.
+func (s *FileServer) Stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), s.Config.ShutdownTimeout)
+	defer cancel()
+
+	if err := s.Shutdown(ctx); err != nil && !errors.Is(err, ErrServerClosed) {
+		s.logger().Warn("Shut down without draining every request", "error", err)
+	}
+}
+
+// Shutdown gracefully stops the server.
+//
+// New client requests and file requests from peers are refused with
+// ErrServerClosed. Shutdown then waits for the in-flight operations, including
+// the transfers to and from peers, to finish. Once the context is done, they
+// are cancelled instead, and Shutdown returns the error of the context after
+// they returned. The peers are then told that the node is leaving, and the
+// listener and every peer connection are closed, which makes Start return.
+//
+// A Store blocked in a Read of its input returns once the Read does.
+//
+// Calling Shutdown again returns ErrServerClosed once the first call is over.
+func (s *FileServer) Shutdown(ctx context.Context) error {
+	s.lifecycleLock.Lock()
+	if s.closing {
+		s.lifecycleLock.Unlock()
+		<-s.stopped
+		return ErrServerClosed
+	}
+	s.closing = true
+	active := s.active
+	if active == 0 {
+		close(s.idle)
+	}
+	s.lifecycleLock.Unlock()
+	defer close(s.stopped)
+
+	if s.startedAt.Load() == 0 {
+		// Never started, there is nothing to drain or close.
+		s.abortCancel()
+		return nil
+	}
+
+	s.logger().Info("Shutting down", "inflight", active)
+
+	var err error
+	select {
+	case <-s.idle:
+	case <-ctx.Done():
+		err = ctx.Err()
+		s.logger().Warn("Cancelling in-flight requests", "error", err)
+		s.abortCancel()
+		// Cancelled operations interrupt their transfers and return promptly.
+		<-s.idle
+	}
+	s.abortCancel()
+
+	message := Message{
+		Payload: NodeLeavingMessage{
+			Address: s.Config.Transport.RemoteAddr(),
+		},
+	}
+	if err := s.broadcast(context.Background(), &message); err != nil {
+		s.logger().Warn("Failed to tell peers the node is leaving", "error", err)
+	}
+
+	close(s.quitCh)
+	if err := s.Config.Transport.Close(); err != nil {
+		s.logger().Warn("Failed to close transport", "error", err)
+	}
+
+	s.peerLock.Lock()
+	for address, peer := range s.peers {
+		delete(s.peers, address)
+		delete(s.streamLocks, peer)
+		s.notifyMembership(peer, false)
+		peer.Close()
+	}
+	s.peerLock.Unlock()
+
+	<-s.loopDone
+
+	for _, ns := range s.openNamespaces() {
+		if err := ns.storage.Close(); err != nil {
+			s.logger().Warn("Failed to close storage", "namespace", ns.name, "error", err)
+		}
+	}
+	if s.Config.AuditLog != nil {
+		if err := s.Config.AuditLog.Close(); err != nil {
+			s.logger().Warn("Failed to close audit log", "error", err)
+		}
+	}
+	return err
+}
+
+// forgetPeer removes the peer with the given remote address from the peer map
+// and returns it.
+func (s *FileServer) forgetPeer(address string) (p2p.Peer, bool) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	peer, ok := s.peers[address]
+	if ok {
+		delete(s.peers, address)
+		delete(s.streamLocks, peer)
+		s.notifyMembership(peer, false)
+	}
+	return peer, ok
+}
+
+// handleNodeLeavingMessage closes the connection to a peer that is shutting
+// down and forgets its address.
+func (s *FileServer) handleNodeLeavingMessage(from net.Addr, message NodeLeavingMessage) error {
+	if peer, ok := s.forgetPeer(from.String()); ok {
+		peer.Close()
+	}
+	s.peerLock.Lock()
+	s.peersAddresses = slices.DeleteFunc(s.peersAddresses, func(address string) bool {
+		return address == message.Address
+	})
+	s.peerLock.Unlock()
+
+	s.logger().Info("Peer left the network", "peer", from.String(), "address", message.Address)
+	return nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+// endlessReader is a slow client that never finishes its upload.
+type endlessReader struct{}
+
+func (endlessReader) Read(p []byte) (int, error) {
+	time.Sleep(5 * time.Millisecond)
+	return copy(p, generateRandomData(min(len(p), 512))), nil
+}
+
+// startServer starts the server in the background and returns the result of Start.
+func startServer(t *testing.T, server *FileServer) <-chan error {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Start()
+	}()
+	time.Sleep(20 * time.Millisecond)
+	return done
+}
+
+func TestShutdown(t *testing.T) {
+	server1 := makeServer("127.0.0.11:4140", true)
+	startServer(t, server1)
+	defer server1.Stop()
+	defer server1.Storage.Clear()
+
+	server2 := makeServer("127.0.0.11:4141", false, "127.0.0.11:4140")
+	done := startServer(t, server2)
+	time.Sleep(30 * time.Millisecond)
+	defer server2.Storage.Clear()
+
+	if err := server2.Store("shutdown/data", bytes.NewReader(generateRandomData(1024))); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := server2.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Start: got %v after Shutdown", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Start did not return after Shutdown")
+	}
+
+	if err := server2.Store("shutdown/other", bytes.NewReader([]byte("late"))); !errors.Is(err, ErrServerClosed) {
+		t.Errorf("Store after Shutdown: got %v, want ErrServerClosed", err)
+	}
+	if _, err := server2.Get("shutdown/data"); !errors.Is(err, ErrServerClosed) {
+		t.Errorf("Get after Shutdown: got %v, want ErrServerClosed", err)
+	}
+	if err := server2.Shutdown(ctx); !errors.Is(err, ErrServerClosed) {
+		t.Errorf("second Shutdown: got %v, want ErrServerClosed", err)
+	}
+
+	// The remaining node was told that its peer left.
+	time.Sleep(50 * time.Millisecond)
+	if peers := server1.Peers(); len(peers) != 0 {
+		t.Errorf("peers after Shutdown of the replica: got %+v", peers)
+	}
+	server1.peerLock.Lock()
+	if n := len(server1.streamLocks); n != 0 {
+		t.Errorf("stream locks after Shutdown of the replica: got %d", n)
+	}
+	server1.peerLock.Unlock()
+	if addresses := server1.PeersAddresses(); slices.Contains(addresses, "127.0.0.11:4141") {
+		t.Errorf("peer addresses after Shutdown of the replica: got %v", addresses)
+	}
+
+	// The listen address is free again.
+	listener, err := net.Listen("tcp", "127.0.0.11:4141")
+	if err != nil {
+		t.Fatalf("listen address still in use: %v", err)
+	}
+	listener.Close()
+}
+
+func TestShutdownCancelsTransfers(t *testing.T) {
+	server1 := makeServer("127.0.0.11:4142", true)
+	startServer(t, server1)
+	defer server1.Stop()
+	defer server1.Storage.Clear()
+
+	server2 := makeServer("127.0.0.11:4143", false, "127.0.0.11:4142")
+	done := startServer(t, server2)
+	time.Sleep(30 * time.Millisecond)
+	defer server2.Storage.Clear()
+
+	// The client never finishes its upload.
+	stored := make(chan error, 1)
+	go func() {
+		stored <- server2.Store("shutdown/stalled", endlessReader{})
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := server2.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Shutdown: got %v, want the deadline to be exceeded", err)
+	}
+
+	select {
+	case err := <-stored:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Store: got %v, want it cancelled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Store was not cancelled by Shutdown")
+	}
+	if server2.Storage.HasKey("shutdown/stalled") {
+		t.Error("the partial file was kept")
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Start did not return after Shutdown")
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if server1.Storage.HasKey("shutdown/stalled") {
+		t.Error("the peer kept the aborted replica")
+	}
+}
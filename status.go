@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"go-distributed-storage/p2p"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// version is the version of the binary, set at build time with
+// -ldflags "-X main.version=...".
+var version = "dev"
+
+// NodeStatus describes the state of a node and of its view of the cluster.
+type NodeStatus struct {
+	// ID is the listen address of the node, which identifies it in the cluster.
+	ID        string        `json:"id"`
+	Version   string        `json:"version"`
+	StartedAt time.Time     `json:"startedAt"`
+	Uptime    time.Duration `json:"uptime"`
+
+	// Peers lists the connected peers, followed by the known addresses this
+	// node is not connected to.
+	Peers          []PeerInfo `json:"peers"`
+	PeersAddresses []string   `json:"peersAddresses"`
+
+	Storage StorageStatus `json:"storage"`
+	// Namespaces describes the namespaces other than DefaultNamespace, sorted
+	// by name. Storage describes DefaultNamespace.
+	Namespaces []NamespaceStatus `json:"namespaces,omitempty"`
+	Transfers  []Transfer        `json:"transfers"`
+}
+
+// StorageStatus describes the files stored on a node.
+type StorageStatus struct {
+	RootDir string `json:"rootDir"`
+	// Keys lists the keys of the stored files, sorted.
+	Keys []string `json:"keys"`
+	// Bytes is the plaintext size of the stored files.
+	Bytes int64 `json:"bytes"`
+	// DiskUsage is the size of everything under RootDir, including metadata
+	// and quarantined blobs.
+	DiskUsage int64 `json:"diskUsage"`
+	// Capacity is the usage of the node against its limits.
+	Capacity Capacity `json:"capacity"`
+}
+
+// NamespaceStatus describes the files of a namespace stored on a node.
+type NamespaceStatus struct {
+	Name   string          `json:"name"`
+	Policy NamespacePolicy `json:"policy"`
+	Files  int             `json:"files"`
+	// Bytes is the plaintext size of the stored files.
+	Bytes int64 `json:"bytes"`
+	// Capacity is the usage of the namespace against its quota.
+	Capacity Capacity `json:"capacity"`
+}
+
+// Transfer describes a stream to or from peers in flight.
+type Transfer struct {
+	Key string `json:"key"`
+	// Direction is "in" for streams received from a peer and "out" for
+	// streams sent to peers.
+	Direction string    `json:"direction"`
+	Peers     []string  `json:"peers"`
+	StartedAt time.Time `json:"startedAt"`
+}
+
+// Status returns the state of the node.
+func (s *FileServer) Status() (NodeStatus, error) {
+	objects, err := s.List("")
+	if err != nil {
+		return NodeStatus{}, err
+	}
+
+	status := NodeStatus{
+		ID:             s.Config.Transport.RemoteAddr(),
+		Version:        version,
+		Peers:          s.Peers(),
+		PeersAddresses: s.PeersAddresses(),
+		Storage: StorageStatus{
+			RootDir:   s.Storage.Config.RootDir,
+			Keys:      make([]string, 0, len(objects)),
+			DiskUsage: diskUsage(s.Storage.Config.RootDir),
+			Capacity:  s.Capacity(),
+		},
+		Transfers: s.Transfers(),
+	}
+	if startedAt := s.startedAt.Load(); startedAt != 0 {
+		status.StartedAt = time.Unix(0, startedAt)
+		status.Uptime = time.Since(status.StartedAt)
+	}
+
+	for _, object := range objects {
+		status.Storage.Keys = append(status.Storage.Keys, object.Key)
+		status.Storage.Bytes += object.Size
+	}
+
+	for _, ns := range s.openNamespaces() {
+		if ns.name == DefaultNamespace {
+			continue
+		}
+		objects, err := s.list(context.Background(), ns, "")
+		if err != nil {
+			return NodeStatus{}, err
+		}
+		namespace := NamespaceStatus{
+			Name:     ns.name,
+			Policy:   ns.Policy(),
+			Files:    len(objects),
+			Capacity: ns.Capacity(),
+		}
+		for _, object := range objects {
+			namespace.Bytes += object.Size
+		}
+		status.Namespaces = append(status.Namespaces, namespace)
+	}
+
+	connected := make(map[string]bool, len(status.Peers))
+	for _, peer := range status.Peers {
+		connected[peer.Address] = true
+	}
+	for _, address := range status.PeersAddresses {
+		if !connected[address] {
+			connected[address] = true
+			status.Peers = append(status.Peers, PeerInfo{Address: address, State: "known"})
+		}
+	}
+
+	return status, nil
+}
+
+// Transfers returns the streams to and from peers in flight, oldest first.
+func (s *FileServer) Transfers() []Transfer {
+	s.transferLock.Lock()
+	defer s.transferLock.Unlock()
+
+	transfers := make([]Transfer, 0, len(s.transfers))
+	for transfer := range s.transfers {
+		transfers = append(transfers, *transfer)
+	}
+	sort.Slice(transfers, func(i, j int) bool {
+		return transfers[i].StartedAt.Before(transfers[j].StartedAt)
+	})
+	return transfers
+}
+
+// trackTransfer lists a stream as in flight until the returned function is called.
+func (s *FileServer) trackTransfer(direction, key string, peers ...p2p.Peer) func() {
+	transfer := &Transfer{
+		Key:       key,
+		Direction: direction,
+		Peers:     make([]string, 0, len(peers)),
+		StartedAt: time.Now(),
+	}
+	for _, peer := range peers {
+		transfer.Peers = append(transfer.Peers, peer.RemoteAddr().String())
+	}
+
+	s.transferLock.Lock()
+	s.transfers[transfer] = struct{}{}
+	s.transferLock.Unlock()
+	untrack := s.metrics.trackStream(direction)
+
+	return func() {
+		untrack()
+		s.transferLock.Lock()
+		delete(s.transfers, transfer)
+		s.transferLock.Unlock()
+	}
+}
+
+// DisconnectPeer closes the connection to the peer with the given remote
+// address. It returns an error wrapping os.ErrNotExist if no such peer is connected.
+func (s *FileServer) DisconnectPeer(address string) error {
+	peer, ok := s.forgetPeer(address)
+	if !ok {
+		return fmt.Errorf("peer %s: %w", address, os.ErrNotExist)
+	}
+
+	s.logger().Info("Disconnected peer", "peer", address)
+	return peer.Close()
+}
+
+// RebalanceReport describes the outcome of a rebalance.
+type RebalanceReport struct {
+	// Files is the number of files sent to the peers.
+	Files int `json:"files"`
+	// Bytes is the on-disk size of the files sent to the peers.
+	Bytes int64 `json:"bytes"`
+	// Peers is the number of peers the files were sent to.
+	Peers int `json:"peers"`
+	// Errors maps keys to the error that prevented sending them.
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+// Rebalance sends every file stored on the node to the connected peers that are
+// not full, so that peers that joined after a file was stored, or lost their
+// replica, hold it again. The stored ciphertext is sent as is, the same way
+// Store replicates it.
+func (s *FileServer) Rebalance(ctx context.Context) (report RebalanceReport, err error) {
+	ctx, done, err := s.begin(ctx)
+	if err != nil {
+		return report, err
+	}
+	defer done()
+
+	ctx, span := s.startSpan(ctx, "FileServer.Rebalance")
+	defer func() { endSpan(span, err) }()
+
+	report.Peers = len(s.replicaPeers())
+	if report.Peers == 0 {
+		return report, nil
+	}
+
+	for _, ns := range s.openNamespaces() {
+		objects, err := s.list(ctx, ns, "")
+		if err != nil {
+			return report, err
+		}
+
+		for _, object := range objects {
+			if err := ctx.Err(); err != nil {
+				return report, err
+			}
+
+			n, err := s.replicate(ctx, ns, object.Key)
+			if err != nil {
+				if report.Errors == nil {
+					report.Errors = make(map[string]string)
+				}
+				report.Errors[ns.qualify(object.Key)] = err.Error()
+				s.logger().Warn("Failed to rebalance file", "key", ns.qualify(object.Key), "error", err)
+				continue
+			}
+			report.Files++
+			report.Bytes += n
+		}
+	}
+
+	span.SetAttributes(attribute.Int("fs.files", report.Files), attribute.Int64("fs.bytes", report.Bytes))
+	s.logger().Info("Rebalanced files", "files", report.Files, "bytes", report.Bytes, "peers", report.Peers, "errors", len(report.Errors))
+	return report, nil
+}
+
+// replicate streams the stored ciphertext of the file to every peer that is
+// not full and returns the number of bytes sent. The file is sent as background traffic.
+func (s *FileServer) replicate(ctx context.Context, ns *Namespace, key string) (int64, error) {
+	ctx = WithPriority(ctx, p2p.PriorityBackground)
+	meta, err := ns.storage.Stat(key)
+	if err != nil {
+		return 0, err
+	}
+	r, _, err := ns.storage.ReadFile(key)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	message := Message{
+		Payload: StoreFileMessage{
+			Namespace: ns.name,
+			Key:       key,
+			SentAt:    time.Now(),
+			Attrs:     meta.ObjectAttrs,
+		},
+	}
+	// Like the replicas of a store, the stream leaves out the full peers and
+	// holds the connections until it ends.
+	replicas := &replicaWriter{ctx: ctx, logger: s.logger(), peers: s.replicaPeers(), priority: p2p.PriorityBackground}
+	unlock, err := s.lockStreams(ctx, replicas.peers)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+	if err := s.sendLocked(ctx, &message, p2p.EncodeStreamMessage, replicas.peers); err != nil {
+		return 0, err
+	}
+
+	stream := newChunkWriter(replicas)
+	defer s.trackTransfer("out", ns.qualify(key), replicas.peers...)()
+
+	stops := make(map[p2p.Peer]func() bool, len(replicas.peers))
+	for _, peer := range replicas.peers {
+		stops[peer] = interruptOnDone(ctx, peer)
+	}
+
+	n, err := io.Copy(stream, &contextReader{ctx: ctx, r: r})
+
+	for peer, stop := range stops {
+		if !stop() {
+			s.dropPeer(peer)
+		}
+	}
+
+	if err != nil {
+		stream.Abort()
+		return n, err
+	}
+	return n, stream.Finish(meta.UncompressedSize)
+}
@@ -1,21 +1,57 @@
 package main
 
 import (
-	"bytes"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"os"
+	"slices"
 	"strings"
+	"time"
 )
 
 // DefaultRootFolderName represents the default name for the root folder
 // where data will be stored in the distributed storage system.
 const DefaultRootFolderName = "data"
 
+// QuarantineFolderName is the folder under the root directory where blobs
+// that failed checksum verification are moved to.
+const QuarantineFolderName = ".quarantine"
+
+// ErrInvalidRange is returned when a requested range starts past the end of a file.
+var ErrInvalidRange = errors.New("invalid range")
+
+// ErrInvalidKey is returned for a key that cannot name a file, e.g. one that
+// would resolve outside of the root directory with the plain path transform.
+var ErrInvalidKey = errors.New("invalid key")
+
+// validateKey reports why key cannot name a file, if it cannot. Keys are made
+// of non-empty segments separated by '/', none of which is "." or "..".
+func validateKey(key string) error {
+	if key == "" {
+		return fmt.Errorf("%w: empty key", ErrInvalidKey)
+	}
+	if strings.ContainsRune(key, 0) {
+		return fmt.Errorf("%w %q: contains a NUL byte", ErrInvalidKey, key)
+	}
+	for _, segment := range strings.Split(key, "/") {
+		switch segment {
+		case "":
+			return fmt.Errorf("%w %q: empty path segment", ErrInvalidKey, key)
+		case ".", "..":
+			return fmt.Errorf("%w %q: %q path segment", ErrInvalidKey, key, segment)
+		}
+	}
+	return nil
+}
+
+// metaFileSuffix is appended to a blob's path to name its metadata sidecar.
+const metaFileSuffix = ".meta"
+
 // HashPathBuilder generates a FileIdentifier for a given file name.
 // It computes the SHA-1 hash of the file name, encodes it to a hexadecimal string,
 // and splits the hash into segments to create a directory path.
@@ -50,26 +86,71 @@ type FileIdentifier struct {
 	FileName string
 }
 
-func (FileIdentifier *FileIdentifier) firstPathSegment() string {
-	pathSegments := strings.Split(FileIdentifier.PathName, "/")
-	if len(pathSegments) == 0 {
-		return ""
-	}
-	return pathSegments[0]
-}
-
 func (fileIdentifier *FileIdentifier) BuildFilePath() string {
 	return fmt.Sprintf("%s/%s", fileIdentifier.PathName, fileIdentifier.FileName)
 }
 
+// ObjectMeta describes a stored blob. Backends persist it next to the blob so
+// the original key can be recovered when walking the storage.
+type ObjectMeta struct {
+	Key      string
+	Size     int64
+	Checksum string
+	ModTime  time.Time
+
+	ObjectAttrs
+}
+
+// ObjectAttrs are the attributes given to a blob when it is stored, which are
+// recorded in its metadata and sent along with its replicas.
+type ObjectAttrs struct {
+	// ExpiresAt is when the blob expires. The zero time means never.
+	ExpiresAt time.Time `json:",omitzero"`
+
+	// ContentType is the media type of the file, as given by the client.
+	ContentType string `json:",omitempty"`
+	// Tags label the file. They are indexed, so files can be listed by tag.
+	Tags map[string]string `json:",omitempty"`
+	// Metadata holds custom headers of the client, which are returned with the file.
+	Metadata map[string]string `json:",omitempty"`
+	// CreatedAt is when the file was stored by the client, the same on every replica.
+	CreatedAt time.Time `json:",omitzero"`
+	// Uploader is the principal that stored the file, empty without access control.
+	Uploader string `json:",omitempty"`
+
+	// Compression is the algorithm the file was compressed with before it was
+	// encrypted, empty when it is stored as is.
+	Compression string `json:",omitempty"`
+	// UncompressedSize is the size of a compressed file before compression.
+	UncompressedSize int64 `json:",omitempty"`
+}
+
+// Expired reports whether the blob has expired at the given time.
+func (a ObjectAttrs) Expired(now time.Time) bool {
+	return !a.ExpiresAt.IsZero() && !now.Before(a.ExpiresAt)
+}
+
 type PathTranformSignature func(string) FileIdentifier
 type StoreOPT struct {
 	PathTranformFunc PathTranformSignature
 	RootDir          string
+	// Backend holds the blobs. A nil Backend means a DiskBackend under
+	// RootDir laid out by PathTranformFunc.
+	Backend Backend
+	// Capacity is the most bytes the storage holds. Zero means unlimited.
+	Capacity int64
+	// MinFreeSpace is the free space kept on the file system of a local
+	// backend. Stores that would go below it are refused.
+	MinFreeSpace int64
+	// Logger receives the logs of the storage. A nil Logger means slog.Default().
+	Logger *slog.Logger
 }
 
 type Storage struct {
 	Config StoreOPT
+
+	used *storageUsage
+	tags *tagIndex
 }
 
 func NewStorage(storeOPT StoreOPT) *Storage {
@@ -79,127 +160,441 @@ func NewStorage(storeOPT StoreOPT) *Storage {
 	if storeOPT.RootDir == "" {
 		storeOPT.RootDir = DefaultRootFolderName
 	}
-	storeOPT.RootDir = strings.ReplaceAll(storeOPT.RootDir, ":", "_")
+	if storeOPT.Logger == nil {
+		storeOPT.Logger = slog.Default()
+	}
+	storeOPT.RootDir = storageRootDir(storeOPT.RootDir)
+	if storeOPT.Backend == nil {
+		storeOPT.Backend = NewDiskBackend(storeOPT.RootDir, storeOPT.PathTranformFunc, storeOPT.Logger)
+	}
 	return &Storage{
 		Config: storeOPT,
+		used:   &storageUsage{},
+		tags:   &tagIndex{},
 	}
 }
 
+// storageRootDir returns the directory used for the given root directory,
+// which may be a listen address.
+func storageRootDir(rootDir string) string {
+	return strings.ReplaceAll(rootDir, ":", "_")
+}
+
+// Clear removes every blob of the storage.
 func (s *Storage) Clear() error {
-	return os.RemoveAll(s.Config.RootDir)
+	s.usage().Store(0)
+	s.tagIndex().reset()
+	if c, ok := s.Config.Backend.(clearer); ok {
+		return c.Clear()
+	}
+	return s.Config.Backend.Walk(func(meta ObjectMeta) error {
+		return s.Config.Backend.Delete(meta.Key)
+	})
 }
 
-func (s *Storage) prependTheRoot(path string) string {
-	return fmt.Sprintf("%s/%s", s.Config.RootDir, path)
+// Close releases the resources held by the backend, if any.
+func (s *Storage) Close() error {
+	if c, ok := s.Config.Backend.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
 }
 
-// HasKey checks if a file with the given name exists in the storage.
+// HasKey checks if a file with the given name exists in the storage and has
+// not expired.
 func (s *Storage) HasKey(fileName string) bool {
-	fileIdentifier := s.Config.PathTranformFunc(fileName)
-	fullPathWithRoot := s.prependTheRoot(fileIdentifier.BuildFilePath())
-
-	_, err := os.Stat(fullPathWithRoot)
+	_, err := s.Stat(fileName)
 	return !errors.Is(err, os.ErrNotExist)
 }
 
 func (s *Storage) DeleteFile(fileName string) error {
-	fileIdentifier := s.Config.PathTranformFunc(fileName)
-
-	defer func() {
-		log.Printf("Deleted file or directory: %s", fileIdentifier.firstPathSegment())
-	}()
-
-	firstPathSegmentWithRoot := s.prependTheRoot(fileIdentifier.firstPathSegment())
-	return os.RemoveAll(firstPathSegmentWithRoot)
+	meta, statErr := s.Config.Backend.Stat(fileName)
+	if err := s.Config.Backend.Delete(fileName); err != nil {
+		return err
+	}
+	if statErr == nil {
+		s.usage().Add(-meta.Size)
+	}
+	s.tagIndex().remove(fileName)
+	return nil
 }
 
 func (s *Storage) ReadFile(fileName string) (io.ReadCloser, int64, error) {
-	return s.readIntoFile(fileName)
+	blob, _, err := s.open(fileName)
+	if err != nil {
+		return nil, 0, err
+	}
+	return blob, blob.Size(), nil
 }
 
-// ReadFileDecrypted reads a file, decrypts its contents using the provided
-// decryption function, and returns an io.Reader for the decrypted data along 
-// with the original file size. The custom decryption function allows for 
-// flexibility in specifying different decryption algorithms as needed.
-func (s *Storage) ReadFileDecrypted(fileName string, decryptFunc func([]byte, io.Writer, io.Reader) (int64, error), key []byte) (io.Reader, int64, error) {
-	file, size, err := s.readIntoFile(fileName)
+// open opens the blob stored under the given name, unless it has expired, and
+// returns its metadata.
+func (s *Storage) open(fileName string) (Blob, ObjectMeta, error) {
+	meta, err := s.Stat(fileName)
+	if err != nil {
+		return nil, meta, err
+	}
+	blob, err := s.Config.Backend.Get(fileName)
+	return blob, meta, err
+}
+
+// ReadFileDecrypted opens a file and returns an io.ReadCloser that decrypts its
+// contents lazily, using the provided decryption function, as the caller reads,
+// along with the original file size. Memory use does not depend on the file
+// size. The custom decryption function allows for flexibility in specifying
+// different decryption algorithms as needed.
+//
+// A compressed file is decompressed after it is decrypted, and the returned
+// size is then its size before compression.
+//
+// The caller must close the returned reader, which releases the file handle.
+func (s *Storage) ReadFileDecrypted(fileName string, decryptFunc func([]byte, io.Writer, io.Reader) (int64, error), key []byte) (io.ReadCloser, int64, error) {
+	blob, meta, err := s.open(fileName)
 	if err != nil {
 		return nil, 0, err
 	}
-	defer file.Close()
 
-	// Create a buffer to handle the decrypted data
-	var buf bytes.Buffer
+	r := decryptingReader(blob, func(dst io.Writer, src io.Reader) (int64, error) {
+		return decryptFunc(key, dst, src)
+	})
+	if meta.Compression == "" {
+		return r, blob.Size(), nil
+	}
+	r, err = decompressingReader(meta.Compression, r)
+	return r, meta.UncompressedSize, err
+}
+
+// decryptingReader runs decrypt in the background, writing into a pipe, and
+// returns the read side of it. The source is closed once decryption finishes,
+// either because the whole source was read or because the caller closed the reader.
+func decryptingReader(src io.ReadCloser, decrypt func(io.Writer, io.Reader) (int64, error)) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := decrypt(pw, src)
+		src.Close()
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
 
-	// Decrypt the data directly into the buffer
-	_, err = decryptFunc(key, &buf, file)
+// ReadFileRange returns a reader over the first headerSize bytes of the file
+// followed by length bytes starting at headerSize+offset. A negative length
+// reads until the end of the file. The returned size is the number of bytes
+// the reader yields.
+func (s *Storage) ReadFileRange(fileName string, headerSize, offset, length int64) (io.ReadCloser, int64, error) {
+	blob, _, err := s.open(fileName)
 	if err != nil {
 		return nil, 0, err
 	}
+	size := blob.Size()
+
+	bodySize := size - headerSize
+	if headerSize > size || offset < 0 || offset > bodySize {
+		blob.Close()
+		return nil, 0, ErrInvalidRange
+	}
+	if length < 0 || offset+length > bodySize {
+		length = bodySize - offset
+	}
 
-	return &buf, size, nil
+	r := io.MultiReader(
+		io.NewSectionReader(blob, 0, headerSize),
+		io.NewSectionReader(blob, headerSize+offset, length),
+	)
+	return struct {
+		io.Reader
+		io.Closer
+	}{r, blob}, headerSize + length, nil
 }
 
-// readIntoFile opens a specified file for reading.
-// It uses the PathTransformFunc from the Storage configuration to transform the file name.
-// The function constructs the full file path by appending the root directory.
-// It then opens the file at the specified full path and retrieves the file's size upon successful opening.
-func (s *Storage) readIntoFile(fileName string) (io.ReadCloser, int64, error) {
-	fileIdentifier := s.Config.PathTranformFunc(fileName)
-	fullPathWithRoot := s.prependTheRoot(fileIdentifier.BuildFilePath())
+// ReadFileDecryptedRange decrypts length bytes of the file starting at the
+// plaintext offset. Only the cipher header and the requested range are read
+// from the backend, the decryptFunc is expected to position its keystream at
+// offset. Like ReadFileDecrypted, the range is decrypted lazily and the caller
+// must close the returned reader. The returned size is the size of the range.
+//
+// Offsets in a compressed file do not map to offsets in the blob, so it is
+// decrypted and decompressed from the start, up to the end of the range.
+func (s *Storage) ReadFileDecryptedRange(fileName string, decryptFunc func([]byte, io.Writer, io.Reader, int64) (int64, error), key []byte, headerSize, offset, length int64) (io.ReadCloser, int64, error) {
+	meta, err := s.Stat(fileName)
+	if err != nil {
+		return nil, 0, err
+	}
+	if meta.Compression != "" {
+		return s.readCompressedRange(fileName, meta, decryptFunc, key, headerSize, offset, length)
+	}
 
-	f, err := os.Open(fullPathWithRoot)
+	file, size, err := s.ReadFileRange(fileName, headerSize, offset, length)
 	if err != nil {
 		return nil, 0, err
 	}
 
-	fileInfo, err := f.Stat()
+	return decryptingReader(file, func(dst io.Writer, src io.Reader) (int64, error) {
+		return decryptFunc(key, dst, src, offset)
+	}), size - headerSize, nil
+}
+
+func (s *Storage) readCompressedRange(fileName string, meta ObjectMeta, decryptFunc func([]byte, io.Writer, io.Reader, int64) (int64, error), key []byte, headerSize, offset, length int64) (io.ReadCloser, int64, error) {
+	if offset < 0 || offset > meta.UncompressedSize {
+		return nil, 0, ErrInvalidRange
+	}
+	if length < 0 || offset+length > meta.UncompressedSize {
+		length = meta.UncompressedSize - offset
+	}
+
+	file, _, err := s.ReadFileRange(fileName, headerSize, 0, -1)
 	if err != nil {
 		return nil, 0, err
 	}
+	r, err := decompressingReader(meta.Compression, decryptingReader(file, func(dst io.Writer, src io.Reader) (int64, error) {
+		return decryptFunc(key, dst, src, 0)
+	}))
+	if err != nil {
+		return nil, 0, err
+	}
+	r, err = sliceReader(r, offset, length)
+	return r, length, err
+}
+
+// Stat returns the metadata recorded for the given file when it was stored.
+// An expired file is reported as missing, even before it is deleted.
+func (s *Storage) Stat(fileName string) (ObjectMeta, error) {
+	meta, err := s.Config.Backend.Stat(fileName)
+	if err != nil {
+		return meta, err
+	}
+	if meta.Expired(time.Now()) {
+		return ObjectMeta{}, fmt.Errorf("file with key %s expired at %s: %w", fileName, meta.ExpiresAt.Format(time.RFC3339), os.ErrNotExist)
+	}
+	return meta, nil
+}
+
+// List returns the metadata of the blobs whose key starts with prefix, sorted
+// by key. Quarantined and expired blobs and the blobs of other namespaces are
+// skipped.
+func (s *Storage) List(prefix string) ([]ObjectMeta, error) {
+	metas, err := s.Config.Backend.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return slices.DeleteFunc(metas, func(meta ObjectMeta) bool {
+		return isQuarantined(meta.Key) || isNamespaced(meta.Key) || meta.Expired(now)
+	}), nil
+}
 
-	return f, fileInfo.Size(), nil
+// Walk calls fn for every stored blob. Quarantined and expired blobs and the
+// blobs of other namespaces are skipped. Returning an error from fn stops the walk.
+func (s *Storage) Walk(fn func(ObjectMeta) error) error {
+	now := time.Now()
+	return s.walkAll(func(meta ObjectMeta) error {
+		if meta.Expired(now) {
+			return nil
+		}
+		return fn(meta)
+	})
 }
 
-// storeToDestinationFile is a helper function that manages file path setup and creation,
-// allowing for either plain or encrypted data copying using the provided copyFunc.
-func (s *Storage) storeToDestinationFile(fileName string, inputStream io.Reader, copyFunc func(io.Writer, io.Reader) (int64, error)) (int64, error) {
-	// Transform and prepare the file path
-	fileIdentifier := s.Config.PathTranformFunc(fileName)
-	pathNameWithRoot := s.prependTheRoot(fileIdentifier.PathName)
+// walkAll is like Walk, but includes the expired blobs, which still take up
+// space until they are deleted.
+func (s *Storage) walkAll(fn func(ObjectMeta) error) error {
+	return s.Config.Backend.Walk(func(meta ObjectMeta) error {
+		if isQuarantined(meta.Key) || isNamespaced(meta.Key) {
+			return nil
+		}
+		return fn(meta)
+	})
+}
+
+// DeleteExpired deletes the blobs that have expired at the given time and
+// returns their metadata. Blobs that could not be deleted are left for the
+// next call, and the first error is returned.
+func (s *Storage) DeleteExpired(now time.Time) ([]ObjectMeta, error) {
+	var expired []ObjectMeta
+	if err := s.walkAll(func(meta ObjectMeta) error {
+		if meta.Expired(now) {
+			expired = append(expired, meta)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	var (
+		deleted  []ObjectMeta
+		firstErr error
+	)
+	for _, meta := range expired {
+		// The blob may have been replaced by a newer one since the walk.
+		current, err := s.Config.Backend.Stat(meta.Key)
+		if err != nil || !current.Expired(now) {
+			continue
+		}
+		if err := s.DeleteFile(meta.Key); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		deleted = append(deleted, current)
+	}
+	return deleted, firstErr
+}
 
-	// Ensure the directory structure exists
-	if err := os.MkdirAll(pathNameWithRoot, os.ModePerm); err != nil {
-		return 0, err
+// VerifyFile recomputes the checksum of the stored blob and compares it with
+// the checksum recorded when the blob was written. The blob is read through
+// wrap, which allows callers to throttle the read.
+func (s *Storage) VerifyFile(fileName string, wrap func(io.Reader) io.Reader) (bool, int64, error) {
+	meta, err := s.Stat(fileName)
+	if err != nil {
+		return false, 0, err
 	}
 
-	// Get the full file path
-	fullPathWithRoot := s.prependTheRoot(fileIdentifier.BuildFilePath())
+	r, _, err := s.ReadFile(fileName)
+	if err != nil {
+		return false, 0, err
+	}
+	defer r.Close()
 
-	// Create the destination file
-	destinationFile, err := os.Create(fullPathWithRoot)
+	hasher := sha256.New()
+	n, err := io.Copy(hasher, wrap(r))
 	if err != nil {
-		return 0, err
+		return false, n, err
 	}
-	defer destinationFile.Close()
 
-	// Use the specified copy function to write data to the file
-	return copyFunc(destinationFile, inputStream)
+	return n == meta.Size && hex.EncodeToString(hasher.Sum(nil)) == meta.Checksum, n, nil
+}
+
+// QuarantineFile moves the blob stored under the given name out of the way into
+// the quarantine folder and removes it from the storage layout, so that it is
+// no longer served while keeping it around for inspection. Backends that cannot
+// quarantine blobs themselves get a copy under the quarantine folder.
+func (s *Storage) QuarantineFile(fileName string) error {
+	if q, ok := s.Config.Backend.(quarantiner); ok {
+		meta, statErr := s.Config.Backend.Stat(fileName)
+		if err := q.Quarantine(fileName); err != nil {
+			return err
+		}
+		if statErr == nil {
+			s.usage().Add(-meta.Size)
+		}
+		s.tagIndex().remove(fileName)
+		return nil
+	}
+
+	blob, err := s.Config.Backend.Get(fileName)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	quarantineKey := fmt.Sprintf("%s/%s-%d", QuarantineFolderName, fileName, time.Now().UnixNano())
+	if _, err := s.Config.Backend.Put(quarantineKey, blob, ObjectAttrs{}); err != nil {
+		return err
+	}
+	return s.DeleteFile(fileName)
+}
+
+// isQuarantined reports whether the key is a copy made by QuarantineFile.
+func isQuarantined(key string) bool {
+	return strings.HasPrefix(key, QuarantineFolderName+"/")
+}
+
+// storeToDestinationFile is a helper function that streams the output of
+// copyFunc to the backend, allowing for either plain or encrypted data copying.
+// It returns the number of bytes copyFunc read. Once the blob would take more
+// than the available capacity, the store fails with ErrInsufficientStorage.
+// The backend records attrs in the metadata of the blob.
+//
+// When attrs.Compression is set without the size before compression, the
+// size is the number of bytes read from inputStream, which copyFunc
+// compresses, unless inputStream reports it itself once read to the end, as
+// the streams of the replicas do.
+func (s *Storage) storeToDestinationFile(fileName string, inputStream io.Reader, attrs ObjectAttrs, copyFunc func(io.Writer, io.Reader) (int64, error)) (int64, error) {
+	type copyResult struct {
+		n   int64
+		err error
+	}
+
+	// Replacing a blob frees its space.
+	var oldSize int64
+	if old, err := s.Config.Backend.Stat(fileName); err == nil {
+		oldSize = old.Size
+	}
+	budget := s.Capacity().Available
+	if budget >= 0 {
+		budget += oldSize
+	}
+
+	pr, pw := io.Pipe()
+	blob := &attrsReader{Reader: pr, attrs: attrs}
+	copied := make(chan copyResult, 1)
+	go func() {
+		src := inputStream
+		counter := &countingReader{r: inputStream}
+		sizeLater := attrs.Compression != "" && attrs.UncompressedSize == 0
+		if sizeLater {
+			src = counter
+		}
+
+		n, err := copyFunc(&capacityWriter{w: pw, key: fileName, budget: budget}, src)
+		// The backend reads the attributes once the pipe is closed.
+		if err == nil && sizeLater {
+			blob.attrs.UncompressedSize = counter.n
+			if sizer, ok := inputStream.(uncompressedSizer); ok {
+				blob.attrs.UncompressedSize = sizer.UncompressedSize()
+			}
+		}
+		pw.CloseWithError(err)
+		copied <- copyResult{n, err}
+	}()
+
+	meta, putErr := s.Config.Backend.Put(fileName, blob, attrs)
+	// Unblock copyFunc if the backend stopped reading early.
+	pr.CloseWithError(putErr)
+
+	result := <-copied
+	err := result.err
+	if err == nil {
+		err = putErr
+	}
+	if err != nil {
+		if oldSize > 0 && !s.HasKey(fileName) {
+			s.usage().Add(-oldSize)
+			s.tagIndex().remove(fileName)
+		}
+		return result.n, storageError(err)
+	}
+
+	s.usage().Add(meta.Size - oldSize)
+	s.tagIndex().set(fileName, attrs.Tags)
+	return result.n, nil
+}
+
+// attrsReader is the AttrsReader given to the backend by storeToDestinationFile.
+type attrsReader struct {
+	io.Reader
+	attrs ObjectAttrs
+}
+
+func (a *attrsReader) Attrs() ObjectAttrs {
+	return a.attrs
 }
 
-// StoreFile reads from the input stream and writes unencrypted data to a file.
-func (s *Storage) StoreFile(fileName string, inputStream io.Reader) (int64, error) {
+// StoreFile reads from the input stream and writes unencrypted data to a file
+// with the given attributes.
+func (s *Storage) StoreFile(fileName string, inputStream io.Reader, attrs ObjectAttrs) (int64, error) {
 	// Use io.Copy for direct data copying
-	return s.storeToDestinationFile(fileName, inputStream, func(dst io.Writer, src io.Reader) (int64, error) {
+	return s.storeToDestinationFile(fileName, inputStream, attrs, func(dst io.Writer, src io.Reader) (int64, error) {
 		return io.Copy(dst, src)
 	})
 }
 
 // StoreFileEncrypted reads from the input stream, encrypts the data using the provided encryptFunc to be more flexible,
-// and writes it to a file.
-func (s *Storage) StoreFileEncrypted(fileName string, inputStream io.Reader, encryptFunc func([]byte, io.Writer, io.Reader) (int64, error), key []byte) (int64, error) {
+// and writes it to a file with the given attributes.
+func (s *Storage) StoreFileEncrypted(fileName string, inputStream io.Reader, attrs ObjectAttrs, encryptFunc func([]byte, io.Writer, io.Reader) (int64, error), key []byte) (int64, error) {
 	// Use the user-defined encryptFunc for encrypted data copying
-	return s.storeToDestinationFile(fileName, inputStream, func(dst io.Writer, src io.Reader) (int64, error) {
+	return s.storeToDestinationFile(fileName, inputStream, attrs, func(dst io.Writer, src io.Reader) (int64, error) {
 		return encryptFunc(key, dst, src)
 	})
 }
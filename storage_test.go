@@ -18,7 +18,7 @@ func TestStore(t *testing.T) {
 		fileName := fmt.Sprintf("foo_%d", i)
 		data := []byte("Hello! How are you ?")
 
-		if _, err := storage.StoreFile(fileName, bytes.NewBuffer(data)); err != nil {
+		if _, err := storage.StoreFile(fileName, bytes.NewBuffer(data), ObjectAttrs{}); err != nil {
 			t.Error(err)
 		}
 
@@ -47,6 +47,52 @@ func TestStore(t *testing.T) {
 	}
 }
 
+func TestReadFileDecrypted(t *testing.T) {
+	opts := StoreOPT{
+		PathTranformFunc: HashPathBuilder,
+	}
+	storage := NewStorage(opts)
+	defer cleanup(t, storage)
+
+	crypto := &BasicCrypto{}
+	key := crypto.newEncryptionKey()
+	data := generateRandomData(1024 * 1024)
+
+	if _, err := storage.StoreFileEncrypted("big_file", bytes.NewReader(data), ObjectAttrs{}, crypto.Encrypt, key); err != nil {
+		t.Fatal(err)
+	}
+
+	r, _, err := storage.ReadFileDecrypted("big_file", crypto.Decrypt, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, data) {
+		t.Error("Wrong data Mismatch!")
+	}
+	if err := r.Close(); err != nil {
+		t.Error(err)
+	}
+
+	// Closing before reading everything must stop the decryption.
+	r, _, err = storage.ReadFileDecrypted("big_file", crypto.Decrypt, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(r, make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Close(); err != nil {
+		t.Error(err)
+	}
+	if _, err := r.Read(make([]byte, 10)); err == nil {
+		t.Error("Expected reading from a closed reader to fail")
+	}
+}
+
 func cleanup(t *testing.T, s *Storage) {
 	if err := s.Clear(); err != nil {
 		t.Error(err)
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-distributed-storage/p2p"
+	"hash"
+	"io"
+	"log/slog"
+	"slices"
+	"strings"
+)
+
+// Replication streams are sent as a sequence of chunks, each prefixed with its
+// length as a little endian uint32, since the size of the file is not known
+// before it has been fully read. A zero length chunk ends the stream and is
+// followed by a status byte and the SHA-256 checksum of all the chunks, which
+// lets the receiver verify that its replica is byte-identical to the sender's,
+// then by the size of the file before compression as a little endian int64,
+// which is zero for files that are not compressed.
+const (
+	streamStatusOK      byte = 0x0
+	streamStatusAborted byte = 0x1
+)
+
+// ErrStreamAborted is returned by a chunkReader when the sender gave up on the stream.
+var ErrStreamAborted = errors.New("stream aborted by sender")
+
+// ErrStreamChecksumMismatch is returned by a chunkReader when the received
+// bytes do not match the checksum sent by the sender.
+var ErrStreamChecksumMismatch = errors.New("stream checksum mismatch")
+
+// chunkWriter frames everything written to it as chunks on the underlying writer.
+type chunkWriter struct {
+	w      io.Writer
+	hasher hash.Hash
+}
+
+func newChunkWriter(w io.Writer) *chunkWriter {
+	return &chunkWriter{
+		w:      w,
+		hasher: sha256.New(),
+	}
+}
+
+func (c *chunkWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	if err := binary.Write(c.w, binary.LittleEndian, uint32(len(p))); err != nil {
+		return 0, err
+	}
+	n, err := c.w.Write(p)
+	c.hasher.Write(p[:n])
+	return n, err
+}
+
+// Finish ends the stream and tells the receiver to keep what it received.
+// uncompressedSize is the size of the file before compression, which is only
+// known once the whole file has been compressed, or zero.
+func (c *chunkWriter) Finish(uncompressedSize int64) error {
+	return c.end(streamStatusOK, uncompressedSize)
+}
+
+// Abort ends the stream and tells the receiver to discard what it received.
+func (c *chunkWriter) Abort() error {
+	return c.end(streamStatusAborted, 0)
+}
+
+func (c *chunkWriter) end(status byte, uncompressedSize int64) error {
+	trailer := new(bytes.Buffer)
+	binary.Write(trailer, binary.LittleEndian, uint32(0))
+	trailer.WriteByte(status)
+	trailer.Write(c.hasher.Sum(nil))
+	binary.Write(trailer, binary.LittleEndian, uncompressedSize)
+
+	_, err := c.w.Write(trailer.Bytes())
+	return err
+}
+
+// chunkReader reads the payload of a chunked stream. It returns io.EOF once the
+// stream ended successfully and its checksum matched.
+type chunkReader struct {
+	r         io.Reader
+	hasher    hash.Hash
+	remaining uint32
+	err       error
+
+	uncompressedSize int64
+}
+
+func newChunkReader(r io.Reader) *chunkReader {
+	return &chunkReader{
+		r:      r,
+		hasher: sha256.New(),
+	}
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	if c.remaining == 0 {
+		if err := binary.Read(c.r, binary.LittleEndian, &c.remaining); err != nil {
+			// The stream must end with a trailer, not with the connection.
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			c.err = err
+			return 0, err
+		}
+		if c.remaining == 0 {
+			c.err = c.readTrailer()
+			return 0, c.err
+		}
+	}
+
+	if uint32(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.r.Read(p)
+	c.remaining -= uint32(n)
+	c.hasher.Write(p[:n])
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		c.err = err
+	}
+	return n, err
+}
+
+func (c *chunkReader) readTrailer() error {
+	trailer := make([]byte, 1+sha256.Size+8)
+	if _, err := io.ReadFull(c.r, trailer); err != nil {
+		return err
+	}
+	if trailer[0] == streamStatusAborted {
+		return ErrStreamAborted
+	}
+	if !bytes.Equal(trailer[1:1+sha256.Size], c.hasher.Sum(nil)) {
+		return ErrStreamChecksumMismatch
+	}
+	c.uncompressedSize = int64(binary.LittleEndian.Uint64(trailer[1+sha256.Size:]))
+	return io.EOF
+}
+
+// UncompressedSize returns the size of the file before compression sent in
+// the trailer, once the stream has been read to the end.
+func (c *chunkReader) UncompressedSize() int64 {
+	return c.uncompressedSize
+}
+
+// A file requested by a peer is sent after a header holding its size as a
+// little endian int64, then the length of its metadata as a little endian
+// uint32 followed by the metadata in JSON, so that the copy kept by the
+// requester carries the same attributes as the others.
+
+// maxFileMetaSize is the largest metadata header accepted from a peer. It
+// leaves room for the key and the checksum next to the attributes.
+const maxFileMetaSize = 2 * maxFileAttrsSize
+
+// invalidRangeSize is the size announced, with no body, by a peer asked for a
+// range that starts past the end of its file, so that the requester fails
+// right away instead of waiting for a file that never comes.
+const invalidRangeSize = -1
+
+// fileNotFoundSize is the size announced, with no body, by a peer asked for a
+// file it does not serve, so that the requester moves on to the next peer
+// instead of waiting PeerResponseTimeout for it.
+const fileNotFoundSize = -2
+
+// writeFileHeader writes the header of a file sent to a peer.
+func writeFileHeader(w io.Writer, size int64, meta ObjectMeta) error {
+	metaJSON, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	header := new(bytes.Buffer)
+	binary.Write(header, binary.LittleEndian, size)
+	binary.Write(header, binary.LittleEndian, uint32(len(metaJSON)))
+	header.Write(metaJSON)
+
+	_, err = w.Write(header.Bytes())
+	return err
+}
+
+// readFileHeader reads the header of a file sent by a peer.
+func readFileHeader(r io.Reader) (size int64, meta ObjectMeta, err error) {
+	if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+		return 0, meta, err
+	}
+	var metaLen uint32
+	if err := binary.Read(r, binary.LittleEndian, &metaLen); err != nil {
+		return 0, meta, err
+	}
+	if metaLen > maxFileMetaSize {
+		return 0, meta, fmt.Errorf("file metadata of %d bytes exceeds the maximum of %d", metaLen, maxFileMetaSize)
+	}
+	metaJSON := make([]byte, metaLen)
+	if _, err := io.ReadFull(r, metaJSON); err != nil {
+		return 0, meta, err
+	}
+	return size, meta, json.Unmarshal(metaJSON, &meta)
+}
+
+// replicaWriter writes to every peer of a replication stream. A peer whose
+// write fails is dropped from the stream instead of failing the whole store,
+// so a single broken connection does not prevent the local copy from being written.
+type replicaWriter struct {
+	// ctx stops the writes waiting for the bandwidth limits once it is done.
+	ctx    context.Context
+	peers  []p2p.Peer
+	logger *slog.Logger
+	// priority is the class the peers are written to in.
+	priority p2p.Priority
+}
+
+func (r *replicaWriter) Write(p []byte) (int, error) {
+	healthy := r.peers[:0]
+	for _, peer := range r.peers {
+		if _, err := p2p.WritePriority(r.ctx, peer, p, r.priority); err != nil {
+			r.logger.Warn("Dropping peer from replication stream", "peer", peer.RemoteAddr().String(), "error", err)
+			continue
+		}
+		healthy = append(healthy, peer)
+	}
+	r.peers = healthy
+	return len(p), nil
+}
+
+// lockStreams gives the caller the exclusive use of the connections to the
+// peers, so that a message and the stream that follows it are not interleaved
+// with the writes of another transfer. The peers are locked in the order of
+// their addresses, so that transfers to overlapping peers do not deadlock.
+// Peers that are no longer connected are skipped. The returned function
+// unlocks the peers.
+func (s *FileServer) lockStreams(ctx context.Context, peers []p2p.Peer) (func(), error) {
+	s.peerLock.Lock()
+	locks := make([]chan struct{}, 0, len(peers))
+	for _, peer := range slices.SortedFunc(slices.Values(peers), func(a, b p2p.Peer) int {
+		return strings.Compare(a.RemoteAddr().String(), b.RemoteAddr().String())
+	}) {
+		if lock, ok := s.streamLocks[peer]; ok {
+			locks = append(locks, lock)
+		}
+	}
+	s.peerLock.Unlock()
+
+	unlock := func(locks []chan struct{}) {
+		for _, lock := range locks {
+			<-lock
+		}
+	}
+	for i, lock := range locks {
+		select {
+		case lock <- struct{}{}:
+		case <-ctx.Done():
+			unlock(locks[:i])
+			return nil, ctx.Err()
+		}
+	}
+	return func() { unlock(locks) }, nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the instrumentation scope of the spans of a FileServer.
+const tracerName = "go-distributed-storage"
+
+// tracePropagator carries the trace context inside a Message, so that the
+// spans of the peers handling it join the trace of the sender.
+var tracePropagator = propagation.TraceContext{}
+
+// startSpan starts a span of the server as a child of the span in ctx. The
+// node is identified by the resource of the TracerProvider.
+func (s *FileServer) startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return s.Config.TracerProvider.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan records err, if any, on the span and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// injectTraceContext stores the trace context of ctx in the message.
+func injectTraceContext(ctx context.Context, message *Message) {
+	carrier := propagation.MapCarrier{}
+	tracePropagator.Inject(ctx, carrier)
+	if len(carrier) > 0 {
+		message.TraceContext = carrier
+	}
+}
+
+// extractTraceContext returns a context holding the trace context carried by the message.
+func extractTraceContext(message Message) context.Context {
+	return tracePropagator.Extract(context.Background(), propagation.MapCarrier(message.TraceContext))
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"testing"
+	"time"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// traceServer returns a server that records its spans in an in-memory exporter.
+func traceServer(listenAddress string, isBootstrapNode bool, bootstrap ...string) (*FileServer, *tracetest.InMemoryExporter) {
+	exporter := tracetest.NewInMemoryExporter()
+	server := makeServer(listenAddress, isBootstrapNode, bootstrap...)
+	server.Config.TracerProvider = sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	return server, exporter
+}
+
+func findSpan(t *testing.T, exporter *tracetest.InMemoryExporter, name string) tracetest.SpanStub {
+	t.Helper()
+	for _, span := range exporter.GetSpans() {
+		if span.Name == name {
+			return span
+		}
+	}
+	t.Fatalf("no %s span recorded", name)
+	return tracetest.SpanStub{}
+}
+
+func TestTracing(t *testing.T) {
+	server1, exporter1 := traceServer("127.0.0.9:4120", true)
+	go func() {
+		if err := server1.Start(); err != nil {
+			log.Fatalf("Failed to start server on 127.0.0.9:4120: %v", err)
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	defer server1.Storage.Clear()
+
+	server2, exporter2 := traceServer("127.0.0.9:4121", false, "127.0.0.9:4120")
+	go func() {
+		if err := server2.Start(); err != nil {
+			log.Fatalf("Failed to start server on 127.0.0.9:4121: %v", err)
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+	defer server2.Storage.Clear()
+
+	exporter1.Reset()
+	exporter2.Reset()
+
+	if err := server1.Store("traced/data", bytes.NewReader(generateRandomData(1024))); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	store := findSpan(t, exporter1, "FileServer.Store")
+	broadcast := findSpan(t, exporter1, "FileServer.broadcast")
+	replica := findSpan(t, exporter2, "FileServer.handleStoreFileMessage")
+	if broadcast.Parent.SpanID() != store.SpanContext.SpanID() {
+		t.Error("broadcast span is not a child of the Store span")
+	}
+	if replica.SpanContext.TraceID() != store.SpanContext.TraceID() {
+		t.Error("the replica was stored in another trace")
+	}
+	if replica.Parent.SpanID() != broadcast.SpanContext.SpanID() || !replica.Parent.IsRemote() {
+		t.Error("handleStoreFileMessage span is not a remote child of the broadcast span")
+	}
+
+	// Fetch the file through the replica once it dropped its copy.
+	if err := server2.Storage.DeleteFile("traced/data"); err != nil {
+		t.Fatal(err)
+	}
+	exporter1.Reset()
+	exporter2.Reset()
+
+	r, err := server2.Get("traced/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, r)
+	r.Close()
+
+	get := findSpan(t, exporter2, "FileServer.Get")
+	fetch := findSpan(t, exporter2, "FileServer.fetchFromPeer")
+	served := findSpan(t, exporter1, "FileServer.handleGetFileMessage")
+	if fetch.SpanContext.TraceID() != get.SpanContext.TraceID() || served.SpanContext.TraceID() != get.SpanContext.TraceID() {
+		t.Error("Get spans do not share one trace")
+	}
+	for _, attr := range get.Attributes {
+		if attr.Key == "fs.source" && attr.Value.AsString() != "peer" {
+			t.Errorf("Get source: got %q, want peer", attr.Value.AsString())
+		}
+	}
+}